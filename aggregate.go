@@ -0,0 +1,70 @@
+package tsdb
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Aggregate 将metric在[start, end]内满足全部选择器的时间线按groupBy中的标签分组，每组合并为一条时间线。
+// 每条时间线先按step对齐的时间窗口降采样，每个时间窗口只取窗口内最后一个数据点，再对组中全部时间线的值使用fn聚合，
+// 例如fn为sum时返回每个时间窗口内组中各时间线的值之和，count为有数据点的时间线数量，
+// first和last为组中最早和最晚采集的值。返回的时间线只包含groupBy中的标签，
+// 时间线缺少的标签不参与分组，groupBy为空时所有时间线合并为一组。metric为空时不限制指标名
+func (db *TSDB) Aggregate(metric string, matchers []*Matcher, fn DownsampleFunc, groupBy []string, start, end, step int64) ([]*Series, error) {
+	if fn == DownsamplePercentile {
+		return nil, fmt.Errorf("aggregate function %q is not supported", fn)
+	}
+	q := &queryOptions{}
+	if err := WithDownsample(step, fn)(q); err != nil {
+		return nil, err
+	}
+	d := q.downsampler
+	seriesList, err := db.downsampleSeries(metric, matchers, start, end, d)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]*downsampledSeries)
+	for _, series := range seriesList {
+		labels := series.labels.group(groupBy)
+		key := labels.String()
+		buckets := alignedBuckets(series.buckets)
+		if group, ok := groups[key]; ok {
+			group.buckets = d.merge(group.buckets, buckets)
+			continue
+		}
+		groups[key] = &downsampledSeries{labels: labels, buckets: buckets}
+	}
+
+	ret := make([]*Series, 0, len(groups))
+	for _, group := range groups {
+		ret = append(ret, &Series{
+			Labels: group.labels,
+			Points: d.points(group.buckets),
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Labels.String() < ret[j].Labels.String()
+	})
+	return ret, nil
+}
+
+// alignedBuckets 将一条时间线的每个时间窗口替换为只包含窗口内最后一个数据点的时间窗口，
+// 合并后每条时间线在每个时间窗口只贡献一个值，不受采集间隔和时间戳偏移的影响
+func alignedBuckets(buckets []*bucket) []*bucket {
+	ret := make([]*bucket, 0, len(buckets))
+	for _, b := range buckets {
+		ret = append(ret, &bucket{
+			start:   b.start,
+			count:   1,
+			sum:     b.last,
+			min:     b.last,
+			max:     b.last,
+			firstTs: b.lastTs,
+			first:   b.last,
+			lastTs:  b.lastTs,
+			last:    b.last,
+		})
+	}
+	return ret
+}
@@ -0,0 +1,385 @@
+// Package api 实现兼容Prometheus HTTP API的查询接口，可以直接作为Grafana的Prometheus数据源
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"tsdb"
+	"tsdb/promql"
+)
+
+type API struct {
+	db     *tsdb.TSDB
+	engine *promql.Engine
+	now    func() time.Time
+}
+
+type response struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type queryData struct {
+	ResultType string      `json:"resultType"`
+	Result     interface{} `json:"result"`
+}
+
+type matrixSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values [][2]interface{}  `json:"values"`
+}
+
+type vectorSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  [2]interface{}    `json:"value"`
+}
+
+type apiError struct {
+	typ string
+	err error
+}
+
+const (
+	statusSuccess = "success"
+	statusError   = "error"
+
+	errorBadData  = "bad_data"
+	errorExec     = "execution"
+	errorInternal = "internal"
+	errorTimeout  = "timeout"
+
+	defaultLookback = 5 * time.Minute // 查询某个时刻的数据时最多向前查找的时长
+	maxPoints       = 11000
+)
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+func NewAPI(db *tsdb.TSDB) *API {
+	return &API{
+		db:     db,
+		engine: promql.NewEngine(db, defaultLookback),
+		now:    time.Now,
+	}
+}
+
+// Register 注册/api/v1下的查询接口和remote_write、remote_read接口
+func (api *API) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/write", api.remoteWrite)
+	mux.HandleFunc("/api/v1/read", api.remoteRead)
+	mux.HandleFunc("/api/v1/query", api.wrap(api.query))
+	mux.HandleFunc("/api/v1/query_range", api.wrap(api.queryRange))
+	mux.HandleFunc("/api/v1/labels", api.wrap(api.labelNames))
+	mux.HandleFunc("/api/v1/label/", api.wrap(api.labelValues))
+	mux.HandleFunc("/api/v1/series", api.wrap(api.series))
+}
+
+func (api *API) wrap(fn func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			writeError(w, &apiError{typ: errorBadData, err: fmt.Errorf("failed to parse form: %v", err)})
+			return
+		}
+		data, err := fn(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, &response{Status: statusSuccess, Data: data})
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	typ := errorInternal
+	var e *apiError
+	if errors.As(err, &e) {
+		typ = e.typ
+		switch e.typ {
+		case errorBadData:
+			code = http.StatusBadRequest
+		case errorExec:
+			code = http.StatusUnprocessableEntity
+		case errorTimeout:
+			code = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, code, &response{Status: statusError, ErrorType: typ, Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, resp *response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logrus.Errorf("failed to write response, err: %v", err)
+	}
+}
+
+func badData(format string, args ...interface{}) error {
+	return &apiError{typ: errorBadData, err: fmt.Errorf(format, args...)}
+}
+
+func (api *API) query(r *http.Request) (interface{}, error) {
+	ts, err := parseTimeParam(r, "time", api.now())
+	if err != nil {
+		return nil, err
+	}
+	expr, err := promql.ParseExpr(r.FormValue("query"))
+	if err != nil {
+		return nil, badData("invalid parameter 'query': %v", err)
+	}
+	value, err := api.engine.Instant(r.Context(), expr, ts)
+	if err != nil {
+		return nil, execError(err)
+	}
+	return &queryData{ResultType: string(value.Type()), Result: api.formatValue(value)}, nil
+}
+
+func (api *API) queryRange(r *http.Request) (interface{}, error) {
+	start, err := parseTime(r.FormValue("start"))
+	if err != nil {
+		return nil, badData("invalid parameter 'start': %v", err)
+	}
+	end, err := parseTime(r.FormValue("end"))
+	if err != nil {
+		return nil, badData("invalid parameter 'end': %v", err)
+	}
+	if end.Before(start) {
+		return nil, badData("invalid parameter 'end': end timestamp must not be before start time")
+	}
+	step, err := parseDuration(r.FormValue("step"))
+	if err != nil {
+		return nil, badData("invalid parameter 'step': %v", err)
+	}
+	if step <= 0 {
+		return nil, badData("zero or negative query resolution step widths are not accepted. Try a positive integer")
+	}
+	if end.Sub(start)/step > maxPoints {
+		return nil, badData("exceeded maximum resolution of %d points per timeseries. Try decreasing the query resolution (?step=XX)", maxPoints)
+	}
+	expr, err := promql.ParseExpr(r.FormValue("query"))
+	if err != nil {
+		return nil, badData("invalid parameter 'query': %v", err)
+	}
+	if typ := expr.Type(); typ != promql.ValueTypeScalar && typ != promql.ValueTypeVector {
+		return nil, badData("invalid expression type %q for range query, must be scalar or instant vector", typ)
+	}
+
+	matrix, err := api.engine.Range(r.Context(), expr, start, end, step)
+	if err != nil {
+		return nil, execError(err)
+	}
+	return &queryData{ResultType: string(promql.ValueTypeMatrix), Result: api.formatValue(matrix)}, nil
+}
+
+// execError 区分查询超时和其他执行错误
+func execError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &apiError{typ: errorTimeout, err: err}
+	}
+	return &apiError{typ: errorExec, err: err}
+}
+
+// formatValue 按照Prometheus的格式输出查询结果
+func (api *API) formatValue(value promql.Value) interface{} {
+	precision := api.db.Precision()
+	switch v := value.(type) {
+	case promql.Scalar:
+		return samplePair(precision.ToTime(v.T), v.V)
+	case promql.String:
+		return [2]interface{}{unixSeconds(precision.ToTime(v.T)), v.V}
+	case promql.Vector:
+		result := make([]vectorSample, 0, len(v))
+		for _, sample := range v {
+			result = append(result, vectorSample{
+				Metric: labelsMap(sample.Metric),
+				Value:  samplePair(precision.ToTime(sample.Point.Timestamp), sample.Point.Value),
+			})
+		}
+		return result
+	case promql.Matrix:
+		result := make([]matrixSeries, 0, len(v))
+		for _, series := range v {
+			values := make([][2]interface{}, 0, len(series.Points))
+			for _, point := range series.Points {
+				values = append(values, samplePair(precision.ToTime(point.Timestamp), point.Value))
+			}
+			result = append(result, matrixSeries{
+				Metric: labelsMap(series.Metric),
+				Values: values,
+			})
+		}
+		return result
+	}
+	return nil
+}
+
+func (api *API) labelNames(r *http.Request) (interface{}, error) {
+	start, end, err := api.parseTimeRange(r)
+	if err != nil {
+		return nil, err
+	}
+	return api.db.QueryLabelNames(start, end), nil
+}
+
+func (api *API) labelValues(r *http.Request) (interface{}, error) {
+	// /api/v1/label/<name>/values
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/label/")
+	if !strings.HasSuffix(path, "/values") {
+		return nil, badData("invalid path: %s", r.URL.Path)
+	}
+	name := strings.TrimSuffix(path, "/values")
+	if name == "" || strings.Contains(name, "/") {
+		return nil, badData("invalid label name: %q", name)
+	}
+	start, end, err := api.parseTimeRange(r)
+	if err != nil {
+		return nil, err
+	}
+	return api.db.QueryLabelValues(name, start, end), nil
+}
+
+func (api *API) series(r *http.Request) (interface{}, error) {
+	selectors := r.Form["match[]"]
+	if len(selectors) == 0 {
+		return nil, badData("no match[] parameter provided")
+	}
+	start, end, err := api.parseTimeRange(r)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]struct{})
+	result := make([]map[string]string, 0)
+	for _, selector := range selectors {
+		matchers, err := promql.ParseMetricSelector(selector)
+		if err != nil {
+			return nil, badData("invalid parameter 'match[]': %v", err)
+		}
+		// 只需要标签，不读取数据点
+		labelsList, err := api.db.QuerySeries("", matchers, start, end)
+		if err != nil {
+			return nil, err
+		}
+		for _, labels := range labelsList {
+			key := labels.String()
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			result = append(result, labelsMap(labels))
+		}
+	}
+	return result, nil
+}
+
+// timestamp 将时间转换为数据库精度下的时间戳
+func (api *API) timestamp(t time.Time) int64 {
+	return api.db.Precision().FromTime(t)
+}
+
+// parseTimeRange 解析start和end参数为数据库精度下的时间戳，没有指定时不限制范围
+func (api *API) parseTimeRange(r *http.Request) (int64, int64, error) {
+	start, end := int64(math.MinInt64), int64(math.MaxInt64)
+	if r.FormValue("start") != "" {
+		t, err := parseTimeParam(r, "start", time.Time{})
+		if err != nil {
+			return 0, 0, err
+		}
+		start = api.timestamp(t)
+	}
+	if r.FormValue("end") != "" {
+		t, err := parseTimeParam(r, "end", time.Time{})
+		if err != nil {
+			return 0, 0, err
+		}
+		end = api.timestamp(t)
+	}
+	if end < start {
+		return 0, 0, badData("invalid parameter 'end': end timestamp must not be before start time")
+	}
+	return start, end, nil
+}
+
+func parseTimeParam(r *http.Request, name string, defaultValue time.Time) (time.Time, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	t, err := parseTime(value)
+	if err != nil {
+		return time.Time{}, badData("invalid parameter '%s': %v", name, err)
+	}
+	return t, nil
+}
+
+// parseTime 解析Unix秒（可以带小数）或者RFC3339格式的时间
+func parseTime(s string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(seconds)
+		return time.Unix(int64(sec), int64(math.Round(frac*1e9))).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parseDuration 解析秒数（可以带小数）或者5m这样的时长
+func parseDuration(s string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		duration := seconds * float64(time.Second)
+		if duration > float64(math.MaxInt64) || duration < float64(math.MinInt64) {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration. It overflows int64", s)
+		}
+		return time.Duration(duration), nil
+	}
+	if d, err := promql.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
+
+func labelsMap(labels tsdb.LabelList) map[string]string {
+	ret := make(map[string]string, len(labels))
+	for _, label := range labels {
+		ret[label.Name] = label.Value
+	}
+	return ret
+}
+
+// samplePair 按照Prometheus的格式输出[Unix秒, "数据值"]
+func samplePair(t time.Time, value float64) [2]interface{} {
+	return [2]interface{}{unixSeconds(t), formatValue(value)}
+}
+
+func unixSeconds(t time.Time) json.Number {
+	return json.Number(strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', -1, 64))
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,392 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/golang/snappy"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+	"tsdb"
+	"tsdb/prompb"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, int64) {
+	db, err := tsdb.Open(tsdb.WithDataPath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close(context.Background())
+	})
+
+	var start int64 = 1600000000
+	rows := make([]*tsdb.Row, 0)
+	for i := int64(0); i < 10; i++ {
+		for _, node := range []string{"vm1", "vm2"} {
+			rows = append(rows, &tsdb.Row{
+				Metric: "cpu_busy",
+				Labels: tsdb.LabelList{{Name: "node", Value: node}},
+				Point:  tsdb.Point{Timestamp: start + i*60, Value: float64(i)},
+			})
+		}
+	}
+	errs, err := db.InsertRowsSync(context.Background(), rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	NewAPI(db).Register(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, start
+}
+
+func get(t *testing.T, server *httptest.Server, path string, params url.Values, code int) *response {
+	resp, err := http.Get(server.URL + path + "?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != code {
+		t.Fatalf("%s: expected status %d, got %d", path, code, resp.StatusCode)
+	}
+	ret := &response{}
+	if err := json.NewDecoder(resp.Body).Decode(ret); err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestQueryRange(t *testing.T) {
+	server, start := newTestServer(t)
+	resp := get(t, server, "/api/v1/query_range", url.Values{
+		"query": {`cpu_busy{node="vm1"}`},
+		"start": {"1600000000"},
+		"end":   {"1600000540"},
+		"step":  {"2m"},
+	}, http.StatusOK)
+	data := resp.Data.(map[string]interface{})
+	if data["resultType"] != "matrix" {
+		t.Fatalf("unexpected result type: %v", data["resultType"])
+	}
+	result := data["result"].([]interface{})
+	if len(result) != 1 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	series := result[0].(map[string]interface{})
+	metric := series["metric"].(map[string]interface{})
+	if metric["__name__"] != "cpu_busy" || metric["node"] != "vm1" {
+		t.Fatalf("unexpected metric: %+v", metric)
+	}
+	values := series["values"].([]interface{})
+	if len(values) != 5 {
+		t.Fatalf("expected 5 values, got %d", len(values))
+	}
+	last := values[4].([]interface{})
+	if last[0].(float64) != float64(start+480) || last[1] != "8" {
+		t.Fatalf("unexpected value: %v", last)
+	}
+
+	get(t, server, "/api/v1/query_range", url.Values{
+		"query": {`cpu_busy`},
+		"start": {"1600000000"},
+		"end":   {"1600000540"},
+		"step":  {"0"},
+	}, http.StatusBadRequest)
+}
+
+func TestQuery(t *testing.T) {
+	server, start := newTestServer(t)
+	resp := get(t, server, "/api/v1/query", url.Values{
+		"query": {`cpu_busy{node=~"vm.*"}`},
+		"time":  {time.Unix(start+150, 0).UTC().Format(time.RFC3339)},
+	}, http.StatusOK)
+	result := resp.Data.(map[string]interface{})["result"].([]interface{})
+	if len(result) != 2 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	value := result[0].(map[string]interface{})["value"].([]interface{})
+	if value[0].(float64) != float64(start+150) || value[1] != "2" {
+		t.Fatalf("unexpected value: %v", value)
+	}
+
+	resp = get(t, server, "/api/v1/query", url.Values{
+		"query": {`sum(rate(cpu_busy[5m])) * 60`},
+		"time":  {strconv.FormatInt(start+300, 10)},
+	}, http.StatusOK)
+	result = resp.Data.(map[string]interface{})["result"].([]interface{})
+	sample := result[0].(map[string]interface{})
+	if len(result) != 1 || len(sample["metric"].(map[string]interface{})) != 0 || sample["value"].([]interface{})[1] != "2" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	resp = get(t, server, "/api/v1/query", url.Values{"query": {`1 + 2`}}, http.StatusOK)
+	if data := resp.Data.(map[string]interface{}); data["resultType"] != "scalar" || data["result"].([]interface{})[1] != "3" {
+		t.Fatalf("unexpected result: %+v", data)
+	}
+
+	resp = get(t, server, "/api/v1/query", url.Values{"query": {`cpu_busy{`}}, http.StatusBadRequest)
+	if resp.Status != statusError || resp.ErrorType != errorBadData {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	resp = get(t, server, "/api/v1/query", url.Values{
+		"query": {`cpu_busy + on() cpu_busy`},
+		"time":  {strconv.FormatInt(start+300, 10)},
+	}, http.StatusUnprocessableEntity)
+	if resp.ErrorType != errorExec {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	server, _ := newTestServer(t)
+	resp := get(t, server, "/api/v1/labels", nil, http.StatusOK)
+	names := resp.Data.([]interface{})
+	if len(names) != 2 || names[0] != "__name__" || names[1] != "node" {
+		t.Fatalf("unexpected label names: %v", names)
+	}
+
+	resp = get(t, server, "/api/v1/label/node/values", nil, http.StatusOK)
+	values := resp.Data.([]interface{})
+	if len(values) != 2 || values[0] != "vm1" || values[1] != "vm2" {
+		t.Fatalf("unexpected label values: %v", values)
+	}
+}
+
+func TestSeries(t *testing.T) {
+	server, _ := newTestServer(t)
+	resp := get(t, server, "/api/v1/series", url.Values{
+		"match[]": {`cpu_busy{node="vm2"}`, `{__name__="cpu_busy",node="vm2"}`},
+	}, http.StatusOK)
+	series := resp.Data.([]interface{})
+	if len(series) != 1 || series[0].(map[string]interface{})["node"] != "vm2" {
+		t.Fatalf("unexpected series: %v", series)
+	}
+
+	get(t, server, "/api/v1/series", nil, http.StatusBadRequest)
+}
+
+func TestRemoteWrite(t *testing.T) {
+	server, start := newTestServer(t)
+	req := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels: []prompb.Label{{Name: "__name__", Value: "mem_used"}, {Name: "node", Value: "vm3"}},
+				Samples: []prompb.Sample{
+					{Value: 1, Timestamp: start * 1000},
+					{Value: 2, Timestamp: (start + 60) * 1000},
+				},
+			},
+		},
+	}
+	post := func(body []byte) int {
+		resp, err := http.Post(server.URL+"/api/v1/write", "application/x-protobuf", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post(snappy.Encode(nil, req.Marshal())); code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, code)
+	}
+
+	// 返回204时数据已经可以查询
+	params := url.Values{
+		"query": {`mem_used{node="vm3"}`},
+		"start": {"1600000000"},
+		"end":   {"1600000060"},
+		"step":  {"60"},
+	}
+	result := get(t, server, "/api/v1/query_range", params, http.StatusOK).Data.(map[string]interface{})["result"].([]interface{})
+	if len(result) != 1 {
+		t.Fatalf("unexpected result: %v", result)
+	}
+	values := result[0].(map[string]interface{})["values"].([]interface{})
+	if len(values) != 2 || values[1].([]interface{})[1] != "2" {
+		t.Fatalf("unexpected values: %v", values)
+	}
+
+	// 无法写入的数据点返回400，客户端不会重试
+	invalid := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "mem_used"}, {Name: "node", Value: "vm3"}, {Name: "node", Value: "vm4"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: start * 1000}},
+	}}}
+	if code := post(snappy.Encode(nil, invalid.Marshal())); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, code)
+	}
+
+	if code := post([]byte("not snappy")); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, code)
+	}
+	// 头部声明的解压后长度超过限制时不解压
+	header := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(header, 1<<30)
+	if code := post(append(header[:n], 0)); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status %d, got %d", http.StatusRequestEntityTooLarge, code)
+	}
+	req.Timeseries[0].Labels = req.Timeseries[0].Labels[1:]
+	if code := post(snappy.Encode(nil, req.Marshal())); code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, code)
+	}
+}
+
+func remoteRead(t *testing.T, server *httptest.Server, typ prompb.ReadRequest_ResponseType) *http.Response {
+	req := &prompb.ReadRequest{
+		Queries: []*prompb.Query{{
+			StartTimestampMs: 1600000000000,
+			EndTimestampMs:   1600000240000,
+			Matchers: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "cpu_busy"},
+				{Type: prompb.LabelMatcher_RE, Name: "node", Value: "vm.*"},
+			},
+		}},
+		AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{typ},
+	}
+	resp, err := http.Post(server.URL+"/api/v1/read", "application/x-protobuf", bytes.NewReader(snappy.Encode(nil, req.Marshal())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	return resp
+}
+
+func TestRemoteRead(t *testing.T) {
+	server, start := newTestServer(t)
+	resp := remoteRead(t, server, prompb.ReadRequest_SAMPLES)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readResp := &prompb.ReadResponse{}
+	if err := readResp.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(readResp.Results) != 1 || len(readResp.Results[0].Timeseries) != 2 {
+		t.Fatalf("unexpected response: %+v", readResp)
+	}
+	ts := readResp.Results[0].Timeseries[1]
+	if len(ts.Labels) != 2 || ts.Labels[0].Name != "__name__" || ts.Labels[1].Value != "vm2" {
+		t.Fatalf("unexpected labels: %+v", ts.Labels)
+	}
+	if len(ts.Samples) != 5 || ts.Samples[4].Timestamp != (start+240)*1000 || ts.Samples[4].Value != 4 {
+		t.Fatalf("unexpected samples: %+v", ts.Samples)
+	}
+}
+
+func TestRemoteReadStreamed(t *testing.T) {
+	server, start := newTestServer(t)
+	resp := remoteRead(t, server, prompb.ReadRequest_STREAMED_XOR_CHUNKS)
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != contentTypeStreamedProtobuf {
+		t.Fatalf("unexpected content type: %s", resp.Header.Get("Content-Type"))
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := make([]*prompb.ChunkedReadResponse, 0)
+	for len(body) > 0 {
+		size, n := binary.Uvarint(body)
+		checksum := binary.BigEndian.Uint32(body[n:])
+		data := body[n+4 : n+4+int(size)]
+		body = body[n+4+int(size):]
+		if crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)) != checksum {
+			t.Fatal("checksum mismatch")
+		}
+		frame := &prompb.ChunkedReadResponse{}
+		if err := frame.Unmarshal(data); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("expected 2 frames, got %d", len(frames))
+	}
+	series := frames[0].ChunkedSeries[0]
+	if frames[0].QueryIndex != 0 || series.Labels[1].Value != "vm1" || len(series.Chunks) != 1 {
+		t.Fatalf("unexpected frame: %+v", series)
+	}
+	chunk := series.Chunks[0]
+	if chunk.Type != prompb.Chunk_XOR || chunk.MinTimeMs != start*1000 || chunk.MaxTimeMs != (start+240)*1000 ||
+		binary.BigEndian.Uint16(chunk.Data) != 5 {
+		t.Fatalf("unexpected chunk: %+v", chunk)
+	}
+}
+
+func TestStreamQuery(t *testing.T) {
+	db, err := tsdb.Open(tsdb.WithDataPath(t.TempDir()), tsdb.WithTimestampPrecision(tsdb.PrecisionMillisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	var start int64 = 1600000000000
+	rows := make([]*tsdb.Row, 0)
+	for i := int64(0); i < 300; i++ {
+		rows = append(rows, &tsdb.Row{Metric: "cpu_busy", Point: tsdb.Point{Timestamp: start + i*1000, Value: float64(i)}})
+	}
+	if _, err = db.InsertRowsSync(context.Background(), rows); err != nil {
+		t.Fatal(err)
+	}
+
+	query := &prompb.Query{StartTimestampMs: start, EndTimestampMs: start + 299000}
+	matchers := []*tsdb.Matcher{tsdb.MustNewMatcher(tsdb.MatchEqual, "__name__", "cpu_busy")}
+	readFrames := func(frameSize int) []*prompb.ChunkedReadResponse {
+		buf := &bytes.Buffer{}
+		if err := NewAPI(db).streamQuery(&chunkedWriter{w: buf, frameSize: frameSize}, query, matchers, 3); err != nil {
+			t.Fatal(err)
+		}
+		frames := make([]*prompb.ChunkedReadResponse, 0)
+		body := buf.Bytes()
+		for len(body) > 0 {
+			size, n := binary.Uvarint(body)
+			frame := &prompb.ChunkedReadResponse{}
+			if err := frame.Unmarshal(body[n+4 : n+4+int(size)]); err != nil {
+				t.Fatal(err)
+			}
+			body = body[n+4+int(size):]
+			frames = append(frames, frame)
+		}
+		return frames
+	}
+
+	// 300个数据点分为3个数据块
+	frames := readFrames(maxBytesInFrame)
+	if len(frames) != 1 || len(frames[0].ChunkedSeries[0].Chunks) != 3 || frames[0].QueryIndex != 3 {
+		t.Fatalf("unexpected frames: %+v", frames)
+	}
+	// 帧的大小不足一个数据块时每个数据块一帧，标签在每一帧中重复
+	frames = readFrames(1)
+	if len(frames) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(frames))
+	}
+	for i, frame := range frames {
+		series := frame.ChunkedSeries[0]
+		if len(series.Labels) != 1 || len(series.Chunks) != 1 || series.Chunks[0].MinTimeMs != start+int64(i)*120000 {
+			t.Fatalf("unexpected frame %d: %+v", i, series)
+		}
+		if n := binary.BigEndian.Uint16(series.Chunks[0].Data); (i < 2 && n != 120) || (i == 2 && n != 60) {
+			t.Fatalf("unexpected samples in chunk %d: %d", i, n)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"sort"
+	"tsdb"
+	"tsdb/prompb"
+)
+
+const (
+	metricLabel = "__name__"
+
+	maxRemoteWriteSize        = 32 << 20  // 解压前请求体的最大字节数
+	maxRemoteWriteDecodedSize = 128 << 20 // 解压后请求体的最大字节数
+	maxRemoteReadSize         = 4 << 20
+	maxRemoteReadDecodedSize  = 16 << 20
+	samplesPerChunk           = 120     // 流式响应中每个数据块的数据点数量，与Prometheus一致
+	maxBytesInFrame           = 1 << 20 // 流式响应中一帧的数据块的最大字节数，与Prometheus一致
+
+	contentTypeProtobuf         = "application/x-protobuf"
+	contentTypeStreamedProtobuf = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// remoteWrite 接收snappy压缩的protobuf格式WriteRequest，写入head memtable后返回204，
+// 请求格式错误或存在无法写入的数据点时返回400不需要重试，数据库写入失败返回5xx由客户端重试
+func (api *API) remoteWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, code, err := readSnappyBody(r, maxRemoteWriteSize, maxRemoteWriteDecodedSize)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	req := &prompb.WriteRequest{}
+	if err := req.Unmarshal(data); err != nil {
+		http.Error(w, fmt.Sprintf("failed to unmarshal write request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := api.writeRequestToRows(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(rows) > 0 {
+		errs, err := api.db.InsertRowsSync(r.Context(), rows)
+		if err != nil {
+			logrus.Errorf("failed to insert remote write rows, err: %v", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		// 校验失败或乱序的数据点重试也无法写入，其余数据点已经写入
+		if err := rejectedRows(errs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rejectedRows 汇总写入失败的row，全部写入成功时返回nil
+func rejectedRows(errs []error) error {
+	var first error
+	count := 0
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if first == nil {
+			first = err
+		}
+		count++
+	}
+	if first == nil {
+		return nil
+	}
+	return fmt.Errorf("%d of %d samples rejected, first err: %v", count, len(errs), first)
+}
+
+// writeRequestToRows 将每条TimeSeries转换为Row，__name__标签作为Row.Metric，
+// 数据点的毫秒时间戳转换为数据库的精度
+func (api *API) writeRequestToRows(req *prompb.WriteRequest) ([]*tsdb.Row, error) {
+	precision := api.db.Precision()
+	count := 0
+	for i := range req.Timeseries {
+		count += len(req.Timeseries[i].Samples)
+	}
+	rows := make([]*tsdb.Row, 0, count)
+	for i := range req.Timeseries {
+		ts := &req.Timeseries[i]
+		metric := ""
+		labels := make(tsdb.LabelList, 0, len(ts.Labels))
+		for _, label := range ts.Labels {
+			if label.Name == metricLabel {
+				metric = label.Value
+				continue
+			}
+			labels = append(labels, tsdb.Label{Name: label.Name, Value: label.Value})
+		}
+		if metric == "" {
+			return nil, fmt.Errorf("time series %d has no %s label", i, metricLabel)
+		}
+		for j, sample := range ts.Samples {
+			// 写入时会原地修改标签，每个row使用独立的标签
+			rowLabels := labels
+			if j > 0 {
+				rowLabels = append(make(tsdb.LabelList, 0, len(labels)), labels...)
+			}
+			rows = append(rows, &tsdb.Row{
+				Metric: metric,
+				Labels: rowLabels,
+				Point: tsdb.Point{
+					Timestamp: precision.Convert(sample.Timestamp, tsdb.PrecisionMillisecond),
+					Value:     sample.Value,
+				},
+			})
+		}
+	}
+	return rows, nil
+}
+
+// remoteRead 处理snappy压缩的protobuf格式ReadRequest，客户端接受流式响应时按时间线返回
+// Prometheus XOR格式的数据块，否则返回snappy压缩的ReadResponse
+func (api *API) remoteRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, code, err := readSnappyBody(r, maxRemoteReadSize, maxRemoteReadDecodedSize)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	req := &prompb.ReadRequest{}
+	if err := req.Unmarshal(data); err != nil {
+		http.Error(w, fmt.Sprintf("failed to unmarshal read request: %v", err), http.StatusBadRequest)
+		return
+	}
+	queries := make([][]*tsdb.Matcher, 0, len(req.Queries))
+	for _, query := range req.Queries {
+		matchers, err := toMatchers(query.Matchers)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		queries = append(queries, matchers)
+	}
+
+	for _, typ := range req.AcceptedResponseTypes {
+		if typ == prompb.ReadRequest_STREAMED_XOR_CHUNKS {
+			api.remoteReadStreamed(w, req, queries)
+			return
+		}
+	}
+	resp := &prompb.ReadResponse{Results: make([]*prompb.QueryResult, 0, len(req.Queries))}
+	for i, query := range req.Queries {
+		result, err := api.remoteQuery(query, queries[i])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	w.Header().Set("Content-Type", contentTypeProtobuf)
+	w.Header().Set("Content-Encoding", "snappy")
+	if _, err := w.Write(snappy.Encode(nil, resp.Marshal())); err != nil {
+		logrus.Errorf("failed to write remote read response, err: %v", err)
+	}
+}
+
+// remoteReadStreamed 逐条时间线逐个数据块编码，数据块累计超过maxBytesInFrame时作为一帧写入:
+// | 长度 uvarint | crc32c 大端 | ChunkedReadResponse |，一条时间线可以分为多帧，内存占用只与帧的大小有关
+func (api *API) remoteReadStreamed(w http.ResponseWriter, req *prompb.ReadRequest, queries [][]*tsdb.Matcher) {
+	w.Header().Set("Content-Type", contentTypeStreamedProtobuf)
+	stream := &chunkedWriter{w: w, frameSize: maxBytesInFrame}
+	stream.flusher, _ = w.(http.Flusher)
+	for i, query := range req.Queries {
+		if err := api.streamQuery(stream, query, queries[i], int64(i)); err != nil {
+			logrus.Errorf("failed to stream remote read, err: %v", err)
+			// 已经开始写入响应后无法再返回错误码，只能中断响应
+			if !stream.written {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+}
+
+// selectQuery 将查询的毫秒时间范围转换为数据库精度后查询，返回的时间线需要调用方Close
+func (api *API) selectQuery(query *prompb.Query, matchers []*tsdb.Matcher) (tsdb.SeriesSet, error) {
+	precision := api.db.Precision()
+	start := precision.Convert(query.StartTimestampMs, tsdb.PrecisionMillisecond)
+	end := precision.Convert(query.EndTimestampMs, tsdb.PrecisionMillisecond)
+	return api.db.Select("", matchers, start, end)
+}
+
+// remoteQuery 读出查询的全部数据点，用于不支持流式响应的客户端
+func (api *API) remoteQuery(query *prompb.Query, matchers []*tsdb.Matcher) (*prompb.QueryResult, error) {
+	set, err := api.selectQuery(query, matchers)
+	if err != nil {
+		return nil, err
+	}
+	defer set.Close()
+	result := &prompb.QueryResult{Timeseries: make([]*prompb.TimeSeries, 0)}
+	for set.Next() {
+		labels, it := set.At()
+		samples := make([]prompb.Sample, 0)
+		for it.Next() {
+			if sample, ok := api.toSample(it, query); ok {
+				samples = append(samples, sample)
+			}
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+		result.Timeseries = append(result.Timeseries, &prompb.TimeSeries{
+			Labels:  toProtoLabels(labels),
+			Samples: samples,
+		})
+	}
+	return result, set.Err()
+}
+
+// streamQuery 逐个数据块写入查询的时间线
+func (api *API) streamQuery(stream *chunkedWriter, query *prompb.Query, matchers []*tsdb.Matcher, index int64) error {
+	set, err := api.selectQuery(query, matchers)
+	if err != nil {
+		return err
+	}
+	defer set.Close()
+	for set.Next() {
+		labels, it := set.At()
+		series := &prompb.ChunkedSeries{Labels: toProtoLabels(labels)}
+		frameBytes := 0
+		var encoder *prompb.XORChunkEncoder
+		var minT, maxT int64
+		// cut 结束当前数据块，累计的数据块超过帧的大小时写入一帧
+		cut := func(force bool) error {
+			if encoder != nil {
+				data := encoder.Bytes()
+				series.Chunks = append(series.Chunks, prompb.Chunk{MinTimeMs: minT, MaxTimeMs: maxT, Type: prompb.Chunk_XOR, Data: data})
+				frameBytes += len(data)
+				encoder = nil
+			}
+			if len(series.Chunks) == 0 || (!force && frameBytes < stream.frameSize) {
+				return nil
+			}
+			frame := &prompb.ChunkedReadResponse{ChunkedSeries: []*prompb.ChunkedSeries{series}, QueryIndex: index}
+			series = &prompb.ChunkedSeries{Labels: series.Labels}
+			frameBytes = 0
+			return stream.write(frame.Marshal())
+		}
+		for it.Next() {
+			sample, ok := api.toSample(it, query)
+			if !ok {
+				continue
+			}
+			if encoder == nil {
+				encoder, minT = prompb.NewXORChunkEncoder(), sample.Timestamp
+			}
+			encoder.Append(sample.Timestamp, sample.Value)
+			maxT = sample.Timestamp
+			if encoder.NumSamples() >= samplesPerChunk {
+				if err := cut(false); err != nil {
+					return err
+				}
+			}
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+		if err := cut(true); err != nil {
+			return err
+		}
+	}
+	return set.Err()
+}
+
+// toSample 将迭代器当前数据点的时间戳转换为毫秒，精度转换后超出查询范围时返回false
+func (api *API) toSample(it tsdb.SeriesIterator, query *prompb.Query) (prompb.Sample, bool) {
+	t, v := it.At()
+	ts := tsdb.PrecisionMillisecond.Convert(t, api.db.Precision())
+	if ts < query.StartTimestampMs || ts > query.EndTimestampMs {
+		return prompb.Sample{}, false
+	}
+	return prompb.Sample{Value: v, Timestamp: ts}, true
+}
+
+// chunkedWriter 写入流式响应的帧，每帧写入后立即发送给客户端
+type chunkedWriter struct {
+	w         io.Writer
+	flusher   http.Flusher
+	frameSize int // 一帧中数据块的字节数超过frameSize时写入
+	written   bool
+}
+
+func (c *chunkedWriter) write(data []byte) error {
+	if err := writeFrame(c.w, data); err != nil {
+		return err
+	}
+	c.written = true
+	if c.flusher != nil {
+		c.flusher.Flush()
+	}
+	return nil
+}
+
+func writeFrame(w io.Writer, data []byte) error {
+	header := make([]byte, binary.MaxVarintLen64+4)
+	n := binary.PutUvarint(header, uint64(len(data)))
+	binary.BigEndian.PutUint32(header[n:], crc32.Checksum(data, castagnoliTable))
+	if _, err := w.Write(header[:n+4]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func toMatchers(matchers []*prompb.LabelMatcher) ([]*tsdb.Matcher, error) {
+	ret := make([]*tsdb.Matcher, 0, len(matchers))
+	for _, m := range matchers {
+		var typ tsdb.MatchType
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			typ = tsdb.MatchEqual
+		case prompb.LabelMatcher_NEQ:
+			typ = tsdb.MatchNotEqual
+		case prompb.LabelMatcher_RE:
+			typ = tsdb.MatchRegexp
+		case prompb.LabelMatcher_NRE:
+			typ = tsdb.MatchNotRegexp
+		default:
+			return nil, fmt.Errorf("unknown matcher type: %d", m.Type)
+		}
+		matcher, err := tsdb.NewMatcher(typ, m.Name, m.Value)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, matcher)
+	}
+	return ret, nil
+}
+
+// toProtoLabels 转换为按标签名排序的标签
+func toProtoLabels(labels tsdb.LabelList) []prompb.Label {
+	ret := make([]prompb.Label, 0, len(labels))
+	for _, label := range labels {
+		ret = append(ret, prompb.Label{Name: label.Name, Value: label.Value})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// readSnappyBody 读取并解压请求体，返回失败时对应的状态码。解压前根据snappy头部记录的长度检查解压后的大小，
+// 避免按照客户端声明的长度分配内存
+func readSnappyBody(r *http.Request, limit, decodedLimit int) ([]byte, int, error) {
+	compressed, err := io.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("failed to read body: %v", err)
+	}
+	if len(compressed) > limit {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("body exceeds %d bytes", limit)
+	}
+	decodedLen, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("failed to decompress body: %v", err)
+	}
+	if decodedLen > decodedLimit {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("decompressed body exceeds %d bytes", decodedLimit)
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("failed to decompress body: %v", err)
+	}
+	return data, http.StatusOK, nil
+}
@@ -0,0 +1,362 @@
+package tsdb
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	BackfillRangeError   = errors.New("timestamp is not older than data in memory")
+	SegmentConflictError = errors.New("another segment has the same min timestamp")
+)
+
+const (
+	backfillPrefix    = "backfill-"     // 正在写入的新segment的临时目录
+	backfillOldPrefix = "backfill-old-" // 与新segment同名的旧segment移走后的目录
+	replacedFilename  = "replaced"      // 新segment替换的旧segment目录名，每行一个
+)
+
+// backfillSeries 回填时一条时间线合并后的数据点
+type backfillSeries struct {
+	labels LabelList // 包含指标名标签__name__，已排序
+	points []Point   // 已有segment中的数据点
+	added  []Point   // 回填的数据点
+}
+
+// Backfill 将历史数据直接写入磁盘segment，不经过预写日志和head memtable。rows按segmentDuration对齐的时间窗口分桶，
+// 每个时间窗口的rows与时间范围重叠的diskSegment合并后生成新的segment并替换旧的segment，同一时间线相同时间戳的数据点以rows为准。
+// 时间戳不早于内存中未持久化数据的row返回BackfillRangeError，这部分数据需要通过InsertRows写入。
+// 返回与rows一一对应的写入结果，error不为nil时表示回填中断，已经完成的时间窗口不会回滚
+func (db *TSDB) Backfill(rows []*Row) ([]error, error) {
+	if db.opts.onlyMemoryMode {
+		return nil, errors.New("failed to backfill rows, database is in only memory mode")
+	}
+	db.closeMutex.RLock()
+	defer db.closeMutex.RUnlock()
+	if db.closed {
+		return nil, errors.New("failed to backfill rows, database is closed")
+	}
+	db.compactMutex.Lock()
+	defer db.compactMutex.Unlock()
+
+	var limit int64 = math.MaxInt64
+	for _, m := range db.segments.memtables() {
+		if m.MinTs() < limit {
+			limit = m.MinTs()
+		}
+	}
+	window := db.opts.precision.FromDuration(db.opts.segmentDuration)
+	errs := make([]error, len(rows))
+	buckets := make(map[int64][]*Row)
+	for i, row := range rows {
+		if err := row.validate(); err != nil {
+			errs[i] = err
+			continue
+		}
+		if row.Point.Timestamp >= limit {
+			errs[i] = fmt.Errorf("%w: timestamp %d", BackfillRangeError, row.Point.Timestamp)
+			continue
+		}
+		start := row.Point.Timestamp - (row.Point.Timestamp%window+window)%window
+		buckets[start] = append(buckets[start], row)
+	}
+
+	starts := make([]int64, 0, len(buckets))
+	for start := range buckets {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i] < starts[j]
+	})
+	for _, start := range starts {
+		if err := db.backfillWindow(buckets[start], start, start+window-1); err != nil {
+			return nil, fmt.Errorf("failed to backfill [%d, %d], err: %v", start, start+window-1, err)
+		}
+	}
+	return errs, nil
+}
+
+// backfillWindow 将[start, end]内的rows与重叠的diskSegment合并为一个新的diskSegment
+func (db *TSDB) backfillWindow(rows []*Row, start, end int64) error {
+	startTime := time.Now()
+	merged := make(map[string]*backfillSeries)
+	olds, err := db.loadOverlapped(start, end, merged)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		labels := make(LabelList, len(row.Labels))
+		copy(labels, row.Labels)
+		labels = labels.AddMetric(row.Metric)
+		labels.Sorted()
+		sid := Row{Metric: row.Metric, Labels: labels}.ID()
+		series, ok := merged[sid]
+		if !ok {
+			series = &backfillSeries{labels: labels}
+			merged[sid] = series
+		}
+		series.added = append(series.added, row.Point)
+	}
+
+	m := newMemtable(db.opts).(*memtable)
+	for _, series := range merged {
+		var metric string
+		labels := make(LabelList, 0, len(series.labels))
+		for _, label := range series.labels {
+			if label.Name == metricName {
+				metric = label.Value
+				continue
+			}
+			labels = append(labels, label)
+		}
+		points := mergePoints(series.points, dedupPoints(series.added))
+		seriesRows := make([]*Row, 0, len(points))
+		for _, point := range points {
+			// memtable会在row.Labels上追加指标名标签，每个row需要独立的标签切片
+			rowLabels := make(LabelList, len(labels))
+			copy(rowLabels, labels)
+			seriesRows = append(seriesRows, &Row{Metric: metric, Labels: rowLabels, Point: point})
+		}
+		m.insertRows(seriesRows)
+	}
+	return db.replaceSegments(m, olds, startTime)
+}
+
+// loadOverlapped 读取与[start, end]重叠的diskSegment中的全部时间线并放入merged
+func (db *TSDB) loadOverlapped(start, end int64, merged map[string]*backfillSeries) ([]*diskSegment, error) {
+	segments := db.segments.Get(start, end)
+	defer db.segments.Release(segments)
+	olds := make([]*diskSegment, 0)
+	for _, segment := range segments {
+		ds, ok := segment.(*diskSegment)
+		if !ok {
+			continue
+		}
+		ds.Load()
+		if err := ds.loadError(); err != nil {
+			return nil, err
+		}
+		seriesList, err := ds.Select(nil, math.MinInt64, math.MaxInt64)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range seriesList {
+			points, err := readPoints(s.iterator)
+			if err != nil {
+				return nil, err
+			}
+			if series, ok := merged[s.sid]; ok {
+				series.points = mergePoints(series.points, points)
+				continue
+			}
+			merged[s.sid] = &backfillSeries{labels: s.labels, points: points}
+		}
+		olds = append(olds, ds)
+	}
+	return olds, nil
+}
+
+// replaceSegments 将m写入磁盘后替换olds。新segment先写入临时目录，写完后在其中记录被替换的旧目录，
+// 之后依次移走同名的旧segment、将临时目录改为正式的目录名并删除旧segment，最后删除记录。
+// 进程在替换过程中退出时，Open会通过recoverBackfill丢弃没有写完的临时目录或者完成剩余的替换
+func (db *TSDB) replaceSegments(m *memtable, olds []*diskSegment, startTime time.Time) error {
+	if m.dataPointsCount == 0 {
+		return nil
+	}
+	removed := make([]Segment, 0, len(olds))
+	for _, old := range olds {
+		removed = append(removed, old)
+	}
+	if err := db.segments.Conflict(removed, m.MinTs()); err != nil {
+		return err
+	}
+	dirname := makeDirName(db.opts.dataPath, m.MinTs(), m.MaxTs())
+	name := path.Base(dirname)
+	tmpDir := path.Join(db.opts.dataPath, backfillPrefix+name)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := writeSegment(m, tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	replaced := make([]string, 0, len(olds))
+	for _, old := range olds {
+		if old.dir == dirname {
+			replaced = append(replaced, backfillOldPrefix+name)
+			continue
+		}
+		replaced = append(replaced, path.Base(old.dir))
+	}
+	if err := writeReplaced(tmpDir, replaced); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+
+	var moved *diskSegment
+	for _, old := range olds {
+		if old.dir != dirname {
+			continue
+		}
+		trash := path.Join(db.opts.dataPath, backfillOldPrefix+name)
+		if err := os.Rename(old.dir, trash); err != nil {
+			os.RemoveAll(tmpDir)
+			return err
+		}
+		moved, old.dir = old, trash
+	}
+	if err := os.Rename(tmpDir, dirname); err != nil {
+		if moved != nil && os.Rename(moved.dir, dirname) == nil {
+			moved.dir = dirname
+		}
+		os.RemoveAll(tmpDir)
+		return err
+	}
+
+	filename := path.Join(dirname, "data")
+	mmapFile, err := OpenMMapFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to make a mmap file %s, %v", filename, err)
+	}
+	if err := db.segments.Swap(removed, newDiskSegment(db.opts, mmapFile, dirname, m.MinTs(), m.MaxTs())); err != nil {
+		// 磁盘上的替换已经完成，重启后加载新segment
+		mmapFile.Close()
+		return err
+	}
+
+	var errs []string
+	for _, old := range olds {
+		if err := old.Close(); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if err := old.Cleanup(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to delete merged segments: %s", strings.Join(errs, "; "))
+	}
+	if err := os.Remove(path.Join(dirname, replacedFilename)); err != nil {
+		return err
+	}
+	logrus.Infof("backfill segment %s, merged %d segments, take: %v", dirname, len(olds), time.Since(startTime))
+	return nil
+}
+
+// writeReplaced 先写入临时文件再重命名，记录存在时新segment一定已经写完
+func writeReplaced(dir string, names []string) error {
+	filename := path.Join(dir, replacedFilename)
+	content := ""
+	for _, name := range names {
+		content += name + "\n"
+	}
+	if err := ioutil.WriteFile(filename+".tmp", []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// recoverBackfill 处理回填替换segment时进程退出留下的目录：没有替换记录的临时目录直接删除，
+// 有替换记录的临时目录移走同名的旧segment后改为正式的目录名，最后删除segment中记录的旧目录，
+// 移走后没有被新segment替换的旧segment会被恢复
+func recoverBackfill(dataPath string) error {
+	entries, err := ioutil.ReadDir(dataPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !strings.HasPrefix(name, backfillPrefix) || strings.HasPrefix(name, backfillOldPrefix) {
+			continue
+		}
+		tmpDir := path.Join(dataPath, name)
+		if !isFileExist(path.Join(tmpDir, replacedFilename)) {
+			logrus.Warnf("remove incomplete backfill segment %s", tmpDir)
+			if err := os.RemoveAll(tmpDir); err != nil {
+				return err
+			}
+			continue
+		}
+		segName := strings.TrimPrefix(name, backfillPrefix)
+		dirname := path.Join(dataPath, segName)
+		if isFileExist(dirname) {
+			if err := os.Rename(dirname, path.Join(dataPath, backfillOldPrefix+segName)); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(tmpDir, dirname); err != nil {
+			return err
+		}
+	}
+
+	entries, err = ioutil.ReadDir(dataPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), backfillOldPrefix) {
+			// 新segment没有写完时移走的旧segment需要恢复
+			dirname := path.Join(dataPath, strings.TrimPrefix(entry.Name(), backfillOldPrefix))
+			if !isFileExist(dirname) {
+				if err := os.Rename(path.Join(dataPath, entry.Name()), dirname); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !strings.HasPrefix(entry.Name(), "seg-") {
+			continue
+		}
+		filename := path.Join(dataPath, entry.Name(), replacedFilename)
+		data, err := ioutil.ReadFile(filename)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, name := range strings.Split(string(data), "\n") {
+			// 只删除数据目录下的目录
+			if name == "" || name != path.Base(name) || name == entry.Name() {
+				continue
+			}
+			logrus.Infof("remove segment %s replaced by backfill segment %s", name, entry.Name())
+			if err := os.RemoveAll(path.Join(dataPath, name)); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dedupPoints 按时间戳排序，时间戳相同时保留最后写入的数据点
+func dedupPoints(points []Point) []Point {
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].Timestamp < points[j].Timestamp
+	})
+	ret := points[:0]
+	for _, point := range points {
+		if len(ret) > 0 && ret[len(ret)-1].Timestamp == point.Timestamp {
+			ret[len(ret)-1] = point
+			continue
+		}
+		ret = append(ret, point)
+	}
+	return ret
+}
@@ -0,0 +1,382 @@
+package tsdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// Gorilla风格的数据块编码，时间戳使用int64的delta-of-delta，数据值使用XOR编码
+// 数据块格式: | 版本号 uint8 | 数据点数量 uint32 | 数据点bit流 |
+
+type xorChunk struct {
+	stream bstream
+	count  uint32
+
+	minT     int64
+	t        int64
+	tDelta   int64
+	v        float64
+	leading  uint8
+	trailing uint8
+}
+
+type chunkIterator struct {
+	reader bitReader
+	total  uint32
+	read   uint32
+
+	t        int64
+	tDelta   int64
+	v        float64
+	leading  uint8
+	trailing uint8
+	err      error
+}
+
+// bstream 按bit写入的字节流
+type bstream struct {
+	stream []byte
+	count  uint8 // 最后一个字节中还可以写入的bit数
+}
+
+// bitReader 按bit读取字节流，不会修改底层数据
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+const (
+	chunkVersion1   uint8 = 1
+	chunkHeaderSize       = 1 + uint32Size
+)
+
+var (
+	errChunkEOF = errors.New("unexpected end of chunk")
+)
+
+func newXORChunk() *xorChunk {
+	c := &xorChunk{leading: 0xff}
+	c.stream.stream = make([]byte, chunkHeaderSize, 128)
+	c.stream.stream[0] = chunkVersion1
+	return c
+}
+
+func (c *xorChunk) Count() int {
+	return int(c.count)
+}
+
+// MinTime 返回数据块中第一个数据点的时间戳
+func (c *xorChunk) MinTime() int64 {
+	return c.minT
+}
+
+// MaxTime 返回数据块中最后一个数据点的时间戳
+func (c *xorChunk) MaxTime() int64 {
+	return c.t
+}
+
+// Append 写入一个数据点，调用方需要保证时间戳递增
+func (c *xorChunk) Append(t int64, v float64) {
+	switch c.count {
+	case 0:
+		c.minT = t
+		var buf [binary.MaxVarintLen64]byte
+		for _, b := range buf[:binary.PutVarint(buf[:], t)] {
+			c.stream.writeBits(uint64(b), 8)
+		}
+		c.stream.writeBits(math.Float64bits(v), 64)
+	case 1:
+		tDelta := t - c.t
+		var buf [binary.MaxVarintLen64]byte
+		for _, b := range buf[:binary.PutVarint(buf[:], tDelta)] {
+			c.stream.writeBits(uint64(b), 8)
+		}
+		c.writeValue(v)
+		c.tDelta = tDelta
+	default:
+		tDelta := t - c.t
+		dod := tDelta - c.tDelta
+		switch {
+		case dod == 0:
+			c.stream.writeBit(false)
+		case bitRange(dod, 14):
+			c.stream.writeBits(0x02, 2) // '10'
+			c.stream.writeBits(uint64(dod), 14)
+		case bitRange(dod, 17):
+			c.stream.writeBits(0x06, 3) // '110'
+			c.stream.writeBits(uint64(dod), 17)
+		case bitRange(dod, 20):
+			c.stream.writeBits(0x0e, 4) // '1110'
+			c.stream.writeBits(uint64(dod), 20)
+		default:
+			c.stream.writeBits(0x0f, 4) // '1111'
+			c.stream.writeBits(uint64(dod), 64)
+		}
+		c.writeValue(v)
+		c.tDelta = tDelta
+	}
+	c.t = t
+	c.v = v
+	c.count++
+	binary.LittleEndian.PutUint32(c.stream.stream[1:chunkHeaderSize], c.count)
+}
+
+func (c *xorChunk) writeValue(v float64) {
+	delta := math.Float64bits(v) ^ math.Float64bits(c.v)
+	if delta == 0 {
+		c.stream.writeBit(false)
+		return
+	}
+	c.stream.writeBit(true)
+
+	leading := uint8(bits.LeadingZeros64(delta))
+	trailing := uint8(bits.TrailingZeros64(delta))
+	// 前导0的数量只有5个bit可以存储
+	if leading >= 32 {
+		leading = 31
+	}
+	// 0xff表示还没有写入过有效位的区间
+	if c.leading != 0xff && leading >= c.leading && trailing >= c.trailing {
+		c.stream.writeBit(false)
+		c.stream.writeBits(delta>>c.trailing, 64-int(c.leading)-int(c.trailing))
+		return
+	}
+	c.leading, c.trailing = leading, trailing
+	c.stream.writeBit(true)
+	c.stream.writeBits(uint64(leading), 5)
+	// 有效位为64时写入0，读取时再还原
+	sigbits := 64 - leading - trailing
+	c.stream.writeBits(uint64(sigbits), 6)
+	c.stream.writeBits(delta>>trailing, int(sigbits))
+}
+
+// Bytes 返回数据块的字节，继续写入后之前返回的字节不再有效
+func (c *xorChunk) Bytes() []byte {
+	return c.stream.stream
+}
+
+func (c *xorChunk) Iterator() *chunkIterator {
+	iter, _ := newChunkIterator(c.Bytes())
+	return iter
+}
+
+func newChunkIterator(data []byte) (*chunkIterator, error) {
+	if len(data) < chunkHeaderSize {
+		return nil, fmt.Errorf("invalid chunk size: %d", len(data))
+	}
+	if data[0] != chunkVersion1 {
+		return nil, fmt.Errorf("unsupported chunk version: %d", data[0])
+	}
+	return &chunkIterator{
+		reader: bitReader{data: data, pos: chunkHeaderSize << 3},
+		total:  binary.LittleEndian.Uint32(data[1:chunkHeaderSize]),
+	}, nil
+}
+
+// SeekTo 跳到第一个时间戳不小于t的数据点，不存在时返回false
+func (it *chunkIterator) SeekTo(t int64) bool {
+	if it.read > 0 && it.t >= t {
+		return true
+	}
+	for it.Next() {
+		if it.t >= t {
+			return true
+		}
+	}
+	return false
+}
+
+// Next 读取下一个数据点
+func (it *chunkIterator) Next() bool {
+	if it.err != nil || it.read >= it.total {
+		return false
+	}
+	switch it.read {
+	case 0:
+		t, err := it.reader.readVarint()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		v, err := it.reader.readBits(64)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.t = t
+		it.v = math.Float64frombits(v)
+	case 1:
+		tDelta, err := it.reader.readVarint()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.tDelta = tDelta
+		it.t += tDelta
+		if !it.readValue() {
+			return false
+		}
+	default:
+		var prefix int
+		for prefix < 4 {
+			bit, err := it.reader.readBit()
+			if err != nil {
+				it.err = err
+				return false
+			}
+			if !bit {
+				break
+			}
+			prefix++
+		}
+		var size int
+		switch prefix {
+		case 1:
+			size = 14
+		case 2:
+			size = 17
+		case 3:
+			size = 20
+		case 4:
+			size = 64
+		}
+		if size > 0 {
+			raw, err := it.reader.readBits(size)
+			if err != nil {
+				it.err = err
+				return false
+			}
+			dod := int64(raw)
+			if size < 64 && raw > 1<<(size-1) {
+				dod -= 1 << size
+			}
+			it.tDelta += dod
+		}
+		it.t += it.tDelta
+		if !it.readValue() {
+			return false
+		}
+	}
+	it.read++
+	return true
+}
+
+func (it *chunkIterator) readValue() bool {
+	bit, err := it.reader.readBit()
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if !bit {
+		return true
+	}
+	bit, err = it.reader.readBit()
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if bit {
+		leading, err := it.reader.readBits(5)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		sigbits, err := it.reader.readBits(6)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if sigbits == 0 {
+			sigbits = 64
+		}
+		it.leading = uint8(leading)
+		it.trailing = 64 - it.leading - uint8(sigbits)
+	}
+	size := 64 - int(it.leading) - int(it.trailing)
+	delta, err := it.reader.readBits(size)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.v = math.Float64frombits(math.Float64bits(it.v) ^ (delta << it.trailing))
+	return true
+}
+
+func (it *chunkIterator) At() (int64, float64) {
+	return it.t, it.v
+}
+
+func (it *chunkIterator) Err() error {
+	return it.err
+}
+
+// bitRange 判断x是否可以用nbits个bit的有符号数表示
+func bitRange(x int64, nbits uint8) bool {
+	return -((1<<(nbits-1))-1) <= x && x <= 1<<(nbits-1)
+}
+
+func (b *bstream) writeBit(bit bool) {
+	if b.count == 0 {
+		b.stream = append(b.stream, 0)
+		b.count = 8
+	}
+	if bit {
+		b.stream[len(b.stream)-1] |= 1 << (b.count - 1)
+	}
+	b.count--
+}
+
+func (b *bstream) writeBits(u uint64, nbits int) {
+	u <<= 64 - uint(nbits)
+	for nbits > 0 {
+		b.writeBit((u >> 63) == 1)
+		u <<= 1
+		nbits--
+	}
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos>>3 >= len(r.data) {
+		return false, errChunkEOF
+	}
+	bit := r.data[r.pos>>3]&(1<<(7-uint(r.pos&7))) != 0
+	r.pos++
+	return bit, nil
+}
+
+func (r *bitReader) readBits(nbits int) (uint64, error) {
+	var u uint64
+	for i := 0; i < nbits; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		u <<= 1
+		if bit {
+			u |= 1
+		}
+	}
+	return u, nil
+}
+
+func (r *bitReader) readVarint() (int64, error) {
+	var buf [binary.MaxVarintLen64]byte
+	for i := 0; i < len(buf); i++ {
+		b, err := r.readBits(8)
+		if err != nil {
+			return 0, err
+		}
+		buf[i] = byte(b)
+		if b < 0x80 {
+			v, n := binary.Varint(buf[:i+1])
+			if n <= 0 {
+				return 0, errors.New("invalid varint in chunk")
+			}
+			return v, nil
+		}
+	}
+	return 0, errors.New("varint overflow in chunk")
+}
@@ -0,0 +1,281 @@
+// tsdb-server 以HTTP服务的方式运行数据库，提供兼容Prometheus的查询接口和remote_write、remote_read接口，
+// 以及兼容InfluxDB line protocol、OpenTSDB、Graphite、StatsD和OTLP的写入接口
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"tsdb"
+	"tsdb/api"
+	"tsdb/graphite"
+	"tsdb/influx"
+	"tsdb/opentsdb"
+	"tsdb/otlp"
+	"tsdb/statsd"
+)
+
+type config struct {
+	listenAddr        string
+	telnetAddr        string
+	graphiteAddr      string
+	graphiteTemplates stringList
+	statsdAddr        string
+	statsdInterval    time.Duration
+	statsdGaugeExpiry time.Duration
+	statsdPercentiles string
+	otlpGRPCAddr      string
+	dataPath          string
+	retention         time.Duration
+	segmentDuration   time.Duration
+	precision         string
+	compressor        string
+	shutdownTimeout   time.Duration
+}
+
+func main() {
+	conf := &config{}
+	flag.StringVar(&conf.listenAddr, "listen-addr", ":9090", "HTTP listen address")
+	flag.StringVar(&conf.telnetAddr, "opentsdb-telnet-addr", "", "OpenTSDB telnet listen address, disabled if empty")
+	flag.StringVar(&conf.graphiteAddr, "graphite-addr", "", "Graphite TCP and UDP listen address, disabled if empty")
+	flag.Var(&conf.graphiteTemplates, "graphite-template", "Graphite template, e.g. 'servers.* .host.measurement*', can be repeated")
+	flag.StringVar(&conf.statsdAddr, "statsd-addr", "", "StatsD UDP listen address, disabled if empty")
+	flag.DurationVar(&conf.statsdInterval, "statsd-flush-interval", 10*time.Second, "StatsD aggregation interval")
+	flag.DurationVar(&conf.statsdGaugeExpiry, "statsd-gauge-expiry", 5*time.Minute, "stop writing StatsD gauges not updated within this duration, never expire if 0")
+	flag.StringVar(&conf.statsdPercentiles, "statsd-percentiles", "50,90,99", "comma separated percentiles of StatsD timers")
+	flag.StringVar(&conf.otlpGRPCAddr, "otlp-grpc-addr", "", "OTLP gRPC listen address, disabled if empty")
+	flag.StringVar(&conf.dataPath, "data-path", "data", "directory to store segments and wal")
+	flag.DurationVar(&conf.retention, "retention", 7*24*time.Hour, "how long to keep data")
+	flag.DurationVar(&conf.segmentDuration, "segment-duration", 2*time.Hour, "time range of a segment")
+	flag.StringVar(&conf.precision, "precision", "ms", "timestamp precision: s, ms, us or ns")
+	flag.StringVar(&conf.compressor, "compressor", "none", "segment compressor: none, zstd or snappy")
+	flag.DurationVar(&conf.shutdownTimeout, "shutdown-timeout", time.Minute, "max time to wait for a graceful shutdown")
+	flag.Parse()
+
+	if err := run(conf); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+func run(conf *config) error {
+	opts, err := conf.options()
+	if err != nil {
+		return err
+	}
+	db, err := tsdb.Open(opts...)
+	if err != nil {
+		return fmt.Errorf("failed to open database, err: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	api.NewAPI(db).Register(mux)
+	influx.NewHandler(db).Register(mux)
+	opentsdb.NewHandler(db).Register(mux)
+	otlp.NewServer(db).Register(mux)
+	server := &http.Server{
+		Addr:    conf.listenAddr,
+		Handler: mux,
+	}
+
+	errCh := make(chan error, 1)
+	// closers 关闭http服务后、关闭数据库前需要关闭的监听
+	closers := make([]func() error, 0)
+	go serve(errCh, "http", conf.listenAddr, func() error {
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	})
+	listeners := []struct {
+		addr  string
+		start func(conf *config, db *tsdb.TSDB, errCh chan<- error) (func() error, error)
+	}{
+		{conf.telnetAddr, serveTelnet},
+		{conf.graphiteAddr, serveGraphite},
+		{conf.statsdAddr, serveStatsD},
+		{conf.otlpGRPCAddr, serveOTLP},
+	}
+	for _, l := range listeners {
+		if l.addr == "" {
+			continue
+		}
+		closer, startErr := l.start(conf, db, errCh)
+		if startErr != nil {
+			err = startErr
+			break
+		}
+		closers = append(closers, closer)
+	}
+
+	if err == nil {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		select {
+		case sig := <-signals:
+			logrus.Infof("received signal %v, shutting down", sig)
+		case err = <-errCh:
+			logrus.Errorf("server error: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logrus.Errorf("failed to shutdown http server, err: %v", err)
+	}
+	for _, closer := range closers {
+		if err := closer(); err != nil {
+			logrus.Errorf("failed to close listener, err: %v", err)
+		}
+	}
+	if err := db.Close(ctx); err != nil {
+		return fmt.Errorf("failed to close database, err: %v", err)
+	}
+	return err
+}
+
+func serveTelnet(conf *config, db *tsdb.TSDB, errCh chan<- error) (func() error, error) {
+	listener, err := net.Listen("tcp", conf.telnetAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen opentsdb telnet, err: %v", err)
+	}
+	server := opentsdb.NewTelnetServer(db)
+	go serve(errCh, "opentsdb telnet", conf.telnetAddr, func() error {
+		return server.Serve(listener)
+	})
+	return server.Close, nil
+}
+
+func serveGraphite(conf *config, db *tsdb.TSDB, errCh chan<- error) (func() error, error) {
+	parser, err := graphite.NewParser(conf.graphiteTemplates, db.Precision())
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", conf.graphiteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen graphite tcp, err: %v", err)
+	}
+	packetConn, err := net.ListenPacket("udp", conf.graphiteAddr)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to listen graphite udp, err: %v", err)
+	}
+	server := graphite.NewServer(db, parser)
+	go serve(errCh, "graphite tcp", conf.graphiteAddr, func() error {
+		return server.ServeTCP(listener)
+	})
+	go serve(errCh, "graphite udp", conf.graphiteAddr, func() error {
+		return server.ServeUDP(packetConn)
+	})
+	return server.Close, nil
+}
+
+func serveStatsD(conf *config, db *tsdb.TSDB, errCh chan<- error) (func() error, error) {
+	if conf.statsdInterval <= 0 {
+		return nil, fmt.Errorf("invalid statsd flush interval: %v", conf.statsdInterval)
+	}
+	if conf.statsdGaugeExpiry < 0 {
+		return nil, fmt.Errorf("invalid statsd gauge expiry: %v", conf.statsdGaugeExpiry)
+	}
+	percentiles := make([]float64, 0)
+	for _, s := range strings.Split(conf.statsdPercentiles, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		p, err := strconv.ParseFloat(s, 64)
+		if err != nil || p <= 0 || p > 100 {
+			return nil, fmt.Errorf("invalid statsd percentile: %s", s)
+		}
+		percentiles = append(percentiles, p)
+	}
+	packetConn, err := net.ListenPacket("udp", conf.statsdAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen statsd udp, err: %v", err)
+	}
+	server := statsd.NewServer(db, conf.statsdInterval, conf.statsdGaugeExpiry, percentiles)
+	go serve(errCh, "statsd", conf.statsdAddr, func() error {
+		return server.Serve(packetConn)
+	})
+	return server.Close, nil
+}
+
+func serveOTLP(conf *config, db *tsdb.TSDB, errCh chan<- error) (func() error, error) {
+	listener, err := net.Listen("tcp", conf.otlpGRPCAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen otlp grpc, err: %v", err)
+	}
+	server := grpc.NewServer()
+	otlp.NewServer(db).RegisterGRPC(server)
+	go serve(errCh, "otlp grpc", conf.otlpGRPCAddr, func() error {
+		return server.Serve(listener)
+	})
+	return func() error {
+		server.GracefulStop()
+		return nil
+	}, nil
+}
+
+// serve 运行fn，返回错误时通知errCh，已经有错误未处理时忽略
+func serve(errCh chan<- error, name, addr string, fn func() error) {
+	logrus.Infof("%s listening on %s", name, addr)
+	if err := fn(); err != nil {
+		select {
+		case errCh <- fmt.Errorf("%s: %v", name, err):
+		default:
+		}
+	}
+}
+
+func (conf *config) options() ([]tsdb.Option, error) {
+	opts := []tsdb.Option{
+		tsdb.WithDataPath(conf.dataPath),
+		tsdb.WithRetention(conf.retention),
+		tsdb.WithSegmentDuration(conf.segmentDuration),
+	}
+	switch conf.precision {
+	case "s":
+		opts = append(opts, tsdb.WithTimestampPrecision(tsdb.PrecisionSecond))
+	case "ms":
+		opts = append(opts, tsdb.WithTimestampPrecision(tsdb.PrecisionMillisecond))
+	case "us":
+		opts = append(opts, tsdb.WithTimestampPrecision(tsdb.PrecisionMicrosecond))
+	case "ns":
+		opts = append(opts, tsdb.WithTimestampPrecision(tsdb.PrecisionNanosecond))
+	default:
+		return nil, fmt.Errorf("unknown precision: %s", conf.precision)
+	}
+	switch conf.compressor {
+	case "none":
+		opts = append(opts, tsdb.WithBytesCompressor(tsdb.NoopBytesCompressor))
+	case "zstd":
+		opts = append(opts, tsdb.WithBytesCompressor(tsdb.ZSTDBytesCompressor))
+	case "snappy":
+		opts = append(opts, tsdb.WithBytesCompressor(tsdb.SnappyBytesCompressor))
+	default:
+		return nil, fmt.Errorf("unknown compressor: %s", conf.compressor)
+	}
+	return opts, nil
+}
+
+// stringList 可以重复指定的字符串参数
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
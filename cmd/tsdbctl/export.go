@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"tsdb"
+	"tsdb/promql"
+)
+
+const metricLabel = "__name__"
+
+// rowWriter 依次写入rows
+type rowWriter interface {
+	Write(row *tsdb.Row) error
+	Flush() error
+}
+
+type csvRowWriter struct {
+	w      *csv.Writer
+	record []string
+}
+
+func (w *csvRowWriter) Write(row *tsdb.Row) error {
+	w.record = append(w.record[:0], row.Metric)
+	for _, label := range row.Labels {
+		w.record = append(w.record, label.Name+"="+label.Value)
+	}
+	w.record = append(w.record,
+		strconv.FormatInt(row.Point.Timestamp, 10),
+		strconv.FormatFloat(row.Point.Value, 'g', -1, 64))
+	return w.w.Write(w.record)
+}
+
+func (w *csvRowWriter) Flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+type jsonRowWriter struct {
+	w *bufio.Writer
+	e *json.Encoder
+}
+
+func newJSONRowWriter(w io.Writer) *jsonRowWriter {
+	bw := bufio.NewWriter(w)
+	return &jsonRowWriter{w: bw, e: json.NewEncoder(bw)}
+}
+
+func (w *jsonRowWriter) Write(row *tsdb.Row) error {
+	return w.e.Encode(row)
+}
+
+func (w *jsonRowWriter) Flush() error {
+	return w.w.Flush()
+}
+
+type selectors []string
+
+func (s *selectors) String() string {
+	return fmt.Sprint(*s)
+}
+
+func (s *selectors) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// runExport 导出与任一选择器匹配的时间线在[start, end]范围内的数据点，每个数据点一行，
+// JSON格式中无法表示的NaN和Inf会被跳过
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dbf := &dbFlags{}
+	dbf.register(fs)
+	format := fs.String("format", formatCSV, "output format: csv or json")
+	output := fs.String("output", "-", "output file, - for stdout")
+	start := fs.String("start", "", "start time, RFC3339 or integer timestamp, unlimited if empty")
+	end := fs.String("end", "", "end time, RFC3339 or integer timestamp, unlimited if empty")
+	var matches selectors
+	fs.Var(&matches, "match", "series selector, e.g. 'cpu.busy{node=\"vm1\"}', can be repeated")
+	fs.Parse(args)
+	if len(matches) == 0 {
+		return fmt.Errorf("at least one -match is required")
+	}
+	matchers := make([][]*tsdb.Matcher, 0, len(matches))
+	for _, match := range matches {
+		m, err := promql.ParseMetricSelector(match)
+		if err != nil {
+			return fmt.Errorf("invalid selector %q: %v", match, err)
+		}
+		matchers = append(matchers, m)
+	}
+	precision, err := parsePrecision(dbf.precision)
+	if err != nil {
+		return err
+	}
+	startTs, endTs := int64(math.MinInt64), int64(math.MaxInt64)
+	if *start != "" {
+		if startTs, err = parseTimestamp(*start, precision); err != nil {
+			return err
+		}
+	}
+	if *end != "" {
+		if endTs, err = parseTimestamp(*end, precision); err != nil {
+			return err
+		}
+	}
+
+	out := io.Writer(os.Stdout)
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	var writer rowWriter
+	switch *format {
+	case formatCSV:
+		writer = &csvRowWriter{w: csv.NewWriter(out)}
+	case formatJSON:
+		writer = newJSONRowWriter(out)
+	default:
+		return fmt.Errorf("unknown format: %s", *format)
+	}
+
+	db, err := dbf.open()
+	if err != nil {
+		return err
+	}
+	exported, skipped, err := exportRows(db, writer, *format == formatJSON, matchers, startTs, endTs)
+	if closeErr := closeDB(db); err == nil {
+		err = closeErr
+	}
+	fmt.Fprintf(os.Stderr, "exported %d rows, skipped %d rows\n", exported, skipped)
+	return err
+}
+
+func exportRows(db *tsdb.TSDB, writer rowWriter, skipNonFinite bool, matchers [][]*tsdb.Matcher, start, end int64) (int, int, error) {
+	exported, skipped := 0, 0
+	seen := make(map[string]struct{})
+	for _, m := range matchers {
+		n, s, err := exportSelected(db, writer, skipNonFinite, m, start, end, seen)
+		exported, skipped = exported+n, skipped+s
+		if err != nil {
+			return exported, skipped, err
+		}
+	}
+	return exported, skipped, writer.Flush()
+}
+
+// exportSelected 逐条时间线逐个数据点导出，不会一次读出全部数据点
+func exportSelected(db *tsdb.TSDB, writer rowWriter, skipNonFinite bool, matchers []*tsdb.Matcher, start, end int64, seen map[string]struct{}) (int, int, error) {
+	exported, skipped := 0, 0
+	set, err := db.Select("", matchers, start, end)
+	if err != nil {
+		return exported, skipped, err
+	}
+	defer set.Close()
+	for set.Next() {
+		labels, it := set.At()
+		// 多个选择器匹配同一条时间线时只导出一次
+		key := labels.String()
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		row := &tsdb.Row{Labels: make(tsdb.LabelList, 0, len(labels))}
+		for _, label := range labels {
+			if label.Name == metricLabel {
+				row.Metric = label.Value
+				continue
+			}
+			row.Labels = append(row.Labels, label)
+		}
+		for it.Next() {
+			ts, value := it.At()
+			if skipNonFinite && (math.IsNaN(value) || math.IsInf(value, 0)) {
+				skipped++
+				continue
+			}
+			row.Point = tsdb.Point{Timestamp: ts, Value: value}
+			if err := writer.Write(row); err != nil {
+				return exported, skipped, err
+			}
+			exported++
+		}
+		if err := it.Err(); err != nil {
+			return exported, skipped, err
+		}
+	}
+	return exported, skipped, set.Err()
+}
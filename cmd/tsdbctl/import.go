@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"tsdb"
+)
+
+// rowReader 依次读取rows，读完时返回io.EOF
+type rowReader interface {
+	Read() (*tsdb.Row, error)
+}
+
+// csvRowReader 每行为metric,name=value...,timestamp,value
+type csvRowReader struct {
+	r    *csv.Reader
+	line int
+}
+
+func newCSVRowReader(r io.Reader) *csvRowReader {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	return &csvRowReader{r: reader}
+}
+
+func (r *csvRowReader) Read() (*tsdb.Row, error) {
+	record, err := r.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	r.line++
+	if len(record) < 3 {
+		return nil, fmt.Errorf("line %d: expected metric,labels...,timestamp,value, got %d fields", r.line, len(record))
+	}
+	row := &tsdb.Row{
+		Metric: record[0],
+		Labels: make(tsdb.LabelList, 0, len(record)-3),
+	}
+	for _, field := range record[1 : len(record)-2] {
+		i := strings.IndexByte(field, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: invalid label %q, expected name=value", r.line, field)
+		}
+		row.Labels = append(row.Labels, tsdb.Label{Name: field[:i], Value: field[i+1:]})
+	}
+	if row.Point.Timestamp, err = strconv.ParseInt(record[len(record)-2], 10, 64); err != nil {
+		return nil, fmt.Errorf("line %d: invalid timestamp %q", r.line, record[len(record)-2])
+	}
+	if row.Point.Value, err = strconv.ParseFloat(record[len(record)-1], 64); err != nil {
+		return nil, fmt.Errorf("line %d: invalid value %q", r.line, record[len(record)-1])
+	}
+	return row, nil
+}
+
+// jsonRowReader 每行为一个JSON编码的tsdb.Row
+type jsonRowReader struct {
+	d    *json.Decoder
+	line int
+}
+
+func (r *jsonRowReader) Read() (*tsdb.Row, error) {
+	row := &tsdb.Row{}
+	if err := r.d.Decode(row); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("row %d: %v", r.line+1, err)
+	}
+	r.line++
+	return row, nil
+}
+
+// runImport 按批写入rows，写入失败的row输出到标准错误后继续导入
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dbf := &dbFlags{}
+	dbf.register(fs)
+	format := fs.String("format", formatCSV, "input format: csv or json")
+	input := fs.String("input", "-", "input file, - for stdin")
+	batchSize := fs.Int("batch-size", 1000, "number of rows per insert")
+	backfill := fs.Bool("backfill", false, "write historical rows directly into disk segments, use a large batch size since every batch rewrites the overlapping segments")
+	fs.Parse(args)
+	if *batchSize <= 0 {
+		return fmt.Errorf("invalid batch size: %d", *batchSize)
+	}
+
+	in := io.Reader(os.Stdin)
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	var reader rowReader
+	switch *format {
+	case formatCSV:
+		reader = newCSVRowReader(bufio.NewReader(in))
+	case formatJSON:
+		reader = &jsonRowReader{d: json.NewDecoder(bufio.NewReader(in))}
+	default:
+		return fmt.Errorf("unknown format: %s", *format)
+	}
+
+	db, err := dbf.open()
+	if err != nil {
+		return err
+	}
+	imported, failed, err := importRows(db, reader, *batchSize, *backfill)
+	if closeErr := closeDB(db); err == nil {
+		err = closeErr
+	}
+	fmt.Fprintf(os.Stderr, "imported %d rows, failed %d rows\n", imported, failed)
+	return err
+}
+
+// importRows 按批写入rows，backfill为true时通过Backfill直接写入磁盘segment
+func importRows(db *tsdb.TSDB, reader rowReader, batchSize int, backfill bool) (int, int, error) {
+	imported, failed := 0, 0
+	batch := make([]*tsdb.Row, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		var errs []error
+		var err error
+		if backfill {
+			errs, err = db.Backfill(batch)
+		} else {
+			errs, err = db.InsertRowsSync(context.Background(), batch)
+		}
+		if err != nil {
+			return err
+		}
+		for i, err := range errs {
+			if err != nil {
+				failed++
+				fmt.Fprintf(os.Stderr, "failed to import %s%s: %v\n", batch[i].Metric, batch[i].Labels.String(), err)
+				continue
+			}
+			imported++
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return imported, failed, err
+		}
+		batch = append(batch, row)
+		if len(batch) >= batchSize {
+			if err := flush(); err != nil {
+				return imported, failed, err
+			}
+		}
+	}
+	return imported, failed, flush()
+}
@@ -0,0 +1,134 @@
+// tsdbctl 数据库的命令行工具，直接读写数据目录，使用时需要先停止tsdb-server
+//
+//	tsdbctl import -data-path data -format csv -input rows.csv
+//	tsdbctl import -data-path data -backfill -batch-size 100000 -input history.csv
+//	tsdbctl export -data-path data -format json -match 'cpu.busy{node="vm1"}' -start 2020-09-13T12:00:00Z
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+	"tsdb"
+)
+
+const (
+	formatCSV  = "csv"
+	formatJSON = "json"
+)
+
+// dbFlags 打开数据库需要的参数，需要与tsdb-server的参数一致
+type dbFlags struct {
+	dataPath        string
+	segmentDuration time.Duration
+	precision       string
+	compressor      string
+}
+
+func (f *dbFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.dataPath, "data-path", "data", "directory to store segments and wal")
+	fs.DurationVar(&f.segmentDuration, "segment-duration", 2*time.Hour, "time range of a segment")
+	fs.StringVar(&f.precision, "precision", "ms", "timestamp precision: s, ms, us or ns")
+	fs.StringVar(&f.compressor, "compressor", "none", "segment compressor: none, zstd or snappy")
+}
+
+// open 打开数据库，允许写入乱序的历史数据。不删除过期的数据，导入的历史数据由tsdb-server按保留时长删除
+func (f *dbFlags) open() (*tsdb.TSDB, error) {
+	precision, err := parsePrecision(f.precision)
+	if err != nil {
+		return nil, err
+	}
+	compressor, err := parseCompressor(f.compressor)
+	if err != nil {
+		return nil, err
+	}
+	return tsdb.Open(
+		tsdb.WithDataPath(f.dataPath),
+		tsdb.WithRetention(0),
+		tsdb.WithSegmentDuration(f.segmentDuration),
+		tsdb.WithTimestampPrecision(precision),
+		tsdb.WithBytesCompressor(compressor),
+		tsdb.WithEnableOutdated(true),
+	)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: tsdbctl <command> [flags]
+
+Commands:
+  import    import rows from CSV or newline-delimited JSON
+  export    export rows matching selectors in a time range
+
+Run 'tsdbctl <command> -h' for the flags of a command.
+`)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "import":
+		err = runImport(os.Args[2:])
+	case "export":
+		err = runExport(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		usage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tsdbctl %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func parsePrecision(s string) (tsdb.TimestampPrecision, error) {
+	switch s {
+	case "s":
+		return tsdb.PrecisionSecond, nil
+	case "ms":
+		return tsdb.PrecisionMillisecond, nil
+	case "us":
+		return tsdb.PrecisionMicrosecond, nil
+	case "ns":
+		return tsdb.PrecisionNanosecond, nil
+	}
+	return 0, fmt.Errorf("unknown precision: %s", s)
+}
+
+func parseCompressor(s string) (tsdb.BytesCompressorType, error) {
+	switch s {
+	case "none":
+		return tsdb.NoopBytesCompressor, nil
+	case "zstd":
+		return tsdb.ZSTDBytesCompressor, nil
+	case "snappy":
+		return tsdb.SnappyBytesCompressor, nil
+	}
+	return 0, fmt.Errorf("unknown compressor: %s", s)
+}
+
+// parseTimestamp 解析RFC3339格式的时间或者数据库精度下的整数时间戳
+func parseTimestamp(s string, precision tsdb.TimestampPrecision) (int64, error) {
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected RFC3339 or integer timestamp", s)
+	}
+	return precision.FromTime(t), nil
+}
+
+func closeDB(db *tsdb.TSDB) error {
+	return db.Close(context.Background())
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+	"tsdb"
+)
+
+func TestImportExport(t *testing.T) {
+	db, err := tsdb.Open(tsdb.WithDataPath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	input := "cpu.busy,node=vm1,dc=dc1,1600000000,1.5\n" +
+		"cpu.busy,node=vm1,dc=dc1,1600000060,2\n" +
+		"cpu.busy,node=vm2,dc=dc1,1600000000,3\n" +
+		"mem.used,node=vm1,1600000000,NaN\n" +
+		",node=vm1,1600000000,1\n"
+	imported, failed, err := importRows(db, newCSVRowReader(strings.NewReader(input)), 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 4 || failed != 1 {
+		t.Fatalf("unexpected result: imported %d, failed %d", imported, failed)
+	}
+	if _, _, err := importRows(db, newCSVRowReader(strings.NewReader("cpu.busy,node,1600000000,1\n")), 2, false); err == nil {
+		t.Fatal("expected error for invalid label")
+	}
+	imported, failed, err = importRows(db, newCSVRowReader(strings.NewReader("cpu.busy,node=db1,1500000000,1\n")), 2, true)
+	if err != nil || imported != 1 || failed != 0 {
+		t.Fatalf("unexpected backfill result: imported %d, failed %d, err %v", imported, failed, err)
+	}
+
+	matchers := [][]*tsdb.Matcher{
+		{tsdb.MustNewMatcher(tsdb.MatchEqual, metricLabel, "cpu.busy"), tsdb.MustNewMatcher(tsdb.MatchEqual, "node", "vm1")},
+		{tsdb.MustNewMatcher(tsdb.MatchRegexp, "node", "vm.*")},
+	}
+	buf := &bytes.Buffer{}
+	exported, skipped, err := exportRows(db, &csvRowWriter{w: csv.NewWriter(buf)}, false, matchers, 1600000000, 1600000060)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "cpu.busy,dc=dc1,node=vm1,1600000000,1.5\n" +
+		"cpu.busy,dc=dc1,node=vm1,1600000060,2\n" +
+		"cpu.busy,dc=dc1,node=vm2,1600000000,3\n" +
+		"mem.used,node=vm1,1600000000,NaN\n"
+	if exported != 4 || skipped != 0 || buf.String() != expected {
+		t.Fatalf("unexpected export: %d rows\n%s", exported, buf.String())
+	}
+
+	buf.Reset()
+	exported, skipped, err = exportRows(db, newJSONRowWriter(buf), true, matchers[1:], math.MinInt64, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported != 3 || skipped != 1 {
+		t.Fatalf("unexpected export: exported %d, skipped %d", exported, skipped)
+	}
+	row := &tsdb.Row{}
+	if err := json.NewDecoder(buf).Decode(row); err != nil {
+		t.Fatal(err)
+	}
+	if row.Metric != "cpu.busy" || len(row.Labels) != 2 || row.Point.Value != 1.5 {
+		t.Fatalf("unexpected row: %+v", row)
+	}
+}
+
+func TestOpenFlags(t *testing.T) {
+	dbf := &dbFlags{dataPath: t.TempDir(), segmentDuration: time.Hour, precision: "s", compressor: "zstd"}
+	db, err := dbf.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 早于默认保留时长的历史数据
+	imported, _, err := importRows(db, newCSVRowReader(strings.NewReader("cpu.busy,node=vm1,1500000000,1\n")), 1, true)
+	if err != nil || imported != 1 {
+		t.Fatalf("unexpected backfill result: imported %d, err %v", imported, err)
+	}
+	if err := closeDB(db); err != nil {
+		t.Fatal(err)
+	}
+
+	matchers := [][]*tsdb.Matcher{{tsdb.MustNewMatcher(tsdb.MatchEqual, metricLabel, "cpu.busy")}}
+	export := func(compressor string) (int, error) {
+		dbf.compressor = compressor
+		db, err := dbf.open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeDB(db)
+		exported, _, err := exportRows(db, &csvRowWriter{w: csv.NewWriter(&bytes.Buffer{})}, false, matchers, math.MinInt64, math.MaxInt64)
+		return exported, err
+	}
+	// 压缩方式不一致时segment无法加载，导出失败而不是返回空结果
+	if _, err := export("none"); err == nil {
+		t.Fatal("expected error for segment that failed to load")
+	}
+	if exported, err := export("zstd"); err != nil || exported != 1 {
+		t.Fatalf("unexpected export: exported %d, err %v", exported, err)
+	}
+	dbf.compressor = "lz4"
+	if _, err := dbf.open(); err == nil {
+		t.Fatal("expected error for unknown compressor")
+	}
+}
@@ -29,10 +29,16 @@ type BytesCompressor interface {
 	Decompress(data []byte) ([]byte, error)
 }
 
+// DoCompress 使用默认配置的压缩算法压缩数据
+//
+// Deprecated: 压缩算法是每个数据库实例的配置，使用WithBytesCompressor设置
 func DoCompress(data []byte) []byte {
 	return defaultOpts.bytesCompressor.Compress(data)
 }
 
+// DoDecompress 使用默认配置的压缩算法解压数据
+//
+// Deprecated: 压缩算法是每个数据库实例的配置，使用WithBytesCompressor设置
 func DoDecompress(data []byte) ([]byte, error) {
 	return defaultOpts.bytesCompressor.Decompress(data)
 }
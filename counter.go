@@ -0,0 +1,184 @@
+package tsdb
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// CounterFunc 单调递增计数器的计算函数
+type CounterFunc string
+
+const (
+	CounterRate     CounterFunc = "rate"     // 窗口内平均每秒的增量
+	CounterIncrease CounterFunc = "increase" // 窗口内的增量
+	CounterIRate    CounterFunc = "irate"    // 窗口内最后两个数据点之间每秒的增量
+)
+
+// Increase 计算计数器在窗口(start, end]内的增量，points为窗口内按时间戳升序排列的数据点。
+// 与Prometheus的increase一致：值变小时认为计数器重置，增量按重置前的值补偿，
+// 并将第一个和最后一个数据点之间的增量外推到窗口边界。少于两个数据点时返回false
+func Increase(points []Point, start, end int64) (float64, bool) {
+	return extrapolatedDelta(points, start, end, true)
+}
+
+// Rate 计算计数器在窗口(start, end]内平均每秒的增量，与Prometheus的rate一致
+func Rate(points []Point, start, end int64, precision TimestampPrecision) (float64, bool) {
+	increase, ok := Increase(points, start, end)
+	if !ok {
+		return 0, false
+	}
+	return increase / seconds(end-start, precision), true
+}
+
+// Delta 计算gauge在窗口(start, end]内最后与第一个数据点的差值并外推到窗口边界，不检测重置
+func Delta(points []Point, start, end int64) (float64, bool) {
+	return extrapolatedDelta(points, start, end, false)
+}
+
+// IRate 使用最后两个数据点计算计数器每秒的增量，与Prometheus的irate一致，计数器重置时使用最后一个数据点的值作为增量
+func IRate(points []Point, precision TimestampPrecision) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+	pre, last := points[len(points)-2], points[len(points)-1]
+	result := last.Value - pre.Value
+	if last.Value < pre.Value {
+		result = last.Value
+	}
+	if last.Timestamp == pre.Timestamp {
+		return 0, false
+	}
+	return result / seconds(last.Timestamp-pre.Timestamp, precision), true
+}
+
+// extrapolatedDelta 计算区间内的增量并外推到区间边界
+func extrapolatedDelta(points []Point, start, end int64, isCounter bool) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+	first, last := points[0], points[len(points)-1]
+	result := last.Value - first.Value
+	if isCounter {
+		pre := first.Value
+		for _, point := range points[1:] {
+			if point.Value < pre {
+				result += pre
+			}
+			pre = point.Value
+		}
+	}
+
+	durationToStart := float64(first.Timestamp - start)
+	durationToEnd := float64(end - last.Timestamp)
+	sampledInterval := float64(last.Timestamp - first.Timestamp)
+	averageInterval := sampledInterval / float64(len(points)-1)
+	// 计数器不会小于0，外推的起点不能早于计数器为0的时刻
+	if isCounter && result > 0 && first.Value >= 0 {
+		if durationToZero := sampledInterval * (first.Value / result); durationToZero < durationToStart {
+			durationToStart = durationToZero
+		}
+	}
+	// 数据点距离边界超过平均间隔的1.1倍时认为时间线在区间内开始或结束，只外推半个平均间隔
+	threshold := averageInterval * 1.1
+	interval := sampledInterval
+	if durationToStart < threshold {
+		interval += durationToStart
+	} else {
+		interval += averageInterval / 2
+	}
+	if durationToEnd < threshold {
+		interval += durationToEnd
+	} else {
+		interval += averageInterval / 2
+	}
+	return result * (interval / sampledInterval), true
+}
+
+// seconds 将时间戳差值转换为秒
+func seconds(delta int64, precision TimestampPrecision) float64 {
+	return float64(delta) / float64(precision.FromDuration(time.Second))
+}
+
+// QueryCounter 在[start, end]内每隔step计算metric满足全部选择器的计数器时间线在(t-window, t]窗口内的fn，
+// 返回的时间线不包含指标名标签__name__，窗口内少于两个数据点的时刻没有数据点。时间参数使用数据库的时间戳精度
+func (db *TSDB) QueryCounter(metric string, matchers []*Matcher, fn CounterFunc, start, end, step, window int64) ([]*Series, error) {
+	switch fn {
+	case CounterRate, CounterIncrease, CounterIRate:
+	default:
+		return nil, fmt.Errorf("unknown counter function: %q", fn)
+	}
+	if step <= 0 {
+		return nil, fmt.Errorf("step must be positive, got: %d", step)
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("window must be positive, got: %d", window)
+	}
+	set, err := db.Select(metric, matchers, start-window+1, end)
+	if err != nil {
+		return nil, err
+	}
+	defer set.Close()
+
+	ret := make([]*Series, 0)
+	for set.Next() {
+		labels, it := set.At()
+		points, err := counterPoints(it, fn, start, end, step, window, db.opts.precision)
+		if err != nil {
+			return nil, err
+		}
+		if len(points) == 0 {
+			continue
+		}
+		withoutName := make(LabelList, 0, len(labels))
+		for _, label := range labels {
+			if label.Name != metricName {
+				withoutName = append(withoutName, label)
+			}
+		}
+		ret = append(ret, &Series{Labels: withoutName, Points: points})
+	}
+	return ret, set.Err()
+}
+
+// counterPoints 遍历数据点时只保留(t-window, t]窗口内的数据点，内存占用只与窗口内的数据点数量有关
+func counterPoints(it SeriesIterator, fn CounterFunc, start, end, step, window int64, precision TimestampPrecision) ([]Point, error) {
+	points := make([]Point, 0)
+	buffer := make([]Point, 0)
+	ok := it.Next()
+	for t := start; t <= end && (ok || len(buffer) > 0); t += step {
+		i := sort.Search(len(buffer), func(i int) bool {
+			return buffer[i].Timestamp > t-window
+		})
+		buffer = buffer[i:]
+		if ok && len(buffer) == 0 {
+			// 跳过两个窗口之间的数据点
+			ok = it.SeekTo(t - window + 1)
+		}
+		for ok {
+			ts, v := it.At()
+			if ts > t {
+				break
+			}
+			buffer = append(buffer, Point{Timestamp: ts, Value: v})
+			ok = it.Next()
+		}
+
+		var (
+			value    float64
+			computed bool
+		)
+		switch fn {
+		case CounterRate:
+			value, computed = Rate(buffer, t-window, t, precision)
+		case CounterIncrease:
+			value, computed = Increase(buffer, t-window, t)
+		case CounterIRate:
+			value, computed = IRate(buffer, precision)
+		}
+		if computed {
+			points = append(points, Point{Timestamp: t, Value: value})
+		}
+	}
+	return points, it.Err()
+}
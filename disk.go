@@ -2,6 +2,7 @@ package tsdb
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/sirupsen/logrus"
 	"os"
 	"path"
@@ -11,10 +12,13 @@ import (
 )
 
 type diskSegment struct {
+	opts         *options
 	dataFd       *MMapFile
 	dataFilename string
 	dir          string
 	load         bool
+	loadErr      error // 最后一次加载失败的原因
+	loadMutex    sync.Mutex
 
 	wait         sync.WaitGroup
 	labelVs      *labelValueList
@@ -44,12 +48,15 @@ func (ds *diskSegment) Frozen() bool {
 }
 
 func (ds *diskSegment) MaxTs() int64 {
-	return 0
+	return ds.maxTimestamp
 }
 
 func (ds *diskSegment) Close() error {
 	// 保证没有进程使用fd
 	ds.wait.Wait()
+	if ds.dataFd == nil {
+		return nil
+	}
 	return ds.dataFd.Close()
 }
 
@@ -58,6 +65,8 @@ func (ds *diskSegment) Cleanup() error {
 }
 
 func (ds *diskSegment) Load() Segment {
+	ds.loadMutex.Lock()
+	defer ds.loadMutex.Unlock()
 	if ds.load {
 		return ds
 	}
@@ -68,37 +77,99 @@ func (ds *diskSegment) Load() Segment {
 	}
 	dataLen, metaLen, err := dreader.Read()
 	if err != nil {
-		logrus.Errorf("faild to read %s, err: %v", ds.dataFilename, err)
+		ds.loadErr = fmt.Errorf("faild to read %s, err: %v", ds.dataFilename, err)
+		logrus.Error(ds.loadErr)
 		return ds
 	}
 	metaBytes := make([]byte, metaLen)
-	_, err = reader.ReadAt(metaBytes, uint64Size>>1+int64(dataLen))
+	_, err = reader.ReadAt(metaBytes, uint64Size<<1+int64(dataLen))
 	if err != nil {
-		logrus.Errorf("faild to read %s, metaData error: %v", ds.dataFilename, err)
+		ds.loadErr = fmt.Errorf("faild to read %s, metaData error: %v", ds.dataFilename, err)
+		logrus.Error(ds.loadErr)
 		return ds
 	}
 	var meta Metadata
-	if err = UnmarshaMeta(metaBytes, &meta); err != nil {
-		logrus.Errorf("faild to unmarshal meta, error: %v", err)
+	if err = ds.opts.unmarshalMeta(metaBytes, &meta); err != nil {
+		ds.loadErr = fmt.Errorf("faild to unmarshal meta of %s, error: %v", ds.dataFilename, err)
+		logrus.Error(ds.loadErr)
 		return ds
 	}
 	for _, label := range meta.Labels {
 		key, value := UnmarshalLabelName(label.Name)
-		if !strings.EqualFold(key, "") && strings.EqualFold(value, "") {
+		if !strings.EqualFold(key, "") && !strings.EqualFold(value, "") {
 			ds.labelVs.Set(key, value)
 		}
 	}
 	ds.indexMap = newDiskIndexMap(meta.Labels)
 	ds.series = meta.Series
 	ds.load = true
+	ds.loadErr = nil
 	logrus.Infof("load disk segment %s, time: %v", ds.dataFilename, time.Since(start))
 	return ds
 }
 
+// loadError 返回索引加载失败的原因，加载成功时返回nil
+func (ds *diskSegment) loadError() error {
+	ds.loadMutex.Lock()
+	defer ds.loadMutex.Unlock()
+	if !ds.load && ds.loadErr == nil {
+		return fmt.Errorf("segment %s is not loaded", ds.dataFilename)
+	}
+	return ds.loadErr
+}
+
 func (ds *diskSegment) QueryLabelValuse(label string) []string {
 	return ds.labelVs.Get(label)
 }
 
+func (ds *diskSegment) QueryLabelNames() []string {
+	return ds.labelVs.Names()
+}
+
+// Select 返回与[start, end]有交集的时间线，只解析数据块索引，数据块在遍历时才会解压，索引加载失败时返回错误
+func (ds *diskSegment) Select(matchers []*Matcher, start, end int64) ([]*segmentSeries, error) {
+	if err := ds.loadError(); err != nil {
+		return nil, err
+	}
+	ret := make([]*segmentSeries, 0)
+	data := ds.dataFd.Bytes()
+	for _, index := range ds.indexMap.Select(ds.labelVs, matchers) {
+		if int(index) >= len(ds.series) {
+			return nil, fmt.Errorf("series index %d out of range in %s", index, ds.dataFilename)
+		}
+		series := ds.series[index]
+		startOffset := uint64Size<<1 + series.StartOffset
+		endOffset := uint64Size<<1 + series.EndOffset
+		if endOffset > uint64(len(data)) || startOffset > endOffset {
+			return nil, fmt.Errorf("series %s offset out of range in %s", series.Sid, ds.dataFilename)
+		}
+		chunks, err := encodedChunks(data[startOffset:endOffset])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode series %s, err: %v", series.Sid, err)
+		}
+		if !overlaps(chunks, start, end) {
+			continue
+		}
+		ret = append(ret, &segmentSeries{
+			sid:      series.Sid,
+			labels:   ds.seriesLabels(series),
+			iterator: newChunksIterator(chunks, ds.opts.bytesCompressor, start, end),
+		})
+	}
+	return ret, nil
+}
+
+// seriesLabels 通过标签序号还原时间线的标签组合
+func (ds *diskSegment) seriesLabels(series metaSeries) LabelList {
+	labels := make(LabelList, 0, len(series.Labels))
+	for _, index := range series.Labels {
+		name, value := UnmarshalLabelName(ds.indexMap.labelOrdered[int(index)])
+		labels = append(labels, Label{Name: name, Value: value})
+	}
+	labels.Sorted()
+	return labels
+}
+
 func (dr *DReader) Read() (int64, int64, error) {
 	// 读取data长度
 	diskDataLen := make([]byte, uint64Size)
@@ -121,11 +192,12 @@ func (dr *DReader) Read() (int64, int64, error) {
 	return int64(dataLen), int64(metaLen), nil
 }
 
-func newDiskSegment(mmapFile *MMapFile, dirname string, minTimestamp, maxTimestamp int64) Segment {
+func newDiskSegment(opts *options, mmapFile *MMapFile, dirname string, minTimestamp, maxTimestamp int64) Segment {
 	return &diskSegment{
+		opts:         opts,
 		dataFd:       mmapFile,
 		dir:          dirname,
-		dataFilename: path.Join(dirname, "meta.json"),
+		dataFilename: path.Join(dirname, "data"),
 		minTimestamp: minTimestamp,
 		maxTimestamp: maxTimestamp,
 		labelVs:      newLabelValueList(),
@@ -0,0 +1,205 @@
+package tsdb
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// DownsampleFunc 降采样时每个时间窗口内数据点的聚合函数
+type DownsampleFunc string
+
+const (
+	DownsampleAvg        DownsampleFunc = "avg"
+	DownsampleMin        DownsampleFunc = "min"
+	DownsampleMax        DownsampleFunc = "max"
+	DownsampleSum        DownsampleFunc = "sum"
+	DownsampleCount      DownsampleFunc = "count"
+	DownsampleFirst      DownsampleFunc = "first"
+	DownsampleLast       DownsampleFunc = "last"
+	DownsamplePercentile DownsampleFunc = "percentile"
+)
+
+// QueryOption 查询选项
+type QueryOption func(q *queryOptions) error
+
+type queryOptions struct {
+	downsampler *downsampler // 不为nil时按时间窗口降采样
+}
+
+// WithDownsample 按step对齐的时间窗口降采样，每个时间窗口返回一个数据点，时间戳为窗口的起始时间。
+// step使用数据库的时间戳精度，时间窗口为[k*step, (k+1)*step)，percentile需要使用WithPercentileDownsample
+func WithDownsample(step int64, fn DownsampleFunc) QueryOption {
+	return func(q *queryOptions) error {
+		switch fn {
+		case DownsampleAvg, DownsampleMin, DownsampleMax, DownsampleSum, DownsampleCount, DownsampleFirst, DownsampleLast:
+		case DownsamplePercentile:
+			return fmt.Errorf("percentile downsample requires WithPercentileDownsample")
+		default:
+			return fmt.Errorf("unknown downsample function: %q", fn)
+		}
+		if step <= 0 {
+			return fmt.Errorf("downsample step must be positive, got: %d", step)
+		}
+		q.downsampler = &downsampler{step: step, fn: fn}
+		return nil
+	}
+}
+
+// WithPercentileDownsample 按step对齐的时间窗口降采样，每个时间窗口返回数据点的percentile分位数，percentile取值[0, 100]
+func WithPercentileDownsample(step int64, percentile float64) QueryOption {
+	return func(q *queryOptions) error {
+		if step <= 0 {
+			return fmt.Errorf("downsample step must be positive, got: %d", step)
+		}
+		if percentile < 0 || percentile > 100 || math.IsNaN(percentile) {
+			return fmt.Errorf("percentile must be in [0, 100], got: %v", percentile)
+		}
+		q.downsampler = &downsampler{step: step, fn: DownsamplePercentile, percentile: percentile}
+		return nil
+	}
+}
+
+// downsampler 在遍历数据块时逐个数据点累加到时间窗口，不需要先读出全部数据点
+type downsampler struct {
+	step       int64
+	fn         DownsampleFunc
+	percentile float64
+}
+
+// bucket 一个时间窗口内数据点的聚合状态，不同时间线中同一时间窗口的状态可以合并
+type bucket struct {
+	start           int64
+	count           int64
+	sum, min, max   float64
+	firstTs, lastTs int64
+	first, last     float64
+	values          []float64 // 只有percentile需要保留全部的值
+}
+
+// downsampledSeries 一条时间线降采样后的时间窗口，按起始时间升序排列
+type downsampledSeries struct {
+	labels  LabelList
+	buckets []*bucket
+}
+
+// bucketStart 返回ts所在时间窗口的起始时间
+func (d *downsampler) bucketStart(ts int64) int64 {
+	return ts - (ts%d.step+d.step)%d.step
+}
+
+// add 将数据点累加到buckets，同一数据源的数据点需要按时间戳升序添加
+func (d *downsampler) add(buckets []*bucket, ts int64, v float64) []*bucket {
+	start := d.bucketStart(ts)
+	if n := len(buckets); n > 0 && buckets[n-1].start == start {
+		buckets[n-1].add(ts, v, d.fn == DownsamplePercentile)
+		return buckets
+	}
+	b := &bucket{start: start, firstTs: ts, first: v, lastTs: ts, last: v, min: v, max: v}
+	b.add(ts, v, d.fn == DownsamplePercentile)
+	return append(buckets, b)
+}
+
+// merge 合并两组有序的时间窗口，起始时间相同的时间窗口合并聚合状态
+func (d *downsampler) merge(a, b []*bucket) []*bucket {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	ret := make([]*bucket, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i].start < b[j].start:
+			ret = append(ret, a[i])
+			i++
+		case a[i].start > b[j].start:
+			ret = append(ret, b[j])
+			j++
+		default:
+			a[i].merge(b[j])
+			ret = append(ret, a[i])
+			i++
+			j++
+		}
+	}
+	ret = append(ret, a[i:]...)
+	return append(ret, b[j:]...)
+}
+
+// points 计算每个时间窗口的聚合值
+func (d *downsampler) points(buckets []*bucket) []Point {
+	points := make([]Point, 0, len(buckets))
+	for _, b := range buckets {
+		points = append(points, Point{Timestamp: b.start, Value: b.value(d.fn, d.percentile)})
+	}
+	return points
+}
+
+func (b *bucket) add(ts int64, v float64, keepValues bool) {
+	b.count++
+	b.sum += v
+	if v < b.min || math.IsNaN(b.min) {
+		b.min = v
+	}
+	if v > b.max || math.IsNaN(b.max) {
+		b.max = v
+	}
+	if ts < b.firstTs {
+		b.firstTs, b.first = ts, v
+	}
+	if ts >= b.lastTs {
+		b.lastTs, b.last = ts, v
+	}
+	if keepValues {
+		b.values = append(b.values, v)
+	}
+}
+
+func (b *bucket) merge(other *bucket) {
+	b.count += other.count
+	b.sum += other.sum
+	if other.min < b.min || math.IsNaN(b.min) {
+		b.min = other.min
+	}
+	if other.max > b.max || math.IsNaN(b.max) {
+		b.max = other.max
+	}
+	if other.firstTs < b.firstTs {
+		b.firstTs, b.first = other.firstTs, other.first
+	}
+	if other.lastTs >= b.lastTs {
+		b.lastTs, b.last = other.lastTs, other.last
+	}
+	b.values = append(b.values, other.values...)
+}
+
+func (b *bucket) value(fn DownsampleFunc, percentile float64) float64 {
+	switch fn {
+	case DownsampleAvg:
+		return b.sum / float64(b.count)
+	case DownsampleMin:
+		return b.min
+	case DownsampleMax:
+		return b.max
+	case DownsampleSum:
+		return b.sum
+	case DownsampleCount:
+		return float64(b.count)
+	case DownsampleFirst:
+		return b.first
+	case DownsampleLast:
+		return b.last
+	case DownsamplePercentile:
+		// 相邻两个值之间线性插值
+		values := b.values
+		sort.Float64s(values)
+		rank := percentile / 100 * float64(len(values)-1)
+		lower := int(math.Floor(rank))
+		upper := int(math.Ceil(rank))
+		return values[lower] + (values[upper]-values[lower])*(rank-float64(lower))
+	}
+	return math.NaN()
+}
@@ -0,0 +1,165 @@
+package graphite
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"tsdb"
+)
+
+func TestParse(t *testing.T) {
+	parser, err := NewParser([]string{
+		"servers.* .host.measurement* region=us",
+		"stats.*.latency .host.measurement.field*",
+		"app host.dc.measurement*",
+	}, tsdb.PrecisionMillisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser.now = func() time.Time {
+		return time.Unix(1600000000, 0)
+	}
+
+	cases := []struct {
+		line   string
+		metric string
+		labels map[string]string
+		ts     int64
+		value  float64
+	}{
+		{"servers.vm1.cpu.busy 1.5 1600000000", "cpu.busy", map[string]string{"host": "vm1", "region": "us"}, 1600000000000, 1.5},
+		{"stats.vm2.latency.p99.max 3 1600000000.5", "latency_p99.max", map[string]string{"host": "vm2"}, 1600000000500, 3},
+		{"app.vm3.dc1.mem.used 4 -1", "dc1.mem.used", map[string]string{"host": "app", "dc": "vm3"}, 1600000000000, 4},
+		{"vm4.dc2.disk.io 5", "vm4.dc2.disk.io", map[string]string{}, 1600000000000, 5},
+		{"servers.vm5.cpu;host=vm6;region=eu 6 1600000060", "cpu", map[string]string{"host": "vm6", "region": "eu"}, 1600000060000, 6},
+		{"net.bytes;iface=eth0 7 1600000060", "net.bytes", map[string]string{"iface": "eth0"}, 1600000060000, 7},
+	}
+	for _, c := range cases {
+		row, err := parser.Parse(c.line)
+		if err != nil {
+			t.Fatalf("%s: %v", c.line, err)
+		}
+		if row.Metric != c.metric || row.Point.Timestamp != c.ts || row.Point.Value != c.value || len(row.Labels) != len(c.labels) {
+			t.Fatalf("%s: unexpected row: %+v", c.line, row)
+		}
+		for _, label := range row.Labels {
+			if c.labels[label.Name] != label.Value {
+				t.Fatalf("%s: unexpected labels: %+v", c.line, row.Labels)
+			}
+		}
+	}
+
+	for _, line := range []string{"cpu", "cpu abc 1600000000", "cpu 1 abc", "cpu;host 1 1600000000", "cpu 1 2 3"} {
+		if _, err := parser.Parse(line); err == nil {
+			t.Fatalf("%s: expected error", line)
+		}
+	}
+
+	for _, tpl := range []string{"host.dc", "a b c d", "host.measurement a"} {
+		if _, err := NewParser([]string{tpl}, tsdb.PrecisionSecond); err == nil {
+			t.Fatalf("%s: expected error", tpl)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	db, err := tsdb.Open(tsdb.WithDataPath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	parser, err := NewParser([]string{"servers.* .host.measurement*"}, db.Precision())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(db, parser)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTCP(listener)
+	go server.ServeUDP(packetConn)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("servers.vm1.cpu.busy 1 1600000000\nservers.vm1.cpu.busy 2 1600000060\nbad line\n"))
+	conn.Close()
+	udp, err := net.Dial("udp", packetConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp.Write([]byte("servers.vm2.cpu.busy 3 1600000000\n"))
+	udp.Close()
+
+	// 等待数据到达后关闭，关闭时写入剩余的rows
+	var seriesList []*tsdb.Series
+	for i := 0; i < 300 && (len(seriesList) != 2 || len(seriesList[0].Points) != 2); i++ {
+		time.Sleep(10 * time.Millisecond)
+		seriesList, err = db.QueryRange("cpu.busy", nil, 1600000000, 1600000060)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 2 || len(seriesList[0].Points) != 2 || seriesList[1].Points[0].Value != 3 {
+		t.Fatalf("unexpected result: %+v", seriesList)
+	}
+}
+
+func TestServerLineTooLong(t *testing.T) {
+	db, err := tsdb.Open(tsdb.WithDataPath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	parser, err := NewParser(nil, db.Precision())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(db, parser)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTCP(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// 超长的行之前到达的数据仍然写入，之后关闭连接
+	go conn.Write([]byte("cpu.busy 1 1600000000\ncpu.busy " + strings.Repeat("x", maxLineSize)))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.ReadAll(conn); err != nil && !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("connection should be closed, got %v", err)
+	}
+	if err = server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var seriesList []*tsdb.Series
+	for i := 0; i < 300 && len(seriesList) != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+		seriesList, err = db.QueryRange("cpu.busy", nil, 1600000000, 1600000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(seriesList) != 1 {
+		t.Fatalf("unexpected result: %+v", seriesList)
+	}
+}
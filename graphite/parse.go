@@ -0,0 +1,233 @@
+// Package graphite 实现Graphite plaintext协议的解析和TCP/UDP监听，
+// 通过模板将以点分隔的路径转换为指标名和标签，同时支持Graphite 1.1的;tag=value语法
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"tsdb"
+)
+
+var (
+	InvalidLineError  = errors.New("invalid graphite line")
+	InvalidValueError = errors.New("invalid value")
+)
+
+// template 一条模板，格式为"[filter] template [tag1=value1,tag2=value2]"，
+// template中的每一节对应路径中的一节，可以是measurement、measurement*、field、field*、
+// 标签名或者空(忽略该节)，带*的部分匹配路径中剩余的所有节
+type template struct {
+	filter []string
+	parts  []string
+	tags   tsdb.LabelList
+}
+
+// Parser 将Graphite的一行数据解析为Row，路径依次与模板的filter匹配，使用第一个匹配的模板，
+// 没有匹配的模板时整个路径作为指标名
+type Parser struct {
+	templates []*template
+	precision tsdb.TimestampPrecision
+	now       func() time.Time
+}
+
+// NewParser 解析模板，时间戳会转换为precision
+func NewParser(templates []string, precision tsdb.TimestampPrecision) (*Parser, error) {
+	p := &Parser{
+		templates: make([]*template, 0, len(templates)),
+		precision: precision,
+		now:       time.Now,
+	}
+	for _, s := range templates {
+		t, err := parseTemplate(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template %q: %v", s, err)
+		}
+		p.templates = append(p.templates, t)
+	}
+	return p, nil
+}
+
+func parseTemplate(s string) (*template, error) {
+	fields := strings.Fields(s)
+	t := &template{}
+	var tags string
+	switch len(fields) {
+	case 1:
+		t.parts = strings.Split(fields[0], ".")
+	case 2:
+		if strings.Contains(fields[1], "=") {
+			t.parts, tags = strings.Split(fields[0], "."), fields[1]
+		} else {
+			t.filter, t.parts = strings.Split(fields[0], "."), strings.Split(fields[1], ".")
+		}
+	case 3:
+		t.filter, t.parts, tags = strings.Split(fields[0], "."), strings.Split(fields[1], "."), fields[2]
+	default:
+		return nil, errors.New("expected [filter] template [tags]")
+	}
+
+	hasMeasurement := false
+	for _, part := range t.parts {
+		if part == "measurement" || part == "measurement*" {
+			hasMeasurement = true
+		}
+	}
+	if !hasMeasurement {
+		return nil, errors.New("no measurement specified")
+	}
+	if tags != "" {
+		for _, tag := range strings.Split(tags, ",") {
+			kv := strings.SplitN(tag, "=", 2)
+			if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				return nil, fmt.Errorf("invalid tag: %s", tag)
+			}
+			t.tags = append(t.tags, tsdb.Label{Name: kv[0], Value: kv[1]})
+		}
+	}
+	return t, nil
+}
+
+// match filter的每一节与路径的前缀逐节匹配，*匹配任意一节
+func (t *template) match(path []string) bool {
+	if len(t.filter) > len(path) {
+		return false
+	}
+	for i, f := range t.filter {
+		if f != "*" && f != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// apply 返回指标名和标签，measurement和field分别以点连接，两者之间以下划线连接
+func (t *template) apply(path []string) (string, tsdb.LabelList) {
+	var measurement, field []string
+	labels := make(tsdb.LabelList, 0, len(t.parts)+len(t.tags))
+	tagIndex := make(map[string]int)
+	for i, part := range t.parts {
+		if i >= len(path) {
+			break
+		}
+		switch part {
+		case "":
+		case "measurement":
+			measurement = append(measurement, path[i])
+		case "measurement*":
+			measurement = append(measurement, path[i:]...)
+		case "field":
+			field = append(field, path[i])
+		case "field*":
+			field = append(field, path[i:]...)
+		default:
+			// 同名的标签以点连接
+			if j, ok := tagIndex[part]; ok {
+				labels[j].Value += "." + path[i]
+				continue
+			}
+			tagIndex[part] = len(labels)
+			labels = append(labels, tsdb.Label{Name: part, Value: path[i]})
+		}
+		if strings.HasSuffix(part, "*") {
+			break
+		}
+	}
+	for _, tag := range t.tags {
+		if _, ok := tagIndex[tag.Name]; !ok {
+			labels = append(labels, tag)
+		}
+	}
+	metric := strings.Join(measurement, ".")
+	if len(field) > 0 {
+		metric += "_" + strings.Join(field, ".")
+	}
+	return metric, labels
+}
+
+// Parse 解析一行: path[;tag=value...] value [timestamp]，时间戳单位为秒，
+// 没有时间戳或者时间戳为-1时使用当前时间
+func (p *Parser) Parse(line string) (*tsdb.Row, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, fmt.Errorf("%w: %q", InvalidLineError, line)
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, fmt.Errorf("%w: %q", InvalidValueError, fields[1])
+	}
+	ts := p.precision.FromTime(p.now())
+	if len(fields) == 3 && fields[2] != "-1" {
+		ts, err = p.parseTimestamp(fields[2])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	path, tags, err := parseTags(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	metric, labels := path, tsdb.LabelList(nil)
+	parts := strings.Split(path, ".")
+	for _, t := range p.templates {
+		if t.match(parts) {
+			metric, labels = t.apply(parts)
+			break
+		}
+	}
+	if metric == "" {
+		return nil, fmt.Errorf("%w: empty metric name: %q", InvalidLineError, line)
+	}
+	// ;tag=value语法中的标签优先于模板中的标签
+	for _, tag := range tags {
+		replaced := false
+		for i := range labels {
+			if labels[i].Name == tag.Name {
+				labels[i].Value = tag.Value
+				replaced = true
+			}
+		}
+		if !replaced {
+			labels = append(labels, tag)
+		}
+	}
+	return &tsdb.Row{
+		Metric: metric,
+		Labels: labels,
+		Point:  tsdb.Point{Timestamp: ts, Value: value},
+	}, nil
+}
+
+// parseTimestamp 解析以秒为单位的时间戳，可以带有小数部分
+func (p *Parser) parseTimestamp(s string) (int64, error) {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return p.precision.Convert(sec, tsdb.PrecisionSecond), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("%w: invalid timestamp %q", InvalidLineError, s)
+	}
+	sec, frac := math.Modf(f)
+	return p.precision.Convert(int64(sec), tsdb.PrecisionSecond) + p.precision.FromDuration(time.Duration(frac*float64(time.Second))), nil
+}
+
+// parseTags 解析Graphite 1.1的path;tag1=value1;tag2=value2
+func parseTags(s string) (string, tsdb.LabelList, error) {
+	parts := strings.Split(s, ";")
+	if len(parts) == 1 {
+		return s, nil, nil
+	}
+	tags := make(tsdb.LabelList, 0, len(parts)-1)
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return "", nil, fmt.Errorf("%w: invalid tag %q", InvalidLineError, part)
+		}
+		tags = append(tags, tsdb.Label{Name: kv[0], Value: kv[1]})
+	}
+	return parts[0], tags, nil
+}
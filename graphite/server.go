@@ -0,0 +1,239 @@
+package graphite
+
+import (
+	"bufio"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"tsdb"
+)
+
+const (
+	defaultBatchSize     = 1000
+	defaultFlushInterval = time.Second
+	maxPacketSize        = 64 << 10
+	maxLineSize          = 64 << 10 // TCP连接中一行的最大长度，超过时关闭连接
+)
+
+// Server 通过TCP和UDP接收Graphite plaintext协议的数据，所有连接解析出的rows合并后批量写入，
+// 达到批量大小或者超过刷新间隔时调用一次InsertRows
+type Server struct {
+	db            *tsdb.TSDB
+	parser        *Parser
+	batchSize     int
+	flushInterval time.Duration
+
+	batchMutex sync.Mutex
+	batch      []*tsdb.Row
+
+	mutex     sync.Mutex
+	listeners []net.Listener
+	packets   []net.PacketConn
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wait      sync.WaitGroup // 正在处理的连接和数据包
+	done      chan struct{}
+	flusher   sync.WaitGroup
+}
+
+func NewServer(db *tsdb.TSDB, parser *Parser) *Server {
+	s := &Server{
+		db:            db,
+		parser:        parser,
+		batchSize:     defaultBatchSize,
+		flushInterval: defaultFlushInterval,
+		batch:         make([]*tsdb.Row, 0, defaultBatchSize),
+		conns:         make(map[net.Conn]struct{}),
+		done:          make(chan struct{}),
+	}
+	s.flusher.Add(1)
+	go s.flushLoop()
+	return s
+}
+
+// ServeTCP 接受连接直到listener关闭，调用Close后返回nil
+func (s *Server) ServeTCP(listener net.Listener) error {
+	if !s.track(func() { s.listeners = append(s.listeners, listener) }) {
+		return errors.New("graphite server is closed")
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			return err
+		}
+		if !s.track(func() {
+			s.conns[conn] = struct{}{}
+			s.wait.Add(1)
+		}) {
+			conn.Close()
+			return nil
+		}
+		go func() {
+			defer s.wait.Done()
+			s.handleConn(conn)
+			s.mutex.Lock()
+			delete(s.conns, conn)
+			s.mutex.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// ServeUDP 读取数据包直到conn关闭，每个数据包可以包含多行，调用Close后返回nil
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	if !s.track(func() {
+		s.packets = append(s.packets, conn)
+		s.wait.Add(1)
+	}) {
+		return errors.New("graphite server is closed")
+	}
+	defer s.wait.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			return err
+		}
+		rows := make([]*tsdb.Row, 0)
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			rows = s.parse(rows, line)
+		}
+		s.add(rows)
+	}
+}
+
+// Close 关闭所有监听和连接，并写入尚未写入的rows
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	var errs []string
+	for _, listener := range s.listeners {
+		if err := listener.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for _, conn := range s.packets {
+		if err := conn.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+
+	s.wait.Wait()
+	close(s.done)
+	s.flusher.Wait()
+	s.flush()
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (s *Server) track(fn func()) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	fn()
+	return true
+}
+
+func (s *Server) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	reader := bufio.NewReaderSize(conn, maxLineSize)
+	rows := make([]*tsdb.Row, 0)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			logrus.Warnf("graphite line from %s exceeds %d bytes, close connection", conn.RemoteAddr(), maxLineSize)
+			s.add(rows)
+			return
+		}
+		rows = s.parse(rows, string(line))
+		// 已经读到的行解析完后再合并到批量写入
+		if err != nil || reader.Buffered() == 0 || len(rows) >= s.batchSize {
+			s.add(rows)
+			rows = rows[:0]
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) parse(rows []*tsdb.Row, line string) []*tsdb.Row {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return rows
+	}
+	row, err := s.parser.Parse(line)
+	if err != nil {
+		logrus.Debugf("failed to parse graphite line, err: %v", err)
+		return rows
+	}
+	return append(rows, row)
+}
+
+// add 将rows加入批量写入，达到批量大小时立即写入
+func (s *Server) add(rows []*tsdb.Row) {
+	if len(rows) == 0 {
+		return
+	}
+	s.batchMutex.Lock()
+	s.batch = append(s.batch, rows...)
+	full := len(s.batch) >= s.batchSize
+	s.batchMutex.Unlock()
+	if full {
+		s.flush()
+	}
+}
+
+func (s *Server) flushLoop() {
+	defer s.flusher.Done()
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Server) flush() {
+	s.batchMutex.Lock()
+	if len(s.batch) == 0 {
+		s.batchMutex.Unlock()
+		return
+	}
+	rows := s.batch
+	s.batch = make([]*tsdb.Row, 0, s.batchSize)
+	s.batchMutex.Unlock()
+	if err := s.db.InsertRows(rows); err != nil {
+		logrus.Errorf("failed to insert %d graphite rows, err: %v", len(rows), err)
+	}
+}
@@ -105,3 +105,96 @@ func (msl *memtableSidList) List() []string {
 	}
 	return keys
 }
+
+// Select 通过选择器从倒排索引中筛选时间线ID，正则选择器从lvl中枚举候选标签值
+func (mim *memtableIndexMap) Select(lvl *labelValueList, matchers []*Matcher) []string {
+	mim.mutex.RLock()
+	defer mim.mutex.RUnlock()
+
+	union := func(name string, values []string, set map[string]struct{}) map[string]struct{} {
+		if set == nil {
+			set = make(map[string]struct{})
+		}
+		for _, value := range values {
+			sidList, ok := mim.index[joinSeprator(name, value)]
+			if !ok {
+				continue
+			}
+			for _, sid := range sidList.List() {
+				set[sid] = struct{}{}
+			}
+		}
+		return set
+	}
+
+	var ret map[string]struct{}
+	exclude := make(map[string]struct{})
+	for _, m := range matchers {
+		// 能匹配空值的选择器同样匹配不含该标签的时间线，只能通过做差集实现
+		if m.Matches("") {
+			exclude = union(m.Name, m.matchValues(lvl, true), exclude)
+			continue
+		}
+		set := union(m.Name, m.matchValues(lvl, false), nil)
+		if ret == nil {
+			ret = set
+			continue
+		}
+		for sid := range ret {
+			if _, ok := set[sid]; !ok {
+				delete(ret, sid)
+			}
+		}
+	}
+	if ret == nil {
+		ret = union(metricName, lvl.Get(metricName), nil)
+	}
+
+	list := make([]string, 0, len(ret))
+	for sid := range ret {
+		if _, ok := exclude[sid]; !ok {
+			list = append(list, sid)
+		}
+	}
+	return list
+}
+
+// Select 通过选择器从倒排索引中筛选时间线序号，正则选择器从lvl中枚举候选标签值
+func (dim *diskIndexMap) Select(lvl *labelValueList, matchers []*Matcher) []uint32 {
+	dim.mutex.RLock()
+	defer dim.mutex.RUnlock()
+
+	union := func(name string, values []string) *roaring.Bitmap {
+		set := roaring.New()
+		for _, value := range values {
+			sidList, ok := dim.label2sids[joinSeprator(name, value)]
+			if !ok {
+				continue
+			}
+			sidList.mutex.RLock()
+			set.Or(sidList.list)
+			sidList.mutex.RUnlock()
+		}
+		return set
+	}
+
+	var ret *roaring.Bitmap
+	exclude := roaring.New()
+	for _, m := range matchers {
+		if m.Matches("") {
+			exclude.Or(union(m.Name, m.matchValues(lvl, true)))
+			continue
+		}
+		set := union(m.Name, m.matchValues(lvl, false))
+		if ret == nil {
+			ret = set
+			continue
+		}
+		ret.And(set)
+	}
+	if ret == nil {
+		ret = union(metricName, lvl.Get(metricName))
+	}
+	ret.AndNot(exclude)
+	return ret.ToArray()
+}
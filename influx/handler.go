@@ -0,0 +1,111 @@
+package influx
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"time"
+	"tsdb"
+)
+
+const maxBodySize = 32 << 20 // 解压后请求体的最大字节数
+
+// Handler 兼容InfluxDB 1.x的/write接口和2.x的/api/v2/write接口，可以作为Telegraf的influxdb输出
+type Handler struct {
+	db  *tsdb.TSDB
+	now func() time.Time
+}
+
+func NewHandler(db *tsdb.TSDB) *Handler {
+	return &Handler{
+		db:  db,
+		now: time.Now,
+	}
+}
+
+// Register 注册写入接口，/ping和/query用于通过客户端的连通性检查和建库语句
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/write", h.write)
+	mux.HandleFunc("/api/v2/write", h.write)
+	mux.HandleFunc("/ping", h.ping)
+	mux.HandleFunc("/query", h.query)
+}
+
+// write 写入head memtable后返回204，存在格式错误或无法写入的行时写入其他行后返回400，客户端不会重试
+func (h *Handler) write(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	unit, err := ParsePrecision(r.URL.Query().Get("precision"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("failed to read gzip body: %v", err))
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxBodySize+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("failed to read body: %v", err))
+		return
+	}
+	if len(data) > maxBodySize {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("body exceeds %d bytes", maxBodySize))
+		return
+	}
+
+	points, parseErr := ParsePoints(data)
+	rows := Rows(points, unit, h.db.Precision(), h.now())
+	if len(rows) > 0 {
+		errs, err := h.db.InsertRowsSync(r.Context(), rows)
+		if err != nil {
+			logrus.Errorf("failed to insert influx rows, err: %v", err)
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		for _, err := range errs {
+			if err != nil && parseErr == nil {
+				parseErr = err
+			}
+		}
+	}
+	if parseErr != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("partial write: %v", parseErr))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) ping(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// query 不支持InfluxQL查询，对任何语句都返回空结果，以便客户端的CREATE DATABASE成功
+func (h *Handler) query(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := io.WriteString(w, `{"results":[{"statement_id":0}]}`); err != nil {
+		logrus.Errorf("failed to write response, err: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Influxdb-Error", err.Error())
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(map[string]string{"error": err.Error()}); err != nil {
+		logrus.Errorf("failed to write response, err: %v", err)
+	}
+}
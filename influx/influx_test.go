@@ -0,0 +1,142 @@
+package influx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"tsdb"
+)
+
+func TestParseLine(t *testing.T) {
+	point, err := ParseLine([]byte(`cpu\ load,host=server\,01,region=us\=west usage_idle=98.5,usage_user=1i,up=true,msg="hello, \"world\"",count=3u 1600000000000000000`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if point.Measurement != "cpu load" {
+		t.Fatalf("unexpected measurement: %q", point.Measurement)
+	}
+	expectedTags := tsdb.LabelList{{Name: "host", Value: "server,01"}, {Name: "region", Value: "us=west"}}
+	if len(point.Tags) != 2 || point.Tags[0] != expectedTags[0] || point.Tags[1] != expectedTags[1] {
+		t.Fatalf("unexpected tags: %+v", point.Tags)
+	}
+	expectedFields := []Field{{Key: "usage_idle", Value: 98.5}, {Key: "usage_user", Value: 1}, {Key: "up", Value: 1}, {Key: "count", Value: 3}}
+	if len(point.Fields) != len(expectedFields) {
+		t.Fatalf("unexpected fields: %+v", point.Fields)
+	}
+	for i := range expectedFields {
+		if point.Fields[i] != expectedFields[i] {
+			t.Fatalf("field %d: expected %+v, got %+v", i, expectedFields[i], point.Fields[i])
+		}
+	}
+	if !point.HasTimestamp || point.Timestamp != 1600000000000000000 {
+		t.Fatalf("unexpected timestamp: %d", point.Timestamp)
+	}
+
+	point, err = ParseLine([]byte(`mem free=1024`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if point.HasTimestamp || len(point.Tags) != 0 || len(point.Fields) != 1 {
+		t.Fatalf("unexpected point: %+v", point)
+	}
+
+	for _, line := range []string{
+		`cpu`,
+		`cpu,host=a`,
+		`cpu value=`,
+		`cpu value=abc`,
+		`cpu value=1 abc`,
+		`cpu value=1 1 2`,
+		`cpu msg="unterminated`,
+		`cpu,host value=1`,
+		`,host=a value=1`,
+	} {
+		if _, err := ParseLine([]byte(line)); err == nil {
+			t.Fatalf("%s: expected error", line)
+		}
+	}
+}
+
+func TestParsePoints(t *testing.T) {
+	data := "# comment\ncpu value=1 1600000000\n\ncpu value=abc\nmem used=2,free=3 1600000060\n"
+	points, err := ParsePoints([]byte(data))
+	var errs ParseErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Line != 4 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rows := Rows(points, time.Second, tsdb.PrecisionMillisecond, time.Now())
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d", len(rows))
+	}
+	if rows[0].Metric != "cpu_value" || rows[2].Metric != "mem_free" || rows[2].Point.Timestamp != 1600000060000 {
+		t.Fatalf("unexpected rows: %+v, %+v", rows[0], rows[2])
+	}
+}
+
+func TestWrite(t *testing.T) {
+	db, err := tsdb.Open(tsdb.WithDataPath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	mux := http.NewServeMux()
+	NewHandler(db).Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte("cpu,host=vm1 usage_idle=90,usage_user=10 1600000000000\ncpu,host=vm2 usage_idle=80 1600000000000\n"))
+	gz.Close()
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/write?db=telegraf&precision=ms", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	// 返回204时数据已经可以查询
+	seriesList, err := db.QueryRange("cpu_usage_idle", nil, 1600000000, 1600000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 2 || seriesList[1].Points[0].Value != 80 {
+		t.Fatalf("unexpected result: %+v", seriesList)
+	}
+
+	// 无法写入的行返回400，其他行仍然写入
+	body := "cpu,host=" + strings.Repeat("a", 70*1024) + " usage_idle=1 1600000060000\ncpu,host=vm1 usage_idle=70 1600000060000"
+	resp, err = http.Post(server.URL+"/write?precision=ms", "text/plain", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || resp.Header.Get("X-Influxdb-Error") == "" {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	if seriesList, err = db.QueryRange("cpu_usage_idle", nil, 1600000060, 1600000060); err != nil || len(seriesList) != 1 {
+		t.Fatalf("unexpected result: %+v, %v", seriesList, err)
+	}
+
+	resp, err = http.Post(server.URL+"/write", "text/plain", bytes.NewBufferString("cpu usage_idle=1\ncpu usage_idle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || resp.Header.Get("X-Influxdb-Error") == "" {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
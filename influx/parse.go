@@ -0,0 +1,315 @@
+// Package influx 实现InfluxDB line protocol的解析和兼容InfluxDB写入接口的HTTP服务，
+// 每个field转换为一个名为measurement_field的指标，tags转换为标签
+package influx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"tsdb"
+)
+
+// Point 一行line protocol，字符串类型的field没有对应的数值，解析时会被忽略
+type Point struct {
+	Measurement  string
+	Tags         tsdb.LabelList
+	Fields       []Field
+	Timestamp    int64 // 单位由写入时指定的precision决定
+	HasTimestamp bool
+}
+
+type Field struct {
+	Key   string
+	Value float64
+}
+
+// LineError 第Line行(从1开始)解析失败
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// ParseErrors 解析失败的行，不影响其他行的解析
+type ParseErrors []*LineError
+
+func (e ParseErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+var (
+	MissingFieldsError      = errors.New("missing fields")
+	MissingMeasurementError = errors.New("missing measurement")
+)
+
+// ParsePoints 按行解析data，跳过空行和以#开头的注释，返回成功解析的points，
+// 存在解析失败的行时error为ParseErrors
+func ParsePoints(data []byte) ([]*Point, error) {
+	points := make([]*Point, 0, bytes.Count(data, []byte{'\n'})+1)
+	var errs ParseErrors
+	for i, line := range bytes.Split(data, []byte{'\n'}) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		point, err := ParseLine(line)
+		if err != nil {
+			errs = append(errs, &LineError{Line: i + 1, Err: err})
+			continue
+		}
+		points = append(points, point)
+	}
+	if len(errs) > 0 {
+		return points, errs
+	}
+	return points, nil
+}
+
+// ParseLine 解析一行: measurement[,tag=value...] field=value[,field=value...] [timestamp]
+func ParseLine(line []byte) (*Point, error) {
+	s := &scanner{b: line}
+	point := &Point{}
+
+	measurement := s.until(", ")
+	if len(measurement) == 0 {
+		return nil, MissingMeasurementError
+	}
+	point.Measurement = unescape(measurement)
+
+	for s.peek() == ',' {
+		s.i++
+		key, value, err := s.tag()
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag: %v", err)
+		}
+		point.Tags = append(point.Tags, tsdb.Label{Name: key, Value: value})
+	}
+
+	if !s.skipSpaces() {
+		return nil, MissingFieldsError
+	}
+	for {
+		key, err := s.key()
+		if err != nil {
+			return nil, fmt.Errorf("invalid field: %v", err)
+		}
+		if s.peek() == '"' {
+			if err := s.skipString(); err != nil {
+				return nil, fmt.Errorf("invalid field %s: %v", key, err)
+			}
+		} else {
+			value, err := parseFieldValue(s.until(", "))
+			if err != nil {
+				return nil, fmt.Errorf("invalid field %s: %v", key, err)
+			}
+			point.Fields = append(point.Fields, Field{Key: key, Value: value})
+		}
+		if s.peek() != ',' {
+			break
+		}
+		s.i++
+	}
+
+	if s.skipSpaces() {
+		ts, err := strconv.ParseInt(string(s.until(" ")), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp: %v", err)
+		}
+		point.Timestamp = ts
+		point.HasTimestamp = true
+		if s.skipSpaces() {
+			return nil, fmt.Errorf("unexpected content after timestamp: %q", line[s.i:])
+		}
+	}
+	return point, nil
+}
+
+// ParsePrecision 解析写入接口的precision参数，返回时间戳单位对应的时长，为空时默认为纳秒
+func ParsePrecision(s string) (time.Duration, error) {
+	switch s {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("unknown precision: %q", s)
+}
+
+// Rows 将points转换为rows，时间戳从unit转换为数据库的精度，没有时间戳的point使用now
+func Rows(points []*Point, unit time.Duration, precision tsdb.TimestampPrecision, now time.Time) []*tsdb.Row {
+	count := 0
+	for _, point := range points {
+		count += len(point.Fields)
+	}
+	rows := make([]*tsdb.Row, 0, count)
+	nowTs := precision.FromTime(now)
+	for _, point := range points {
+		ts := nowTs
+		if point.HasTimestamp {
+			ts = convertTimestamp(point.Timestamp, unit, precision.Unit())
+		}
+		for _, field := range point.Fields {
+			// 写入时会原地修改标签，每个row使用独立的标签
+			labels := append(make(tsdb.LabelList, 0, len(point.Tags)+1), point.Tags...)
+			rows = append(rows, &tsdb.Row{
+				Metric: point.Measurement + "_" + field.Key,
+				Labels: labels,
+				Point:  tsdb.Point{Timestamp: ts, Value: field.Value},
+			})
+		}
+	}
+	return rows
+}
+
+func convertTimestamp(ts int64, from, to time.Duration) int64 {
+	if from >= to {
+		return ts * int64(from/to)
+	}
+	return ts / int64(to/from)
+}
+
+// parseFieldValue 解析数值类型的field: 浮点数、以i结尾的整数、以u结尾的无符号整数和布尔值
+func parseFieldValue(b []byte) (float64, error) {
+	if len(b) == 0 {
+		return 0, errors.New("missing value")
+	}
+	s := string(b)
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	}
+	switch s[len(s)-1] {
+	case 'i':
+		v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return float64(v), err
+	case 'u':
+		v, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		return float64(v), err
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("invalid number: %s", s)
+	}
+	return v, nil
+}
+
+type scanner struct {
+	b []byte
+	i int
+}
+
+func (s *scanner) peek() byte {
+	if s.i >= len(s.b) {
+		return 0
+	}
+	return s.b[s.i]
+}
+
+// until 读取到未转义的stops中的任一字符或行尾为止，返回未去除转义的内容
+func (s *scanner) until(stops string) []byte {
+	start := s.i
+	for s.i < len(s.b) {
+		c := s.b[s.i]
+		if c == '\\' && s.i+1 < len(s.b) {
+			s.i += 2
+			continue
+		}
+		if strings.IndexByte(stops, c) >= 0 {
+			break
+		}
+		s.i++
+	}
+	return s.b[start:s.i]
+}
+
+// skipSpaces 跳过空格，返回之后是否还有内容
+func (s *scanner) skipSpaces() bool {
+	for s.i < len(s.b) && s.b[s.i] == ' ' {
+		s.i++
+	}
+	return s.i < len(s.b)
+}
+
+func (s *scanner) key() (string, error) {
+	key := s.until(",= ")
+	if len(key) == 0 {
+		return "", errors.New("missing key")
+	}
+	if s.peek() != '=' {
+		return "", fmt.Errorf("missing '=' after %q", key)
+	}
+	s.i++
+	return unescape(key), nil
+}
+
+func (s *scanner) tag() (string, string, error) {
+	key, err := s.key()
+	if err != nil {
+		return "", "", err
+	}
+	value := s.until(", ")
+	if len(value) == 0 {
+		return "", "", fmt.Errorf("missing value for %q", key)
+	}
+	return key, unescape(value), nil
+}
+
+// skipString 跳过双引号包围的字符串
+func (s *scanner) skipString() error {
+	for s.i++; s.i < len(s.b); s.i++ {
+		switch s.b[s.i] {
+		case '\\':
+			s.i++
+		case '"':
+			s.i++
+			return nil
+		}
+	}
+	return errors.New("unterminated string")
+}
+
+// unescape 去除逗号、等号、空格和反斜杠前的转义符
+func unescape(b []byte) string {
+	if bytes.IndexByte(b, '\\') < 0 {
+		return string(b)
+	}
+	buf := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] == '\\' && i+1 < len(b) {
+			switch b[i+1] {
+			case ',', '=', ' ', '\\':
+				i++
+			}
+		}
+		buf = append(buf, b[i])
+	}
+	return string(buf)
+}
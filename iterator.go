@@ -0,0 +1,441 @@
+package tsdb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SeriesIterator 按时间戳升序遍历一条时间线的数据点，数据块在遍历到时才会解码
+type SeriesIterator interface {
+	// Next 移动到下一个数据点
+	Next() bool
+	// SeekTo 移动到第一个时间戳不小于t的数据点，当前数据点满足条件时不移动，只能向后移动
+	SeekTo(t int64) bool
+	// At 返回当前数据点的时间戳和值
+	At() (int64, float64)
+	// Err 返回遍历中遇到的错误
+	Err() error
+}
+
+// SeriesSet 按标签升序遍历查询到的时间线，只包含在查询范围内有数据点的时间线。
+// 使用结束后需要调用Close释放查询的segment，可以在遍历完之前提前Close
+type SeriesSet interface {
+	Next() bool
+	// At 返回当前时间线的标签和数据点迭代器，标签包含指标名标签__name__
+	At() (LabelList, SeriesIterator)
+	Err() error
+	Close() error
+}
+
+// chunkRef 一个数据块的时间范围和数据，持久化的数据块是压缩后的数据
+type chunkRef struct {
+	minT, maxT int64
+	data       []byte
+}
+
+// chunksIterator 依次遍历时间线的数据块中[start, end]范围内的数据点，每次只解压一个数据块
+type chunksIterator struct {
+	chunks     []chunkRef
+	compressor BytesCompressor // 为nil时数据块没有压缩
+	start, end int64
+
+	index int // 下一个需要打开的数据块
+	maxT  int64
+	cur   *chunkIterator
+	done  bool
+	err   error
+}
+
+// pointsIterator 遍历有序的数据点切片
+type pointsIterator struct {
+	points []Point
+	i      int
+}
+
+// mergeIterator 合并两个迭代器，时间戳相同时使用b的数据点
+type mergeIterator struct {
+	a, b         SeriesIterator
+	aOk, bOk     bool
+	nextA, nextB bool // 当前数据点来自哪个迭代器，移动时需要推进
+	started      bool
+	valid        bool // 是否有当前数据点
+	t            int64
+	v            float64
+}
+
+// primedIterator 已经读取了第一个数据点的迭代器，用于过滤没有数据点的时间线
+type primedIterator struct {
+	SeriesIterator
+	primed bool
+}
+
+// segmentSeries 一个segment中的一条时间线
+type segmentSeries struct {
+	sid      string
+	labels   LabelList
+	iterator SeriesIterator
+}
+
+// selectedSeries 跨segment合并的一条时间线，迭代器按segment的顺序排列
+type selectedSeries struct {
+	labels    LabelList
+	iterators []SeriesIterator
+}
+
+// seriesSet TSDB.Select返回的SeriesSet，持有查询的segment直到Close
+type seriesSet struct {
+	series   []*selectedSeries
+	index    int
+	labels   LabelList
+	iterator SeriesIterator
+	err      error
+	release  func()
+}
+
+func newChunksIterator(chunks []chunkRef, compressor BytesCompressor, start, end int64) *chunksIterator {
+	return &chunksIterator{
+		chunks:     chunks,
+		compressor: compressor,
+		start:      start,
+		end:        end,
+	}
+}
+
+func (it *chunksIterator) Next() bool {
+	if it.done {
+		return false
+	}
+	if it.cur != nil {
+		if it.cur.Next() {
+			return it.check()
+		}
+		if it.cur.Err() != nil {
+			return it.fail(it.cur.Err())
+		}
+	}
+	return it.seekChunk(it.start)
+}
+
+func (it *chunksIterator) SeekTo(t int64) bool {
+	if it.done {
+		return false
+	}
+	if t < it.start {
+		t = it.start
+	}
+	if it.cur != nil && it.maxT >= t {
+		if it.cur.SeekTo(t) {
+			return it.check()
+		}
+		if it.cur.Err() != nil {
+			return it.fail(it.cur.Err())
+		}
+	}
+	return it.seekChunk(t)
+}
+
+// seekChunk 打开后面的数据块，移动到第一个时间戳不小于t的数据点
+func (it *chunksIterator) seekChunk(t int64) bool {
+	for it.index < len(it.chunks) {
+		ref := it.chunks[it.index]
+		it.index++
+		if ref.maxT < t {
+			continue
+		}
+		if ref.minT > it.end {
+			break
+		}
+		data := ref.data
+		if it.compressor != nil {
+			var err error
+			if data, err = it.compressor.Decompress(ref.data); err != nil {
+				return it.fail(fmt.Errorf("failed to decompress chunk %d, err: %v", it.index-1, err))
+			}
+		}
+		cur, err := newChunkIterator(data)
+		if err != nil {
+			return it.fail(err)
+		}
+		it.cur, it.maxT = cur, ref.maxT
+		if cur.SeekTo(t) {
+			return it.check()
+		}
+		if cur.Err() != nil {
+			return it.fail(fmt.Errorf("failed to decode chunk %d, err: %v", it.index-1, cur.Err()))
+		}
+	}
+	it.done = true
+	return false
+}
+
+// check 当前数据点超过end时结束遍历
+func (it *chunksIterator) check() bool {
+	if t, _ := it.cur.At(); t > it.end {
+		it.done = true
+		return false
+	}
+	return true
+}
+
+func (it *chunksIterator) fail(err error) bool {
+	it.err = err
+	it.done = true
+	return false
+}
+
+func (it *chunksIterator) At() (int64, float64) {
+	return it.cur.At()
+}
+
+func (it *chunksIterator) Err() error {
+	return it.err
+}
+
+// encodedChunks 解析持久化数据中的数据块索引: | 数据块数量 uint32 | 数据块索引 | 压缩后的数据块 |，不会解压数据块
+func encodedChunks(data []byte) ([]chunkRef, error) {
+	if len(data) < uint32Size {
+		return nil, fmt.Errorf("invalid series block size: %d", len(data))
+	}
+	nowDecodingBuf := newDecodingBuf()
+	count := int(nowDecodingBuf.UnmarshalUint32(data[:uint32Size]))
+	offset := uint32Size + count*chunkIndexSize
+	if offset > len(data) {
+		return nil, fmt.Errorf("invalid series block, chunk count: %d, size: %d", count, len(data))
+	}
+	chunks := make([]chunkRef, 0, count)
+	for i := 0; i < count; i++ {
+		index := data[uint32Size+i*chunkIndexSize:]
+		length := int(nowDecodingBuf.UnmarshalUint32(index[uint64Size<<1 : chunkIndexSize]))
+		if offset+length > len(data) {
+			return nil, fmt.Errorf("chunk %d out of range, offset: %d, length: %d", i, offset, length)
+		}
+		chunks = append(chunks, chunkRef{
+			minT: int64(nowDecodingBuf.UnmarshalUint64(index[:uint64Size])),
+			maxT: int64(nowDecodingBuf.UnmarshalUint64(index[uint64Size : uint64Size<<1])),
+			data: data[offset : offset+length],
+		})
+		offset += length
+	}
+	return chunks, nil
+}
+
+// overlaps 判断数据块是否与[start, end]有交集
+func overlaps(chunks []chunkRef, start, end int64) bool {
+	for _, ref := range chunks {
+		if ref.maxT >= start && ref.minT <= end {
+			return true
+		}
+	}
+	return false
+}
+
+func newPointsIterator(points []Point) *pointsIterator {
+	return &pointsIterator{points: points, i: -1}
+}
+
+func (it *pointsIterator) Next() bool {
+	if it.i < len(it.points) {
+		it.i++
+	}
+	return it.i < len(it.points)
+}
+
+func (it *pointsIterator) SeekTo(t int64) bool {
+	if it.i < 0 {
+		it.i = 0
+	}
+	rest := it.points[it.i:]
+	it.i += sort.Search(len(rest), func(i int) bool {
+		return rest[i].Timestamp >= t
+	})
+	return it.i < len(it.points)
+}
+
+func (it *pointsIterator) At() (int64, float64) {
+	return it.points[it.i].Timestamp, it.points[it.i].Value
+}
+
+func (it *pointsIterator) Err() error {
+	return nil
+}
+
+// newMergeIterator 合并多个迭代器，时间戳相同时使用后面的迭代器的数据点
+func newMergeIterator(iterators ...SeriesIterator) SeriesIterator {
+	if len(iterators) == 0 {
+		return newPointsIterator(nil)
+	}
+	ret := iterators[0]
+	for _, it := range iterators[1:] {
+		ret = &mergeIterator{a: ret, b: it}
+	}
+	return ret
+}
+
+func (it *mergeIterator) Next() bool {
+	if !it.started {
+		it.started = true
+		it.aOk, it.bOk = it.a.Next(), it.b.Next()
+	} else {
+		if it.nextA && it.aOk {
+			it.aOk = it.a.Next()
+		}
+		if it.nextB && it.bOk {
+			it.bOk = it.b.Next()
+		}
+	}
+	return it.pick()
+}
+
+func (it *mergeIterator) SeekTo(t int64) bool {
+	if it.valid && it.t >= t {
+		return true
+	}
+	if !it.started {
+		it.started = true
+		it.aOk, it.bOk = true, true
+	}
+	if it.aOk {
+		it.aOk = it.a.SeekTo(t)
+	}
+	if it.bOk {
+		it.bOk = it.b.SeekTo(t)
+	}
+	return it.pick()
+}
+
+// pick 选择两个迭代器中时间戳较小的数据点作为当前数据点
+func (it *mergeIterator) pick() bool {
+	it.nextA, it.nextB = false, false
+	var at, bt int64
+	var av, bv float64
+	if it.aOk {
+		at, av = it.a.At()
+	}
+	if it.bOk {
+		bt, bv = it.b.At()
+	}
+	it.valid = it.aOk || it.bOk
+	switch {
+	case !it.valid:
+		return false
+	case !it.bOk || (it.aOk && at < bt):
+		it.t, it.v, it.nextA = at, av, true
+	case !it.aOk || bt < at:
+		it.t, it.v, it.nextB = bt, bv, true
+	default:
+		it.t, it.v, it.nextA, it.nextB = bt, bv, true, true
+	}
+	return true
+}
+
+func (it *mergeIterator) At() (int64, float64) {
+	return it.t, it.v
+}
+
+func (it *mergeIterator) Err() error {
+	if err := it.a.Err(); err != nil {
+		return err
+	}
+	return it.b.Err()
+}
+
+func (it *primedIterator) Next() bool {
+	if it.primed {
+		it.primed = false
+		return true
+	}
+	return it.SeriesIterator.Next()
+}
+
+func (it *primedIterator) SeekTo(t int64) bool {
+	it.primed = false
+	return it.SeriesIterator.SeekTo(t)
+}
+
+// Select 查询metric在[start, end]内满足全部选择器的时间线，数据点在遍历时才会读取，同一时间线跨segment的数据点会合并，
+// 时间戳相同时以后面的segment为准。metric为空时不限制指标名
+func (db *TSDB) Select(metric string, matchers []*Matcher, start, end int64) (SeriesSet, error) {
+	if !strings.EqualFold(metric, "") {
+		matchers = append([]*Matcher{MustNewMatcher(MatchEqual, metricName, metric)}, matchers...)
+	}
+	segments := db.segments.Get(start, end)
+	merged := make(map[string]*selectedSeries)
+	for _, segment := range segments {
+		segment = segment.Load()
+		seriesList, err := segment.Select(matchers, start, end)
+		if err != nil {
+			db.segments.Release(segments)
+			return nil, err
+		}
+		for _, series := range seriesList {
+			if pre, ok := merged[series.sid]; ok {
+				pre.iterators = append(pre.iterators, series.iterator)
+				continue
+			}
+			merged[series.sid] = &selectedSeries{labels: series.labels, iterators: []SeriesIterator{series.iterator}}
+		}
+	}
+
+	set := &seriesSet{
+		series: make([]*selectedSeries, 0, len(merged)),
+		index:  -1,
+		release: func() {
+			db.segments.Release(segments)
+		},
+	}
+	for _, series := range merged {
+		set.series = append(set.series, series)
+	}
+	sort.Slice(set.series, func(i, j int) bool {
+		return set.series[i].labels.String() < set.series[j].labels.String()
+	})
+	return set, nil
+}
+
+func (s *seriesSet) Next() bool {
+	if s.err != nil {
+		return false
+	}
+	for s.index+1 < len(s.series) {
+		s.index++
+		series := s.series[s.index]
+		// 不在查询范围内的时间线不返回
+		it := newMergeIterator(series.iterators...)
+		if !it.Next() {
+			if s.err = it.Err(); s.err != nil {
+				return false
+			}
+			continue
+		}
+		s.labels, s.iterator = series.labels, &primedIterator{SeriesIterator: it, primed: true}
+		return true
+	}
+	return false
+}
+
+func (s *seriesSet) At() (LabelList, SeriesIterator) {
+	return s.labels, s.iterator
+}
+
+func (s *seriesSet) Err() error {
+	return s.err
+}
+
+func (s *seriesSet) Close() error {
+	if s.release != nil {
+		s.release()
+		s.release = nil
+	}
+	return nil
+}
+
+// readPoints 读出迭代器剩余的全部数据点
+func readPoints(it SeriesIterator) ([]Point, error) {
+	points := make([]Point, 0)
+	for it.Next() {
+		t, v := it.At()
+		points = append(points, Point{Timestamp: t, Value: v})
+	}
+	return points, it.Err()
+}
@@ -1,8 +1,12 @@
 package tsdb
 
 import (
+	"errors"
+	"fmt"
 	"github.com/cespare/xxhash"
+	"math"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -21,6 +25,12 @@ type Label struct {
 type LabelList []Label
 
 var (
+	EmptyLabelNameError = errors.New("label name is empty")
+	DuplicateLabelError = errors.New("duplicate label name")
+	ReservedLabelError  = errors.New("label name is reserved")
+	LabelTooLongError   = errors.New("label is too long")
+	TooManyLabelsError  = errors.New("too many labels")
+
 	labelBufPoll = sync.Pool{
 		New: func() interface{} {
 			return make([]byte, 0, 1024)
@@ -28,6 +38,13 @@ var (
 	}
 )
 
+const (
+	// 持久化时标签名和标签值拼接后的长度使用uint16编码，endBlock作为结束标记不能使用
+	maxLabelSize = int(endBlock) - 1
+	// 预写日志中标签数量使用uint16编码
+	maxLabelCount = math.MaxUint16
+)
+
 func newLabelValueList() *labelValueList {
 	return &labelValueList{
 		values: map[string]map[string]struct{}{},
@@ -58,6 +75,18 @@ func (lvl *labelValueList) Get(label string) []string {
 	return ret
 }
 
+// Names 返回全部标签名
+func (lvl *labelValueList) Names() []string {
+	lvl.mutex.RLock()
+	defer lvl.mutex.RUnlock()
+
+	ret := make([]string, 0, len(lvl.values))
+	for key := range lvl.values {
+		ret = append(ret, key)
+	}
+	return ret
+}
+
 func (ll *LabelList) AddMetric(metric string) LabelList {
 	// todo 需要在这儿进行筛选吗，要不要异步进行
 	labels := ll.filter()
@@ -68,6 +97,38 @@ func (ll *LabelList) AddMetric(metric string) LabelList {
 	return labels
 }
 
+// validate 校验标签组合，标签名不能为空、不能重复，也不能使用保留的指标名标签
+func (ll LabelList) validate() error {
+	if len(ll) > maxLabelCount {
+		return fmt.Errorf("%w: %d", TooManyLabelsError, len(ll))
+	}
+	names := make(map[string]struct{}, len(ll))
+	for _, label := range ll {
+		if strings.EqualFold(label.Name, "") {
+			return EmptyLabelNameError
+		}
+		if err := validateLabelSize(label.Name, label.Value); err != nil {
+			return err
+		}
+		if label.Name == metricName {
+			return fmt.Errorf("%w: %s", ReservedLabelError, label.Name)
+		}
+		if _, ok := names[label.Name]; ok {
+			return fmt.Errorf("%w: %s", DuplicateLabelError, label.Name)
+		}
+		names[label.Name] = struct{}{}
+	}
+	return nil
+}
+
+// validateLabelSize 校验标签名和标签值的长度，超过持久化格式的限制时无法写入预写日志和segment
+func validateLabelSize(name, value string) error {
+	if size := len(joinSeprator(name, value)); size > maxLabelSize {
+		return fmt.Errorf("%w: %s, size: %d", LabelTooLongError, name, size)
+	}
+	return nil
+}
+
 // filter 过滤脏数据
 func (ll LabelList) filter() LabelList {
 	labels := make(map[string]struct{})
@@ -114,6 +175,44 @@ func (ll LabelList) Hash() uint64 {
 	return hash
 }
 
+// Get 返回标签值，标签不存在时返回空字符串
+func (ll LabelList) Get(name string) string {
+	for _, label := range ll {
+		if label.Name == name {
+			return label.Value
+		}
+	}
+	return ""
+}
+
+// group 返回names中的标签组成的有序标签组合，用于计算分组的key，不存在的标签会被忽略
+func (ll LabelList) group(names []string) LabelList {
+	ret := make(LabelList, 0, len(names))
+	for _, name := range names {
+		if value := ll.Get(name); value != "" && ret.Get(name) == "" {
+			ret = append(ret, Label{Name: name, Value: value})
+		}
+	}
+	ret.Sorted()
+	return ret
+}
+
+// String 以{name="value", ...}的格式输出标签组合
+func (ll LabelList) String() string {
+	var builder strings.Builder
+	builder.WriteByte('{')
+	for i, label := range ll {
+		if i > 0 {
+			builder.WriteString(", ")
+		}
+		builder.WriteString(label.Name)
+		builder.WriteString("=")
+		builder.WriteString(strconv.Quote(label.Value))
+	}
+	builder.WriteByte('}')
+	return builder.String()
+}
+
 func (l Label) MarshalName() string {
 	return joinSeprator(l.Name, l.Value)
 }
@@ -17,9 +17,11 @@ type Iter interface {
 	Value() interface{}
 }
 
+// iter 中序遍历avlTree中[start, end]范围内的节点，不会复制节点的值，遍历期间不能修改树
 type iter struct {
-	cursor int
-	data   []interface{}
+	start, end int64
+	stack      []*node
+	cur        *node
 }
 
 type node struct {
@@ -60,19 +62,38 @@ func (tree *avlTree) Range(start, end int64) Iter {
 }
 
 func (tree *avlTree) All() Iter {
-	return tree.tree.values(0, math.MaxInt64)
+	return tree.tree.values(math.MinInt64, math.MaxInt64)
 }
 
 func (it *iter) Next() bool {
-	it.cursor++
-	if len(it.data) > it.cursor {
-		return true
+	if len(it.stack) == 0 {
+		return false
 	}
-	return false
+	it.cur = it.stack[len(it.stack)-1]
+	it.stack = it.stack[:len(it.stack)-1]
+	if it.cur.key > it.end {
+		it.stack = nil
+		return false
+	}
+	it.pushLeft(it.cur.right)
+	return true
 }
 
 func (it *iter) Value() interface{} {
-	return it.data[it.cursor]
+	return it.cur.value
+}
+
+// pushLeft 将avlNode的左侧路径上不小于start的节点入栈，小于start的节点只需要遍历右子树
+func (it *iter) pushLeft(avlNode *node) {
+	// height为-2的是空树的占位节点
+	for avlNode != nil && avlNode.height != -2 {
+		if avlNode.key < it.start {
+			avlNode = avlNode.right
+			continue
+		}
+		it.stack = append(it.stack, avlNode)
+		avlNode = avlNode.left
+	}
 }
 
 func insert(key int64, value interface{}, avlNode *node) *node {
@@ -101,20 +122,18 @@ func insert(key int64, value interface{}, avlNode *node) *node {
 		avlNode.value = value
 	}
 
-	avlNode.keepBalance(key)
-	avlNode.height = maxHeight(avlNode.left.nollHeight(), avlNode.right.nollHeight()) + 1
-	return avlNode
+	return avlNode.keepBalance()
 }
 
-func (avlNode *node) keepBalance(key int64) *node {
+func (avlNode *node) keepBalance() *node {
 	if avlNode.left.nollHeight()-avlNode.right.nollHeight() == 2 {
-		if key-avlNode.left.key < 0 {
+		if avlNode.left.left.nollHeight() >= avlNode.left.right.nollHeight() {
 			avlNode = avlNode.rr()
 		} else {
 			avlNode = avlNode.lr()
 		}
 	} else if avlNode.right.nollHeight()-avlNode.left.nollHeight() == 2 {
-		if avlNode.right.right.nollHeight() > avlNode.right.left.nollHeight() {
+		if avlNode.right.right.nollHeight() >= avlNode.right.left.nollHeight() {
 			avlNode = avlNode.ll()
 		} else {
 			avlNode = avlNode.rl()
@@ -149,7 +168,7 @@ func (avlNode *node) ll() *node {
 	next.left = avlNode
 
 	next.height = maxHeight(next.left.nollHeight(), next.right.nollHeight()) + 1
-	avlNode.height = maxHeight(avlNode.left.nollHeight(), avlNode.right.nollHeight())
+	avlNode.height = maxHeight(avlNode.left.nollHeight(), avlNode.right.nollHeight()) + 1
 	return next
 }
 
@@ -160,26 +179,11 @@ func (avlNode *node) rl() *node {
 }
 
 func (avlNode *node) values(start, end int64) Iter {
-	item := &iter{
-		data: []interface{}{
-			nil,
-		},
-	}
-	item.data = list(item.data, start, end, avlNode)
+	item := &iter{start: start, end: end}
+	item.pushLeft(avlNode)
 	return item
 }
 
-func list(values []interface{}, start, end int64, avlNode *node) []interface{} {
-	if avlNode != nil {
-		values = list(values, start, end, avlNode.left)
-		if avlNode.key >= start && avlNode.key <= end {
-			values = append(values, avlNode.value)
-		}
-		values = list(values, start, end, avlNode.right)
-	}
-	return values
-}
-
 func maxHeight(left, right int) int {
 	if left > right {
 		return left
@@ -226,7 +230,7 @@ func (avlNode *node) delete(key int64) *node {
 
 	if avlNode != nil {
 		avlNode.height = maxHeight(avlNode.left.nollHeight(), avlNode.right.nollHeight()) + 1
-		avlNode = avlNode.keepBalance(key)
+		avlNode = avlNode.keepBalance()
 	}
 	return avlNode
 }
@@ -0,0 +1,105 @@
+package tsdb
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestAVLTreeOutOfOrder(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	keys := r.Perm(200)
+	tree := newTree()
+	expected := make(map[int64]bool)
+	for _, key := range keys {
+		// 负数key在All中也需要返回
+		k := int64(key - 100)
+		tree.Add(k, k)
+		expected[k] = true
+	}
+	checkTree(t, tree, expected)
+
+	for i, key := range r.Perm(200) {
+		if i%2 == 0 {
+			continue
+		}
+		k := int64(key - 100)
+		if !tree.Remove(k) {
+			t.Fatalf("failed to remove key %d", k)
+		}
+		delete(expected, k)
+	}
+	if tree.Remove(1000) {
+		t.Fatal("removed a key that does not exist")
+	}
+	checkTree(t, tree, expected)
+
+	// 删除后重新插入
+	for _, key := range []int64{-1000, 1000, 0} {
+		tree.Add(key, key)
+		expected[key] = true
+	}
+	checkTree(t, tree, expected)
+
+	if newTree().All().Next() {
+		t.Fatal("empty tree should have no keys")
+	}
+}
+
+// checkTree 检查All和Range返回的key有序且完整，并且树保持平衡
+func checkTree(t *testing.T, list List, expected map[int64]bool) {
+	t.Helper()
+	keys := make([]int64, 0, len(expected))
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+
+	assertKeys(t, list.All(), keys)
+	for _, bound := range [][2]int64{{-50, 50}, {-3, 3}, {7, 7}, {60, 40}} {
+		inRange := make([]int64, 0)
+		for _, key := range keys {
+			if key >= bound[0] && key <= bound[1] {
+				inRange = append(inRange, key)
+			}
+		}
+		assertKeys(t, list.Range(bound[0], bound[1]), inRange)
+	}
+	if _, ok := balancedHeight(list.(*avlTree).tree); !ok {
+		t.Fatal("tree is not balanced")
+	}
+}
+
+func assertKeys(t *testing.T, it Iter, keys []int64) {
+	t.Helper()
+	got := make([]int64, 0, len(keys))
+	for it.Next() {
+		got = append(got, it.Value().(int64))
+	}
+	if len(got) != len(keys) {
+		t.Fatalf("expected %d keys, got %d: %v", len(keys), len(got), got)
+	}
+	for i := range keys {
+		if got[i] != keys[i] {
+			t.Fatalf("expected key %d at %d, got %d", keys[i], i, got[i])
+		}
+	}
+}
+
+// balancedHeight 返回子树的高度，左右子树高度差超过1时返回false
+func balancedHeight(n *node) (int, bool) {
+	if n == nil {
+		return -1, true
+	}
+	left, ok := balancedHeight(n.left)
+	if !ok {
+		return 0, false
+	}
+	right, ok := balancedHeight(n.right)
+	if !ok || left-right > 1 || right-left > 1 {
+		return 0, false
+	}
+	return maxHeight(left, right) + 1, true
+}
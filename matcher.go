@@ -0,0 +1,111 @@
+package tsdb
+
+import (
+	"fmt"
+	"regexp"
+)
+
+type MatchType int8
+
+const (
+	// MatchEqual 标签值相等 =
+	MatchEqual MatchType = iota
+
+	// MatchNotEqual 标签值不相等 !=
+	MatchNotEqual
+
+	// MatchRegexp 标签值匹配正则 =~
+	MatchRegexp
+
+	// MatchNotRegexp 标签值不匹配正则 !~
+	MatchNotRegexp
+)
+
+// Matcher 标签选择器，标签不存在时视为值为空字符串
+type Matcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+
+	re *regexp.Regexp
+}
+
+func (mt MatchType) String() string {
+	switch mt {
+	case MatchEqual:
+		return "="
+	case MatchNotEqual:
+		return "!="
+	case MatchRegexp:
+		return "=~"
+	case MatchNotRegexp:
+		return "!~"
+	}
+	return "unknown"
+}
+
+// NewMatcher 创建标签选择器，正则会被完整锚定
+func NewMatcher(t MatchType, name, value string) (*Matcher, error) {
+	m := &Matcher{
+		Type:  t,
+		Name:  name,
+		Value: value,
+	}
+	switch t {
+	case MatchEqual, MatchNotEqual:
+	case MatchRegexp, MatchNotRegexp:
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regexp %q, err: %v", value, err)
+		}
+		m.re = re
+	default:
+		return nil, fmt.Errorf("unknown match type: %d", t)
+	}
+	return m, nil
+}
+
+// MustNewMatcher 创建标签选择器，失败时panic
+func MustNewMatcher(t MatchType, name, value string) *Matcher {
+	m, err := NewMatcher(t, name, value)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func (m *Matcher) String() string {
+	return fmt.Sprintf("%s%s%q", m.Name, m.Type, m.Value)
+}
+
+// Matches 判断标签值是否满足选择器
+func (m *Matcher) Matches(value string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	case MatchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+// matchValues 从标签值列表中挑选出满足选择器的标签值
+func (m *Matcher) matchValues(lvl *labelValueList, inverse bool) []string {
+	if m.Type == MatchEqual && m.Value != "" && !inverse {
+		return []string{m.Value}
+	}
+	if m.Type == MatchNotEqual && m.Value != "" && inverse {
+		return []string{m.Value}
+	}
+	ret := make([]string, 0)
+	for _, value := range lvl.Get(m.Name) {
+		if m.Matches(value) != inverse {
+			ret = append(ret, value)
+		}
+	}
+	return ret
+}
@@ -13,6 +13,7 @@ import (
 )
 
 type memtable struct {
+	opts          *options
 	once          sync.Once
 	segment       sync.Map
 	indexMap      *memtableIndexMap
@@ -25,32 +26,47 @@ type memtable struct {
 
 	seriesCount     int64
 	dataPointsCount int64
+
+	walIndex int64 // 写入的rows所在的最小预写日志序号
+
+	writers sync.WaitGroup // 取得memtable后正在写入的协程，刷盘前需要等待全部写入结束
 }
 
-func newMemtable() Segment {
+func newMemtable(opts *options) Segment {
 	return &memtable{
+		opts:         opts,
 		indexMap:     newMemtableIndexMap(),
 		labelVs:      newLabelValueList(),
 		outdated:     make(map[string]List),
 		minTimestamp: math.MaxInt64,
 		maxTimestamp: math.MinInt64,
+		walIndex:     math.MaxInt64,
 	}
 }
 
 func (m *memtable) InsertRows(rows []*Row) {
-	for _, row := range rows {
-		m.labelVs.Set(metricName, row.Metric)
-		for _, label := range row.Labels {
-			m.labelVs.Set(label.Name, label.Value)
-		}
+	m.insertRows(rows)
+}
+
+// insertRows 写入rows并返回与rows一一对应的写入结果
+func (m *memtable) insertRows(rows []*Row) []error {
+	errs := make([]error, len(rows))
+	for i, row := range rows {
 		// todo 基于字符串排序
 		row.Labels = row.Labels.AddMetric(row.Metric)
 		row.Labels.Sorted()
+		for _, label := range row.Labels {
+			m.labelVs.Set(label.Name, label.Value)
+		}
 
 		series := m.getSeries(row)
 		points := series.Append(&row.Point)
 
 		if points != nil {
+			if !m.opts.enableOutdated {
+				errs[i] = fmt.Errorf("%w: timestamp %d", OutOfOrderError, row.Point.Timestamp)
+				continue
+			}
 			m.outdatedMutex.Lock()
 			if _, ok := m.outdated[row.ID()]; !ok {
 				m.outdated[row.ID()] = newTree()
@@ -69,6 +85,7 @@ func (m *memtable) InsertRows(rows []*Row) {
 		atomic.AddInt64(&m.dataPointsCount, 1)
 		m.indexMap.UpdateIndex(row.ID(), row.Labels)
 	}
+	return errs
 }
 
 func (m *memtable) MinTs() int64 {
@@ -79,15 +96,32 @@ func (m *memtable) MaxTs() int64 {
 	return atomic.LoadInt64(&m.maxTimestamp)
 }
 
+// MarkWAL 记录即将写入的rows所在的预写日志序号
+func (m *memtable) MarkWAL(index int) {
+	for {
+		pre := atomic.LoadInt64(&m.walIndex)
+		if int64(index) >= pre || atomic.CompareAndSwapInt64(&m.walIndex, pre, int64(index)) {
+			return
+		}
+	}
+}
+
+func (m *memtable) WALIndex() int64 {
+	return atomic.LoadInt64(&m.walIndex)
+}
+
 func (m *memtable) Frozen() bool {
-	if defaultOpts.onlyMemoryMode {
+	if m.opts.onlyMemoryMode {
 		return false
 	}
-	return m.MaxTs()-m.MinTs() > int64(defaultOpts.segmentDuration.Seconds())
+	if atomic.LoadInt64(&m.dataPointsCount) >= m.opts.maxRowsPerSegment {
+		return true
+	}
+	return m.MaxTs()-m.MinTs() > m.opts.precision.FromDuration(m.opts.segmentDuration)
 }
 
 func (m *memtable) Close() error {
-	if m.dataPointsCount == 0 || defaultOpts.onlyMemoryMode {
+	if m.dataPointsCount == 0 || m.opts.onlyMemoryMode {
 		return nil
 	}
 	return writeToDisk(m)
@@ -105,6 +139,43 @@ func (m *memtable) QueryLabelValuse(label string) []string {
 	return m.labelVs.Get(label)
 }
 
+func (m *memtable) QueryLabelNames() []string {
+	return m.labelVs.Names()
+}
+
+// Select 返回与[start, end]有交集的时间线，乱序写入的数据点会复制出来，数据块在遍历时才会解码
+func (m *memtable) Select(matchers []*Matcher, start, end int64) ([]*segmentSeries, error) {
+	ret := make([]*segmentSeries, 0)
+	for _, sid := range m.indexMap.Select(m.labelVs, matchers) {
+		value, ok := m.segment.Load(sid)
+		if !ok {
+			continue
+		}
+		series := value.(*memSeries)
+		chunks := series.chunkRefs()
+
+		outdatedPoints := make([]Point, 0)
+		m.outdatedMutex.RLock()
+		if outdatedList, ok := m.outdated[sid]; ok {
+			item := outdatedList.Range(start, end)
+			for item.Next() {
+				outdatedPoints = append(outdatedPoints, item.Value().(Point))
+			}
+		}
+		m.outdatedMutex.RUnlock()
+		if len(outdatedPoints) == 0 && !overlaps(chunks, start, end) {
+			continue
+		}
+		ret = append(ret, &segmentSeries{
+			sid:    sid,
+			labels: series.labels,
+			// 时间戳相同时以数据块中的数据点为准
+			iterator: newMergeIterator(newPointsIterator(outdatedPoints), newChunksIterator(chunks, nil, start, end)),
+		})
+	}
+	return ret, nil
+}
+
 func mkdir(dir string) {
 	if _, err := os.Stat(dir); !os.IsNotExist(err) {
 		return
@@ -122,12 +193,17 @@ func (m *memtable) getSeries(row *Row) *memSeries {
 	}
 
 	atomic.AddInt64(&m.seriesCount, 1)
-	newSeries := newSeries(row)
+	newSeries := newSeries(row, m.opts.maxRowsPerChunk)
 	m.segment.Store(row.ID(), newSeries)
 	return newSeries
 }
 
 func writeToDisk(segment *memtable) error {
+	return writeSegment(segment, makeDirName(segment.opts.dataPath, segment.MinTs(), segment.MaxTs()))
+}
+
+// writeSegment 将segment的data和meta文件写入dirname
+func writeSegment(segment *memtable, dirname string) error {
 	dataBytes, descBytes, err := segment.Marshal()
 	if err != nil {
 		return fmt.Errorf("faild to marshal segment: %s", err.Error())
@@ -138,14 +214,13 @@ func writeToDisk(segment *memtable) error {
 		}
 		fd, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY, os.ModePerm)
 		if err != nil {
-			return nil
+			return err
 		}
 		defer fd.Close()
 		_, err = fd.Write(data)
 		return err
 	}
 
-	dirname := makeDirName(segment.MinTs(), segment.MaxTs())
 	mkdir(dirname)
 
 	if err = writeFile(path.Join(dirname, "data"), dataBytes); err != nil {
@@ -164,7 +239,7 @@ func (m *memtable) Marshal() ([]byte, []byte, error) {
 	startOffset := 0
 	size := 0
 	dataBuf := make([]byte, 0)
-	dataBuf = append(dataBuf, make([]byte, uint64Size>>1)...)
+	dataBuf = append(dataBuf, make([]byte, uint64Size<<1)...)
 	meta := Metadata{
 		MinTimestamp: m.minTimestamp,
 		MaxTimestamp: m.maxTimestamp,
@@ -182,9 +257,9 @@ func (m *memtable) Marshal() ([]byte, []byte, error) {
 
 		var dataBytes []byte
 		if ok {
-			dataBytes = DoCompress(series.MergeOutdatedList(listValue).Bytes())
+			dataBytes = series.MergeOutdatedList(listValue).Encode(m.opts.bytesCompressor)
 		} else {
-			dataBytes = DoCompress(series.Bytes())
+			dataBytes = series.Encode(m.opts.bytesCompressor)
 		}
 
 		dataBuf = append(dataBuf, dataBytes...)
@@ -212,7 +287,7 @@ func (m *memtable) Marshal() ([]byte, []byte, error) {
 		})
 	})
 	meta.Labels = labelIndex
-	metaBytes, err := MarshalMeta(meta)
+	metaBytes, err := m.opts.marshalMeta(meta)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -225,7 +300,10 @@ func (m *memtable) Marshal() ([]byte, []byte, error) {
 	}
 
 	descBytes, err := json.MarshalIndent(desc, "", "\t")
-	dataLen := len(dataBuf) - (uint64Size >> 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	dataLen := len(dataBuf) - (uint64Size << 1)
 	dataBuf = append(dataBuf, metaBytes...)
 	newEncodingBuf := newEncodingBuf()
 
@@ -79,21 +79,17 @@ func (b *binaryMetaserializer) Marshal(meta Metadata) ([]byte, error) {
 	nowEncodingBuf.MarshalUint64(uint64(meta.MinTimestamp))
 	nowEncodingBuf.MarshalUint64(uint64(meta.MaxTimestamp))
 	nowEncodingBuf.MarshalString(signature)
-	return DoCompress(nowEncodingBuf.Bytes()), nil
+	return nowEncodingBuf.Bytes(), nil
 }
 
 func (b *binaryMetaserializer) Unmarshal(data []byte, meta *Metadata) error {
-	data, err := DoDecompress(data)
-	if err != nil {
-		return fmt.Errorf("faild to decompress, err: %v", err)
-	}
 	if len(data) < len(signature) {
 		return fmt.Errorf("the data block is incomplete, data len: %d", len(data))
 	}
 
 	nowDecodingBuf := newDecodingBuf()
 	// 首先判断数据是否完整
-	if strings.EqualFold(nowDecodingBuf.UnmarshalString(data[len(data)-len(signature):]), signature) {
+	if !strings.EqualFold(nowDecodingBuf.UnmarshalString(data[len(data)-len(signature):]), signature) {
 		return fmt.Errorf("the data block is incomplete, data: %s", nowDecodingBuf.UnmarshalString(data[len(data)-len(signature):]))
 	}
 	offset := 0
@@ -159,10 +155,34 @@ func (b *binaryMetaserializer) Unmarshal(data []byte, meta *Metadata) error {
 	return nowDecodingBuf.err
 }
 
+// MarshalMeta 使用默认配置编码并压缩元数据
+//
+// Deprecated: 元数据的编码和压缩是每个数据库实例的配置，使用WithMetaSerializer和WithBytesCompressor设置
 func MarshalMeta(meta Metadata) ([]byte, error) {
-	return defaultOpts.metaSerializer.Marshal(meta)
+	return defaultOpts.marshalMeta(meta)
 }
 
+// UnmarshaMeta 使用默认配置解压并解码元数据
+//
+// Deprecated: 元数据的编码和压缩是每个数据库实例的配置，使用WithMetaSerializer和WithBytesCompressor设置
 func UnmarshaMeta(data []byte, meta *Metadata) error {
-	return defaultOpts.metaSerializer.Unmarshal(data, meta)
+	return defaultOpts.unmarshalMeta(data, meta)
+}
+
+// marshalMeta 编码并压缩元数据
+func (c *options) marshalMeta(meta Metadata) ([]byte, error) {
+	data, err := c.metaSerializer.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	return c.bytesCompressor.Compress(data), nil
+}
+
+// unmarshalMeta 解压并解码元数据
+func (c *options) unmarshalMeta(data []byte, meta *Metadata) error {
+	data, err := c.bytesCompressor.Decompress(data)
+	if err != nil {
+		return fmt.Errorf("faild to decompress, err: %v", err)
+	}
+	return c.metaSerializer.Unmarshal(data, meta)
 }
@@ -0,0 +1,182 @@
+package opentsdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"tsdb"
+)
+
+func openDB(t *testing.T) *tsdb.TSDB {
+	db, err := tsdb.Open(tsdb.WithDataPath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close(context.Background())
+	})
+	return db
+}
+
+func post(t *testing.T, url, body string) (int, []byte) {
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	buf := &bytes.Buffer{}
+	buf.ReadFrom(resp.Body)
+	return resp.StatusCode, buf.Bytes()
+}
+
+func TestPut(t *testing.T) {
+	db := openDB(t)
+	mux := http.NewServeMux()
+	NewHandler(db).Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	code, _ := post(t, server.URL+"/api/put", `{"metric":"cpu.busy","timestamp":1600000000,"value":1,"tags":{"node":"vm1"}}`)
+	if code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, code)
+	}
+
+	body := `[
+		{"metric":"cpu.busy","timestamp":1600000060000,"value":"2.5","tags":{"node":"vm1"}},
+		{"metric":"cpu.busy","timestamp":1600000060,"value":"abc","tags":{"node":"vm1"}},
+		{"metric":"cpu.busy","timestamp":1600000060,"value":1},
+		{"metric":"cpu.busy","timestamp":1600000060,"value":1,"tags":{"__name__":"mem"}}
+	]`
+	code, data := post(t, server.URL+"/api/put?details", body)
+	if code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, code)
+	}
+	summary := &putSummary{}
+	if err := json.Unmarshal(data, summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Success != 1 || summary.Failed != 3 || len(summary.Errors) != 3 ||
+		summary.Errors[0].Error != InvalidValueError.Error() || summary.Errors[1].Error != MissingTagsError.Error() ||
+		!strings.Contains(summary.Errors[2].Error, "reserved") || summary.Errors[0].DataPoint.Value != "abc" {
+		t.Fatalf("unexpected summary: %s", data)
+	}
+
+	code, data = post(t, server.URL+"/api/put", body)
+	if code != http.StatusBadRequest || !strings.Contains(string(data), "One or more data points had errors") {
+		t.Fatalf("unexpected response: %d %s", code, data)
+	}
+	code, _ = post(t, server.URL+"/api/put", `{"metric":`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, code)
+	}
+
+	seriesList, err := db.QueryRange("cpu.busy", nil, 1600000000, 1600000060)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 || len(seriesList[0].Points) != 2 || seriesList[0].Points[1].Value != 2.5 {
+		t.Fatalf("unexpected result: %+v", seriesList)
+	}
+}
+
+func TestTelnet(t *testing.T) {
+	db := openDB(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewTelnetServer(db)
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(listener)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("put cpu.busy 1600000000 1 node=vm1 dc=dc1\n" +
+		"put cpu.busy 1600000060 x node=vm1\n" +
+		"put cpu.busy 1600000060\n" +
+		"put cpu.busy 1600000060 NaN node=vm1 dc=dc1\n" +
+		"put cpu.busy 1600000060 -Inf node=vm1 dc=dc1\n" +
+		"put cpu.busy 1600000060 2 node=vm1 dc=dc1\n" +
+		"version\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	lines := make([]string, 0)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSpace(line))
+		if line == "tsdb\n" {
+			break
+		}
+	}
+	if len(lines) != 5 || !strings.HasPrefix(lines[0], "put: "+InvalidValueError.Error()) ||
+		!strings.HasPrefix(lines[1], "put: illegal argument") ||
+		!strings.HasPrefix(lines[2], "put: "+InvalidValueError.Error()) || !strings.HasPrefix(lines[3], "put: "+InvalidValueError.Error()) {
+		t.Fatalf("unexpected response: %q", lines)
+	}
+
+	seriesList, err := db.QueryRange("cpu.busy", []*tsdb.Matcher{tsdb.MustNewMatcher(tsdb.MatchEqual, "dc", "dc1")}, 1600000000, 1600000060)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 || len(seriesList[0].Points) != 2 {
+		t.Fatalf("unexpected result: %+v", seriesList)
+	}
+
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTelnetLineTooLong(t *testing.T) {
+	db := openDB(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewTelnetServer(db)
+	defer server.Close()
+	go server.Serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// 超长的行之前到达的命令仍然写入，之后关闭连接
+	go conn.Write([]byte("put cpu.busy 1600000000 1 node=vm1\nput " + strings.Repeat("x", maxTelnetLineSize)))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.ReadAll(conn); err != nil && !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("connection should be closed, got %v", err)
+	}
+
+	seriesList, err := db.QueryRange("cpu.busy", nil, 1600000000, 1600000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 {
+		t.Fatalf("unexpected result: %+v", seriesList)
+	}
+}
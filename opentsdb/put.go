@@ -0,0 +1,259 @@
+// Package opentsdb 实现兼容OpenTSDB的写入接口，包括HTTP /api/put和telnet put协议，
+// 数据点同步写入数据库，写入失败的原因按OpenTSDB的格式返回
+package opentsdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"tsdb"
+)
+
+const (
+	maxBodySize = 32 << 20 // 解压后请求体的最大字节数
+
+	// 超过该值的时间戳单位为毫秒，与OpenTSDB一致
+	maxSecondTimestamp = 1<<32 - 1
+)
+
+var (
+	MissingTagsError       = errors.New("missing tags")
+	InvalidTimestampError  = errors.New("invalid timestamp")
+	InvalidValueError      = errors.New("unable to parse value to a number")
+	MissingMetricNameError = errors.New("missing metric name")
+)
+
+// DataPoint /api/put请求中的一个数据点，timestamp的单位为秒或毫秒
+type DataPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     Value             `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// Value 数据点的值，可以是数字或者字符串形式的数字，解析失败时原样返回给客户端
+type Value string
+
+func (v *Value) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*v = Value(s)
+		return nil
+	}
+	*v = Value(data)
+	return nil
+}
+
+func (v Value) MarshalJSON() ([]byte, error) {
+	if _, err := strconv.ParseFloat(string(v), 64); err == nil && json.Valid([]byte(v)) {
+		return []byte(v), nil
+	}
+	return json.Marshal(string(v))
+}
+
+// Row 转换为数据库精度下的Row
+func (dp *DataPoint) Row(precision tsdb.TimestampPrecision) (*tsdb.Row, error) {
+	if dp.Metric == "" {
+		return nil, MissingMetricNameError
+	}
+	if len(dp.Tags) == 0 {
+		return nil, MissingTagsError
+	}
+	ts, err := convertTimestamp(dp.Timestamp, precision)
+	if err != nil {
+		return nil, err
+	}
+	// 与OpenTSDB一致，NaN和Inf不是合法的值
+	value, err := strconv.ParseFloat(string(dp.Value), 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, InvalidValueError
+	}
+	labels := make(tsdb.LabelList, 0, len(dp.Tags)+1)
+	for name, value := range dp.Tags {
+		labels = append(labels, tsdb.Label{Name: name, Value: value})
+	}
+	return &tsdb.Row{
+		Metric: dp.Metric,
+		Labels: labels,
+		Point:  tsdb.Point{Timestamp: ts, Value: value},
+	}, nil
+}
+
+func convertTimestamp(ts int64, precision tsdb.TimestampPrecision) (int64, error) {
+	if ts <= 0 {
+		return 0, InvalidTimestampError
+	}
+	if ts > maxSecondTimestamp {
+		return precision.Convert(ts, tsdb.PrecisionMillisecond), nil
+	}
+	return precision.Convert(ts, tsdb.PrecisionSecond), nil
+}
+
+// Handler 兼容OpenTSDB的/api/put接口
+type Handler struct {
+	db *tsdb.TSDB
+}
+
+type putError struct {
+	DataPoint *DataPoint `json:"datapoint"`
+	Error     string     `json:"error"`
+}
+
+// putSummary 请求带有summary或details参数时的响应
+type putSummary struct {
+	Errors  []putError `json:"errors,omitempty"`
+	Failed  int        `json:"failed"`
+	Success int        `json:"success"`
+}
+
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Details string `json:"details,omitempty"`
+}
+
+func NewHandler(db *tsdb.TSDB) *Handler {
+	return &Handler{db: db}
+}
+
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/put", h.put)
+}
+
+// put 接收单个数据点或数据点数组，全部写入成功时返回204，带有summary或details参数时返回200和写入统计，
+// 存在写入失败的数据点时返回400
+func (h *Handler) put(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+	points, err := readDataPoints(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Unable to parse the given JSON", err.Error())
+		return
+	}
+
+	precision := h.db.Precision()
+	errs := make([]error, len(points))
+	rows := make([]*tsdb.Row, 0, len(points))
+	indexes := make([]int, 0, len(points))
+	for i, dp := range points {
+		if dp == nil {
+			errs[i] = MissingMetricNameError
+			continue
+		}
+		row, err := dp.Row(precision)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		rows = append(rows, row)
+		indexes = append(indexes, i)
+	}
+	if len(rows) > 0 {
+		results, err := h.db.InsertRowsSync(r.Context(), rows)
+		if err != nil {
+			logrus.Errorf("failed to insert opentsdb data points, err: %v", err)
+			writeError(w, http.StatusServiceUnavailable, "Failed to store data points", err.Error())
+			return
+		}
+		for i, err := range results {
+			errs[indexes[i]] = err
+		}
+	}
+
+	summary := &putSummary{}
+	for i, err := range errs {
+		if err == nil {
+			summary.Success++
+			continue
+		}
+		summary.Failed++
+		summary.Errors = append(summary.Errors, putError{DataPoint: points[i], Error: err.Error()})
+	}
+	query := r.URL.Query()
+	_, details := query["details"]
+	_, summaryOnly := query["summary"]
+	if !details && !summaryOnly {
+		if summary.Failed > 0 {
+			writeError(w, http.StatusBadRequest, "One or more data points had errors",
+				`Please see the TSD logs or append "details" to the put request`)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !details {
+		summary.Errors = nil
+	} else if summary.Errors == nil {
+		summary.Errors = []putError{}
+	}
+	code := http.StatusOK
+	if summary.Failed > 0 {
+		code = http.StatusBadRequest
+	}
+	writeJSON(w, code, summary)
+}
+
+// readDataPoints 解析单个数据点或数据点数组，支持gzip压缩的请求体
+func readDataPoints(r *http.Request) ([]*DataPoint, error) {
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		body = gz
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBodySize {
+		return nil, fmt.Errorf("body exceeds %d bytes", maxBodySize)
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, errors.New("missing request content")
+	}
+	if data[0] != '[' {
+		dp := &DataPoint{}
+		if err := json.Unmarshal(data, dp); err != nil {
+			return nil, err
+		}
+		return []*DataPoint{dp}, nil
+	}
+	points := make([]*DataPoint, 0)
+	if err := json.Unmarshal(data, &points); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+func writeError(w http.ResponseWriter, code int, message, details string) {
+	writeJSON(w, code, &errorResponse{Error: errorBody{Code: code, Message: message, Details: details}})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Errorf("failed to write response, err: %v", err)
+	}
+}
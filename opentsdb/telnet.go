@@ -0,0 +1,223 @@
+package opentsdb
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"tsdb"
+)
+
+const (
+	// maxTelnetBatch 同一个连接中已经到达的put命令合并写入，每批最多的数据点数量
+	maxTelnetBatch = 1000
+	// maxTelnetLineSize 一行命令的最大长度，超过时关闭连接，避免没有换行符的数据占满内存
+	maxTelnetLineSize = 64 << 10
+)
+
+// TelnetServer 兼容OpenTSDB的telnet协议，支持put、version和exit命令，
+// 写入失败时向客户端返回"put: <原因>"
+type TelnetServer struct {
+	db *tsdb.TSDB
+
+	mutex    sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wait     sync.WaitGroup
+}
+
+// putLine 一条put命令及其所在的行
+type putLine struct {
+	row  *tsdb.Row
+	line string
+}
+
+func NewTelnetServer(db *tsdb.TSDB) *TelnetServer {
+	return &TelnetServer{
+		db:    db,
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve 接受连接直到listener关闭，调用Close后返回nil
+func (s *TelnetServer) Serve(listener net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return errors.New("telnet server is closed")
+	}
+	s.listener = listener
+	s.mutex.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return nil
+		}
+		go func() {
+			defer s.wait.Done()
+			defer s.untrack(conn)
+			s.handle(conn)
+		}()
+	}
+}
+
+// Close 关闭listener和所有连接，并等待正在处理的命令结束
+func (s *TelnetServer) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wait.Wait()
+	return err
+}
+
+// track 记录连接并计入wait，与Close使用同一个锁，Close开始等待后不会再有新的连接计入
+func (s *TelnetServer) track(conn net.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	s.wait.Add(1)
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *TelnetServer) untrack(conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.conns, conn)
+	conn.Close()
+}
+
+func (s *TelnetServer) handle(conn net.Conn) {
+	reader := bufio.NewReaderSize(conn, maxTelnetLineSize)
+	writer := bufio.NewWriter(conn)
+	batch := make([]putLine, 0)
+	for {
+		data, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			logrus.Warnf("telnet line from %s exceeds %d bytes, close connection", conn.RemoteAddr(), maxTelnetLineSize)
+			s.flush(writer, batch)
+			writer.Flush()
+			return
+		}
+		if line := strings.TrimSpace(string(data)); line != "" {
+			var exit bool
+			batch, exit = s.command(writer, batch, line)
+			if exit {
+				s.flush(writer, batch)
+				writer.Flush()
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				logrus.Debugf("failed to read telnet connection %s, err: %v", conn.RemoteAddr(), err)
+			}
+			s.flush(writer, batch)
+			writer.Flush()
+			return
+		}
+		// 已经读到的命令处理完后再写入，减少同步写入的次数
+		if reader.Buffered() == 0 || len(batch) >= maxTelnetBatch {
+			batch = s.flush(writer, batch)
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// command 执行一行命令，put命令加入batch，返回是否需要关闭连接
+func (s *TelnetServer) command(w *bufio.Writer, batch []putLine, line string) ([]putLine, bool) {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case "put":
+		row, err := parsePut(fields[1:], s.db.Precision())
+		if err != nil {
+			fmt.Fprintf(w, "put: %v: %s\n", err, line)
+			return batch, false
+		}
+		return append(batch, putLine{row: row, line: line}), false
+	case "version":
+		fmt.Fprintf(w, "tsdb\n")
+	case "exit":
+		return batch, true
+	default:
+		fmt.Fprintf(w, "unknown command: %s. Try `help'.\n", fields[0])
+	}
+	return batch, false
+}
+
+// flush 同步写入batch中的数据点，返回清空后的batch
+func (s *TelnetServer) flush(w *bufio.Writer, batch []putLine) []putLine {
+	if len(batch) == 0 {
+		return batch
+	}
+	rows := make([]*tsdb.Row, 0, len(batch))
+	for _, put := range batch {
+		rows = append(rows, put.row)
+	}
+	errs, err := s.db.InsertRowsSync(context.Background(), rows)
+	if err != nil {
+		logrus.Errorf("failed to insert opentsdb telnet data points, err: %v", err)
+		fmt.Fprintf(w, "put: %v\n", err)
+		return batch[:0]
+	}
+	for i, err := range errs {
+		if err != nil {
+			fmt.Fprintf(w, "put: %v: %s\n", err, batch[i].line)
+		}
+	}
+	return batch[:0]
+}
+
+// parsePut 解析put命令的参数: <metric> <timestamp> <value> <tagk1=tagv1 ...>
+func parsePut(args []string, precision tsdb.TimestampPrecision) (*tsdb.Row, error) {
+	if len(args) < 3 {
+		return nil, fmt.Errorf("illegal argument: not enough arguments (need least 4, got %d)", len(args)+1)
+	}
+	ts, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return nil, InvalidTimestampError
+	}
+	dp := &DataPoint{
+		Metric:    args[0],
+		Timestamp: ts,
+		Value:     Value(args[2]),
+		Tags:      make(map[string]string, len(args)-3),
+	}
+	for _, tag := range args[3:] {
+		i := strings.IndexByte(tag, '=')
+		if i <= 0 || i == len(tag)-1 {
+			return nil, fmt.Errorf("invalid tag: %s", tag)
+		}
+		dp.Tags[tag[:i]] = tag[i+1:]
+	}
+	return dp.Row(precision)
+}
@@ -0,0 +1,186 @@
+package tsdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type options struct {
+	metaSerializer    MetaSerializer  // 元数据自定义Marshal接口
+	bytesCompressor   BytesCompressor // 数据持久化存储压缩接口
+	retention         time.Duration   // 数据保留时长，为0时永久保留
+	segmentDuration   time.Duration   // 一个segment的时长
+	writeTimeout      time.Duration   // 写超时
+	onlyMemoryMode    bool
+	enableOutdated    bool               // 是否可以写入过时数据（乱序写入）
+	maxRowsPerSegment int64              // 每段的最大row的数量，head写满后会刷盘
+	maxRowsPerChunk   int64              // 每个数据块的最大数据点数量
+	dataPath          string             // Segment 持久化存储文件夹
+	precision         TimestampPrecision // 数据点时间戳的精度
+}
+
+type Option func(c *options) error
+
+var (
+	defaultOpts = &options{
+		metaSerializer:    newBinaryMetaSerializer(),
+		bytesCompressor:   newNoopBytesCompressor(),
+		segmentDuration:   2 * time.Hour, // 默认两小时
+		retention:         7 * 24 * time.Hour,
+		writeTimeout:      30 * time.Second,
+		onlyMemoryMode:    false,
+		enableOutdated:    true,
+		maxRowsPerSegment: 19960412, // 该数字可自定义
+		maxRowsPerChunk:   1024,     // 该数字可自定义
+		dataPath:          ".",
+		precision:         PrecisionSecond,
+	}
+)
+
+// validate 校验配置是否合法
+func (c *options) validate() error {
+	if c.metaSerializer == nil {
+		return errors.New("meta serializer is required")
+	}
+	if c.bytesCompressor == nil {
+		return errors.New("bytes compressor is required")
+	}
+	if c.retention < 0 {
+		return fmt.Errorf("retention must not be negative, got: %v", c.retention)
+	}
+	if c.segmentDuration <= 0 {
+		return fmt.Errorf("segment duration must be positive, got: %v", c.segmentDuration)
+	}
+	if c.writeTimeout <= 0 {
+		return fmt.Errorf("write timeout must be positive, got: %v", c.writeTimeout)
+	}
+	if c.maxRowsPerSegment <= 0 {
+		return fmt.Errorf("max rows per segment must be positive, got: %d", c.maxRowsPerSegment)
+	}
+	if c.maxRowsPerChunk <= 0 {
+		return fmt.Errorf("max rows per chunk must be positive, got: %d", c.maxRowsPerChunk)
+	}
+	if !c.precision.valid() {
+		return fmt.Errorf("unknown timestamp precision: %d", c.precision)
+	}
+	if strings.TrimSpace(c.dataPath) == "" && !c.onlyMemoryMode {
+		return errors.New("data path is required")
+	}
+	return nil
+}
+
+// GetDataPath 设置segment持久化存储文件夹
+//
+// Deprecated: 使用WithDataPath
+func GetDataPath(dataPath string) Option {
+	return WithDataPath(dataPath)
+}
+
+// WithDataPath 设置segment持久化存储文件夹
+func WithDataPath(dataPath string) Option {
+	return func(c *options) error {
+		c.dataPath = dataPath
+		return nil
+	}
+}
+
+// WithRetention 设置数据保留时长，为0时永久保留，不会删除过期的segment
+func WithRetention(retention time.Duration) Option {
+	return func(c *options) error {
+		c.retention = retention
+		return nil
+	}
+}
+
+// WithSegmentDuration 设置一个segment的时长，head memtable超过该时长后会被持久化
+func WithSegmentDuration(duration time.Duration) Option {
+	return func(c *options) error {
+		c.segmentDuration = duration
+		return nil
+	}
+}
+
+// WithWriteTimeout 设置写入队列的超时时间
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(c *options) error {
+		c.writeTimeout = timeout
+		return nil
+	}
+}
+
+// WithOnlyMemoryMode 设置是否只在内存中存储数据，开启后不会写入预写日志和segment文件
+func WithOnlyMemoryMode(onlyMemoryMode bool) Option {
+	return func(c *options) error {
+		c.onlyMemoryMode = onlyMemoryMode
+		return nil
+	}
+}
+
+// WithEnableOutdated 设置是否可以写入过时数据（乱序写入），关闭后乱序的数据点会被丢弃
+func WithEnableOutdated(enableOutdated bool) Option {
+	return func(c *options) error {
+		c.enableOutdated = enableOutdated
+		return nil
+	}
+}
+
+// WithMaxRowsPerSegment 设置每段的最大row的数量，head memtable写满后会刷盘
+//
+// Deprecated: segment按时长切分，使用WithSegmentDuration设置；数据块的大小使用WithMaxRowsPerChunk设置
+func WithMaxRowsPerSegment(maxRows int64) Option {
+	return func(c *options) error {
+		c.maxRowsPerSegment = maxRows
+		return nil
+	}
+}
+
+// WithMaxRowsPerChunk 设置每个数据块的最大数据点数量，数据块写满后会新建数据块
+func WithMaxRowsPerChunk(maxRows int64) Option {
+	return func(c *options) error {
+		c.maxRowsPerChunk = maxRows
+		return nil
+	}
+}
+
+// WithTimestampPrecision 设置数据点时间戳的精度，默认为秒
+func WithTimestampPrecision(precision TimestampPrecision) Option {
+	return func(c *options) error {
+		c.precision = precision
+		return nil
+	}
+}
+
+// WithMetaSerializer 设置segment元数据的编解码方式
+func WithMetaSerializer(serializer MetaSerializer) Option {
+	return func(c *options) error {
+		c.metaSerializer = serializer
+		return nil
+	}
+}
+
+// WithBytesCompressor 设置数据持久化存储使用的压缩算法
+func WithBytesCompressor(compressorType BytesCompressorType) Option {
+	return func(c *options) error {
+		switch compressorType {
+		case NoopBytesCompressor:
+			c.bytesCompressor = newNoopBytesCompressor()
+		case ZSTDBytesCompressor:
+			c.bytesCompressor = newZSTDBytesCompressor()
+		case SnappyBytesCompressor:
+			c.bytesCompressor = newSnappyBytesCompressor()
+		default:
+			return fmt.Errorf("unknown bytes compressor type: %d", compressorType)
+		}
+		return nil
+	}
+}
+
+// WithCustomBytesCompressor 设置自定义的压缩算法
+func WithCustomBytesCompressor(compressor BytesCompressor) Option {
+	return func(c *options) error {
+		c.bytesCompressor = compressor
+		return nil
+	}
+}
@@ -0,0 +1,380 @@
+// Package otlp 实现OpenTelemetry OTLP指标的写入，支持gRPC和HTTP(protobuf或JSON)两种传输方式
+package otlp
+
+import (
+	"encoding/base64"
+	"fmt"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tsdb"
+)
+
+const (
+	bucketLabel   = "le"
+	quantileLabel = "quantile"
+
+	// defaultStaleness delta时间线超过这个时间没有数据点时删除累计值
+	defaultStaleness = 15 * time.Minute
+)
+
+// Converter 将OTLP指标转换为rows，标签依次由resource、scope和数据点的属性合并而成，后者优先。
+// Gauge和Sum转换为同名指标，Histogram展开为name_bucket{le=...}、name_count和name_sum，
+// ExponentialHistogram只转换name_count和name_sum，Summary展开为name{quantile=...}、name_count和name_sum。
+// 数据库中的Sum和Histogram都是累计值，delta类型的数据点会按时间线累加为累计值后写入，
+// 因此同一条时间线的delta数据需要发送到同一个实例，未指定temporality的数据点会被拒绝。
+// 累计值只保存在内存中，进程重启或时间线超过staleness没有数据点后从0重新累加，
+// 与计数器重置相同，查询时由increase和rate的重置检测处理
+type Converter struct {
+	precision tsdb.TimestampPrecision
+	staleness time.Duration
+	now       func() time.Time
+
+	mutex      sync.Mutex
+	cumulative map[string]*cumulativeState // delta数据点累加后的累计值
+	lastEvict  time.Time
+}
+
+// cumulativeState 一条delta时间线累加后的值
+type cumulativeState struct {
+	updated   time.Time // 最后一次累加的时间，用于删除不再更新的时间线
+	timestamp int64
+	value     float64
+	bounds    []float64
+	buckets   []uint64
+	count     uint64
+	sum       float64
+}
+
+// Result 一次转换的结果，Rejected为无法转换的数据点数量
+type Result struct {
+	Rows     []*tsdb.Row
+	Rejected int64
+	Errors   []string
+}
+
+func NewConverter(precision tsdb.TimestampPrecision) *Converter {
+	return &Converter{
+		precision:  precision,
+		staleness:  defaultStaleness,
+		now:        time.Now,
+		cumulative: make(map[string]*cumulativeState),
+		lastEvict:  time.Now(),
+	}
+}
+
+func (c *Converter) Convert(req *colmetricspb.ExportMetricsServiceRequest) *Result {
+	c.evictStale()
+	ret := &Result{Rows: make([]*tsdb.Row, 0)}
+	for _, rm := range req.GetResourceMetrics() {
+		resourceLabels := attributesToLabels(nil, rm.GetResource().GetAttributes())
+		for _, sm := range rm.GetScopeMetrics() {
+			scopeLabels := attributesToLabels(resourceLabels, sm.GetScope().GetAttributes())
+			for _, metric := range sm.GetMetrics() {
+				c.convertMetric(ret, metric, scopeLabels)
+			}
+		}
+	}
+	return ret
+}
+
+func (c *Converter) convertMetric(ret *Result, metric *metricspb.Metric, labels tsdb.LabelList) {
+	name := metric.GetName()
+	if name == "" {
+		ret.reject(1, "metric without name")
+		return
+	}
+	switch data := metric.GetData().(type) {
+	case *metricspb.Metric_Gauge:
+		for _, dp := range data.Gauge.GetDataPoints() {
+			if noValue(dp.GetFlags()) {
+				continue
+			}
+			ret.add(name, attributesToLabels(labels, dp.GetAttributes()), c.timestamp(dp.GetTimeUnixNano()), numberValue(dp))
+		}
+	case *metricspb.Metric_Sum:
+		temporality := data.Sum.GetAggregationTemporality()
+		for _, dp := range data.Sum.GetDataPoints() {
+			if noValue(dp.GetFlags()) {
+				continue
+			}
+			dpLabels := attributesToLabels(labels, dp.GetAttributes())
+			ts, value := c.timestamp(dp.GetTimeUnixNano()), numberValue(dp)
+			switch temporality {
+			case metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE:
+			case metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA:
+				var ok bool
+				if value, ok = c.accumulateSum(name, dpLabels, ts, value); !ok {
+					ret.reject(1, fmt.Sprintf("out of order delta data point of %s", name))
+					continue
+				}
+			default:
+				ret.reject(1, fmt.Sprintf("unspecified aggregation temporality of %s", name))
+				continue
+			}
+			ret.add(name, dpLabels, ts, value)
+		}
+	case *metricspb.Metric_Histogram:
+		temporality := data.Histogram.GetAggregationTemporality()
+		for _, dp := range data.Histogram.GetDataPoints() {
+			if noValue(dp.GetFlags()) {
+				continue
+			}
+			dpLabels := attributesToLabels(labels, dp.GetAttributes())
+			ts := c.timestamp(dp.GetTimeUnixNano())
+			bounds, buckets, count, sum := dp.GetExplicitBounds(), dp.GetBucketCounts(), dp.GetCount(), dp.GetSum()
+			if len(buckets) > 0 && len(buckets) != len(bounds)+1 {
+				ret.reject(1, fmt.Sprintf("invalid bucket counts of %s", name))
+				continue
+			}
+			switch temporality {
+			case metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE:
+			case metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA:
+				state, ok := c.accumulateHistogram(name, dpLabels, ts, bounds, buckets, count, sum)
+				if !ok {
+					ret.reject(1, fmt.Sprintf("out of order delta data point of %s", name))
+					continue
+				}
+				buckets, count, sum = state.buckets, state.count, state.sum
+			default:
+				ret.reject(1, fmt.Sprintf("unspecified aggregation temporality of %s", name))
+				continue
+			}
+			var cumulative uint64
+			for i, bound := range bounds {
+				if i < len(buckets) {
+					cumulative += buckets[i]
+				}
+				ret.add(name+"_bucket", withLabel(dpLabels, bucketLabel, formatFloat(bound)), ts, float64(cumulative))
+			}
+			ret.add(name+"_bucket", withLabel(dpLabels, bucketLabel, "+Inf"), ts, float64(count))
+			ret.add(name+"_count", dpLabels, ts, float64(count))
+			if dp.Sum != nil {
+				ret.add(name+"_sum", dpLabels, ts, sum)
+			}
+		}
+	case *metricspb.Metric_ExponentialHistogram:
+		temporality := data.ExponentialHistogram.GetAggregationTemporality()
+		for _, dp := range data.ExponentialHistogram.GetDataPoints() {
+			if noValue(dp.GetFlags()) {
+				continue
+			}
+			dpLabels := attributesToLabels(labels, dp.GetAttributes())
+			ts := c.timestamp(dp.GetTimeUnixNano())
+			count, sum := dp.GetCount(), dp.GetSum()
+			switch temporality {
+			case metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE:
+			case metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA:
+				state, ok := c.accumulateHistogram(name, dpLabels, ts, nil, nil, count, sum)
+				if !ok {
+					ret.reject(1, fmt.Sprintf("out of order delta data point of %s", name))
+					continue
+				}
+				count, sum = state.count, state.sum
+			default:
+				ret.reject(1, fmt.Sprintf("unspecified aggregation temporality of %s", name))
+				continue
+			}
+			ret.add(name+"_count", dpLabels, ts, float64(count))
+			ret.add(name+"_sum", dpLabels, ts, sum)
+		}
+	case *metricspb.Metric_Summary:
+		for _, dp := range data.Summary.GetDataPoints() {
+			if noValue(dp.GetFlags()) {
+				continue
+			}
+			dpLabels := attributesToLabels(labels, dp.GetAttributes())
+			ts := c.timestamp(dp.GetTimeUnixNano())
+			for _, q := range dp.GetQuantileValues() {
+				ret.add(name, withLabel(dpLabels, quantileLabel, formatFloat(q.GetQuantile())), ts, q.GetValue())
+			}
+			ret.add(name+"_count", dpLabels, ts, float64(dp.GetCount()))
+			ret.add(name+"_sum", dpLabels, ts, dp.GetSum())
+		}
+	default:
+		ret.reject(1, fmt.Sprintf("unsupported metric type of %s", name))
+	}
+}
+
+// evictStale 删除超过staleness没有更新的累计值，每个staleness周期最多遍历一次
+func (c *Converter) evictStale() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.now()
+	if now.Sub(c.lastEvict) < c.staleness {
+		return
+	}
+	c.lastEvict = now
+	for key, state := range c.cumulative {
+		if now.Sub(state.updated) >= c.staleness {
+			delete(c.cumulative, key)
+		}
+	}
+}
+
+// accumulateSum 将delta值累加到时间线的累计值，时间戳不递增时返回false
+func (c *Converter) accumulateSum(name string, labels tsdb.LabelList, ts int64, value float64) (float64, bool) {
+	key := seriesKey(name, labels)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	state, ok := c.cumulative[key]
+	if !ok {
+		c.cumulative[key] = &cumulativeState{updated: c.now(), timestamp: ts, value: value}
+		return value, true
+	}
+	if ts <= state.timestamp {
+		return 0, false
+	}
+	state.updated = c.now()
+	state.timestamp = ts
+	state.value += value
+	return state.value, true
+}
+
+// accumulateHistogram 将delta的桶计数、数量和总和累加到时间线的累计值，桶的边界变化时重新开始累加
+func (c *Converter) accumulateHistogram(name string, labels tsdb.LabelList, ts int64, bounds []float64, buckets []uint64, count uint64, sum float64) (*cumulativeState, bool) {
+	key := seriesKey(name, labels)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	state, ok := c.cumulative[key]
+	if ok && ts <= state.timestamp {
+		return nil, false
+	}
+	if !ok || !equalBounds(state.bounds, bounds) || len(state.buckets) != len(buckets) {
+		state = &cumulativeState{
+			bounds:  append([]float64(nil), bounds...),
+			buckets: make([]uint64, len(buckets)),
+		}
+		c.cumulative[key] = state
+	}
+	state.updated = c.now()
+	state.timestamp = ts
+	for i, n := range buckets {
+		state.buckets[i] += n
+	}
+	state.count += count
+	state.sum += sum
+	// 返回副本，避免调用方读取时被并发修改
+	return &cumulativeState{
+		buckets: append([]uint64(nil), state.buckets...),
+		count:   state.count,
+		sum:     state.sum,
+	}, true
+}
+
+func (c *Converter) timestamp(unixNano uint64) int64 {
+	return c.precision.Convert(int64(unixNano), tsdb.PrecisionNanosecond)
+}
+
+func (ret *Result) add(metric string, labels tsdb.LabelList, ts int64, value float64) {
+	// 写入时会原地修改标签，每个row使用独立的标签
+	ret.Rows = append(ret.Rows, &tsdb.Row{
+		Metric: metric,
+		Labels: append(make(tsdb.LabelList, 0, len(labels)+1), labels...),
+		Point:  tsdb.Point{Timestamp: ts, Value: value},
+	})
+}
+
+func (ret *Result) reject(n int64, msg string) {
+	ret.Rejected += n
+	ret.Errors = append(ret.Errors, msg)
+}
+
+// attributesToLabels 将属性合并到base的副本中，同名时属性优先
+func attributesToLabels(base tsdb.LabelList, attrs []*commonpb.KeyValue) tsdb.LabelList {
+	labels := append(make(tsdb.LabelList, 0, len(base)+len(attrs)), base...)
+	for _, attr := range attrs {
+		labels = setLabel(labels, attr.GetKey(), anyValueString(attr.GetValue()))
+	}
+	return labels
+}
+
+func withLabel(labels tsdb.LabelList, name, value string) tsdb.LabelList {
+	return setLabel(append(make(tsdb.LabelList, 0, len(labels)+1), labels...), name, value)
+}
+
+func setLabel(labels tsdb.LabelList, name, value string) tsdb.LabelList {
+	for i := range labels {
+		if labels[i].Name == name {
+			labels[i].Value = value
+			return labels
+		}
+	}
+	return append(labels, tsdb.Label{Name: name, Value: value})
+}
+
+// anyValueString 将属性值转换为字符串，数组和键值对转换为类似JSON的格式
+func anyValueString(v *commonpb.AnyValue) string {
+	switch value := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return value.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(value.BoolValue)
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(value.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return formatFloat(value.DoubleValue)
+	case *commonpb.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(value.BytesValue)
+	case *commonpb.AnyValue_ArrayValue:
+		values := make([]string, 0, len(value.ArrayValue.GetValues()))
+		for _, item := range value.ArrayValue.GetValues() {
+			values = append(values, strconv.Quote(anyValueString(item)))
+		}
+		return "[" + strings.Join(values, ",") + "]"
+	case *commonpb.AnyValue_KvlistValue:
+		values := make([]string, 0, len(value.KvlistValue.GetValues()))
+		for _, kv := range value.KvlistValue.GetValues() {
+			values = append(values, strconv.Quote(kv.GetKey())+":"+strconv.Quote(anyValueString(kv.GetValue())))
+		}
+		sort.Strings(values)
+		return "{" + strings.Join(values, ",") + "}"
+	}
+	return ""
+}
+
+func numberValue(dp *metricspb.NumberDataPoint) float64 {
+	switch value := dp.GetValue().(type) {
+	case *metricspb.NumberDataPoint_AsDouble:
+		return value.AsDouble
+	case *metricspb.NumberDataPoint_AsInt:
+		return float64(value.AsInt)
+	}
+	return 0
+}
+
+// noValue 数据点带有NO_RECORDED_VALUE标记时没有值
+func noValue(flags uint32) bool {
+	return flags&uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK) != 0
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func equalBounds(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func seriesKey(name string, labels tsdb.LabelList) string {
+	sorted := append(tsdb.LabelList(nil), labels...)
+	sorted.Sorted()
+	return name + sorted.String()
+}
@@ -0,0 +1,293 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"tsdb"
+)
+
+const baseTime = uint64(1600000000) * 1e9
+
+func stringAttr(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func newRequest(metrics ...*metricspb.Metric) *colmetricspb.ExportMetricsServiceRequest {
+	return &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{stringAttr("service.name", "api"), stringAttr("host", "vm1")}},
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope:   &commonpb.InstrumentationScope{Name: "test", Attributes: []*commonpb.KeyValue{stringAttr("host", "vm2")}},
+				Metrics: metrics,
+			}},
+		}},
+	}
+}
+
+func sumMetric(name string, temporality metricspb.AggregationTemporality, ts uint64, value float64) *metricspb.Metric {
+	return &metricspb.Metric{
+		Name: name,
+		Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			AggregationTemporality: temporality,
+			IsMonotonic:            true,
+			DataPoints: []*metricspb.NumberDataPoint{{
+				Attributes:   []*commonpb.KeyValue{stringAttr("method", "GET")},
+				TimeUnixNano: ts,
+				Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+			}},
+		}},
+	}
+}
+
+func rowValues(rows []*tsdb.Row) map[string]float64 {
+	values := make(map[string]float64)
+	for _, row := range rows {
+		key := row.Metric
+		for _, label := range row.Labels {
+			if label.Name == bucketLabel {
+				key += "{le=" + label.Value + "}"
+			}
+		}
+		values[key] = row.Point.Value
+	}
+	return values
+}
+
+func TestConvert(t *testing.T) {
+	converter := NewConverter(tsdb.PrecisionSecond)
+	sum := 12.5
+	result := converter.Convert(newRequest(
+		&metricspb.Metric{
+			Name: "memory.used",
+			Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: []*metricspb.NumberDataPoint{
+				{TimeUnixNano: baseTime, Value: &metricspb.NumberDataPoint_AsInt{AsInt: 1024}},
+				{TimeUnixNano: baseTime, Flags: uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK)},
+			}}},
+		},
+		sumMetric("requests", metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, baseTime, 10),
+		sumMetric("errors", metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_UNSPECIFIED, baseTime, 1),
+		&metricspb.Metric{
+			Name: "latency",
+			Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				DataPoints: []*metricspb.HistogramDataPoint{{
+					TimeUnixNano:   baseTime,
+					Count:          6,
+					Sum:            &sum,
+					ExplicitBounds: []float64{0.1, 1},
+					BucketCounts:   []uint64{1, 2, 3},
+				}},
+			}},
+		},
+	))
+	if result.Rejected != 1 || len(result.Errors) != 1 {
+		t.Fatalf("unexpected rejected: %d %v", result.Rejected, result.Errors)
+	}
+	gauge := result.Rows[0]
+	if gauge.Metric != "memory.used" || gauge.Point.Timestamp != 1600000000 || gauge.Point.Value != 1024 {
+		t.Fatalf("unexpected row: %+v", gauge)
+	}
+	// 数据点的属性优先于scope的属性，scope的属性优先于resource的属性
+	labels := make(map[string]string)
+	for _, label := range result.Rows[1].Labels {
+		labels[label.Name] = label.Value
+	}
+	if len(labels) != 3 || labels["service.name"] != "api" || labels["host"] != "vm2" || labels["method"] != "GET" {
+		t.Fatalf("unexpected labels: %v", labels)
+	}
+	expected := map[string]float64{
+		"memory.used":             1024,
+		"requests":                10,
+		"latency_bucket{le=0.1}":  1,
+		"latency_bucket{le=1}":    3,
+		"latency_bucket{le=+Inf}": 6,
+		"latency_count":           6,
+		"latency_sum":             12.5,
+	}
+	values := rowValues(result.Rows)
+	if len(values) != len(expected) {
+		t.Fatalf("unexpected rows: %v", values)
+	}
+	for key, value := range expected {
+		if values[key] != value {
+			t.Fatalf("%s: expected %v, got %v", key, value, values[key])
+		}
+	}
+}
+
+func TestConvertDelta(t *testing.T) {
+	converter := NewConverter(tsdb.PrecisionSecond)
+	delta := metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+	histogram := func(ts uint64, buckets []uint64, sum float64) *metricspb.Metric {
+		count := uint64(0)
+		for _, n := range buckets {
+			count += n
+		}
+		return &metricspb.Metric{
+			Name: "latency",
+			Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+				AggregationTemporality: delta,
+				DataPoints: []*metricspb.HistogramDataPoint{{
+					TimeUnixNano:   ts,
+					Count:          count,
+					Sum:            &sum,
+					ExplicitBounds: []float64{1},
+					BucketCounts:   buckets,
+				}},
+			}},
+		}
+	}
+	converter.Convert(newRequest(sumMetric("requests", delta, baseTime, 3), histogram(baseTime, []uint64{1, 1}, 2)))
+	result := converter.Convert(newRequest(sumMetric("requests", delta, baseTime+60e9, 4), histogram(baseTime+60e9, []uint64{2, 0}, 1)))
+	expected := map[string]float64{
+		"requests":                7,
+		"latency_bucket{le=1}":    3,
+		"latency_bucket{le=+Inf}": 4,
+		"latency_count":           4,
+		"latency_sum":             3,
+	}
+	values := rowValues(result.Rows)
+	for key, value := range expected {
+		if values[key] != value {
+			t.Fatalf("%s: expected %v, got %v", key, value, values[key])
+		}
+	}
+
+	// 重复发送的delta数据点会被拒绝，不会重复累加
+	result = converter.Convert(newRequest(sumMetric("requests", delta, baseTime+60e9, 4)))
+	if result.Rejected != 1 || len(result.Rows) != 0 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}
+
+func TestConvertDeltaStale(t *testing.T) {
+	converter := NewConverter(tsdb.PrecisionSecond)
+	now := time.Now()
+	converter.now = func() time.Time {
+		return now
+	}
+	delta := metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+	converter.Convert(newRequest(sumMetric("requests", delta, baseTime, 3), sumMetric("errors", delta, baseTime, 1)))
+
+	// 只有requests继续更新
+	now = now.Add(defaultStaleness / 2)
+	result := converter.Convert(newRequest(sumMetric("requests", delta, baseTime+60e9, 4)))
+	if values := rowValues(result.Rows); values["requests"] != 7 {
+		t.Fatalf("unexpected rows: %v", values)
+	}
+
+	now = now.Add(defaultStaleness / 2)
+	result = converter.Convert(newRequest(sumMetric("requests", delta, baseTime+120e9, 1), sumMetric("errors", delta, baseTime+120e9, 2)))
+	values := rowValues(result.Rows)
+	if values["requests"] != 8 || values["errors"] != 2 {
+		t.Fatalf("unexpected rows: %v", values)
+	}
+	if len(converter.cumulative) != 2 {
+		t.Fatalf("expected 2 series, got %d", len(converter.cumulative))
+	}
+}
+
+func openDB(t *testing.T) *tsdb.TSDB {
+	db, err := tsdb.Open(tsdb.WithDataPath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close(context.Background())
+	})
+	return db
+}
+
+func TestGRPC(t *testing.T) {
+	db := openDB(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	NewServer(db).RegisterGRPC(server)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := colmetricspb.NewMetricsServiceClient(conn)
+	resp, err := client.Export(context.Background(), newRequest(
+		sumMetric("requests", metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, baseTime, 10),
+		sumMetric("errors", metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_UNSPECIFIED, baseTime, 1),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetPartialSuccess().GetRejectedDataPoints() != 1 {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+	seriesList, err := db.QueryRange("requests", []*tsdb.Matcher{tsdb.MustNewMatcher(tsdb.MatchEqual, "service.name", "api")}, 1600000000, 1600000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 || seriesList[0].Points[0].Value != 10 {
+		t.Fatalf("unexpected result: %+v", seriesList)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	db := openDB(t)
+	mux := http.NewServeMux()
+	NewServer(db).Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	body, err := protojson.Marshal(newRequest(sumMetric("requests", metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, baseTime, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(server.URL+"/v1/metrics", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != contentTypeJSON {
+		t.Fatalf("unexpected response: %d %s", resp.StatusCode, data)
+	}
+	exportResp := &colmetricspb.ExportMetricsServiceResponse{}
+	if err := protojson.Unmarshal(data, exportResp); err != nil {
+		t.Fatal(err)
+	}
+	if exportResp.PartialSuccess != nil {
+		t.Fatalf("unexpected response: %s", data)
+	}
+	seriesList, err := db.QueryRange("requests", nil, 1600000000, 1600000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 {
+		t.Fatalf("unexpected result: %+v", seriesList)
+	}
+
+	resp, err = http.Post(server.URL+"/v1/metrics", "text/plain", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected status %d, got %d", http.StatusUnsupportedMediaType, resp.StatusCode)
+	}
+}
@@ -0,0 +1,167 @@
+package otlp
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip" // 支持gzip压缩的gRPC请求
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"strings"
+	"tsdb"
+)
+
+const (
+	maxBodySize = 32 << 20 // 解压后请求体的最大字节数
+
+	contentTypeProtobuf = "application/x-protobuf"
+	contentTypeJSON     = "application/json"
+)
+
+// Server 实现OTLP的MetricsService，同时提供HTTP的/v1/metrics接口，
+// 数据同步写入数据库，转换或写入失败的数据点通过partial_success返回
+type Server struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+
+	db        *tsdb.TSDB
+	converter *Converter
+}
+
+func NewServer(db *tsdb.TSDB) *Server {
+	return &Server{
+		db:        db,
+		converter: NewConverter(db.Precision()),
+	}
+}
+
+// RegisterGRPC 注册gRPC服务
+func (s *Server) RegisterGRPC(server *grpc.Server) {
+	colmetricspb.RegisterMetricsServiceServer(server, s)
+}
+
+// Register 注册HTTP接口
+func (s *Server) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/v1/metrics", s.handleHTTP)
+}
+
+func (s *Server) Export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	resp, err := s.export(ctx, req)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return resp, nil
+}
+
+func (s *Server) export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	result := s.converter.Convert(req)
+	if len(result.Rows) > 0 {
+		errs, err := s.db.InsertRowsSync(ctx, result.Rows)
+		if err != nil {
+			logrus.Errorf("failed to insert otlp rows, err: %v", err)
+			return nil, err
+		}
+		for i, err := range errs {
+			if err != nil {
+				result.reject(1, fmt.Sprintf("%s: %v", result.Rows[i].Metric, err))
+			}
+		}
+	}
+	resp := &colmetricspb.ExportMetricsServiceResponse{}
+	if result.Rejected > 0 {
+		resp.PartialSuccess = &colmetricspb.ExportMetricsPartialSuccess{
+			RejectedDataPoints: result.Rejected,
+			ErrorMessage:       summarizeErrors(result.Errors),
+		}
+	}
+	return resp, nil
+}
+
+// handleHTTP 按Content-Type解析protobuf或JSON格式的请求，并以相同的格式返回
+func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	contentType := r.Header.Get("Content-Type")
+	isJSON := strings.HasPrefix(contentType, contentTypeJSON)
+	if !isJSON && !strings.HasPrefix(contentType, contentTypeProtobuf) {
+		http.Error(w, fmt.Sprintf("unsupported content type: %s", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+	data, err := readBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &colmetricspb.ExportMetricsServiceRequest{}
+	if isJSON {
+		err = protojson.Unmarshal(data, req)
+	} else {
+		err = proto.Unmarshal(data, req)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to unmarshal request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := s.export(r.Context(), req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	var body []byte
+	if isJSON {
+		body, err = protojson.Marshal(resp)
+	} else {
+		body, err = proto.Marshal(resp)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if isJSON {
+		w.Header().Set("Content-Type", contentTypeJSON)
+	} else {
+		w.Header().Set("Content-Type", contentTypeProtobuf)
+	}
+	if _, err := w.Write(body); err != nil {
+		logrus.Errorf("failed to write otlp response, err: %v", err)
+	}
+}
+
+func readBody(r *http.Request) ([]byte, error) {
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip body: %v", err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %v", err)
+	}
+	if len(data) > maxBodySize {
+		return nil, fmt.Errorf("body exceeds %d bytes", maxBodySize)
+	}
+	return data, nil
+}
+
+// summarizeErrors 最多返回前10个错误
+func summarizeErrors(errs []string) string {
+	const maxErrors = 10
+	if len(errs) <= maxErrors {
+		return strings.Join(errs, "; ")
+	}
+	return fmt.Sprintf("%s; and %d more errors", strings.Join(errs[:maxErrors], "; "), len(errs)-maxErrors)
+}
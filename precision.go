@@ -0,0 +1,91 @@
+package tsdb
+
+import (
+	"fmt"
+	"time"
+)
+
+// TimestampPrecision 数据点时间戳的精度
+type TimestampPrecision int8
+
+const (
+	// PrecisionSecond Unix秒
+	PrecisionSecond TimestampPrecision = iota
+
+	// PrecisionMillisecond Unix毫秒，与Prometheus一致
+	PrecisionMillisecond
+
+	// PrecisionMicrosecond Unix微秒
+	PrecisionMicrosecond
+
+	// PrecisionNanosecond Unix纳秒
+	PrecisionNanosecond
+)
+
+func (p TimestampPrecision) String() string {
+	switch p {
+	case PrecisionSecond:
+		return "s"
+	case PrecisionMillisecond:
+		return "ms"
+	case PrecisionMicrosecond:
+		return "us"
+	case PrecisionNanosecond:
+		return "ns"
+	}
+	return fmt.Sprintf("unknown(%d)", int8(p))
+}
+
+// Unit 返回一个时间戳单位对应的时长
+func (p TimestampPrecision) Unit() time.Duration {
+	switch p {
+	case PrecisionMillisecond:
+		return time.Millisecond
+	case PrecisionMicrosecond:
+		return time.Microsecond
+	case PrecisionNanosecond:
+		return time.Nanosecond
+	}
+	return time.Second
+}
+
+func (p TimestampPrecision) valid() bool {
+	return p >= PrecisionSecond && p <= PrecisionNanosecond
+}
+
+// FromDuration 将时长转换为当前精度下的时间戳差值
+func (p TimestampPrecision) FromDuration(d time.Duration) int64 {
+	return int64(d / p.Unit())
+}
+
+// ToDuration 将当前精度下的时间戳差值转换为时长
+func (p TimestampPrecision) ToDuration(delta int64) time.Duration {
+	return time.Duration(delta) * p.Unit()
+}
+
+// FromTime 将时间转换为当前精度下的时间戳
+func (p TimestampPrecision) FromTime(t time.Time) int64 {
+	return t.UnixNano() / int64(p.Unit())
+}
+
+// ToTime 将当前精度下的时间戳转换为时间
+func (p TimestampPrecision) ToTime(ts int64) time.Time {
+	switch p {
+	case PrecisionMillisecond:
+		return time.UnixMilli(ts)
+	case PrecisionMicrosecond:
+		return time.UnixMicro(ts)
+	case PrecisionNanosecond:
+		return time.Unix(0, ts)
+	}
+	return time.Unix(ts, 0)
+}
+
+// Convert 将时间戳从precision转换为当前精度
+func (p TimestampPrecision) Convert(ts int64, precision TimestampPrecision) int64 {
+	from, to := int64(precision.Unit()), int64(p.Unit())
+	if from >= to {
+		return ts * (from / to)
+	}
+	return ts / (to / from)
+}
@@ -0,0 +1,155 @@
+package prompb
+
+import (
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"math"
+)
+
+// protobuf的wire type
+const (
+	wireVarint  = int(protowire.VarintType)
+	wireFixed64 = int(protowire.Fixed64Type)
+	wireBytes   = int(protowire.BytesType)
+	wireFixed32 = int(protowire.Fixed32Type)
+)
+
+var (
+	ErrTruncated = errors.New("prompb: unexpected end of message")
+	ErrOverflow  = errors.New("prompb: varint overflow")
+)
+
+type decoder struct {
+	b []byte
+}
+
+// decodeMessage 依次读取消息中的字段，fn负责读取字段的值，不需要的字段调用skip跳过
+func decodeMessage(data []byte, fn func(d *decoder, field int, wireType int) error) error {
+	d := &decoder{b: data}
+	for len(d.b) > 0 {
+		field, wireType, n := protowire.ConsumeTag(d.b)
+		if n < 0 {
+			return parseError(n)
+		}
+		d.b = d.b[n:]
+		if err := fn(d, int(field), int(wireType)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseError 将protowire的错误码转换为error
+func parseError(n int) error {
+	err := protowire.ParseError(n)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrTruncated
+	}
+	return fmt.Errorf("prompb: %v", err)
+}
+
+func (d *decoder) varint() (uint64, error) {
+	v, n := protowire.ConsumeVarint(d.b)
+	if n < 0 {
+		// varint只会出现长度不足和溢出两种错误
+		if err := parseError(n); err != ErrTruncated {
+			return 0, ErrOverflow
+		}
+		return 0, ErrTruncated
+	}
+	d.b = d.b[n:]
+	return v, nil
+}
+
+func (d *decoder) fixed64() (uint64, error) {
+	v, n := protowire.ConsumeFixed64(d.b)
+	if n < 0 {
+		return 0, parseError(n)
+	}
+	d.b = d.b[n:]
+	return v, nil
+}
+
+func (d *decoder) double() (float64, error) {
+	v, err := d.fixed64()
+	return math.Float64frombits(v), err
+}
+
+// bytes 读取length-delimited类型的值，返回的切片引用原始数据
+func (d *decoder) bytes() ([]byte, error) {
+	b, n := protowire.ConsumeBytes(d.b)
+	if n < 0 {
+		return nil, parseError(n)
+	}
+	d.b = d.b[n:]
+	return b, nil
+}
+
+func (d *decoder) skip(wireType int) error {
+	switch wireType {
+	case wireVarint, wireFixed64, wireBytes, wireFixed32:
+	default:
+		return fmt.Errorf("prompb: unsupported wire type %d", wireType)
+	}
+	n := protowire.ConsumeFieldValue(0, protowire.Type(wireType), d.b)
+	if n < 0 {
+		return parseError(n)
+	}
+	d.b = d.b[n:]
+	return nil
+}
+
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) int64(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	e.b = protowire.AppendTag(e.b, protowire.Number(field), protowire.VarintType)
+	e.b = protowire.AppendVarint(e.b, uint64(v))
+}
+
+func (e *encoder) double(field int, v float64) {
+	if v == 0 && !math.Signbit(v) {
+		return
+	}
+	e.b = protowire.AppendTag(e.b, protowire.Number(field), protowire.Fixed64Type)
+	e.b = protowire.AppendFixed64(e.b, math.Float64bits(v))
+}
+
+func (e *encoder) string(field int, v string) {
+	if v == "" {
+		return
+	}
+	e.b = protowire.AppendTag(e.b, protowire.Number(field), protowire.BytesType)
+	e.b = protowire.AppendString(e.b, v)
+}
+
+// message 写入嵌套的消息，空消息也需要写入以保留repeated字段中的元素
+func (e *encoder) message(field int, b []byte) {
+	e.b = protowire.AppendTag(e.b, protowire.Number(field), protowire.BytesType)
+	e.b = protowire.AppendBytes(e.b, b)
+}
+
+func (e *encoder) bytes(field int, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	e.message(field, v)
+}
+
+// packedVarints 写入packed编码的repeated varint字段
+func (e *encoder) packedVarints(field int, values []uint64) {
+	if len(values) == 0 {
+		return
+	}
+	packed := make([]byte, 0, len(values))
+	for _, v := range values {
+		packed = protowire.AppendVarint(packed, v)
+	}
+	e.message(field, packed)
+}
@@ -0,0 +1,109 @@
+package prompb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// 以下数据由google.golang.org/protobuf按照prometheus/prompb中remote.proto、types.proto的字段定义编码
+const (
+	goldenWriteRequest        = "0a5e0a1f0a085f5f6e616d655f5f1213687474705f72657175657374735f746f74616c0a0a0a036a6f621203617069121009000000000000f83f108080babbc82e12140900000000000000c010ffffffffffffffffff0112071098f5babbc82e"
+	goldenReadRequest         = "0a41088080babbc82e10e0a7ccbbc82e1a1f12085f5f6e616d655f5f1a13687474705f72657175657374735f746f74616c1a10080212036a6f621a076170697c77656212020100"
+	goldenReadResponse        = "0a600a5e0a1f0a085f5f6e616d655f5f1213687474705f72657175657374735f746f74616c0a0a0a036a6f621203617069121009000000000000f83f108080babbc82e12140900000000000000c010ffffffffffffffffff0112071098f5babbc82e"
+	goldenChunkedReadResponse = "0a280a0e0a085f5f6e616d655f5f120275701216088080babbc82e10e0d4bdbbc82e18012204000102ff1003"
+)
+
+type message interface {
+	Marshal() []byte
+	Unmarshal(data []byte) error
+}
+
+func goldenTimeSeries() TimeSeries {
+	return TimeSeries{
+		Labels: []Label{{Name: "__name__", Value: "http_requests_total"}, {Name: "job", Value: "api"}},
+		Samples: []Sample{
+			{Value: 1.5, Timestamp: 1600000000000},
+			{Value: -2, Timestamp: -1},
+			{Value: 0, Timestamp: 1600000015000},
+		},
+	}
+}
+
+func TestGoldenPayloads(t *testing.T) {
+	ts := goldenTimeSeries()
+	cases := []struct {
+		golden   string
+		expected message
+		decoded  message
+	}{
+		{goldenWriteRequest, &WriteRequest{Timeseries: []TimeSeries{ts}}, &WriteRequest{}},
+		{goldenReadRequest, &ReadRequest{
+			Queries: []*Query{{
+				StartTimestampMs: 1600000000000,
+				EndTimestampMs:   1600000300000,
+				Matchers: []*LabelMatcher{
+					{Type: LabelMatcher_EQ, Name: "__name__", Value: "http_requests_total"},
+					{Type: LabelMatcher_RE, Name: "job", Value: "api|web"},
+				},
+			}},
+			AcceptedResponseTypes: []ReadRequest_ResponseType{ReadRequest_STREAMED_XOR_CHUNKS, ReadRequest_SAMPLES},
+		}, &ReadRequest{}},
+		{goldenReadResponse, &ReadResponse{Results: []*QueryResult{{Timeseries: []*TimeSeries{&ts}}}}, &ReadResponse{}},
+		{goldenChunkedReadResponse, &ChunkedReadResponse{
+			ChunkedSeries: []*ChunkedSeries{{
+				Labels: []Label{{Name: "__name__", Value: "up"}},
+				Chunks: []Chunk{{MinTimeMs: 1600000000000, MaxTimeMs: 1600000060000, Type: Chunk_XOR, Data: []byte{0x00, 0x01, 0x02, 0xff}}},
+			}},
+			QueryIndex: 3,
+		}, &ChunkedReadResponse{}},
+	}
+	for _, c := range cases {
+		golden, err := hex.DecodeString(c.golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data := c.expected.Marshal(); !bytes.Equal(data, golden) {
+			t.Fatalf("%T: marshal mismatch\nexpected: %x\ngot:      %x", c.expected, golden, data)
+		}
+		if err := c.decoded.Unmarshal(golden); err != nil {
+			t.Fatalf("%T: %v", c.decoded, err)
+		}
+		if !reflect.DeepEqual(c.decoded, c.expected) {
+			t.Fatalf("%T: unmarshal mismatch\nexpected: %+v\ngot:      %+v", c.decoded, c.expected, c.decoded)
+		}
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	golden, err := hex.DecodeString(goldenWriteRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 未知字段需要跳过: field 3 bytes, field 15 varint, field 4 fixed32, field 5 fixed64
+	unknown := []byte{0x1a, 0x02, 0x01, 0x02, 0x78, 0x96, 0x01, 0x25, 0x01, 0x02, 0x03, 0x04, 0x29, 1, 2, 3, 4, 5, 6, 7, 8}
+	req := &WriteRequest{}
+	if err := req.Unmarshal(append(append([]byte{}, golden...), unknown...)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(req, &WriteRequest{Timeseries: []TimeSeries{goldenTimeSeries()}}) {
+		t.Fatalf("unexpected request: %+v", req)
+	}
+
+	if err := (&WriteRequest{}).Unmarshal(golden[:len(golden)-1]); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expected %v, got %v", ErrTruncated, err)
+	}
+	truncated := []byte{0x0a, 0x04, 0x12, 0x02, 0x10, 0xff}
+	if err := (&WriteRequest{}).Unmarshal(truncated); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expected %v, got %v", ErrTruncated, err)
+	}
+	overflow := append([]byte{0x10}, bytes.Repeat([]byte{0xff}, 10)...)
+	if err := (&Sample{}).Unmarshal(overflow); !errors.Is(err, ErrOverflow) {
+		t.Fatalf("expected %v, got %v", ErrOverflow, err)
+	}
+	if err := (&WriteRequest{}).Unmarshal([]byte{0x00}); err == nil {
+		t.Fatal("field number 0 should be rejected")
+	}
+}
@@ -0,0 +1,344 @@
+package prompb
+
+// ReadRequest_ResponseType 客户端可以接受的响应类型
+type ReadRequest_ResponseType int32
+
+const (
+	// ReadRequest_SAMPLES 返回snappy压缩的ReadResponse
+	ReadRequest_SAMPLES ReadRequest_ResponseType = 0
+	// ReadRequest_STREAMED_XOR_CHUNKS 以流的方式返回多个ChunkedReadResponse
+	ReadRequest_STREAMED_XOR_CHUNKS ReadRequest_ResponseType = 1
+)
+
+type LabelMatcher_Type int32
+
+const (
+	LabelMatcher_EQ  LabelMatcher_Type = 0
+	LabelMatcher_NEQ LabelMatcher_Type = 1
+	LabelMatcher_RE  LabelMatcher_Type = 2
+	LabelMatcher_NRE LabelMatcher_Type = 3
+)
+
+type Chunk_Encoding int32
+
+const (
+	Chunk_UNKNOWN Chunk_Encoding = 0
+	Chunk_XOR     Chunk_Encoding = 1
+)
+
+// ReadRequest remote_read请求
+type ReadRequest struct {
+	Queries               []*Query
+	AcceptedResponseTypes []ReadRequest_ResponseType
+}
+
+// Query 一个查询，时间戳单位为毫秒
+type Query struct {
+	StartTimestampMs int64
+	EndTimestampMs   int64
+	Matchers         []*LabelMatcher
+}
+
+type LabelMatcher struct {
+	Type  LabelMatcher_Type
+	Name  string
+	Value string
+}
+
+// ReadResponse 与请求中的Queries一一对应的查询结果
+type ReadResponse struct {
+	Results []*QueryResult
+}
+
+type QueryResult struct {
+	Timeseries []*TimeSeries
+}
+
+// ChunkedReadResponse 流式响应中的一帧，包含第QueryIndex个查询的部分时间线
+type ChunkedReadResponse struct {
+	ChunkedSeries []*ChunkedSeries
+	QueryIndex    int64
+}
+
+type ChunkedSeries struct {
+	Labels []Label
+	Chunks []Chunk
+}
+
+// Chunk 编码后的数据块，时间戳单位为毫秒
+type Chunk struct {
+	MinTimeMs int64
+	MaxTimeMs int64
+	Type      Chunk_Encoding
+	Data      []byte
+}
+
+func (m *ReadRequest) Unmarshal(data []byte) error {
+	return decodeMessage(data, func(d *decoder, field int, wireType int) error {
+		switch {
+		case field == 1 && wireType == wireBytes:
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			query := &Query{}
+			if err := query.Unmarshal(b); err != nil {
+				return err
+			}
+			m.Queries = append(m.Queries, query)
+			return nil
+		case field == 2 && wireType == wireVarint:
+			v, err := d.varint()
+			m.AcceptedResponseTypes = append(m.AcceptedResponseTypes, ReadRequest_ResponseType(v))
+			return err
+		case field == 2 && wireType == wireBytes:
+			// packed repeated enum
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			packed := &decoder{b: b}
+			for len(packed.b) > 0 {
+				v, err := packed.varint()
+				if err != nil {
+					return err
+				}
+				m.AcceptedResponseTypes = append(m.AcceptedResponseTypes, ReadRequest_ResponseType(v))
+			}
+			return nil
+		}
+		return d.skip(wireType)
+	})
+}
+
+func (m *ReadRequest) Marshal() []byte {
+	e := &encoder{}
+	for _, query := range m.Queries {
+		e.message(1, query.Marshal())
+	}
+	types := make([]uint64, 0, len(m.AcceptedResponseTypes))
+	for _, typ := range m.AcceptedResponseTypes {
+		types = append(types, uint64(typ))
+	}
+	e.packedVarints(2, types)
+	return e.b
+}
+
+func (m *Query) Unmarshal(data []byte) error {
+	return decodeMessage(data, func(d *decoder, field int, wireType int) error {
+		switch {
+		case field == 1 && wireType == wireVarint:
+			v, err := d.varint()
+			m.StartTimestampMs = int64(v)
+			return err
+		case field == 2 && wireType == wireVarint:
+			v, err := d.varint()
+			m.EndTimestampMs = int64(v)
+			return err
+		case field == 3 && wireType == wireBytes:
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			matcher := &LabelMatcher{}
+			if err := matcher.Unmarshal(b); err != nil {
+				return err
+			}
+			m.Matchers = append(m.Matchers, matcher)
+			return nil
+		}
+		return d.skip(wireType)
+	})
+}
+
+func (m *Query) Marshal() []byte {
+	e := &encoder{}
+	e.int64(1, m.StartTimestampMs)
+	e.int64(2, m.EndTimestampMs)
+	for _, matcher := range m.Matchers {
+		e.message(3, matcher.Marshal())
+	}
+	return e.b
+}
+
+func (m *LabelMatcher) Unmarshal(data []byte) error {
+	return decodeMessage(data, func(d *decoder, field int, wireType int) error {
+		switch {
+		case field == 1 && wireType == wireVarint:
+			v, err := d.varint()
+			m.Type = LabelMatcher_Type(v)
+			return err
+		case (field == 2 || field == 3) && wireType == wireBytes:
+			b, err := d.bytes()
+			if field == 2 {
+				m.Name = string(b)
+			} else {
+				m.Value = string(b)
+			}
+			return err
+		}
+		return d.skip(wireType)
+	})
+}
+
+func (m *LabelMatcher) Marshal() []byte {
+	e := &encoder{}
+	e.int64(1, int64(m.Type))
+	e.string(2, m.Name)
+	e.string(3, m.Value)
+	return e.b
+}
+
+func (m *ReadResponse) Unmarshal(data []byte) error {
+	return decodeMessage(data, func(d *decoder, field int, wireType int) error {
+		if field != 1 || wireType != wireBytes {
+			return d.skip(wireType)
+		}
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		result := &QueryResult{}
+		if err := result.Unmarshal(b); err != nil {
+			return err
+		}
+		m.Results = append(m.Results, result)
+		return nil
+	})
+}
+
+func (m *ReadResponse) Marshal() []byte {
+	e := &encoder{}
+	for _, result := range m.Results {
+		e.message(1, result.Marshal())
+	}
+	return e.b
+}
+
+func (m *QueryResult) Unmarshal(data []byte) error {
+	return decodeMessage(data, func(d *decoder, field int, wireType int) error {
+		if field != 1 || wireType != wireBytes {
+			return d.skip(wireType)
+		}
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		ts := &TimeSeries{}
+		if err := ts.Unmarshal(b); err != nil {
+			return err
+		}
+		m.Timeseries = append(m.Timeseries, ts)
+		return nil
+	})
+}
+
+func (m *QueryResult) Marshal() []byte {
+	e := &encoder{}
+	for _, ts := range m.Timeseries {
+		e.message(1, ts.Marshal())
+	}
+	return e.b
+}
+
+func (m *ChunkedReadResponse) Unmarshal(data []byte) error {
+	return decodeMessage(data, func(d *decoder, field int, wireType int) error {
+		switch {
+		case field == 1 && wireType == wireBytes:
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			series := &ChunkedSeries{}
+			if err := series.Unmarshal(b); err != nil {
+				return err
+			}
+			m.ChunkedSeries = append(m.ChunkedSeries, series)
+			return nil
+		case field == 2 && wireType == wireVarint:
+			v, err := d.varint()
+			m.QueryIndex = int64(v)
+			return err
+		}
+		return d.skip(wireType)
+	})
+}
+
+func (m *ChunkedReadResponse) Marshal() []byte {
+	e := &encoder{}
+	for _, series := range m.ChunkedSeries {
+		e.message(1, series.Marshal())
+	}
+	e.int64(2, m.QueryIndex)
+	return e.b
+}
+
+func (m *ChunkedSeries) Unmarshal(data []byte) error {
+	return decodeMessage(data, func(d *decoder, field int, wireType int) error {
+		if wireType != wireBytes || (field != 1 && field != 2) {
+			return d.skip(wireType)
+		}
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		if field == 1 {
+			label := Label{}
+			if err := label.Unmarshal(b); err != nil {
+				return err
+			}
+			m.Labels = append(m.Labels, label)
+			return nil
+		}
+		chunk := Chunk{}
+		if err := chunk.Unmarshal(b); err != nil {
+			return err
+		}
+		m.Chunks = append(m.Chunks, chunk)
+		return nil
+	})
+}
+
+func (m *ChunkedSeries) Marshal() []byte {
+	e := &encoder{}
+	for i := range m.Labels {
+		e.message(1, m.Labels[i].Marshal())
+	}
+	for i := range m.Chunks {
+		e.message(2, m.Chunks[i].Marshal())
+	}
+	return e.b
+}
+
+func (m *Chunk) Unmarshal(data []byte) error {
+	return decodeMessage(data, func(d *decoder, field int, wireType int) error {
+		switch {
+		case field == 1 && wireType == wireVarint:
+			v, err := d.varint()
+			m.MinTimeMs = int64(v)
+			return err
+		case field == 2 && wireType == wireVarint:
+			v, err := d.varint()
+			m.MaxTimeMs = int64(v)
+			return err
+		case field == 3 && wireType == wireVarint:
+			v, err := d.varint()
+			m.Type = Chunk_Encoding(v)
+			return err
+		case field == 4 && wireType == wireBytes:
+			b, err := d.bytes()
+			m.Data = append([]byte(nil), b...)
+			return err
+		}
+		return d.skip(wireType)
+	})
+}
+
+func (m *Chunk) Marshal() []byte {
+	e := &encoder{}
+	e.int64(1, m.MinTimeMs)
+	e.int64(2, m.MaxTimeMs)
+	e.int64(3, int64(m.Type))
+	e.bytes(4, m.Data)
+	return e.b
+}
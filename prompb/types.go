@@ -0,0 +1,141 @@
+// Package prompb 实现Prometheus远程读写协议中用到的protobuf消息，只包含需要的字段。
+//
+// Prometheus的prompb使用gogoproto生成，TimeSeries中的Labels、Samples是值切片，protoc-gen-go无法生成相同的结构，
+// 而且生成代码需要在构建中引入protoc，所以消息结构手写，wire格式的编解码使用与otlp相同的google.golang.org/protobuf中的protowire。
+// 字段编号与prometheus/prompb中的remote.proto、types.proto一致，codec_test.go使用protobuf官方库按照proto定义编码的数据校验
+package prompb
+
+// WriteRequest remote_write请求
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+// TimeSeries 一条时间线及其数据点
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample 一个数据点，时间戳单位为毫秒
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// Unmarshal 解析protobuf编码的WriteRequest
+func (m *WriteRequest) Unmarshal(data []byte) error {
+	return decodeMessage(data, func(d *decoder, field int, wireType int) error {
+		if field != 1 || wireType != wireBytes {
+			return d.skip(wireType)
+		}
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		ts := TimeSeries{}
+		if err := ts.Unmarshal(b); err != nil {
+			return err
+		}
+		m.Timeseries = append(m.Timeseries, ts)
+		return nil
+	})
+}
+
+// Marshal 编码为protobuf格式
+func (m *WriteRequest) Marshal() []byte {
+	e := &encoder{}
+	for i := range m.Timeseries {
+		e.message(1, m.Timeseries[i].Marshal())
+	}
+	return e.b
+}
+
+func (m *TimeSeries) Unmarshal(data []byte) error {
+	return decodeMessage(data, func(d *decoder, field int, wireType int) error {
+		if wireType != wireBytes || (field != 1 && field != 2) {
+			return d.skip(wireType)
+		}
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		if field == 1 {
+			label := Label{}
+			if err := label.Unmarshal(b); err != nil {
+				return err
+			}
+			m.Labels = append(m.Labels, label)
+			return nil
+		}
+		sample := Sample{}
+		if err := sample.Unmarshal(b); err != nil {
+			return err
+		}
+		m.Samples = append(m.Samples, sample)
+		return nil
+	})
+}
+
+func (m *TimeSeries) Marshal() []byte {
+	e := &encoder{}
+	for i := range m.Labels {
+		e.message(1, m.Labels[i].Marshal())
+	}
+	for i := range m.Samples {
+		e.message(2, m.Samples[i].Marshal())
+	}
+	return e.b
+}
+
+func (m *Label) Unmarshal(data []byte) error {
+	return decodeMessage(data, func(d *decoder, field int, wireType int) error {
+		if wireType != wireBytes || (field != 1 && field != 2) {
+			return d.skip(wireType)
+		}
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		if field == 1 {
+			m.Name = string(b)
+		} else {
+			m.Value = string(b)
+		}
+		return nil
+	})
+}
+
+func (m *Label) Marshal() []byte {
+	e := &encoder{}
+	e.string(1, m.Name)
+	e.string(2, m.Value)
+	return e.b
+}
+
+func (m *Sample) Unmarshal(data []byte) error {
+	return decodeMessage(data, func(d *decoder, field int, wireType int) error {
+		switch {
+		case field == 1 && wireType == wireFixed64:
+			v, err := d.double()
+			m.Value = v
+			return err
+		case field == 2 && wireType == wireVarint:
+			v, err := d.varint()
+			m.Timestamp = int64(v)
+			return err
+		}
+		return d.skip(wireType)
+	})
+}
+
+func (m *Sample) Marshal() []byte {
+	e := &encoder{}
+	e.double(1, m.Value)
+	e.int64(2, m.Timestamp)
+	return e.b
+}
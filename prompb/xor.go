@@ -0,0 +1,128 @@
+package prompb
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// XORChunkEncoder 按Prometheus的XOR格式编码数据块: | 数据点数量 uint16 大端 | 比特流 |，
+// 时间戳单位为毫秒，与Prometheus的chunkenc.XORChunk兼容
+type XORChunkEncoder struct {
+	b        []byte
+	count    int // 写入比特流的比特数
+	num      uint16
+	t        int64
+	tDelta   uint64
+	v        float64
+	leading  uint8
+	trailing uint8
+}
+
+func NewXORChunkEncoder() *XORChunkEncoder {
+	return &XORChunkEncoder{
+		b:       make([]byte, 2, 128),
+		leading: 0xff,
+	}
+}
+
+// Append 追加一个数据点，时间戳需要递增
+func (c *XORChunkEncoder) Append(t int64, v float64) {
+	switch c.num {
+	case 0:
+		var buf [binary.MaxVarintLen64]byte
+		for _, b := range buf[:binary.PutVarint(buf[:], t)] {
+			c.writeBits(uint64(b), 8)
+		}
+		c.writeBits(math.Float64bits(v), 64)
+	case 1:
+		tDelta := uint64(t - c.t)
+		var buf [binary.MaxVarintLen64]byte
+		for _, b := range buf[:binary.PutUvarint(buf[:], tDelta)] {
+			c.writeBits(uint64(b), 8)
+		}
+		c.writeValue(v)
+		c.tDelta = tDelta
+	default:
+		tDelta := uint64(t - c.t)
+		dod := int64(tDelta - c.tDelta)
+		switch {
+		case dod == 0:
+			c.writeBits(0, 1)
+		case bitRange(dod, 14):
+			c.writeBits(0b10, 2)
+			c.writeBits(uint64(dod), 14)
+		case bitRange(dod, 17):
+			c.writeBits(0b110, 3)
+			c.writeBits(uint64(dod), 17)
+		case bitRange(dod, 20):
+			c.writeBits(0b1110, 4)
+			c.writeBits(uint64(dod), 20)
+		default:
+			c.writeBits(0b1111, 4)
+			c.writeBits(uint64(dod), 64)
+		}
+		c.writeValue(v)
+		c.tDelta = tDelta
+	}
+	c.t = t
+	c.v = v
+	c.num++
+	binary.BigEndian.PutUint16(c.b[:2], c.num)
+}
+
+// NumSamples 返回数据点数量
+func (c *XORChunkEncoder) NumSamples() int {
+	return int(c.num)
+}
+
+// Bytes 返回编码后的数据块
+func (c *XORChunkEncoder) Bytes() []byte {
+	return c.b
+}
+
+func (c *XORChunkEncoder) writeValue(v float64) {
+	delta := math.Float64bits(v) ^ math.Float64bits(c.v)
+	if delta == 0 {
+		c.writeBits(0, 1)
+		return
+	}
+	c.writeBits(1, 1)
+
+	leading := uint8(bits.LeadingZeros64(delta))
+	trailing := uint8(bits.TrailingZeros64(delta))
+	// 前导零的数量只用5个比特存储
+	if leading >= 32 {
+		leading = 31
+	}
+	if c.leading != 0xff && leading >= c.leading && trailing >= c.trailing {
+		c.writeBits(0, 1)
+		c.writeBits(delta>>c.trailing, int(64-c.leading-c.trailing))
+		return
+	}
+	c.leading, c.trailing = leading, trailing
+	c.writeBits(1, 1)
+	c.writeBits(uint64(leading), 5)
+	// 有效位为64时写入0，读取时还原
+	sigbits := 64 - leading - trailing
+	c.writeBits(uint64(sigbits), 6)
+	c.writeBits(delta>>trailing, int(sigbits))
+}
+
+// writeBits 从高位到低位写入v的低n个比特
+func (c *XORChunkEncoder) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if c.count%8 == 0 {
+			c.b = append(c.b, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			c.b[len(c.b)-1] |= 1 << (7 - uint(c.count%8))
+		}
+		c.count++
+	}
+}
+
+// bitRange x是否可以用nbits个比特表示
+func bitRange(x int64, nbits uint8) bool {
+	return -((1<<(nbits-1))-1) <= x && x <= 1<<(nbits-1)
+}
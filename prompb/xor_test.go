@@ -0,0 +1,152 @@
+package prompb
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+type bitReader struct {
+	b     []byte
+	count int
+}
+
+func (r *bitReader) readBits(n int) uint64 {
+	var v uint64
+	for i := 0; i < n; i++ {
+		bit := r.b[r.count/8] >> (7 - uint(r.count%8)) & 1
+		v = v<<1 | uint64(bit)
+		r.count++
+	}
+	return v
+}
+
+func (r *bitReader) readVarint(signed bool) int64 {
+	buf := make([]byte, 0, binary.MaxVarintLen64)
+	for {
+		b := byte(r.readBits(8))
+		buf = append(buf, b)
+		if b < 0x80 {
+			break
+		}
+	}
+	if signed {
+		v, _ := binary.Varint(buf)
+		return v
+	}
+	v, _ := binary.Uvarint(buf)
+	return int64(v)
+}
+
+// decodeXOR 按Prometheus chunkenc.XORChunk的读取逻辑解码数据块
+func decodeXOR(t *testing.T, data []byte) []Sample {
+	num := int(binary.BigEndian.Uint16(data[:2]))
+	r := &bitReader{b: data[2:]}
+	samples := make([]Sample, 0, num)
+	var ts, tDelta int64
+	var vbits uint64
+	var leading, trailing int
+	readValue := func() {
+		if r.readBits(1) == 0 {
+			return
+		}
+		if r.readBits(1) == 1 {
+			leading = int(r.readBits(5))
+			sigbits := int(r.readBits(6))
+			if sigbits == 0 {
+				sigbits = 64
+			}
+			trailing = 64 - leading - sigbits
+		}
+		vbits ^= r.readBits(64-leading-trailing) << uint(trailing)
+	}
+	for i := 0; i < num; i++ {
+		switch i {
+		case 0:
+			ts = r.readVarint(true)
+			vbits = r.readBits(64)
+		case 1:
+			tDelta = r.readVarint(false)
+			ts += tDelta
+			readValue()
+		default:
+			d := 0
+			for d < 4 && r.readBits(1) == 1 {
+				d++
+			}
+			size := []int{0, 14, 17, 20, 64}[d]
+			var dod int64
+			if size > 0 {
+				bits := r.readBits(size)
+				if size != 64 && bits > 1<<(size-1) {
+					bits -= 1 << size
+				}
+				dod = int64(bits)
+			}
+			tDelta += dod
+			ts += tDelta
+			readValue()
+		}
+		samples = append(samples, Sample{Timestamp: ts, Value: math.Float64frombits(vbits)})
+	}
+	return samples
+}
+
+func TestXORChunkEncoder(t *testing.T) {
+	samples := []Sample{
+		{Timestamp: -1000, Value: 1},
+		{Timestamp: 1600000000000, Value: 1},
+		{Timestamp: 1600000015000, Value: 1.5},
+		{Timestamp: 1600000030000, Value: -2.25},
+		{Timestamp: 1600000045001, Value: math.Inf(1)},
+		{Timestamp: 1600000045002, Value: 1e300},
+		{Timestamp: 1600000145002, Value: 0},
+		{Timestamp: 1600010145002, Value: 0},
+		{Timestamp: 1600010145003, Value: math.MaxFloat64},
+		{Timestamp: 1700010145003, Value: 3},
+	}
+	encoder := NewXORChunkEncoder()
+	for _, sample := range samples {
+		encoder.Append(sample.Timestamp, sample.Value)
+	}
+	if encoder.NumSamples() != len(samples) {
+		t.Fatalf("expected %d samples, got %d", len(samples), encoder.NumSamples())
+	}
+	decoded := decodeXOR(t, encoder.Bytes())
+	for i := range samples {
+		if decoded[i] != samples[i] {
+			t.Fatalf("sample %d: expected %+v, got %+v", i, samples[i], decoded[i])
+		}
+	}
+}
+
+func TestReadRequest(t *testing.T) {
+	req := &ReadRequest{
+		Queries: []*Query{{
+			StartTimestampMs: 1000,
+			EndTimestampMs:   2000,
+			Matchers: []*LabelMatcher{
+				{Type: LabelMatcher_EQ, Name: "__name__", Value: "cpu"},
+				{Type: LabelMatcher_NRE, Name: "node", Value: "vm.*"},
+			},
+		}},
+		AcceptedResponseTypes: []ReadRequest_ResponseType{ReadRequest_STREAMED_XOR_CHUNKS, ReadRequest_SAMPLES},
+	}
+	decoded := &ReadRequest{}
+	if err := decoded.Unmarshal(req.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Queries) != 1 || len(decoded.AcceptedResponseTypes) != 2 ||
+		decoded.AcceptedResponseTypes[0] != ReadRequest_STREAMED_XOR_CHUNKS {
+		t.Fatalf("unexpected request: %+v", decoded)
+	}
+	query := decoded.Queries[0]
+	if query.StartTimestampMs != 1000 || query.EndTimestampMs != 2000 || len(query.Matchers) != 2 ||
+		*query.Matchers[1] != *req.Queries[0].Matchers[1] {
+		t.Fatalf("unexpected query: %+v", query)
+	}
+
+	if err := decoded.Unmarshal(req.Marshal()[:10]); err == nil {
+		t.Fatal("expected error for truncated message")
+	}
+}
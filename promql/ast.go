@@ -0,0 +1,257 @@
+package promql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"tsdb"
+)
+
+// ValueType 表达式的结果类型
+type ValueType string
+
+const (
+	ValueTypeScalar ValueType = "scalar"
+	ValueTypeVector ValueType = "vector"
+	ValueTypeMatrix ValueType = "matrix"
+	ValueTypeString ValueType = "string"
+)
+
+// Expr 语法树中的表达式
+type Expr interface {
+	Type() ValueType
+	String() string
+}
+
+// NumberLiteral 数字常量，例如1、2.5e3、Inf
+type NumberLiteral struct {
+	Val float64
+}
+
+// StringLiteral 字符串常量，只能作为函数参数
+type StringLiteral struct {
+	Val string
+}
+
+// VectorSelector 序列选择器，例如cpu.busy{node="vm1"} offset 5m，指标名已经转换为__name__选择器
+type VectorSelector struct {
+	Name     string
+	Matchers []*tsdb.Matcher
+	Offset   time.Duration
+}
+
+// MatrixSelector 范围选择器，例如cpu.busy[5m]
+type MatrixSelector struct {
+	Vector *VectorSelector
+	Range  time.Duration
+}
+
+// Call 函数调用
+type Call struct {
+	Func *function
+	Args []Expr
+}
+
+// AggregateExpr 聚合表达式，例如sum by (node) (cpu.busy)
+type AggregateExpr struct {
+	Op       string
+	Expr     Expr
+	Param    Expr // topk、bottomk和quantile的参数
+	Grouping []string
+	Without  bool
+}
+
+// BinaryExpr 二元运算表达式
+type BinaryExpr struct {
+	Op         tokenType
+	LHS, RHS   Expr
+	Matching   *VectorMatching // 两侧都是瞬时向量时的匹配方式
+	ReturnBool bool            // 比较运算返回0或1而不是过滤
+}
+
+// UnaryExpr 取负运算表达式，例如-cpu.busy
+type UnaryExpr struct {
+	Expr Expr
+}
+
+// ParenExpr 括号表达式
+type ParenExpr struct {
+	Expr Expr
+}
+
+// VectorMatching 两个瞬时向量之间的匹配方式
+type VectorMatching struct {
+	Card           string   // one-to-one、many-to-one、one-to-many或many-to-many
+	MatchingLabels []string // on或ignoring指定的标签
+	On             bool
+	Include        []string // group_left或group_right从one一侧带入结果的标签
+}
+
+const (
+	cardOneToOne   = "one-to-one"
+	cardManyToOne  = "many-to-one"
+	cardOneToMany  = "one-to-many"
+	cardManyToMany = "many-to-many"
+)
+
+func (e *NumberLiteral) Type() ValueType  { return ValueTypeScalar }
+func (e *StringLiteral) Type() ValueType  { return ValueTypeString }
+func (e *VectorSelector) Type() ValueType { return ValueTypeVector }
+func (e *MatrixSelector) Type() ValueType { return ValueTypeMatrix }
+func (e *Call) Type() ValueType           { return e.Func.returnType }
+func (e *AggregateExpr) Type() ValueType  { return ValueTypeVector }
+func (e *UnaryExpr) Type() ValueType      { return e.Expr.Type() }
+func (e *ParenExpr) Type() ValueType      { return e.Expr.Type() }
+
+func (e *BinaryExpr) Type() ValueType {
+	if e.LHS.Type() == ValueTypeScalar && e.RHS.Type() == ValueTypeScalar {
+		return ValueTypeScalar
+	}
+	return ValueTypeVector
+}
+
+func (e *NumberLiteral) String() string {
+	return strconv.FormatFloat(e.Val, 'g', -1, 64)
+}
+
+func (e *StringLiteral) String() string {
+	return strconv.Quote(e.Val)
+}
+
+func (e *VectorSelector) String() string {
+	return e.selectorString() + offsetString(e.Offset)
+}
+
+// selectorString 输出不带offset的选择器
+func (e *VectorSelector) selectorString() string {
+	matchers := make([]string, 0, len(e.Matchers))
+	for _, m := range e.Matchers {
+		if e.Name != "" && m.Name == metricLabel && m.Type == tsdb.MatchEqual {
+			continue
+		}
+		matchers = append(matchers, m.String())
+	}
+	s := e.Name
+	if len(matchers) > 0 || s == "" {
+		s += "{" + strings.Join(matchers, ", ") + "}"
+	}
+	return s
+}
+
+func (e *MatrixSelector) String() string {
+	return fmt.Sprintf("%s[%s]%s", e.Vector.selectorString(), formatDuration(e.Range), offsetString(e.Vector.Offset))
+}
+
+func (e *Call) String() string {
+	args := make([]string, 0, len(e.Args))
+	for _, arg := range e.Args {
+		args = append(args, arg.String())
+	}
+	return fmt.Sprintf("%s(%s)", e.Func.name, strings.Join(args, ", "))
+}
+
+func (e *AggregateExpr) String() string {
+	s := e.Op
+	if e.Without {
+		s += fmt.Sprintf(" without (%s) ", strings.Join(e.Grouping, ", "))
+	} else if len(e.Grouping) > 0 {
+		s += fmt.Sprintf(" by (%s) ", strings.Join(e.Grouping, ", "))
+	}
+	if e.Param != nil {
+		return fmt.Sprintf("%s(%s, %s)", s, e.Param, e.Expr)
+	}
+	return fmt.Sprintf("%s(%s)", s, e.Expr)
+}
+
+func (e *BinaryExpr) String() string {
+	op := binaryOps[e.Op].name
+	if e.ReturnBool {
+		op += " bool"
+	}
+	if m := e.Matching; m != nil {
+		if m.On {
+			op += fmt.Sprintf(" on (%s)", strings.Join(m.MatchingLabels, ", "))
+		} else if len(m.MatchingLabels) > 0 {
+			op += fmt.Sprintf(" ignoring (%s)", strings.Join(m.MatchingLabels, ", "))
+		}
+		switch m.Card {
+		case cardManyToOne:
+			op += fmt.Sprintf(" group_left (%s)", strings.Join(m.Include, ", "))
+		case cardOneToMany:
+			op += fmt.Sprintf(" group_right (%s)", strings.Join(m.Include, ", "))
+		}
+	}
+	return fmt.Sprintf("%s %s %s", e.LHS, op, e.RHS)
+}
+
+func (e *UnaryExpr) String() string {
+	return "-" + e.Expr.String()
+}
+
+func (e *ParenExpr) String() string {
+	return "(" + e.Expr.String() + ")"
+}
+
+func offsetString(offset time.Duration) string {
+	if offset == 0 {
+		return ""
+	}
+	if offset < 0 {
+		return " offset -" + formatDuration(-offset)
+	}
+	return " offset " + formatDuration(offset)
+}
+
+// formatDuration 以ParseDuration可以解析的格式输出时长，例如1h30m
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "0s"
+	}
+	units := []struct {
+		name string
+		unit time.Duration
+	}{
+		{"y", 365 * 24 * time.Hour},
+		{"w", 7 * 24 * time.Hour},
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+		{"ms", time.Millisecond},
+	}
+	var builder strings.Builder
+	for _, u := range units {
+		if n := d / u.unit; n > 0 {
+			builder.WriteString(strconv.FormatInt(int64(n), 10))
+			builder.WriteString(u.name)
+			d -= n * u.unit
+		}
+	}
+	return builder.String()
+}
+
+// inspect 深度优先遍历表达式
+func inspect(expr Expr, fn func(Expr)) {
+	fn(expr)
+	switch e := expr.(type) {
+	case *MatrixSelector:
+		inspect(e.Vector, fn)
+	case *Call:
+		for _, arg := range e.Args {
+			inspect(arg, fn)
+		}
+	case *AggregateExpr:
+		if e.Param != nil {
+			inspect(e.Param, fn)
+		}
+		inspect(e.Expr, fn)
+	case *BinaryExpr:
+		inspect(e.LHS, fn)
+		inspect(e.RHS, fn)
+	case *UnaryExpr:
+		inspect(e.Expr, fn)
+	case *ParenExpr:
+		inspect(e.Expr, fn)
+	}
+}
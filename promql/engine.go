@@ -0,0 +1,273 @@
+package promql
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+	"tsdb"
+)
+
+// Engine 在数据库上计算PromQL表达式，数据点来自全部memtable和diskSegment
+type Engine struct {
+	db       *tsdb.TSDB
+	lookback time.Duration // 瞬时向量选择器最多向前查找的时长
+}
+
+// evaluator 计算一次查询，计算的时刻需要单调不减，每条时间线只在内存中保留选择器时间窗口内的数据点
+type evaluator struct {
+	ctx       context.Context
+	precision tsdb.TimestampPrecision
+	lookback  int64
+	second    float64 // 一秒对应的时间戳差值
+	series    map[*VectorSelector]*selection
+	sets      []tsdb.SeriesSet
+}
+
+// selection 一个选择器查询到的时间线，rng为选择器的时间窗口
+type selection struct {
+	rng     int64
+	cursors []*cursor
+}
+
+// cursor 按时间顺序遍历一条时间线，buffer为最近一次计算时时间窗口内的数据点
+type cursor struct {
+	labels tsdb.LabelList
+	it     tsdb.SeriesIterator
+	ok     bool // it指向还没有放入buffer的数据点
+	buffer []tsdb.Point
+}
+
+func NewEngine(db *tsdb.TSDB, lookback time.Duration) *Engine {
+	return &Engine{
+		db:       db,
+		lookback: lookback,
+	}
+}
+
+// Instant 计算expr在ts时刻的值
+func (e *Engine) Instant(ctx context.Context, expr Expr, ts time.Time) (Value, error) {
+	t := e.db.Precision().FromTime(ts)
+	ev, err := e.newEvaluator(ctx, expr, t, t)
+	if err != nil {
+		return nil, err
+	}
+	defer ev.close()
+	return ev.eval(expr, t)
+}
+
+// Range 计算expr在[start, end]内每隔step的值，expr的结果必须是标量或者瞬时向量
+func (e *Engine) Range(ctx context.Context, expr Expr, start, end time.Time, step time.Duration) (Matrix, error) {
+	if typ := expr.Type(); typ != ValueTypeScalar && typ != ValueTypeVector {
+		return nil, fmt.Errorf("invalid expression type %q for range query, must be scalar or instant vector", typ)
+	}
+	precision := e.db.Precision()
+	startTs, endTs, stepTs := precision.FromTime(start), precision.FromTime(end), precision.FromDuration(step)
+	if stepTs <= 0 {
+		return nil, fmt.Errorf("step %v is smaller than timestamp precision %v", step, precision.Unit())
+	}
+	ev, err := e.newEvaluator(ctx, expr, startTs, endTs)
+	if err != nil {
+		return nil, err
+	}
+	defer ev.close()
+
+	merged := make(map[string]*Series)
+	for ts := startTs; ts <= endTs; ts += stepTs {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		value, err := ev.eval(expr, ts)
+		if err != nil {
+			return nil, err
+		}
+		var vector Vector
+		switch v := value.(type) {
+		case Scalar:
+			vector = Vector{{Point: tsdb.Point{Timestamp: ts, Value: v.V}}}
+		case Vector:
+			vector = v
+		}
+		for _, sample := range vector {
+			key := sample.Metric.String()
+			series, ok := merged[key]
+			if !ok {
+				series = &Series{Metric: sample.Metric}
+				merged[key] = series
+			}
+			if n := len(series.Points); n > 0 && series.Points[n-1].Timestamp == ts {
+				return nil, fmt.Errorf("vector cannot contain metrics with the same labelset %s", key)
+			}
+			series.Points = append(series.Points, tsdb.Point{Timestamp: ts, Value: sample.Point.Value})
+		}
+	}
+
+	matrix := make(Matrix, 0, len(merged))
+	for _, series := range merged {
+		matrix = append(matrix, *series)
+	}
+	sort.Slice(matrix, func(i, j int) bool {
+		return matrix[i].Metric.String() < matrix[j].Metric.String()
+	})
+	return matrix, nil
+}
+
+// newEvaluator 查询expr中每个选择器在[start, end]内计算需要的时间线，数据点在计算时才会读取，使用结束后需要调用close
+func (e *Engine) newEvaluator(ctx context.Context, expr Expr, start, end int64) (*evaluator, error) {
+	precision := e.db.Precision()
+	ev := &evaluator{
+		ctx:       ctx,
+		precision: precision,
+		lookback:  precision.FromDuration(e.lookback),
+		second:    float64(precision.FromDuration(time.Second)),
+		series:    make(map[*VectorSelector]*selection),
+	}
+	ranges := make(map[*VectorSelector]int64)
+	inspect(expr, func(node Expr) {
+		switch n := node.(type) {
+		case *MatrixSelector:
+			ranges[n.Vector] = ev.duration(n.Range)
+		case *VectorSelector:
+			if _, ok := ranges[n]; !ok {
+				ranges[n] = ev.lookback
+			}
+		}
+	})
+	for vs, rng := range ranges {
+		offset := ev.duration(vs.Offset)
+		// 选择器的时间范围左开右闭
+		set, err := e.db.Select("", vs.Matchers, start-offset-rng+1, end-offset)
+		if err != nil {
+			ev.close()
+			return nil, err
+		}
+		ev.sets = append(ev.sets, set)
+		sel := &selection{rng: rng}
+		for set.Next() {
+			labels, it := set.At()
+			sel.cursors = append(sel.cursors, &cursor{labels: labels, it: it, ok: it.Next()})
+		}
+		if err = set.Err(); err != nil {
+			ev.close()
+			return nil, err
+		}
+		ev.series[vs] = sel
+	}
+	return ev, nil
+}
+
+func (ev *evaluator) close() {
+	for _, set := range ev.sets {
+		set.Close()
+	}
+	ev.sets = nil
+}
+
+// advance 将时间窗口移动到(ref-rng, ref]并返回窗口内的数据点，ref需要单调不减
+func (c *cursor) advance(ref, rng int64) ([]tsdb.Point, error) {
+	i := sort.Search(len(c.buffer), func(i int) bool {
+		return c.buffer[i].Timestamp > ref-rng
+	})
+	c.buffer = c.buffer[i:]
+	if c.ok && len(c.buffer) == 0 {
+		// 跳过两个时间窗口之间的数据点
+		c.ok = c.it.SeekTo(ref - rng + 1)
+	}
+	for c.ok {
+		t, v := c.it.At()
+		if t > ref {
+			break
+		}
+		c.buffer = append(c.buffer, tsdb.Point{Timestamp: t, Value: v})
+		c.ok = c.it.Next()
+	}
+	return c.buffer, c.it.Err()
+}
+
+func (ev *evaluator) eval(expr Expr, ts int64) (Value, error) {
+	if err := ev.ctx.Err(); err != nil {
+		return nil, err
+	}
+	switch e := expr.(type) {
+	case *NumberLiteral:
+		return Scalar{T: ts, V: e.Val}, nil
+	case *StringLiteral:
+		return String{T: ts, V: e.Val}, nil
+	case *ParenExpr:
+		return ev.eval(e.Expr, ts)
+	case *UnaryExpr:
+		value, err := ev.eval(e.Expr, ts)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := value.(Scalar); ok {
+			return Scalar{T: ts, V: -s.V}, nil
+		}
+		vector := value.(Vector)
+		ret := make(Vector, 0, len(vector))
+		for _, sample := range vector {
+			ret = append(ret, Sample{Metric: dropMetricName(sample.Metric), Point: tsdb.Point{Timestamp: ts, Value: -sample.Point.Value}})
+		}
+		return ret, nil
+	case *VectorSelector:
+		return ev.vectorSelector(e, ts)
+	case *MatrixSelector:
+		return ev.matrixSelector(e, ts)
+	case *Call:
+		args := make([]Value, 0, len(e.Args))
+		for _, arg := range e.Args {
+			value, err := ev.eval(arg, ts)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, value)
+		}
+		return e.Func.call(ev, e, args, ts)
+	case *AggregateExpr:
+		return ev.aggregate(e, ts)
+	case *BinaryExpr:
+		return ev.binary(e, ts)
+	}
+	return nil, fmt.Errorf("unknown expression %T", expr)
+}
+
+// vectorSelector 取每条时间线在ts之前lookback范围内最新的数据点
+func (ev *evaluator) vectorSelector(vs *VectorSelector, ts int64) (Vector, error) {
+	ref := ts - ev.duration(vs.Offset)
+	sel := ev.series[vs]
+	vector := make(Vector, 0)
+	for _, c := range sel.cursors {
+		points, err := c.advance(ref, sel.rng)
+		if err != nil {
+			return nil, err
+		}
+		if len(points) == 0 {
+			continue
+		}
+		vector = append(vector, Sample{Metric: c.labels, Point: tsdb.Point{Timestamp: ts, Value: points[len(points)-1].Value}})
+	}
+	return vector, nil
+}
+
+// matrixSelector 取每条时间线在(ts-range, ts]内的数据点
+func (ev *evaluator) matrixSelector(ms *MatrixSelector, ts int64) (Matrix, error) {
+	ref := ts - ev.duration(ms.Vector.Offset)
+	sel := ev.series[ms.Vector]
+	matrix := make(Matrix, 0)
+	for _, c := range sel.cursors {
+		points, err := c.advance(ref, sel.rng)
+		if err != nil {
+			return nil, err
+		}
+		if len(points) == 0 {
+			continue
+		}
+		matrix = append(matrix, Series{Metric: c.labels, Points: points})
+	}
+	return matrix, nil
+}
+
+// duration 将时长转换为数据库精度下的时间戳差值
+func (ev *evaluator) duration(d time.Duration) int64 {
+	return ev.precision.FromDuration(d)
+}
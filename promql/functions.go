@@ -0,0 +1,275 @@
+package promql
+
+import (
+	"math"
+	"sort"
+	"tsdb"
+)
+
+// function PromQL函数，参数在调用前已经计算
+type function struct {
+	name       string
+	argTypes   []ValueType
+	optional   int // 末尾可以省略的参数个数
+	returnType ValueType
+	call       func(ev *evaluator, e *Call, args []Value, ts int64) (Value, error)
+}
+
+// rangeContext 区间向量函数的计算范围，时间范围为(start, end]
+type rangeContext struct {
+	start     int64
+	end       int64
+	precision tsdb.TimestampPrecision
+	param     float64 // quantile_over_time的分位数
+}
+
+var functions = map[string]*function{
+	"rate": rangeFunction("rate", func(points []tsdb.Point, rc *rangeContext) (float64, bool) {
+		return tsdb.Rate(points, rc.start, rc.end, rc.precision)
+	}),
+	"increase": rangeFunction("increase", func(points []tsdb.Point, rc *rangeContext) (float64, bool) {
+		return tsdb.Increase(points, rc.start, rc.end)
+	}),
+	"delta": rangeFunction("delta", func(points []tsdb.Point, rc *rangeContext) (float64, bool) {
+		return tsdb.Delta(points, rc.start, rc.end)
+	}),
+	"irate": rangeFunction("irate", func(points []tsdb.Point, rc *rangeContext) (float64, bool) {
+		return tsdb.IRate(points, rc.precision)
+	}),
+
+	"avg_over_time": rangeFunction("avg_over_time", func(points []tsdb.Point, _ *rangeContext) (float64, bool) {
+		return aggregateValues("avg", pointValues(points), 0), true
+	}),
+	"min_over_time": rangeFunction("min_over_time", func(points []tsdb.Point, _ *rangeContext) (float64, bool) {
+		return aggregateValues("min", pointValues(points), 0), true
+	}),
+	"max_over_time": rangeFunction("max_over_time", func(points []tsdb.Point, _ *rangeContext) (float64, bool) {
+		return aggregateValues("max", pointValues(points), 0), true
+	}),
+	"sum_over_time": rangeFunction("sum_over_time", func(points []tsdb.Point, _ *rangeContext) (float64, bool) {
+		return aggregateValues("sum", pointValues(points), 0), true
+	}),
+	"count_over_time": rangeFunction("count_over_time", func(points []tsdb.Point, _ *rangeContext) (float64, bool) {
+		return float64(len(points)), true
+	}),
+	"stddev_over_time": rangeFunction("stddev_over_time", func(points []tsdb.Point, _ *rangeContext) (float64, bool) {
+		return aggregateValues("stddev", pointValues(points), 0), true
+	}),
+	"stdvar_over_time": rangeFunction("stdvar_over_time", func(points []tsdb.Point, _ *rangeContext) (float64, bool) {
+		return aggregateValues("stdvar", pointValues(points), 0), true
+	}),
+	"last_over_time": rangeFunction("last_over_time", func(points []tsdb.Point, _ *rangeContext) (float64, bool) {
+		return points[len(points)-1].Value, true
+	}),
+	"present_over_time": rangeFunction("present_over_time", func(points []tsdb.Point, _ *rangeContext) (float64, bool) {
+		return 1, true
+	}),
+	"quantile_over_time": rangeFunction("quantile_over_time", func(points []tsdb.Point, rc *rangeContext) (float64, bool) {
+		return aggregateValues("quantile", pointValues(points), rc.param), true
+	}).withParam(),
+
+	"abs":   mathFunction("abs", math.Abs),
+	"ceil":  mathFunction("ceil", math.Ceil),
+	"floor": mathFunction("floor", math.Floor),
+	"exp":   mathFunction("exp", math.Exp),
+	"sqrt":  mathFunction("sqrt", math.Sqrt),
+	"ln":    mathFunction("ln", math.Log),
+	"log2":  mathFunction("log2", math.Log2),
+	"log10": mathFunction("log10", math.Log10),
+	"clamp_min": {
+		name:       "clamp_min",
+		argTypes:   []ValueType{ValueTypeVector, ValueTypeScalar},
+		returnType: ValueTypeVector,
+		call: func(ev *evaluator, e *Call, args []Value, ts int64) (Value, error) {
+			min := args[1].(Scalar).V
+			return mapVector(args[0].(Vector), ts, func(v float64) float64 { return math.Max(min, v) }), nil
+		},
+	},
+	"clamp_max": {
+		name:       "clamp_max",
+		argTypes:   []ValueType{ValueTypeVector, ValueTypeScalar},
+		returnType: ValueTypeVector,
+		call: func(ev *evaluator, e *Call, args []Value, ts int64) (Value, error) {
+			max := args[1].(Scalar).V
+			return mapVector(args[0].(Vector), ts, func(v float64) float64 { return math.Min(max, v) }), nil
+		},
+	},
+	"round": {
+		name:       "round",
+		argTypes:   []ValueType{ValueTypeVector, ValueTypeScalar},
+		optional:   1,
+		returnType: ValueTypeVector,
+		call: func(ev *evaluator, e *Call, args []Value, ts int64) (Value, error) {
+			toNearest := 1.0
+			if len(args) > 1 {
+				toNearest = args[1].(Scalar).V
+			}
+			// 除以倒数可以避免toNearest为小数时的精度问题
+			inverse := 1.0 / toNearest
+			return mapVector(args[0].(Vector), ts, func(v float64) float64 { return math.Floor(v*inverse+0.5) / inverse }), nil
+		},
+	},
+	"scalar": {
+		name:       "scalar",
+		argTypes:   []ValueType{ValueTypeVector},
+		returnType: ValueTypeScalar,
+		call: func(ev *evaluator, e *Call, args []Value, ts int64) (Value, error) {
+			vector := args[0].(Vector)
+			if len(vector) != 1 {
+				return Scalar{T: ts, V: math.NaN()}, nil
+			}
+			return Scalar{T: ts, V: vector[0].Point.Value}, nil
+		},
+	},
+	"vector": {
+		name:       "vector",
+		argTypes:   []ValueType{ValueTypeScalar},
+		returnType: ValueTypeVector,
+		call: func(ev *evaluator, e *Call, args []Value, ts int64) (Value, error) {
+			return Vector{{Metric: tsdb.LabelList{}, Point: tsdb.Point{Timestamp: ts, Value: args[0].(Scalar).V}}}, nil
+		},
+	},
+	"time": {
+		name:       "time",
+		argTypes:   []ValueType{},
+		returnType: ValueTypeScalar,
+		call: func(ev *evaluator, e *Call, args []Value, ts int64) (Value, error) {
+			return Scalar{T: ts, V: float64(ts) / ev.second}, nil
+		},
+	},
+}
+
+// rangeFunction 对区间向量中的每条时间线计算一个值，fn返回false时忽略该时间线
+func rangeFunction(name string, fn func(points []tsdb.Point, rc *rangeContext) (float64, bool)) *function {
+	return &function{
+		name:       name,
+		argTypes:   []ValueType{ValueTypeMatrix},
+		returnType: ValueTypeVector,
+		call: func(ev *evaluator, e *Call, args []Value, ts int64) (Value, error) {
+			ms := unwrapParens(e.Args[len(e.Args)-1]).(*MatrixSelector)
+			end := ts - ev.duration(ms.Vector.Offset)
+			rc := &rangeContext{
+				start:     end - ev.duration(ms.Range),
+				end:       end,
+				precision: ev.precision,
+			}
+			if len(args) > 1 {
+				rc.param = args[0].(Scalar).V
+			}
+			matrix := args[len(args)-1].(Matrix)
+			vector := make(Vector, 0, len(matrix))
+			for _, series := range matrix {
+				value, ok := fn(series.Points, rc)
+				if !ok {
+					continue
+				}
+				vector = append(vector, Sample{Metric: dropMetricName(series.Metric), Point: tsdb.Point{Timestamp: ts, Value: value}})
+			}
+			return vector, nil
+		},
+	}
+}
+
+// withParam 在区间向量参数之前增加一个标量参数
+func (f *function) withParam() *function {
+	f.argTypes = []ValueType{ValueTypeScalar, ValueTypeMatrix}
+	return f
+}
+
+func mathFunction(name string, fn func(float64) float64) *function {
+	return &function{
+		name:       name,
+		argTypes:   []ValueType{ValueTypeVector},
+		returnType: ValueTypeVector,
+		call: func(ev *evaluator, e *Call, args []Value, ts int64) (Value, error) {
+			return mapVector(args[0].(Vector), ts, fn), nil
+		},
+	}
+}
+
+// mapVector 对每个样本的值计算fn，结果去掉指标名
+func mapVector(vector Vector, ts int64, fn func(float64) float64) Vector {
+	ret := make(Vector, 0, len(vector))
+	for _, sample := range vector {
+		ret = append(ret, Sample{Metric: dropMetricName(sample.Metric), Point: tsdb.Point{Timestamp: ts, Value: fn(sample.Point.Value)}})
+	}
+	return ret
+}
+
+func unwrapParens(expr Expr) Expr {
+	for {
+		paren, ok := expr.(*ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = paren.Expr
+	}
+}
+
+func pointValues(points []tsdb.Point) []float64 {
+	values := make([]float64, 0, len(points))
+	for _, point := range points {
+		values = append(values, point.Value)
+	}
+	return values
+}
+
+// aggregateValues 计算一组值的聚合结果，param为quantile的分位数
+func aggregateValues(op string, values []float64, param float64) float64 {
+	switch op {
+	case "sum":
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	case "avg":
+		return aggregateValues("sum", values, 0) / float64(len(values))
+	case "count":
+		return float64(len(values))
+	case "group":
+		return 1
+	case "min", "max":
+		result := values[0]
+		for _, v := range values[1:] {
+			// NaN只在全部都是NaN时返回
+			if math.IsNaN(result) || (op == "min" && v < result) || (op == "max" && v > result) {
+				result = v
+			}
+		}
+		return result
+	case "stddev":
+		return math.Sqrt(aggregateValues("stdvar", values, 0))
+	case "stdvar":
+		mean := aggregateValues("avg", values, 0)
+		var variance float64
+		for _, v := range values {
+			variance += (v - mean) * (v - mean)
+		}
+		return variance / float64(len(values))
+	case "quantile":
+		return quantile(param, values)
+	}
+	return math.NaN()
+}
+
+// quantile 线性插值计算分位数，q小于0时返回-Inf，大于1时返回+Inf
+func quantile(q float64, values []float64) float64 {
+	if len(values) == 0 || math.IsNaN(q) {
+		return math.NaN()
+	}
+	if q < 0 {
+		return math.Inf(-1)
+	}
+	if q > 1 {
+		return math.Inf(1)
+	}
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	rank := q * float64(len(sorted)-1)
+	lower := math.Max(0, math.Floor(rank))
+	upper := math.Min(float64(len(sorted)-1), lower+1)
+	weight := rank - math.Floor(rank)
+	return sorted[int(lower)]*(1-weight) + sorted[int(upper)]*weight
+}
@@ -0,0 +1,253 @@
+package promql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// 词法分析，将查询语句切分为token
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdentifier
+	tokenString
+	tokenNumber
+	tokenDuration
+
+	tokenLeftBrace    // {
+	tokenRightBrace   // }
+	tokenLeftParen    // (
+	tokenRightParen   // )
+	tokenLeftBracket  // [
+	tokenRightBracket // ]
+	tokenComma        // ,
+	tokenColon        // :
+
+	tokenAssign   // =
+	tokenNotEqual // !=
+	tokenRegexp   // =~
+	tokenNotRegex // !~
+
+	tokenAdd // +
+	tokenSub // -
+	tokenMul // *
+	tokenDiv // /
+	tokenMod // %
+	tokenPow // ^
+
+	tokenEqlC // ==
+	tokenGtr  // >
+	tokenLss  // <
+	tokenGte  // >=
+	tokenLte  // <=
+
+	// 集合运算符在词法分析时是标识符，由语法分析转换
+	tokenAnd
+	tokenOr
+	tokenUnless
+)
+
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+func (t token) String() string {
+	if t.typ == tokenEOF {
+		return "EOF"
+	}
+	return strconv.Quote(t.val)
+}
+
+// lex 将input切分为token，最后一个token为tokenEOF
+func lex(input string) ([]token, error) {
+	tokens := make([]token, 0)
+	pos := 0
+	for pos < len(input) {
+		ch := input[pos]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			pos++
+			continue
+		case ch == '#':
+			// 注释一直到行尾
+			for pos < len(input) && input[pos] != '\n' {
+				pos++
+			}
+			continue
+		case ch == '"' || ch == '\'' || ch == '`':
+			value, next, err := lexString(input, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{typ: tokenString, val: value, pos: pos})
+			pos = next
+			continue
+		case isDigit(ch) || (ch == '.' && pos+1 < len(input) && isDigit(input[pos+1])):
+			next, typ := lexNumberOrDuration(input, pos)
+			tokens = append(tokens, token{typ: typ, val: input[pos:next], pos: pos})
+			pos = next
+			continue
+		case isIdentifierStart(ch):
+			next := pos + 1
+			for next < len(input) && isIdentifierChar(input[next]) {
+				next++
+			}
+			value := input[pos:next]
+			// Inf和NaN作为数字处理
+			if strings.EqualFold(value, "inf") || strings.EqualFold(value, "nan") {
+				tokens = append(tokens, token{typ: tokenNumber, val: value, pos: pos})
+			} else {
+				tokens = append(tokens, token{typ: tokenIdentifier, val: value, pos: pos})
+			}
+			pos = next
+			continue
+		}
+
+		two := ""
+		if pos+1 < len(input) {
+			two = input[pos : pos+2]
+		}
+		var typ tokenType
+		size := 2
+		switch two {
+		case "!=":
+			typ = tokenNotEqual
+		case "=~":
+			typ = tokenRegexp
+		case "!~":
+			typ = tokenNotRegex
+		case "==":
+			typ = tokenEqlC
+		case ">=":
+			typ = tokenGte
+		case "<=":
+			typ = tokenLte
+		default:
+			size = 1
+			switch ch {
+			case '{':
+				typ = tokenLeftBrace
+			case '}':
+				typ = tokenRightBrace
+			case '(':
+				typ = tokenLeftParen
+			case ')':
+				typ = tokenRightParen
+			case '[':
+				typ = tokenLeftBracket
+			case ']':
+				typ = tokenRightBracket
+			case ',':
+				typ = tokenComma
+			case ':':
+				typ = tokenColon
+			case '=':
+				typ = tokenAssign
+			case '+':
+				typ = tokenAdd
+			case '-':
+				typ = tokenSub
+			case '*':
+				typ = tokenMul
+			case '/':
+				typ = tokenDiv
+			case '%':
+				typ = tokenMod
+			case '^':
+				typ = tokenPow
+			case '>':
+				typ = tokenGtr
+			case '<':
+				typ = tokenLss
+			default:
+				return nil, fmt.Errorf("unexpected character %q at position %d", ch, pos)
+			}
+		}
+		tokens = append(tokens, token{typ: typ, val: input[pos : pos+size], pos: pos})
+		pos += size
+	}
+	return append(tokens, token{typ: tokenEOF, pos: len(input)}), nil
+}
+
+func lexString(input string, pos int) (string, int, error) {
+	quote := input[pos]
+	next := pos + 1
+	for next < len(input) {
+		switch input[next] {
+		case '\\':
+			if quote != '`' {
+				next++
+			}
+		case quote:
+			raw := input[pos : next+1]
+			if quote == '`' {
+				return raw[1 : len(raw)-1], next + 1, nil
+			}
+			if quote == '\'' {
+				// 单引号字符串转换为双引号后再解析转义
+				raw = `"` + strings.ReplaceAll(strings.ReplaceAll(raw[1:len(raw)-1], `\'`, `'`), `"`, `\"`) + `"`
+			}
+			value, err := strconv.Unquote(raw)
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid string %s at position %d", input[pos:next+1], pos)
+			}
+			return value, next + 1, nil
+		}
+		next++
+	}
+	return "", 0, fmt.Errorf("unterminated string at position %d", pos)
+}
+
+// lexNumberOrDuration 解析数字或者1h30m这样的时长
+func lexNumberOrDuration(input string, pos int) (int, tokenType) {
+	next := pos
+	for next < len(input) && (isDigit(input[next]) || input[next] == '.') {
+		next++
+	}
+	// 科学计数法
+	if next < len(input) && (input[next] == 'e' || input[next] == 'E') {
+		exp := next + 1
+		if exp < len(input) && (input[exp] == '+' || input[exp] == '-') {
+			exp++
+		}
+		if exp < len(input) && isDigit(input[exp]) {
+			for exp < len(input) && isDigit(input[exp]) {
+				exp++
+			}
+			return exp, tokenNumber
+		}
+	}
+	if next < len(input) && strings.ContainsRune("smhdwy", rune(input[next])) {
+		for next < len(input) && (isDigit(input[next]) || strings.ContainsRune("smhdwy", rune(input[next]))) {
+			next++
+		}
+		return next, tokenDuration
+	}
+	// 十六进制
+	if next < len(input) && next == pos+1 && input[pos] == '0' && (input[next] == 'x' || input[next] == 'X') {
+		next++
+		for next < len(input) && strings.ContainsRune("0123456789abcdefABCDEF", rune(input[next])) {
+			next++
+		}
+	}
+	return next, tokenNumber
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+// isIdentifierStart 指标名中允许出现'.'，例如cpu.busy
+func isIdentifierStart(ch byte) bool {
+	return ch == '_' || ch == ':' || unicode.IsLetter(rune(ch))
+}
+
+func isIdentifierChar(ch byte) bool {
+	return isIdentifierStart(ch) || isDigit(ch) || ch == '.'
+}
@@ -0,0 +1,331 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"tsdb"
+)
+
+// aggregate 按照by或without的标签分组聚合
+func (ev *evaluator) aggregate(e *AggregateExpr, ts int64) (Value, error) {
+	value, err := ev.eval(e.Expr, ts)
+	if err != nil {
+		return nil, err
+	}
+	var param float64
+	if e.Param != nil {
+		p, err := ev.eval(e.Param, ts)
+		if err != nil {
+			return nil, err
+		}
+		param = p.(Scalar).V
+	}
+
+	type group struct {
+		metric  tsdb.LabelList
+		samples []Sample
+	}
+	groups := make(map[string]*group)
+	keys := make([]string, 0)
+	for _, sample := range value.(Vector) {
+		metric := groupingLabels(sample.Metric, e.Grouping, e.Without)
+		key := metric.String()
+		g, ok := groups[key]
+		if !ok {
+			g = &group{metric: metric}
+			groups[key] = g
+			keys = append(keys, key)
+		}
+		g.samples = append(g.samples, sample)
+	}
+
+	vector := make(Vector, 0, len(groups))
+	for _, key := range keys {
+		g := groups[key]
+		switch e.Op {
+		case "topk", "bottomk":
+			k := int(param)
+			if k < 1 {
+				continue
+			}
+			samples := make([]Sample, len(g.samples))
+			copy(samples, g.samples)
+			// NaN排在最后
+			sort.SliceStable(samples, func(i, j int) bool {
+				a, b := samples[i].Point.Value, samples[j].Point.Value
+				if math.IsNaN(b) {
+					return !math.IsNaN(a)
+				}
+				if e.Op == "topk" {
+					return a > b
+				}
+				return a < b
+			})
+			if k < len(samples) {
+				samples = samples[:k]
+			}
+			vector = append(vector, samples...)
+		default:
+			values := make([]float64, 0, len(g.samples))
+			for _, sample := range g.samples {
+				values = append(values, sample.Point.Value)
+			}
+			vector = append(vector, Sample{Metric: g.metric, Point: tsdb.Point{Timestamp: ts, Value: aggregateValues(e.Op, values, param)}})
+		}
+	}
+	return vector, nil
+}
+
+// groupingLabels 返回分组标签，without时去掉指定的标签和指标名
+func groupingLabels(labels tsdb.LabelList, grouping []string, without bool) tsdb.LabelList {
+	names := make(map[string]struct{}, len(grouping))
+	for _, name := range grouping {
+		names[name] = struct{}{}
+	}
+	if without {
+		names[metricLabel] = struct{}{}
+	}
+	ret := make(tsdb.LabelList, 0, len(grouping))
+	for _, label := range labels {
+		if _, ok := names[label.Name]; ok != without {
+			ret = append(ret, label)
+		}
+	}
+	return ret
+}
+
+func (ev *evaluator) binary(e *BinaryExpr, ts int64) (Value, error) {
+	lhs, err := ev.eval(e.LHS, ts)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := ev.eval(e.RHS, ts)
+	if err != nil {
+		return nil, err
+	}
+	switch l := lhs.(type) {
+	case Scalar:
+		switch r := rhs.(type) {
+		case Scalar:
+			value, keep := binaryValue(e.Op, l.V, r.V)
+			if binaryOps[e.Op].comparison {
+				value = boolValue(keep)
+			}
+			return Scalar{T: ts, V: value}, nil
+		case Vector:
+			return vectorScalarBinary(e, r, l.V, true, ts), nil
+		}
+	case Vector:
+		switch r := rhs.(type) {
+		case Scalar:
+			return vectorScalarBinary(e, l, r.V, false, ts), nil
+		case Vector:
+			switch e.Op {
+			case tokenAnd, tokenOr, tokenUnless:
+				return setBinary(e, l, r), nil
+			}
+			return vectorBinary(e, l, r, ts)
+		}
+	}
+	return nil, fmt.Errorf("invalid operands of binary expression: %s and %s", lhs.Type(), rhs.Type())
+}
+
+// binaryValue 计算算术运算的结果，比较运算返回左侧的值和比较结果
+func binaryValue(op tokenType, lhs, rhs float64) (float64, bool) {
+	switch op {
+	case tokenAdd:
+		return lhs + rhs, true
+	case tokenSub:
+		return lhs - rhs, true
+	case tokenMul:
+		return lhs * rhs, true
+	case tokenDiv:
+		return lhs / rhs, true
+	case tokenMod:
+		return math.Mod(lhs, rhs), true
+	case tokenPow:
+		return math.Pow(lhs, rhs), true
+	case tokenEqlC:
+		return lhs, lhs == rhs
+	case tokenNotEqual:
+		return lhs, lhs != rhs
+	case tokenGtr:
+		return lhs, lhs > rhs
+	case tokenLss:
+		return lhs, lhs < rhs
+	case tokenGte:
+		return lhs, lhs >= rhs
+	case tokenLte:
+		return lhs, lhs <= rhs
+	}
+	return math.NaN(), false
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// vectorScalarBinary 向量与标量运算，swap表示标量在左侧
+func vectorScalarBinary(e *BinaryExpr, vector Vector, scalar float64, swap bool, ts int64) Vector {
+	comparison := binaryOps[e.Op].comparison
+	ret := make(Vector, 0, len(vector))
+	for _, sample := range vector {
+		lhs, rhs := sample.Point.Value, scalar
+		if swap {
+			lhs, rhs = rhs, lhs
+		}
+		value, keep := binaryValue(e.Op, lhs, rhs)
+		if comparison {
+			// 比较运算总是保留向量一侧的值
+			value = sample.Point.Value
+		}
+		if e.ReturnBool {
+			value, keep = boolValue(keep), true
+		}
+		if !keep {
+			continue
+		}
+		metric := sample.Metric
+		if !comparison || e.ReturnBool {
+			metric = dropMetricName(metric)
+		}
+		ret = append(ret, Sample{Metric: metric, Point: tsdb.Point{Timestamp: ts, Value: value}})
+	}
+	return ret
+}
+
+// vectorBinary 两个向量按照on或ignoring的标签一一匹配后运算，group_left和group_right允许多对一匹配
+func vectorBinary(e *BinaryExpr, lhs, rhs Vector, ts int64) (Vector, error) {
+	matching := e.Matching
+	comparison := binaryOps[e.Op].comparison
+	// 统一让lhs作为many一侧
+	swapped := matching.Card == cardOneToMany
+	if swapped {
+		lhs, rhs = rhs, lhs
+	}
+	signature := signatureFunc(matching.On, matching.MatchingLabels)
+
+	rightSigs := make(map[string]Sample, len(rhs))
+	for _, sample := range rhs {
+		sig := signature(sample.Metric)
+		if pre, ok := rightSigs[sig]; ok {
+			side := "right"
+			if swapped {
+				side = "left"
+			}
+			return nil, fmt.Errorf("found duplicate series for the match group %s on the %s hand-side of the operation: [%s, %s];many-to-many matching not allowed: matching labels must be unique on one side",
+				sig, side, pre.Metric, sample.Metric)
+		}
+		rightSigs[sig] = sample
+	}
+
+	matched := make(map[string]struct{})
+	ret := make(Vector, 0, len(lhs))
+	for _, ls := range lhs {
+		sig := signature(ls.Metric)
+		rs, ok := rightSigs[sig]
+		if !ok {
+			continue
+		}
+		l, r := ls.Point.Value, rs.Point.Value
+		if swapped {
+			l, r = r, l
+		}
+		value, keep := binaryValue(e.Op, l, r)
+		if e.ReturnBool {
+			value, keep = boolValue(keep), true
+		}
+		if !keep {
+			continue
+		}
+		metric := resultMetric(ls.Metric, rs.Metric, e, comparison)
+		key := sig
+		if matching.Card != cardOneToOne {
+			key = metric.String()
+		}
+		if _, ok := matched[key]; ok {
+			if matching.Card == cardOneToOne {
+				return nil, fmt.Errorf("multiple matches for labels: many-to-one matching must be explicit (group_left/group_right)")
+			}
+			return nil, fmt.Errorf("multiple matches for labels: grouping labels must ensure unique matches")
+		}
+		matched[key] = struct{}{}
+		ret = append(ret, Sample{Metric: metric, Point: tsdb.Point{Timestamp: ts, Value: value}})
+	}
+	return ret, nil
+}
+
+// resultMetric 计算向量运算结果的标签，many为many一侧的标签，one为one一侧的标签
+func resultMetric(many, one tsdb.LabelList, e *BinaryExpr, comparison bool) tsdb.LabelList {
+	matching := e.Matching
+	names := make(map[string]struct{}, len(matching.MatchingLabels))
+	for _, name := range matching.MatchingLabels {
+		names[name] = struct{}{}
+	}
+	ret := make(tsdb.LabelList, 0, len(many))
+	for _, label := range many {
+		if label.Name == metricLabel && (!comparison || e.ReturnBool) {
+			continue
+		}
+		if matching.Card == cardOneToOne {
+			if _, ok := names[label.Name]; ok != matching.On {
+				continue
+			}
+		}
+		ret = append(ret, label)
+	}
+	for _, name := range matching.Include {
+		for i := 0; i < len(ret); i++ {
+			if ret[i].Name == name {
+				ret = append(ret[:i], ret[i+1:]...)
+				break
+			}
+		}
+		if value := one.Get(name); value != "" {
+			ret = append(ret, tsdb.Label{Name: name, Value: value})
+		}
+	}
+	ret.Sorted()
+	return ret
+}
+
+// setBinary 计算and、or和unless，结果保留原来的样本
+func setBinary(e *BinaryExpr, lhs, rhs Vector) Vector {
+	signature := signatureFunc(e.Matching.On, e.Matching.MatchingLabels)
+	rightSigs := make(map[string]struct{}, len(rhs))
+	for _, sample := range rhs {
+		rightSigs[signature(sample.Metric)] = struct{}{}
+	}
+	ret := make(Vector, 0, len(lhs))
+	switch e.Op {
+	case tokenAnd, tokenUnless:
+		for _, sample := range lhs {
+			if _, ok := rightSigs[signature(sample.Metric)]; ok == (e.Op == tokenAnd) {
+				ret = append(ret, sample)
+			}
+		}
+	case tokenOr:
+		leftSigs := make(map[string]struct{}, len(lhs))
+		for _, sample := range lhs {
+			leftSigs[signature(sample.Metric)] = struct{}{}
+			ret = append(ret, sample)
+		}
+		for _, sample := range rhs {
+			if _, ok := leftSigs[signature(sample.Metric)]; !ok {
+				ret = append(ret, sample)
+			}
+		}
+	}
+	return ret
+}
+
+// signatureFunc 返回计算匹配标签的函数，on时只使用指定的标签，否则使用除指定标签和指标名以外的标签
+func signatureFunc(on bool, names []string) func(tsdb.LabelList) string {
+	return func(labels tsdb.LabelList) string {
+		return groupingLabels(labels, names, !on).String()
+	}
+}
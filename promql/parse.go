@@ -0,0 +1,662 @@
+// Package promql 实现PromQL查询语言，与Prometheus不同的是指标名中允许出现'.'，例如cpu.busy
+package promql
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"tsdb"
+)
+
+const (
+	metricLabel = "__name__"
+
+	precedencePow = 6
+)
+
+// binaryOp 二元运算符的优先级和类别
+type binaryOp struct {
+	name       string
+	precedence int
+	comparison bool
+	set        bool
+}
+
+var (
+	binaryOps = map[tokenType]binaryOp{
+		tokenOr:       {name: "or", precedence: 1, set: true},
+		tokenAnd:      {name: "and", precedence: 2, set: true},
+		tokenUnless:   {name: "unless", precedence: 2, set: true},
+		tokenEqlC:     {name: "==", precedence: 3, comparison: true},
+		tokenNotEqual: {name: "!=", precedence: 3, comparison: true},
+		tokenGtr:      {name: ">", precedence: 3, comparison: true},
+		tokenLss:      {name: "<", precedence: 3, comparison: true},
+		tokenGte:      {name: ">=", precedence: 3, comparison: true},
+		tokenLte:      {name: "<=", precedence: 3, comparison: true},
+		tokenAdd:      {name: "+", precedence: 4},
+		tokenSub:      {name: "-", precedence: 4},
+		tokenMul:      {name: "*", precedence: 5},
+		tokenDiv:      {name: "/", precedence: 5},
+		tokenMod:      {name: "%", precedence: 5},
+		tokenPow:      {name: "^", precedence: precedencePow},
+	}
+
+	// aggregators 聚合运算符，值表示是否需要参数
+	aggregators = map[string]bool{
+		"sum":      false,
+		"avg":      false,
+		"min":      false,
+		"max":      false,
+		"count":    false,
+		"group":    false,
+		"stddev":   false,
+		"stdvar":   false,
+		"topk":     true,
+		"bottomk":  true,
+		"quantile": true,
+	}
+)
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func newParser(input string) (*parser, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	return &parser{tokens: tokens}, nil
+}
+
+// ParseMetricSelector 解析cpu.busy{dc=~"gz-.*", node!="vm1"}这样的序列选择器，指标名会转换为__name__选择器
+func ParseMetricSelector(input string) ([]*tsdb.Matcher, error) {
+	p, err := newParser(input)
+	if err != nil {
+		return nil, err
+	}
+	matchers, err := p.parseSelector()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != tokenEOF {
+		return nil, p.errorf(t, "unexpected %s after selector", t)
+	}
+	return matchers, nil
+}
+
+// ParseExpr 解析PromQL表达式，支持选择器、函数、聚合、二元运算和offset，不支持子查询和@
+func ParseExpr(input string) (Expr, error) {
+	p, err := newParser(input)
+	if err != nil {
+		return nil, err
+	}
+	expr, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != tokenEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+	return expr, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+// peekAt 返回当前位置之后第n个token
+func (p *parser) peekAt(n int) token {
+	if p.pos+n >= len(p.tokens) {
+		return p.tokens[len(p.tokens)-1]
+	}
+	return p.tokens[p.pos+n]
+}
+
+// isKeyword 判断下一个token是否为关键字，关键字不区分大小写
+func (p *parser) isKeyword(keyword string) bool {
+	t := p.peek()
+	return t.typ == tokenIdentifier && strings.EqualFold(t.val, keyword)
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(typ tokenType, context string) (token, error) {
+	t := p.next()
+	if t.typ != typ {
+		return t, p.errorf(t, "unexpected %s in %s", t, context)
+	}
+	return t, nil
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return fmt.Errorf("parse error at position %d: %s", t.pos, fmt.Sprintf(format, args...))
+}
+
+// parseExpr 按运算符优先级解析二元运算，只处理优先级不低于minPrecedence的运算符
+func (p *parser) parseExpr(minPrecedence int) (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		typ, ok := binaryOpType(t)
+		if !ok || binaryOps[typ].precedence < minPrecedence {
+			return lhs, nil
+		}
+		p.next()
+		op := binaryOps[typ]
+		expr := &BinaryExpr{Op: typ, LHS: lhs}
+		if p.isKeyword("bool") {
+			if !op.comparison {
+				return nil, p.errorf(p.peek(), "bool modifier can only be used on comparison operators")
+			}
+			p.next()
+			expr.ReturnBool = true
+		}
+		matching, err := p.parseVectorMatching(op)
+		if err != nil {
+			return nil, err
+		}
+		next := op.precedence + 1
+		if typ == tokenPow {
+			// ^是右结合的
+			next = op.precedence
+		}
+		if expr.RHS, err = p.parseExpr(next); err != nil {
+			return nil, err
+		}
+		if err = p.checkBinary(t, expr, matching); err != nil {
+			return nil, err
+		}
+		lhs = expr
+	}
+}
+
+// binaryOpType 返回t对应的二元运算符，集合运算符是标识符
+func binaryOpType(t token) (tokenType, bool) {
+	typ := t.typ
+	if typ == tokenIdentifier {
+		switch strings.ToLower(t.val) {
+		case "and":
+			typ = tokenAnd
+		case "or":
+			typ = tokenOr
+		case "unless":
+			typ = tokenUnless
+		default:
+			return 0, false
+		}
+	}
+	_, ok := binaryOps[typ]
+	return typ, ok
+}
+
+// parseVectorMatching 解析on、ignoring、group_left和group_right
+func (p *parser) parseVectorMatching(op binaryOp) (*VectorMatching, error) {
+	matching := &VectorMatching{Card: cardOneToOne}
+	if op.set {
+		matching.Card = cardManyToMany
+	}
+	if !p.isKeyword("on") && !p.isKeyword("ignoring") {
+		return matching, nil
+	}
+	matching.On = strings.EqualFold(p.next().val, "on")
+	labels, err := p.parseLabelList("vector matching")
+	if err != nil {
+		return nil, err
+	}
+	matching.MatchingLabels = labels
+	if !p.isKeyword("group_left") && !p.isKeyword("group_right") {
+		return matching, nil
+	}
+	t := p.next()
+	if op.set {
+		return nil, p.errorf(t, "no grouping allowed for %q operation", op.name)
+	}
+	matching.Card = cardManyToOne
+	if strings.EqualFold(t.val, "group_right") {
+		matching.Card = cardOneToMany
+	}
+	if p.peek().typ == tokenLeftParen {
+		if matching.Include, err = p.parseLabelList("grouping"); err != nil {
+			return nil, err
+		}
+	}
+	return matching, nil
+}
+
+// checkBinary 校验二元运算两侧的类型
+func (p *parser) checkBinary(t token, expr *BinaryExpr, matching *VectorMatching) error {
+	op := binaryOps[expr.Op]
+	lt, rt := expr.LHS.Type(), expr.RHS.Type()
+	for _, typ := range []ValueType{lt, rt} {
+		if typ != ValueTypeScalar && typ != ValueTypeVector {
+			return p.errorf(t, "binary expression must contain only scalar and instant vector types")
+		}
+	}
+	if op.set && (lt != ValueTypeVector || rt != ValueTypeVector) {
+		return p.errorf(t, "set operator %q not allowed in binary scalar expression", op.name)
+	}
+	if op.comparison && lt == ValueTypeScalar && rt == ValueTypeScalar && !expr.ReturnBool {
+		return p.errorf(t, "comparisons between scalars must use BOOL modifier")
+	}
+	if lt == ValueTypeVector && rt == ValueTypeVector {
+		expr.Matching = matching
+		return nil
+	}
+	if matching.On || len(matching.MatchingLabels) > 0 || matching.Card == cardManyToOne || matching.Card == cardOneToMany {
+		return p.errorf(t, "vector matching only allowed between instant vectors")
+	}
+	return nil
+}
+
+// parseUnary 解析取负运算，-2^2等价于-(2^2)
+func (p *parser) parseUnary() (Expr, error) {
+	t := p.peek()
+	if t.typ != tokenSub && t.typ != tokenAdd {
+		return p.parsePostfix()
+	}
+	p.next()
+	expr, err := p.parseExpr(precedencePow)
+	if err != nil {
+		return nil, err
+	}
+	if typ := expr.Type(); typ != ValueTypeScalar && typ != ValueTypeVector {
+		return nil, p.errorf(t, "unary expression only allowed on expressions of type scalar or instant vector, got %s", typ)
+	}
+	if t.typ == tokenAdd {
+		return expr, nil
+	}
+	if number, ok := expr.(*NumberLiteral); ok {
+		number.Val = -number.Val
+		return number, nil
+	}
+	return &UnaryExpr{Expr: expr}, nil
+}
+
+// parsePostfix 解析表达式后面的范围和offset
+func (p *parser) parsePostfix() (Expr, error) {
+	expr, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		switch {
+		case t.typ == tokenLeftBracket:
+			vs, ok := expr.(*VectorSelector)
+			if !ok || vs.Offset != 0 {
+				return nil, p.errorf(t, "ranges only allowed for vector selectors")
+			}
+			p.next()
+			d, err := p.parseDurationToken("range")
+			if err != nil {
+				return nil, err
+			}
+			if p.peek().typ == tokenColon {
+				return nil, p.errorf(p.peek(), "subqueries are not supported")
+			}
+			if _, err = p.expect(tokenRightBracket, "range"); err != nil {
+				return nil, err
+			}
+			if d <= 0 {
+				return nil, p.errorf(t, "range must be positive")
+			}
+			expr = &MatrixSelector{Vector: vs, Range: d}
+		case p.isKeyword("offset"):
+			var vs *VectorSelector
+			switch e := expr.(type) {
+			case *VectorSelector:
+				vs = e
+			case *MatrixSelector:
+				vs = e.Vector
+			}
+			if vs == nil || vs.Offset != 0 {
+				return nil, p.errorf(t, "offset modifier must be preceded by an instant vector selector or range vector selector")
+			}
+			p.next()
+			negative := p.peek().typ == tokenSub
+			if negative {
+				p.next()
+			}
+			d, err := p.parseDurationToken("offset")
+			if err != nil {
+				return nil, err
+			}
+			if negative {
+				d = -d
+			}
+			vs.Offset = d
+		default:
+			return expr, nil
+		}
+	}
+}
+
+func (p *parser) parseDurationToken(context string) (time.Duration, error) {
+	t, err := p.expect(tokenDuration, context)
+	if err != nil {
+		return 0, err
+	}
+	d, err := ParseDuration(t.val)
+	if err != nil {
+		return 0, p.errorf(t, "%v", err)
+	}
+	return d, nil
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.peek()
+	switch t.typ {
+	case tokenNumber:
+		p.next()
+		value, err := parseNumber(t.val)
+		if err != nil {
+			return nil, p.errorf(t, "%v", err)
+		}
+		return &NumberLiteral{Val: value}, nil
+	case tokenString:
+		p.next()
+		return &StringLiteral{Val: t.val}, nil
+	case tokenLeftParen:
+		p.next()
+		expr, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = p.expect(tokenRightParen, "parenthesized expression"); err != nil {
+			return nil, err
+		}
+		return &ParenExpr{Expr: expr}, nil
+	case tokenLeftBrace:
+		return p.parseVectorSelector()
+	case tokenIdentifier:
+		next := p.peekAt(1)
+		if _, ok := aggregators[strings.ToLower(t.val)]; ok {
+			if next.typ == tokenLeftParen || (next.typ == tokenIdentifier && (strings.EqualFold(next.val, "by") || strings.EqualFold(next.val, "without"))) {
+				return p.parseAggregate()
+			}
+		}
+		if next.typ == tokenLeftParen {
+			return p.parseCall()
+		}
+		return p.parseVectorSelector()
+	}
+	return nil, p.errorf(t, "unexpected %s, expected an expression", t)
+}
+
+func parseNumber(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "inf":
+		return math.Inf(1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		n, err := strconv.ParseInt(s, 0, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %q", s)
+		}
+		return float64(n), nil
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return value, nil
+}
+
+func (p *parser) parseVectorSelector() (Expr, error) {
+	vs := &VectorSelector{}
+	if t := p.peek(); t.typ == tokenIdentifier {
+		vs.Name = t.val
+	}
+	matchers, err := p.parseSelector()
+	if err != nil {
+		return nil, err
+	}
+	vs.Matchers = matchers
+	return vs, nil
+}
+
+func (p *parser) parseCall() (Expr, error) {
+	t := p.next()
+	fn, ok := functions[t.val]
+	if !ok {
+		return nil, p.errorf(t, "unknown function with name %q", t.val)
+	}
+	p.next()
+	args := make([]Expr, 0)
+	for p.peek().typ != tokenRightParen {
+		arg, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.peek().typ == tokenComma {
+			p.next()
+			continue
+		}
+		if next := p.peek(); next.typ != tokenRightParen {
+			return nil, p.errorf(next, "unexpected %s in function call, expected , or )", next)
+		}
+	}
+	p.next()
+
+	if len(args) < len(fn.argTypes)-fn.optional || len(args) > len(fn.argTypes) {
+		return nil, p.errorf(t, "expected %d argument(s) in call to %q, got %d", len(fn.argTypes), fn.name, len(args))
+	}
+	for i, arg := range args {
+		if arg.Type() != fn.argTypes[i] {
+			return nil, p.errorf(t, "expected type %s in call to function %q, got %s", fn.argTypes[i], fn.name, arg.Type())
+		}
+	}
+	return &Call{Func: fn, Args: args}, nil
+}
+
+// parseAggregate 解析sum by (node) (expr)或者sum(expr) by (node)
+func (p *parser) parseAggregate() (Expr, error) {
+	t := p.next()
+	agg := &AggregateExpr{Op: strings.ToLower(t.val)}
+	modified := false
+	parseModifier := func() error {
+		if !p.isKeyword("by") && !p.isKeyword("without") {
+			return nil
+		}
+		agg.Without = strings.EqualFold(p.next().val, "without")
+		labels, err := p.parseLabelList("grouping")
+		if err != nil {
+			return err
+		}
+		agg.Grouping = labels
+		modified = true
+		return nil
+	}
+	if err := parseModifier(); err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(tokenLeftParen, "aggregation"); err != nil {
+		return nil, err
+	}
+	if aggregators[agg.Op] {
+		param, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		if param.Type() != ValueTypeScalar {
+			return nil, p.errorf(t, "expected type scalar in aggregation parameter, got %s", param.Type())
+		}
+		agg.Param = param
+		if _, err = p.expect(tokenComma, "aggregation"); err != nil {
+			return nil, err
+		}
+	}
+	expr, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if expr.Type() != ValueTypeVector {
+		return nil, p.errorf(t, "expected type instant vector in aggregation expression, got %s", expr.Type())
+	}
+	agg.Expr = expr
+	if _, err = p.expect(tokenRightParen, "aggregation"); err != nil {
+		return nil, err
+	}
+	if !modified {
+		if err = parseModifier(); err != nil {
+			return nil, err
+		}
+	}
+	return agg, nil
+}
+
+// parseLabelList 解析(label1, label2)这样的标签列表
+func (p *parser) parseLabelList(context string) ([]string, error) {
+	if _, err := p.expect(tokenLeftParen, context); err != nil {
+		return nil, err
+	}
+	labels := make([]string, 0)
+	for p.peek().typ != tokenRightParen {
+		t, err := p.expect(tokenIdentifier, context)
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, t.val)
+		if p.peek().typ == tokenComma {
+			p.next()
+			continue
+		}
+		if next := p.peek(); next.typ != tokenRightParen {
+			return nil, p.errorf(next, "unexpected %s in %s, expected , or )", next, context)
+		}
+	}
+	p.next()
+	return labels, nil
+}
+
+// parseSelector 解析 metric{label="value", ...}，指标名和标签选择器至少有一个
+func (p *parser) parseSelector() ([]*tsdb.Matcher, error) {
+	matchers := make([]*tsdb.Matcher, 0)
+	t := p.peek()
+	if t.typ == tokenIdentifier {
+		p.next()
+		matchers = append(matchers, tsdb.MustNewMatcher(tsdb.MatchEqual, metricLabel, t.val))
+	}
+	if p.peek().typ == tokenLeftBrace {
+		labelMatchers, err := p.parseLabelMatchers()
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, labelMatchers...)
+	}
+	if len(matchers) == 0 {
+		return nil, p.errorf(t, "unexpected %s, expected a selector", t)
+	}
+	// 至少需要一个不匹配空值的选择器，避免查询全部时间线
+	for _, m := range matchers {
+		if !m.Matches("") {
+			return matchers, nil
+		}
+	}
+	return nil, p.errorf(t, "vector selector must contain at least one non-empty matcher")
+}
+
+func (p *parser) parseLabelMatchers() ([]*tsdb.Matcher, error) {
+	if _, err := p.expect(tokenLeftBrace, "label matching"); err != nil {
+		return nil, err
+	}
+	matchers := make([]*tsdb.Matcher, 0)
+	for p.peek().typ != tokenRightBrace {
+		name, err := p.expect(tokenIdentifier, "label matching")
+		if err != nil {
+			return nil, err
+		}
+		op := p.next()
+		var matchType tsdb.MatchType
+		switch op.typ {
+		case tokenAssign:
+			matchType = tsdb.MatchEqual
+		case tokenNotEqual:
+			matchType = tsdb.MatchNotEqual
+		case tokenRegexp:
+			matchType = tsdb.MatchRegexp
+		case tokenNotRegex:
+			matchType = tsdb.MatchNotRegexp
+		default:
+			return nil, p.errorf(op, "unexpected %s in label matching, expected one of =, !=, =~, !~", op)
+		}
+		value, err := p.expect(tokenString, "label matching")
+		if err != nil {
+			return nil, err
+		}
+		m, err := tsdb.NewMatcher(matchType, name.val, value.val)
+		if err != nil {
+			return nil, p.errorf(value, "%v", err)
+		}
+		matchers = append(matchers, m)
+
+		if p.peek().typ == tokenComma {
+			p.next()
+			continue
+		}
+		if p.peek().typ != tokenRightBrace {
+			t := p.peek()
+			return nil, p.errorf(t, "unexpected %s in label matching, expected , or }", t)
+		}
+	}
+	p.next()
+	return matchers, nil
+}
+
+// ParseDuration 解析1h30m、5m、100ms这样的时长，单位支持y、w、d、h、m、s、ms
+func ParseDuration(s string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"y":  365 * 24 * time.Hour,
+		"w":  7 * 24 * time.Hour,
+		"d":  24 * time.Hour,
+		"h":  time.Hour,
+		"m":  time.Minute,
+		"s":  time.Second,
+		"ms": time.Millisecond,
+	}
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+	var total time.Duration
+	for len(s) > 0 {
+		i := 0
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		n, err := strconv.ParseInt(s[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		s = s[i:]
+		j := 0
+		for j < len(s) && !isDigit(s[j]) {
+			j++
+		}
+		unit, ok := units[s[:j]]
+		if !ok {
+			return 0, fmt.Errorf("unknown duration unit %q", s[:j])
+		}
+		total += time.Duration(n) * unit
+		s = s[j:]
+	}
+	return total, nil
+}
@@ -0,0 +1,251 @@
+package promql
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+	"tsdb"
+)
+
+func TestParseMetricSelector(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected []string
+	}{
+		{`cpu_busy`, []string{`__name__="cpu_busy"`}},
+		{`cpu.busy{node="vm1", dc!~'dc[12]'}`, []string{`__name__="cpu.busy"`, `node="vm1"`, `dc!~"dc[12]"`}},
+		{`{__name__=~"cpu.*",}`, []string{`__name__=~"cpu.*"`}},
+	}
+	for _, c := range cases {
+		matchers, err := ParseMetricSelector(c.input)
+		if err != nil {
+			t.Fatalf("%s: %v", c.input, err)
+		}
+		if len(matchers) != len(c.expected) {
+			t.Fatalf("%s: unexpected matchers: %v", c.input, matchers)
+		}
+		for i := range matchers {
+			if matchers[i].String() != c.expected[i] {
+				t.Fatalf("%s: expected %s, got %s", c.input, c.expected[i], matchers[i].String())
+			}
+		}
+	}
+
+	for _, input := range []string{``, `cpu{`, `{node=""}`, `cpu{node="vm1"} + 1`, `cpu{node=~"("}`} {
+		if _, err := ParseMetricSelector(input); err == nil {
+			t.Fatalf("%s: expected error", input)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	cases := map[string]time.Duration{
+		"5m":    5 * time.Minute,
+		"1h30m": 90 * time.Minute,
+		"250ms": 250 * time.Millisecond,
+		"1w":    7 * 24 * time.Hour,
+	}
+	for input, expected := range cases {
+		d, err := ParseDuration(input)
+		if err != nil {
+			t.Fatalf("%s: %v", input, err)
+		}
+		if d != expected {
+			t.Fatalf("%s: expected %v, got %v", input, expected, d)
+		}
+	}
+	if _, err := ParseDuration("5x"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestParseExpr(t *testing.T) {
+	cases := map[string]string{
+		`cpu_busy{node="vm1"} offset 5m`:                      `cpu_busy{node="vm1"} offset 5m`,
+		`sum by (node) (rate(cpu_busy[5m]))`:                  `sum by (node) (rate(cpu_busy[5m]))`,
+		`sum(rate(cpu_busy[1h30m])) without (dc)`:             `sum without (dc) (rate(cpu_busy[1h30m]))`,
+		`topk(3, cpu_busy)`:                                   `topk(3, cpu_busy)`,
+		`1 + 2 * 3 ^ 2 ^ 2`:                                   `1 + 2 * 3 ^ 2 ^ 2`,
+		`-2 ^ 2`:                                              `-2 ^ 2`,
+		`cpu_busy > bool on (node) group_left (dc) cpu_total`: `cpu_busy > bool on (node) group_left (dc) cpu_total`,
+		`cpu_busy and ignoring (dc) cpu_total`:                `cpu_busy and ignoring (dc) cpu_total`,
+		`round(cpu_busy, 0.5)`:                                `round(cpu_busy, 0.5)`,
+	}
+	for input, expected := range cases {
+		expr, err := ParseExpr(input)
+		if err != nil {
+			t.Fatalf("%s: %v", input, err)
+		}
+		if expr.String() != expected {
+			t.Fatalf("%s: expected %s, got %s", input, expected, expr.String())
+		}
+	}
+
+	// ^右结合，-比^优先级低
+	expr, _ := ParseExpr(`-2 ^ 3 ^ 2`)
+	unary, ok := expr.(*UnaryExpr)
+	if !ok {
+		t.Fatalf("unexpected expr: %#v", expr)
+	}
+	if rhs := unary.Expr.(*BinaryExpr).RHS; rhs.String() != `3 ^ 2` {
+		t.Fatalf("unexpected rhs: %s", rhs)
+	}
+
+	for _, input := range []string{
+		``, `sum(`, `rate(cpu_busy)`, `rate(cpu_busy[5m:1m])`, `unknown(cpu_busy)`,
+		`topk(cpu_busy)`, `cpu_busy and 1`, `1 > 2`, `"a" + 1`, `cpu_busy[5m] + 1`,
+		`cpu_busy + on(node) group_left`, `sum by (node) (cpu_busy) by (dc)`,
+	} {
+		if _, err := ParseExpr(input); err == nil {
+			t.Fatalf("%s: expected error", input)
+		}
+	}
+}
+
+func TestEngine(t *testing.T) {
+	db, err := tsdb.Open(tsdb.WithDataPath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	// 计数器每分钟增加60，vm2在第5个点重置
+	var start int64 = 1600000000
+	rows := make([]*tsdb.Row, 0)
+	for i := int64(0); i < 10; i++ {
+		for _, node := range []string{"vm1", "vm2"} {
+			value := float64(i * 60)
+			if node == "vm2" && i >= 5 {
+				value = float64((i - 5) * 60)
+			}
+			rows = append(rows, &tsdb.Row{
+				Metric: "requests",
+				Labels: tsdb.LabelList{{Name: "node", Value: node}, {Name: "dc", Value: "dc1"}},
+				Point:  tsdb.Point{Timestamp: start + i*60, Value: value},
+			}, &tsdb.Row{
+				Metric: "capacity",
+				Labels: tsdb.LabelList{{Name: "node", Value: node}, {Name: "owner", Value: "team-" + node}},
+				Point:  tsdb.Point{Timestamp: start + i*60, Value: 100},
+			})
+		}
+	}
+	errs, err := db.InsertRowsSync(context.Background(), rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	engine := NewEngine(db, 5*time.Minute)
+	instant := func(input string, ts int64) Value {
+		expr, err := ParseExpr(input)
+		if err != nil {
+			t.Fatalf("%s: %v", input, err)
+		}
+		value, err := engine.Instant(context.Background(), expr, time.Unix(ts, 0))
+		if err != nil {
+			t.Fatalf("%s: %v", input, err)
+		}
+		return value
+	}
+	expectVector := func(input string, ts int64, expected map[string]float64) {
+		vector, ok := instant(input, ts).(Vector)
+		if !ok || len(vector) != len(expected) {
+			t.Fatalf("%s: unexpected result: %v", input, vector)
+		}
+		for _, sample := range vector {
+			value, ok := expected[sample.Metric.String()]
+			if !ok || math.Abs(value-sample.Point.Value) > 1e-9 {
+				t.Fatalf("%s: unexpected sample %s => %v", input, sample.Metric, sample.Point.Value)
+			}
+		}
+	}
+
+	last := start + 9*60
+	expectVector(`requests{node="vm1"}`, last, map[string]float64{
+		`{__name__="requests", dc="dc1", node="vm1"}`: 540,
+	})
+	expectVector(`requests{node="vm1"} offset 2m`, last, map[string]float64{
+		`{__name__="requests", dc="dc1", node="vm1"}`: 420,
+	})
+	// 超过lookback没有数据
+	expectVector(`requests`, last+10*60, map[string]float64{})
+	// vm2从0开始，外推不会超过0
+	expectVector(`rate(requests[5m])`, last, map[string]float64{
+		`{dc="dc1", node="vm1"}`: 1,
+		`{dc="dc1", node="vm2"}`: 0.8,
+	})
+	// 计数器重置
+	expectVector(`increase(requests{node="vm2"}[10m])`, last, map[string]float64{
+		`{dc="dc1", node="vm2"}`: 480,
+	})
+	expectVector(`sum by (dc) (increase(requests[4m]))`, last, map[string]float64{
+		`{dc="dc1"}`: 480,
+	})
+	expectVector(`irate(requests{node="vm2"}[5m])`, start+5*60, map[string]float64{
+		`{dc="dc1", node="vm2"}`: 0,
+	})
+	expectVector(`max_over_time(requests[3m])`, last, map[string]float64{
+		`{dc="dc1", node="vm1"}`: 540,
+		`{dc="dc1", node="vm2"}`: 240,
+	})
+	expectVector(`topk(1, requests)`, last, map[string]float64{
+		`{__name__="requests", dc="dc1", node="vm1"}`: 540,
+	})
+	expectVector(`count without (node) (requests)`, last, map[string]float64{
+		`{dc="dc1"}`: 2,
+	})
+	expectVector(`requests > 300`, last, map[string]float64{
+		`{__name__="requests", dc="dc1", node="vm1"}`: 540,
+	})
+	expectVector(`requests / on (node) group_left (owner) capacity`, last, map[string]float64{
+		`{dc="dc1", node="vm1", owner="team-vm1"}`: 5.4,
+		`{dc="dc1", node="vm2", owner="team-vm2"}`: 2.4,
+	})
+	expectVector(`requests unless on (node) requests{node="vm1"}`, last, map[string]float64{
+		`{__name__="requests", dc="dc1", node="vm2"}`: 240,
+	})
+	if s := instant(`scalar(sum(requests)) * 2`, last).(Scalar); s.V != 1560 {
+		t.Fatalf("unexpected scalar: %v", s.V)
+	}
+
+	expr, _ := ParseExpr(`requests / on () capacity`)
+	if _, err = engine.Instant(context.Background(), expr, time.Unix(last, 0)); err == nil {
+		t.Fatal("expected many-to-many error")
+	}
+
+	expr, _ = ParseExpr(`sum(requests)`)
+	matrix, err := engine.Range(context.Background(), expr, time.Unix(start, 0), time.Unix(last, 0), 3*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matrix) != 1 || len(matrix[0].Points) != 4 || matrix[0].Points[3].Value != 780 {
+		t.Fatalf("unexpected matrix: %v", matrix)
+	}
+	if _, err = engine.Range(context.Background(), expr, time.Unix(start, 0), time.Unix(last, 0), time.Millisecond); err == nil {
+		t.Fatal("expected step error")
+	}
+
+	// 每一步只读取时间窗口内的数据点，窗口移出数据范围后没有数据点
+	expectRange := func(input string, expected []float64, first int64) {
+		expr, _ := ParseExpr(input)
+		matrix, err := engine.Range(context.Background(), expr, time.Unix(start, 0), time.Unix(last+20*60, 0), time.Minute)
+		if err != nil {
+			t.Fatalf("%s: %v", input, err)
+		}
+		if len(matrix) != 1 || len(matrix[0].Points) != len(expected) {
+			t.Fatalf("%s: unexpected matrix: %v", input, matrix)
+		}
+		for i, p := range matrix[0].Points {
+			if p.Timestamp != first+int64(i)*60 || p.Value != expected[i] {
+				t.Fatalf("%s: unexpected point %d: %v", input, i, p)
+			}
+		}
+	}
+	expectRange(`max_over_time(requests{node="vm1"}[2m])`, []float64{0, 60, 120, 180, 240, 300, 360, 420, 480, 540, 540}, start)
+	expectRange(`requests{node="vm1"} offset 1m`, []float64{0, 60, 120, 180, 240, 300, 360, 420, 480, 540, 540, 540, 540, 540}, start+60)
+}
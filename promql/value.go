@@ -0,0 +1,56 @@
+package promql
+
+import (
+	"tsdb"
+)
+
+// Value 表达式的计算结果，时间戳使用数据库的精度
+type Value interface {
+	Type() ValueType
+}
+
+// Scalar 标量
+type Scalar struct {
+	T int64
+	V float64
+}
+
+// String 字符串
+type String struct {
+	T int64
+	V string
+}
+
+// Sample 瞬时向量中的一个样本
+type Sample struct {
+	Metric tsdb.LabelList
+	Point  tsdb.Point
+}
+
+// Vector 瞬时向量，同一时刻每条时间线一个样本
+type Vector []Sample
+
+// Series 区间向量中的一条时间线
+type Series struct {
+	Metric tsdb.LabelList
+	Points []tsdb.Point
+}
+
+// Matrix 区间向量，也是范围查询的结果
+type Matrix []Series
+
+func (Scalar) Type() ValueType { return ValueTypeScalar }
+func (String) Type() ValueType { return ValueTypeString }
+func (Vector) Type() ValueType { return ValueTypeVector }
+func (Matrix) Type() ValueType { return ValueTypeMatrix }
+
+// dropMetricName 返回去掉__name__标签的副本，运算结果不再表示原来的指标
+func dropMetricName(labels tsdb.LabelList) tsdb.LabelList {
+	ret := make(tsdb.LabelList, 0, len(labels))
+	for _, label := range labels {
+		if label.Name != metricLabel {
+			ret = append(ret, label)
+		}
+	}
+	return ret
+}
@@ -1,6 +1,7 @@
 package tsdb
 
 import (
+	"fmt"
 	"os"
 	"sync"
 )
@@ -14,12 +15,15 @@ type Segment interface {
 	Cleanup() error
 	Load() Segment
 	QueryLabelValuse(label string) []string
+	QueryLabelNames() []string
+	Select(matchers []*Matcher, start, end int64) ([]*segmentSeries, error)
 }
 
 type segmentList struct {
 	mutex sync.RWMutex
 	head  Segment
 	list  List
+	keys  map[Segment]int64 // segment在list中的key，memtable加入list后乱序写入会使MinTs变小，需要按加入时的key移除
 }
 
 type Desc struct {
@@ -33,38 +37,164 @@ const (
 	metricName = "__name__"
 )
 
-func newSegmentList() *segmentList {
+func newSegmentList(opts *options) *segmentList {
 	return &segmentList{
-		head: newMemtable(),
+		head: newMemtable(opts),
 		list: newTree(),
+		keys: make(map[Segment]int64),
 	}
 }
 
-func (s *segmentList) Add(segment Segment) {
+// Head 返回正在写入的memtable
+func (s *segmentList) Head() Segment {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.head
+}
+
+// RotateHead 将head加入list并使用next作为新的head，两步在同一个锁内完成，查询不会漏掉旧的head。
+// 与list中的segment的MinTs相同时返回SegmentConflictError，head保持不变
+func (s *segmentList) RotateHead(next Segment) (Segment, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.list.Add(segment.MinTs(), segment)
+	pre := s.head
+	if err := s.add(pre); err != nil {
+		return nil, err
+	}
+	s.head = next
+	return pre, nil
 }
 
-func (s *segmentList) Replace(pre, next Segment) error {
+// Add 将segment加入list，与list中的segment的MinTs相同时返回SegmentConflictError
+func (s *segmentList) Add(segment Segment) error {
 	s.mutex.Lock()
-	s.mutex.Unlock()
-	if err := pre.Close(); err != nil {
+	defer s.mutex.Unlock()
+	return s.add(segment)
+}
+
+func (s *segmentList) add(segment Segment) error {
+	key := segment.MinTs()
+	if err := s.conflict(nil, key); err != nil {
 		return err
 	}
+	s.list.Add(key, segment)
+	s.keys[segment] = key
+	return nil
+}
+
+// remove 按加入list时的key移除segment
+func (s *segmentList) remove(segment Segment) {
+	if key, ok := s.keys[segment]; ok {
+		s.list.Remove(key)
+		delete(s.keys, segment)
+	}
+}
 
+// Replace 使用next替换list中的pre，pre需要调用方提前Close。
+// pre不在list中，或者list中除pre以外的segment与next的MinTs相同时返回错误，list保持不变
+func (s *segmentList) Replace(pre, next Segment) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.keys[pre]; !ok {
+		return fmt.Errorf("segment [%d, %d] is not in list", pre.MinTs(), pre.MaxTs())
+	}
+	if err := s.conflict([]Segment{pre}, next.MinTs()); err != nil {
+		return err
+	}
 	if err := pre.Cleanup(); err != nil {
 		return err
 	}
-	s.list.Add(pre.MinTs(), next)
+	s.remove(pre)
+	return s.add(next)
+}
+
+// Swap 从list中移除olds并添加next，olds需要调用方在之后Close。
+// list以MinTs为key，不属于olds的segment与next的MinTs相同时返回SegmentConflictError，list保持不变
+func (s *segmentList) Swap(olds []Segment, next Segment) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.conflict(olds, next.MinTs()); err != nil {
+		return err
+	}
+	for _, old := range olds {
+		s.remove(old)
+	}
+	return s.add(next)
+}
+
+// Conflict 检查list中是否有不属于olds且MinTs为minTs的segment
+func (s *segmentList) Conflict(olds []Segment, minTs int64) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.conflict(olds, minTs)
+}
+
+func (s *segmentList) conflict(olds []Segment, minTs int64) error {
+	iter := s.list.Range(minTs, minTs)
+	for iter.Next() {
+		segment := iter.Value().(Segment)
+		replaced := false
+		for _, old := range olds {
+			if old == segment {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			return fmt.Errorf("%w: %d", SegmentConflictError, minTs)
+		}
+	}
 	return nil
 }
 
+// all 返回全部segment，包括head
+func (s *segmentList) all() []Segment {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	ret := make([]Segment, 0)
+	iter := s.list.All()
+	for iter.Next() {
+		ret = append(ret, iter.Value().(Segment))
+	}
+	return append(ret, s.head)
+}
+
+// memtables 返回还未持久化的memtable，包括head
+func (s *segmentList) memtables() []*memtable {
+	ret := make([]*memtable, 0)
+	for _, segment := range s.all() {
+		if m, ok := segment.(*memtable); ok {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
+
+// RemoveBefore 从list中移除MaxTs早于ts的diskSegment并返回
+func (s *segmentList) RemoveBefore(ts int64) []Segment {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	removed := make([]Segment, 0)
+	iter := s.list.All()
+	for iter.Next() {
+		segment, ok := iter.Value().(*diskSegment)
+		if !ok || segment.MaxTs() >= ts {
+			continue
+		}
+		removed = append(removed, segment)
+	}
+	for _, segment := range removed {
+		s.remove(segment)
+	}
+	return removed
+}
+
 func isFileExist(path string) bool {
 	_, err := os.Stat(path)
 	return !os.IsNotExist(err)
 }
 
+// Get 返回与[start, end]有交集的segment，使用结束后需要调用Release
 func (s *segmentList) Get(start, end int64) []Segment {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -73,6 +203,10 @@ func (s *segmentList) Get(start, end int64) []Segment {
 	for iter.Next() {
 		segment := iter.Value().(Segment)
 		if s.Scope(segment, start, end) {
+			if ds, ok := segment.(*diskSegment); ok {
+				// 保证查询结束前segment不会被Close
+				ds.wait.Add(1)
+			}
 			segments = append(segments, segment)
 		}
 	}
@@ -82,17 +216,16 @@ func (s *segmentList) Get(start, end int64) []Segment {
 	return segments
 }
 
-func (s *segmentList) Scope(segment Segment, start, end int64) bool {
-	if segment.MinTs() < start && segment.MaxTs() > start {
-		return true
-	}
-
-	if segment.MinTs() > start && segment.MaxTs() < end {
-		return true
+// Release 释放Get返回的segment
+func (s *segmentList) Release(segments []Segment) {
+	for _, segment := range segments {
+		if ds, ok := segment.(*diskSegment); ok {
+			ds.wait.Done()
+		}
 	}
+}
 
-	if segment.MinTs() < end && segment.MaxTs() > end {
-		return true
-	}
-	return false
+// Scope 判断segment的时间范围与[start, end]是否有交集
+func (s *segmentList) Scope(segment Segment, start, end int64) bool {
+	return segment.MinTs() <= end && segment.MaxTs() >= start
 }
@@ -1,14 +1,14 @@
 package tsdb
 
 import (
-	"github.com/dgryski/go-tsz"
 	"math"
 	"sort"
 	"sync"
 )
 
 type tsStore struct {
-	block        *tsz.Series
+	chunks       []*xorChunk
+	maxRows      int64 // 每个数据块最多的数据点数量，不大于0时不限制
 	lock         sync.RWMutex
 	maxTimestamp int64
 	count        int64
@@ -19,35 +19,51 @@ type memSeries struct {
 	*tsStore
 }
 
-func newSeries(row *Row) *memSeries {
+// Series 一条时间线的查询结果，数据点按时间戳升序排列
+type Series struct {
+	Labels LabelList
+	Points []Point
+}
+
+const (
+	// 持久化时每个数据块的索引: | minT uint64 | maxT uint64 | 压缩后的长度 uint32 |
+	chunkIndexSize = uint64Size<<1 + uint32Size
+)
+
+func newSeries(row *Row, maxRows int64) *memSeries {
 	return &memSeries{
 		labels:  row.Labels,
-		tsStore: &tsStore{},
+		tsStore: &tsStore{maxRows: maxRows},
 	}
 }
 
 func (store *tsStore) Append(point *Point) *Point {
 	store.lock.Lock()
 	defer store.lock.Unlock()
-	if store.maxTimestamp >= point.Timestamp {
+	if store.count > 0 && store.maxTimestamp >= point.Timestamp {
 		return point
 	}
-	store.maxTimestamp = point.Timestamp
-	if store.count <= 0 {
-		store.block = tsz.New(uint32(point.Timestamp))
+	if store.count <= 0 || (store.maxRows > 0 && int64(store.head().Count()) >= store.maxRows) {
+		store.chunks = append(store.chunks, newXORChunk())
 	}
-	store.block.Push(uint32(point.Timestamp), point.Value)
+	store.head().Append(point.Timestamp, point.Value)
 	store.maxTimestamp = point.Timestamp
 	store.count++
 	return nil
 }
 
+// head 返回正在写入的数据块
+func (store *tsStore) head() *xorChunk {
+	return store.chunks[len(store.chunks)-1]
+}
+
+// MergeOutdatedList 合并乱序写入的数据点，返回新的tsStore。时间戳相同时保留数据块中的数据点，与memtable查询时的合并规则一致
 func (store *tsStore) MergeOutdatedList(list List) *tsStore {
 	if list == nil {
 		return store
 	}
 
-	newStore := &tsStore{}
+	newStore := &tsStore{maxRows: store.maxRows}
 	point := store.All()
 	item := list.All()
 	for item.Next() {
@@ -57,7 +73,8 @@ func (store *tsStore) MergeOutdatedList(list List) *tsStore {
 			Value:     listPoint.Value,
 		})
 	}
-	sort.Slice(point, func(i, j int) bool {
+	// 稳定排序保证时间戳相同时数据块中的数据点在前，Append会丢弃后面时间戳重复的数据点
+	sort.SliceStable(point, func(i, j int) bool {
 		return point[i].Timestamp < point[j].Timestamp
 	})
 	for i := 0; i < len(point); i++ {
@@ -66,8 +83,24 @@ func (store *tsStore) MergeOutdatedList(list List) *tsStore {
 	return newStore
 }
 
-func (store *tsStore) Bytes() []byte {
-	return store.block.Bytes()
+// Encode 编码为持久化格式: | 数据块数量 uint32 | 数据块索引 | 压缩后的数据块 |，
+// 数据块单独压缩，查询时只需要解压与查询时间有交集的数据块
+func (store *tsStore) Encode(compressor BytesCompressor) []byte {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	nowEncodingBuf := newEncodingBuf()
+	nowEncodingBuf.MarshalUint32(uint32(len(store.chunks)))
+	blocks := make([][]byte, 0, len(store.chunks))
+	for _, chunk := range store.chunks {
+		block := compressor.Compress(chunk.Bytes())
+		blocks = append(blocks, block)
+		nowEncodingBuf.MarshalUint64(uint64(chunk.MinTime()), uint64(chunk.MaxTime()))
+		nowEncodingBuf.MarshalUint32(uint32(len(block)))
+	}
+	for _, block := range blocks {
+		nowEncodingBuf.B = append(nowEncodingBuf.B, block...)
+	}
+	return nowEncodingBuf.Bytes()
 }
 
 func (store *tsStore) All() []Point {
@@ -75,19 +108,50 @@ func (store *tsStore) All() []Point {
 }
 
 func (store *tsStore) Get(start, end int64) []Point {
-	points := make([]Point, 0)
-	item := store.block.Iter()
-	for item.Next() {
-		ts, val := item.Values()
-		if ts > uint32(end) {
-			break
+	// 内存中的数据块不会出错
+	points, _ := readPoints(newChunksIterator(store.chunkRefs(), nil, start, end))
+	return points
+}
+
+// chunkRefs 返回全部数据块，已经写满的数据块不会再修改，正在写入的数据块会复制一份
+func (store *tsStore) chunkRefs() []chunkRef {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	chunks := make([]chunkRef, 0, len(store.chunks))
+	for i, chunk := range store.chunks {
+		data := chunk.Bytes()
+		if i == len(store.chunks)-1 {
+			data = append([]byte(nil), data...)
 		}
-		if ts >= uint32(start) {
-			points = append(points, Point{
-				Timestamp: int64(ts),
-				Value:     val,
-			})
+		chunks = append(chunks, chunkRef{minT: chunk.MinTime(), maxT: chunk.MaxTime(), data: data})
+	}
+	return chunks
+}
+
+// mergePoints 合并两组有序数据点，时间戳相同时保留后者
+func mergePoints(a, b []Point) []Point {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	ret := make([]Point, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i].Timestamp < b[j].Timestamp:
+			ret = append(ret, a[i])
+			i++
+		case a[i].Timestamp > b[j].Timestamp:
+			ret = append(ret, b[j])
+			j++
+		default:
+			ret = append(ret, b[j])
+			i++
+			j++
 		}
 	}
-	return points
+	ret = append(ret, a[i:]...)
+	return append(ret, b[j:]...)
 }
@@ -0,0 +1,149 @@
+package statsd
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"tsdb"
+)
+
+// series 同一个指标名、类型和标签组合的聚合结果
+type series struct {
+	name   string
+	typ    MetricType
+	tags   tsdb.LabelList
+	count  float64 // 按采样率换算后的数量
+	value  float64 // Counter的累计值，Gauge的当前值
+	values []float64
+	set    map[string]struct{}
+	idle   int // Gauge连续没有更新的刷新次数
+}
+
+// aggregator 聚合一个刷新间隔内的数据，Gauge在刷新后保留最后的值并在之后的每次刷新时写入，
+// 连续gaugeExpiry次刷新没有更新的Gauge被删除，gaugeExpiry为0时Gauge永不过期
+type aggregator struct {
+	mutex       sync.Mutex
+	series      map[string]*series
+	percentiles []float64
+	gaugeExpiry int
+}
+
+func newAggregator(percentiles []float64, gaugeExpiry int) *aggregator {
+	return &aggregator{
+		series:      make(map[string]*series),
+		percentiles: percentiles,
+		gaugeExpiry: gaugeExpiry,
+	}
+}
+
+func seriesKey(m *Metric) string {
+	tags := append(tsdb.LabelList(nil), m.Tags...)
+	tags.Sorted()
+	typ := m.Type
+	if typ == Histogram || typ == Distribution {
+		typ = Timer
+	}
+	return string(typ) + "|" + m.Name + "|" + tags.String()
+}
+
+func (a *aggregator) Add(m *Metric) {
+	key := seriesKey(m)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	s, ok := a.series[key]
+	if !ok {
+		s = &series{name: m.Name, typ: m.Type, tags: m.Tags}
+		if s.typ == Histogram || s.typ == Distribution {
+			s.typ = Timer
+		}
+		a.series[key] = s
+	}
+	switch s.typ {
+	case Counter:
+		s.value += m.Value / m.Rate
+	case Gauge:
+		s.idle = 0
+		if m.Delta {
+			s.value += m.Value
+		} else {
+			s.value = m.Value
+		}
+	case Timer:
+		s.count += 1 / m.Rate
+		s.values = append(s.values, m.Value)
+	case Set:
+		if s.set == nil {
+			s.set = make(map[string]struct{})
+		}
+		s.set[m.SetValue] = struct{}{}
+	}
+}
+
+// Flush 返回聚合结果并重置，interval为刷新间隔的秒数，用于计算Counter的速率
+func (a *aggregator) Flush(ts int64, interval float64) []*tsdb.Row {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	rows := make([]*tsdb.Row, 0, len(a.series))
+	emit := func(s *series, suffix string, value float64) {
+		metric := s.name
+		if suffix != "" {
+			metric += "_" + suffix
+		}
+		rows = append(rows, &tsdb.Row{
+			Metric: metric,
+			Labels: append(make(tsdb.LabelList, 0, len(s.tags)+1), s.tags...),
+			Point:  tsdb.Point{Timestamp: ts, Value: value},
+		})
+	}
+	for key, s := range a.series {
+		switch s.typ {
+		case Counter:
+			emit(s, "count", s.value)
+			emit(s, "rate", s.value/interval)
+		case Gauge:
+			if a.gaugeExpiry > 0 && s.idle >= a.gaugeExpiry {
+				delete(a.series, key)
+				continue
+			}
+			emit(s, "", s.value)
+			s.idle++
+		case Timer:
+			sort.Float64s(s.values)
+			sum := 0.0
+			for _, v := range s.values {
+				sum += v
+			}
+			emit(s, "count", s.count)
+			emit(s, "sum", sum)
+			emit(s, "min", s.values[0])
+			emit(s, "max", s.values[len(s.values)-1])
+			emit(s, "mean", sum/float64(len(s.values)))
+			for _, p := range a.percentiles {
+				emit(s, percentileName(p), percentile(s.values, p))
+			}
+		case Set:
+			emit(s, "count", float64(len(s.set)))
+		}
+		if s.typ == Gauge {
+			continue
+		}
+		delete(a.series, key)
+	}
+	return rows
+}
+
+// percentile 按nearest-rank计算有序数据的百分位数
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// percentileName 例如99.9对应p99_9
+func percentileName(p float64) string {
+	return "p" + strings.ReplaceAll(strconv.FormatFloat(p, 'f', -1, 64), ".", "_")
+}
@@ -0,0 +1,88 @@
+// Package statsd 实现StatsD协议的UDP监听，在内存中按刷新间隔聚合后写入数据库，
+// 支持DogStatsD的|#key:value标签
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"tsdb"
+)
+
+// MetricType StatsD指标类型
+type MetricType string
+
+const (
+	Counter      MetricType = "c"
+	Gauge        MetricType = "g"
+	Timer        MetricType = "ms"
+	Histogram    MetricType = "h"
+	Distribution MetricType = "d"
+	Set          MetricType = "s"
+)
+
+var InvalidLineError = errors.New("invalid statsd line")
+
+// Metric 一行StatsD数据: name:value|type[|@rate][|#tag1:value1,tag2:value2]
+type Metric struct {
+	Name     string
+	Type     MetricType
+	Value    float64
+	SetValue string  // Set类型的原始值
+	Delta    bool    // Gauge的值带有+或-前缀时表示增量
+	Rate     float64 // 采样率，(0, 1]
+	Tags     tsdb.LabelList
+}
+
+// ParseLine 解析一行数据，没有值的标签的值为true
+func ParseLine(line string) (*Metric, error) {
+	i := strings.LastIndexByte(strings.SplitN(line, "|", 2)[0], ':')
+	if i <= 0 {
+		return nil, fmt.Errorf("%w: missing name: %q", InvalidLineError, line)
+	}
+	m := &Metric{Name: line[:i], Rate: 1}
+	parts := strings.Split(line[i+1:], "|")
+	if len(parts) < 2 || parts[0] == "" {
+		return nil, fmt.Errorf("%w: missing value or type: %q", InvalidLineError, line)
+	}
+	m.Type = MetricType(parts[1])
+	switch m.Type {
+	case Counter, Gauge, Timer, Histogram, Distribution:
+		value, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, fmt.Errorf("%w: invalid value: %q", InvalidLineError, line)
+		}
+		m.Value = value
+		m.Delta = m.Type == Gauge && (parts[0][0] == '+' || parts[0][0] == '-')
+	case Set:
+		m.SetValue = parts[0]
+	default:
+		return nil, fmt.Errorf("%w: unknown type %q", InvalidLineError, parts[1])
+	}
+
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			rate, err := strconv.ParseFloat(part[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, fmt.Errorf("%w: invalid sample rate: %q", InvalidLineError, line)
+			}
+			m.Rate = rate
+		case strings.HasPrefix(part, "#"):
+			for _, tag := range strings.Split(part[1:], ",") {
+				if tag == "" {
+					continue
+				}
+				kv := strings.SplitN(tag, ":", 2)
+				if len(kv) == 1 || kv[1] == "" {
+					m.Tags = append(m.Tags, tsdb.Label{Name: kv[0], Value: "true"})
+					continue
+				}
+				m.Tags = append(m.Tags, tsdb.Label{Name: kv[0], Value: kv[1]})
+			}
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,140 @@
+package statsd
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"tsdb"
+)
+
+const maxPacketSize = 64 << 10
+
+// DefaultPercentiles 计时器默认输出的百分位数
+var DefaultPercentiles = []float64{50, 90, 99}
+
+// Server 通过UDP接收StatsD数据，每个刷新间隔将聚合结果写入数据库:
+// Counter输出name_count和name_rate，Gauge输出name，
+// Timer、Histogram和Distribution输出name_count、name_sum、name_min、name_max、name_mean和name_p<百分位>，
+// Set输出name_count。Gauge在每个刷新间隔重复写入最后的值，超过gaugeExpiry没有更新时不再写入
+type Server struct {
+	db            *tsdb.TSDB
+	aggregator    *aggregator
+	flushInterval time.Duration
+	now           func() time.Time
+
+	mutex   sync.Mutex
+	conns   []net.PacketConn
+	closed  bool
+	serving sync.WaitGroup // 正在读取的连接
+	done    chan struct{}
+	flusher sync.WaitGroup
+}
+
+// NewServer gaugeExpiry为0时Gauge永不过期，不足一个刷新间隔时按一个刷新间隔计算
+func NewServer(db *tsdb.TSDB, flushInterval, gaugeExpiry time.Duration, percentiles []float64) *Server {
+	expiry := 0
+	if gaugeExpiry > 0 {
+		expiry = int((gaugeExpiry + flushInterval - 1) / flushInterval)
+	}
+	s := &Server{
+		db:            db,
+		aggregator:    newAggregator(percentiles, expiry),
+		flushInterval: flushInterval,
+		now:           time.Now,
+		done:          make(chan struct{}),
+	}
+	s.flusher.Add(1)
+	go s.flushLoop()
+	return s
+}
+
+// Serve 读取数据包直到conn关闭，每个数据包可以包含多行，调用Close后返回nil
+func (s *Server) Serve(conn net.PacketConn) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return errors.New("statsd server is closed")
+	}
+	s.conns = append(s.conns, conn)
+	s.serving.Add(1)
+	s.mutex.Unlock()
+	defer s.serving.Done()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line = strings.TrimSpace(line); line == "" {
+				continue
+			}
+			m, err := ParseLine(line)
+			if err != nil {
+				logrus.Debugf("failed to parse statsd line, err: %v", err)
+				continue
+			}
+			s.aggregator.Add(m)
+		}
+	}
+}
+
+// Close 关闭所有监听并写入最后一个刷新间隔的聚合结果
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	var errs []string
+	for _, conn := range s.conns {
+		if err := conn.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	s.mutex.Unlock()
+
+	s.serving.Wait()
+	close(s.done)
+	s.flusher.Wait()
+	s.flush()
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (s *Server) flushLoop() {
+	defer s.flusher.Done()
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Server) flush() {
+	rows := s.aggregator.Flush(s.db.Precision().FromTime(s.now()), s.flushInterval.Seconds())
+	if len(rows) == 0 {
+		return
+	}
+	if err := s.db.InsertRows(rows); err != nil {
+		logrus.Errorf("failed to insert %d statsd rows, err: %v", len(rows), err)
+	}
+}
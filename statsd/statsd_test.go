@@ -0,0 +1,166 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+	"tsdb"
+)
+
+func TestParseLine(t *testing.T) {
+	m, err := ParseLine("page.views:2|c|@0.5|#env:prod,canary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "page.views" || m.Type != Counter || m.Value != 2 || m.Rate != 0.5 || len(m.Tags) != 2 ||
+		m.Tags[0] != (tsdb.Label{Name: "env", Value: "prod"}) || m.Tags[1] != (tsdb.Label{Name: "canary", Value: "true"}) {
+		t.Fatalf("unexpected metric: %+v", m)
+	}
+	m, err = ParseLine("queue.size:-3|g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != Gauge || m.Value != -3 || !m.Delta {
+		t.Fatalf("unexpected metric: %+v", m)
+	}
+	m, err = ParseLine("users:alice|s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != Set || m.SetValue != "alice" {
+		t.Fatalf("unexpected metric: %+v", m)
+	}
+
+	for _, line := range []string{"views", "views:1", ":1|c", "views:abc|c", "views:1|x", "views:1|c|@2", "views:|c"} {
+		if _, err := ParseLine(line); err == nil {
+			t.Fatalf("%s: expected error", line)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	agg := newAggregator([]float64{50, 99.9}, 2)
+	lines := []string{
+		"hits:1|c|#env:prod",
+		"hits:2|c|@0.5|#env:prod",
+		"temp:10|g",
+		"temp:+5|g",
+		"latency:30|ms",
+		"latency:10|h",
+		"latency:20|ms|@0.5",
+		"users:alice|s",
+		"users:bob|s",
+		"users:alice|s",
+	}
+	for _, line := range lines {
+		m, err := ParseLine(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		agg.Add(m)
+	}
+	values := make(map[string]float64)
+	for _, row := range agg.Flush(1600000000, 10) {
+		values[row.Metric] = row.Point.Value
+		if row.Point.Timestamp != 1600000000 {
+			t.Fatalf("unexpected timestamp: %d", row.Point.Timestamp)
+		}
+	}
+	expected := map[string]float64{
+		"hits_count":    5,
+		"hits_rate":     0.5,
+		"temp":          15,
+		"latency_count": 4,
+		"latency_sum":   60,
+		"latency_min":   10,
+		"latency_max":   30,
+		"latency_mean":  20,
+		"latency_p50":   20,
+		"latency_p99_9": 30,
+		"users_count":   2,
+	}
+	if len(values) != len(expected) {
+		t.Fatalf("unexpected rows: %v", values)
+	}
+	for metric, value := range expected {
+		if values[metric] != value {
+			t.Fatalf("%s: expected %v, got %v", metric, value, values[metric])
+		}
+	}
+
+	// Gauge在之后的刷新中保留
+	rows := agg.Flush(1600000010, 10)
+	if len(rows) != 1 || rows[0].Metric != "temp" || rows[0].Point.Value != 15 {
+		t.Fatalf("unexpected rows: %+v", rows)
+	}
+	// 连续两次刷新没有更新后过期
+	if rows := agg.Flush(1600000020, 10); len(rows) != 0 {
+		t.Fatalf("expected gauge to expire, got: %+v", rows)
+	}
+	m, err := ParseLine("temp:+1|g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	agg.Add(m)
+	rows = agg.Flush(1600000030, 10)
+	if len(rows) != 1 || rows[0].Metric != "temp" || rows[0].Point.Value != 1 {
+		t.Fatalf("unexpected rows: %+v", rows)
+	}
+}
+
+func TestServer(t *testing.T) {
+	db, err := tsdb.Open(tsdb.WithDataPath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(db, time.Hour, 0, DefaultPercentiles)
+	server.now = func() time.Time {
+		return time.Unix(1600000000, 0)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(packetConn)
+	}()
+
+	conn, err := net.Dial("udp", packetConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("requests:1|c|#host:vm1\nrequests:1|c|#host:vm1\n"))
+
+	// 等待数据包被处理，关闭时写入聚合结果
+	for i := 0; i < 100; i++ {
+		server.aggregator.mutex.Lock()
+		n := len(server.aggregator.series)
+		server.aggregator.mutex.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	var seriesList []*tsdb.Series
+	for i := 0; i < 100 && len(seriesList) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		seriesList, err = db.QueryRange("requests_count", []*tsdb.Matcher{tsdb.MustNewMatcher(tsdb.MatchEqual, "host", "vm1")}, 1600000000, 1600000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(seriesList) != 1 || seriesList[0].Points[0].Value != 2 {
+		t.Fatalf("unexpected result: %+v", seriesList)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"io/fs"
 	"io/ioutil"
+	"math"
 	"path"
 	"path/filepath"
 	"runtime"
@@ -18,26 +19,30 @@ import (
 	"time"
 )
 
-type options struct {
-	metaSerializer    MetaSerializer  // 元数据自定义Marshal接口
-	bytesCompressor   BytesCompressor // 数据持久化存储压缩接口
-	retention         time.Duration   // 数据保留时长
-	segmentDuration   time.Duration   // 一个segment的时长
-	writeTimeout      time.Duration   // 写超时
-	onlyMemoryMode    bool
-	enableOutdated    bool   // 是否可以写入过时数据（乱序写入）
-	maxRowsPerSegment int64  // 每段的最大row的数量
-	dataPath          string // Segment 持久化存储文件夹
-}
-
 type TSDB struct {
+	opts     *options
 	segments *segmentList
 	mutex    sync.RWMutex
 	ctx      context.Context
 	cancel   context.CancelFunc
 
-	queue chan []*Row
-	wait  sync.WaitGroup
+	queue   chan *rowsBatch
+	slots   chan struct{}  // queue中的空位，占用空位后才写入预写日志，写入queue时不会阻塞
+	wait    sync.WaitGroup // 正在刷盘的segment
+	workers sync.WaitGroup // 消费queue的协程
+	wal     *wal
+
+	closeMutex sync.RWMutex
+	closed     bool
+
+	compactMutex sync.Mutex // 串行化回填和过期删除对diskSegment的替换
+}
+
+// rowsBatch 写入队列中的一批rows及其所在的预写日志序号
+type rowsBatch struct {
+	rows     []*Row
+	walIndex int
+	done     chan []error // 同步写入时接收每个row的写入结果
 }
 
 // Point 一个数据点
@@ -47,18 +52,10 @@ type Point struct {
 }
 
 var (
-	timerPool   sync.Pool
-	defaultOpts = &options{
-		metaSerializer:    newBinaryMetaSerializer(),
-		bytesCompressor:   newNoopBytesCompressor(),
-		segmentDuration:   2 * time.Hour, // 默认两小时
-		retention:         7 * 24 * time.Hour,
-		writeTimeout:      30 * time.Second,
-		onlyMemoryMode:    false,
-		enableOutdated:    true,
-		maxRowsPerSegment: 19960412, // 该数字可自定义
-		dataPath:          ".",
-	}
+	timerPool sync.Pool
+
+	EmptyMetricError = errors.New("metric name is empty")
+	OutOfOrderError  = errors.New("out of order sample")
 )
 
 // Row 一行时序数据库，包括数据点和标签组合
@@ -68,52 +65,303 @@ type Row struct {
 	Point  Point
 }
 
-type Option func(c *options)
-
 const (
-	defaultQueueSize = 512
-	separator        = "/-/"
+	defaultQueueSize  = 512
+	separator         = "/-/"
+	retentionInterval = time.Minute
 )
 
+// OpenTSDB 打开数据库，配置校验或加载数据出错时panic，不会返回nil
+//
+// Deprecated: 使用Open，可以获取配置校验以及加载数据时的错误
 func OpenTSDB(opts ...Option) *TSDB {
+	db, err := Open(opts...)
+	if err != nil {
+		panic(fmt.Sprintf("failed to open database, err: %v", err))
+	}
+	return db
+}
+
+// Open 校验配置后打开数据库，加载磁盘上的segment并回放预写日志
+func Open(opts ...Option) (*TSDB, error) {
+	// 每个数据库实例持有独立的配置，defaultOpts只作为默认值
+	conf := *defaultOpts
 	for _, opt := range opts {
-		opt(defaultOpts)
+		if err := opt(&conf); err != nil {
+			return nil, err
+		}
+	}
+	if err := conf.validate(); err != nil {
+		return nil, err
 	}
 
 	db := &TSDB{
-		segments: newSegmentList(),
-		queue:    make(chan []*Row, defaultQueueSize),
+		opts:     &conf,
+		segments: newSegmentList(&conf),
+		queue:    make(chan *rowsBatch, defaultQueueSize),
+		slots:    make(chan struct{}, defaultQueueSize),
 	}
 
-	// 加载文件
-	db.loadFiles()
+	if !db.opts.onlyMemoryMode {
+		mkdir(db.opts.dataPath)
+		// 完成进程退出时中断的回填
+		if err := recoverBackfill(db.opts.dataPath); err != nil {
+			return nil, fmt.Errorf("failed to recover backfill, err: %v", err)
+		}
+		// 加载文件
+		if err := db.loadFiles(); err != nil {
+			return nil, err
+		}
+		// 回放预写日志，恢复崩溃前head memtable中的数据
+		if err := db.replayWAL(); err != nil {
+			return nil, fmt.Errorf("failed to replay wal, err: %v", err)
+		}
+	}
 
 	worker := runtime.GOMAXPROCS(-1)
 	db.ctx, db.cancel = context.WithCancel(context.Background())
 	for i := 0; i < worker; i++ {
 		// 刷盘
+		db.workers.Add(1)
 		go db.saveRows(db.ctx)
 	}
-	return db
+	// 保留时长为0时永久保留，不需要定期删除
+	if db.opts.retention > 0 {
+		go db.retain(db.ctx)
+	}
+	return db, nil
+}
+
+// Precision 返回数据点时间戳的精度
+func (db *TSDB) Precision() TimestampPrecision {
+	return db.opts.precision
+}
+
+// DeleteBefore 删除数据全部早于ts的diskSegment，正在进行的查询结束后才会释放文件
+func (db *TSDB) DeleteBefore(ts int64) error {
+	db.closeMutex.RLock()
+	closed := db.closed
+	db.closeMutex.RUnlock()
+	if closed {
+		return errors.New("failed to delete segments, database is closed")
+	}
+	db.compactMutex.Lock()
+	defer db.compactMutex.Unlock()
+
+	var errs []string
+	for _, segment := range db.segments.RemoveBefore(ts) {
+		if err := segment.Close(); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if err := segment.Cleanup(); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		logrus.Infof("delete expired segment [%d, %d]", segment.MinTs(), segment.MaxTs())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to delete segments: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// retain 定期删除超过保留时长的segment
+func (db *TSDB) retain(ctx context.Context) {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := db.applyRetention(); err != nil {
+				logrus.Error(err)
+			}
+		}
+	}
+}
+
+// applyRetention 删除超过保留时长的segment，保留时长为0时永久保留
+func (db *TSDB) applyRetention() error {
+	if db.opts.retention <= 0 {
+		return nil
+	}
+	return db.DeleteBefore(db.opts.precision.FromTime(time.Now().Add(-db.opts.retention)))
+}
+
+// Close 停止写入并消费完queue中的rows，等待刷盘结束后将head memtable持久化，最后释放所有segment的mmap并关闭预写日志。
+// ctx结束时停止等待并返回ctx.Err()，head刷盘失败时返回错误，这两种情况下同样会释放mmap和预写日志，
+// 没有持久化的数据保留在预写日志中，下次打开时回放
+func (db *TSDB) Close(ctx context.Context) (err error) {
+	db.closeMutex.Lock()
+	if db.closed {
+		db.closeMutex.Unlock()
+		return errors.New("database is already closed")
+	}
+	db.closed = true
+	close(db.queue)
+	db.closeMutex.Unlock()
+	defer db.cancel()
+
+	// Close不能重试，任何情况下都需要释放资源
+	persisted := false
+	defer func() {
+		if releaseErr := db.release(persisted); releaseErr != nil {
+			if err != nil {
+				err = fmt.Errorf("%v; %v", err, releaseErr)
+			} else {
+				err = releaseErr
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		db.workers.Wait()
+		db.wait.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if err := db.segments.Head().Close(); err != nil {
+		return fmt.Errorf("failed to flush head segment, err: %v", err)
+	}
+	// 之前刷盘失败的memtable，数据只存在于预写日志中
+	persisted = len(db.segments.memtables()) == 1
+	return nil
+}
+
+// release 释放全部diskSegment的mmap并关闭预写日志，persisted为true时数据已经全部持久化，删除预写日志
+func (db *TSDB) release(persisted bool) error {
+	var errs []string
+	for _, segment := range db.segments.all() {
+		if _, ok := segment.(*memtable); ok {
+			continue
+		}
+		if err := segment.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if db.wal != nil {
+		if err := db.wal.Close(); err != nil {
+			errs = append(errs, err.Error())
+		} else if persisted {
+			if err = db.wal.Cleanup(); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to close database: %s", strings.Join(errs, "; "))
+	}
+	return nil
 }
 
-// InsertRows 插入rows
+// InsertRows 异步插入rows，校验失败的row会被丢弃并在返回的error中说明，其余的row仍然会写入
 func (tsdb *TSDB) InsertRows(rows []*Row) error {
-	timer := getTimer(defaultOpts.writeTimeout)
+	valid := make([]*Row, 0, len(rows))
+	var invalid error
+	dropped := 0
+	for _, row := range rows {
+		if err := row.validate(); err != nil {
+			if invalid == nil {
+				invalid = err
+			}
+			dropped++
+			continue
+		}
+		valid = append(valid, row)
+	}
+	if len(valid) > 0 {
+		if err := tsdb.enqueue(context.Background(), &rowsBatch{rows: valid}); err != nil {
+			return err
+		}
+	}
+	if invalid != nil {
+		return fmt.Errorf("drop %d invalid rows, err: %w", dropped, invalid)
+	}
+	return nil
+}
+
+// InsertRowsSync 写入rows并等待写入head memtable，返回与rows一一对应的写入结果，
+// error不为nil时表示整批写入失败，例如数据库已关闭、写入超时或ctx结束。
+// ctx只在rows进入写入队列前生效，进入队列后rows一定会写入，需要等待写入结果，否则调用方会把已经写入的rows当作失败重试
+func (db *TSDB) InsertRowsSync(ctx context.Context, rows []*Row) ([]error, error) {
+	errs := make([]error, len(rows))
+	valid := make([]*Row, 0, len(rows))
+	indexes := make([]int, 0, len(rows))
+	for i, row := range rows {
+		if err := row.validate(); err != nil {
+			errs[i] = err
+			continue
+		}
+		valid = append(valid, row)
+		indexes = append(indexes, i)
+	}
+	if len(valid) == 0 {
+		return errs, nil
+	}
+
+	batch := &rowsBatch{
+		rows: valid,
+		done: make(chan []error, 1),
+	}
+	if err := db.enqueue(ctx, batch); err != nil {
+		return nil, err
+	}
+	results := <-batch.done
+	for i, err := range results {
+		errs[indexes[i]] = err
+	}
+	return errs, nil
+}
+
+// enqueue 在写入队列中占用空位后写入预写日志，再将batch放入写入队列。
+// 超时或ctx结束时rows还没有写入预写日志，被拒绝的rows不会在回放时重新写入
+func (db *TSDB) enqueue(ctx context.Context, batch *rowsBatch) error {
+	db.closeMutex.RLock()
+	defer db.closeMutex.RUnlock()
+	if db.closed {
+		return errors.New("failed to insert rows to database, database is closed")
+	}
+
+	timer := getTimer(db.opts.writeTimeout)
 	select {
-	case tsdb.queue <- rows:
+	case db.slots <- struct{}{}:
 		putTimer(timer)
 	case <-timer.C:
 		putTimer(timer)
 		return errors.New("failed to insert rows to database, write overload")
+	case <-ctx.Done():
+		putTimer(timer)
+		return ctx.Err()
+	}
+
+	if db.wal != nil {
+		index, err := db.wal.Append(batch.rows)
+		if err != nil {
+			<-db.slots
+			return fmt.Errorf("failed to write wal, err: %v", err)
+		}
+		batch.walIndex = index
 	}
+	db.queue <- batch
 	return nil
 }
 
 // QueryLabelValues 查询标签值
 func (db *TSDB) QueryLabelValues(label string, start, end int64) []string {
 	temp := make(map[string]struct{})
-	for _, segment := range db.segments.Get(start, end) {
+	segments := db.segments.Get(start, end)
+	defer db.segments.Release(segments)
+	for _, segment := range segments {
 		segment = segment.Load()
 		values := segment.QueryLabelValuse(label)
 		for i := 0; i < len(values); i++ {
@@ -128,6 +376,123 @@ func (db *TSDB) QueryLabelValues(label string, start, end int64) []string {
 	return ret
 }
 
+// QueryRange 查询metric在[start, end]内满足全部选择器的时间线并读出全部数据点，同一时间线跨segment的数据点会合并，
+// metric为空时不限制指标名。使用WithDownsample时每条时间线返回按时间窗口聚合后的数据点，数据点较多时使用Select
+func (db *TSDB) QueryRange(metric string, matchers []*Matcher, start, end int64, opts ...QueryOption) ([]*Series, error) {
+	q := &queryOptions{}
+	for _, opt := range opts {
+		if err := opt(q); err != nil {
+			return nil, err
+		}
+	}
+	if q.downsampler != nil {
+		return db.downsample(metric, matchers, start, end, q.downsampler)
+	}
+
+	set, err := db.Select(metric, matchers, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer set.Close()
+	ret := make([]*Series, 0)
+	for set.Next() {
+		labels, it := set.At()
+		points, err := readPoints(it)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, &Series{Labels: labels, Points: points})
+	}
+	return ret, set.Err()
+}
+
+// downsample 遍历每条时间线的数据点时直接累加到时间窗口
+func (db *TSDB) downsample(metric string, matchers []*Matcher, start, end int64, d *downsampler) ([]*Series, error) {
+	seriesList, err := db.downsampleSeries(metric, matchers, start, end, d)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*Series, 0, len(seriesList))
+	for _, series := range seriesList {
+		ret = append(ret, &Series{
+			Labels: series.labels,
+			Points: d.points(series.buckets),
+		})
+	}
+	return ret, nil
+}
+
+// downsampleSeries 返回每条时间线降采样后的时间窗口，按标签排序
+func (db *TSDB) downsampleSeries(metric string, matchers []*Matcher, start, end int64, d *downsampler) ([]*downsampledSeries, error) {
+	set, err := db.Select(metric, matchers, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer set.Close()
+	ret := make([]*downsampledSeries, 0)
+	for set.Next() {
+		labels, it := set.At()
+		var buckets []*bucket
+		for it.Next() {
+			t, v := it.At()
+			buckets = d.add(buckets, t, v)
+		}
+		if err = it.Err(); err != nil {
+			return nil, err
+		}
+		ret = append(ret, &downsampledSeries{labels: labels, buckets: buckets})
+	}
+	return ret, set.Err()
+}
+
+// QueryLabelNames 查询[start, end]内出现过的标签名，包括指标名标签__name__
+func (db *TSDB) QueryLabelNames(start, end int64) []string {
+	temp := make(map[string]struct{})
+	segments := db.segments.Get(start, end)
+	defer db.segments.Release(segments)
+	for _, segment := range segments {
+		segment = segment.Load()
+		for _, name := range segment.QueryLabelNames() {
+			temp[name] = struct{}{}
+		}
+	}
+	ret := make([]string, 0, len(temp))
+	for key := range temp {
+		ret = append(ret, key)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// QuerySeries 查询metric在[start, end]内满足全部选择器的时间线的标签，只读取索引，不读取数据点，
+// 数据块的时间范围与[start, end]有交集的时间线都会返回。标签包含指标名标签__name__，按标签排序，metric为空时不限制指标名
+func (db *TSDB) QuerySeries(metric string, matchers []*Matcher, start, end int64) ([]LabelList, error) {
+	if !strings.EqualFold(metric, "") {
+		matchers = append([]*Matcher{MustNewMatcher(MatchEqual, metricName, metric)}, matchers...)
+	}
+	segments := db.segments.Get(start, end)
+	defer db.segments.Release(segments)
+	merged := make(map[string]LabelList)
+	for _, segment := range segments {
+		segment = segment.Load()
+		seriesList, err := segment.Select(matchers, start, end)
+		if err != nil {
+			return nil, err
+		}
+		for _, series := range seriesList {
+			merged[series.sid] = series.labels
+		}
+	}
+	ret := make([]LabelList, 0, len(merged))
+	for _, labels := range merged {
+		ret = append(ret, labels)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].String() < ret[j].String()
+	})
+	return ret, nil
+}
+
 func getTimer(duration time.Duration) *time.Timer {
 	if value := timerPool.Get(); value != nil {
 		t := value.(*time.Timer)
@@ -149,9 +514,9 @@ func putTimer(t *time.Timer) {
 	}
 }
 
-func (db *TSDB) loadFiles() {
-	mkdir(defaultOpts.dataPath)
-	err := filepath.Walk(defaultOpts.dataPath, func(path string, info fs.FileInfo, err error) error {
+func (db *TSDB) loadFiles() error {
+	mkdir(db.opts.dataPath)
+	err := filepath.Walk(db.opts.dataPath, func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
 			return fmt.Errorf("failed to traverse the dir: %s, err: %v", path, err)
 		}
@@ -160,15 +525,15 @@ func (db *TSDB) loadFiles() {
 			return nil
 		}
 
-		files, err := ioutil.ReadDir(filepath.Join(defaultOpts.dataPath, info.Name()))
+		files, err := ioutil.ReadDir(filepath.Join(db.opts.dataPath, info.Name()))
 		if err != nil {
 			return fmt.Errorf("failed to load the data storage, err: %v", err)
 		}
 
 		// 从磁盘加载出最近的segment数据进入内存
-		nowDiskSegment := &diskSegment{}
+		nowDiskSegment := &diskSegment{opts: db.opts}
 		for _, file := range files {
-			filename := filepath.Join(defaultOpts.dataPath, info.Name(), file.Name())
+			filename := filepath.Join(db.opts.dataPath, info.Name(), file.Name())
 			if strings.EqualFold(file.Name(), "data") {
 				mmapFile, err := OpenMMapFile(filename)
 				if err != nil {
@@ -176,6 +541,7 @@ func (db *TSDB) loadFiles() {
 				}
 				nowDiskSegment.dataFd = mmapFile
 				nowDiskSegment.dataFilename = filename
+				nowDiskSegment.dir = filepath.Join(db.opts.dataPath, info.Name())
 				nowDiskSegment.labelVs = newLabelValueList()
 			}
 
@@ -193,79 +559,172 @@ func (db *TSDB) loadFiles() {
 				nowDiskSegment.maxTimestamp = desc.MaxTimestamp
 			}
 		}
-		db.segments.Add(nowDiskSegment)
+		if err := db.segments.Add(nowDiskSegment); err != nil {
+			if nowDiskSegment.dataFd != nil {
+				nowDiskSegment.dataFd.Close()
+			}
+			return fmt.Errorf("failed to add segment %s, err: %v", info.Name(), err)
+		}
 		return nil
 	})
-
 	if err != nil {
-		logrus.Error(err)
+		return fmt.Errorf("failed to load files from %s, err: %v", db.opts.dataPath, err)
 	}
+	return nil
 }
 
 func (db *TSDB) saveRows(ctx context.Context) {
+	defer db.workers.Done()
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case rows := <-db.queue:
+		case batch, ok := <-db.queue:
+			if !ok {
+				return
+			}
+			<-db.slots
 			head, err := db.writeColdSegment()
 			if err != nil {
 				logrus.Errorf("failed to write cold data to disk: %v, err: %v", head, err)
+				if db.wal != nil {
+					db.wal.Done(batch.walIndex)
+				}
+				if batch.done != nil {
+					errs := make([]error, len(batch.rows))
+					for i := range errs {
+						errs[i] = err
+					}
+					batch.done <- errs
+				}
 				continue
 			}
-			head.InsertRows(rows)
+			if db.wal != nil {
+				head.MarkWAL(batch.walIndex)
+			}
+			errs := head.insertRows(batch.rows)
+			head.writers.Done()
+			if db.wal != nil {
+				db.wal.Done(batch.walIndex)
+			}
+			if batch.done != nil {
+				batch.done <- errs
+			}
 		}
 	}
 }
 
-func (db *TSDB) writeColdSegment() (Segment, error) {
+// writeColdSegment 返回可以写入的head memtable，head已经写满时加入segment列表并替换为新的memtable，然后异步刷盘。
+// 返回的memtable写入结束后需要调用writers.Done，刷盘会等待取得该memtable的协程全部写入结束
+func (db *TSDB) writeColdSegment() (*memtable, error) {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
-	if db.segments.head.Frozen() {
-		head := db.segments.head
-		go func() {
+	head := db.segments.Head()
+	if head.Frozen() {
+		frozen, err := db.segments.RotateHead(newMemtable(db.opts))
+		if err != nil {
+			// 无法加入segment列表时继续写入当前的head，下次写入时重试
+			logrus.Errorf("failed to freeze head segment, err: %v", err)
+		} else {
+			head = db.segments.Head()
 			db.wait.Add(1)
-			defer db.wait.Done()
-			db.segments.Add(head)
-			startTime := time.Now()
-			dirname := makeDirName(head.MinTs(), head.MaxTs())
-			if err := writeToDisk(head.(*memtable)); err != nil {
-				logrus.Errorf("faild to flush data to disk, %v", err)
-				return
-			}
-			filename := path.Join(dirname, "data")
-			mmapFile, err := OpenMMapFile(filename)
-			if err != nil {
-				logrus.Errorf("failed to make a mmap file %s, %v", filename, err)
-				return
-			}
-			// 将diskSegment添加进入tree，方便查询
-			err = db.segments.Replace(head, newDiskSegment(mmapFile, dirname, head.MinTs(), head.MaxTs()))
-			if err != nil {
-				logrus.Errorf("add diskSegment into in list error: %v", err)
-				return
-			}
-			logrus.Infof("write file %s take: %v", filename, time.Since(startTime))
-		}()
-		db.segments.head = newMemtable()
+			go db.flush(frozen.(*memtable))
+		}
 	}
-	return db.segments.head, nil
+	m := head.(*memtable)
+	m.writers.Add(1)
+	return m, nil
+}
+
+// flush 等待写入结束后将已经加入segment列表的memtable持久化，并用diskSegment替换
+func (db *TSDB) flush(m *memtable) {
+	defer db.wait.Done()
+	// 写入结束前刷盘会漏掉之后写入的rows，而这些rows所在的预写日志会在刷盘后删除
+	m.writers.Wait()
+	startTime := time.Now()
+	dirname := makeDirName(db.opts.dataPath, m.MinTs(), m.MaxTs())
+	if err := m.Close(); err != nil {
+		logrus.Errorf("faild to flush data to disk, %v", err)
+		return
+	}
+	filename := path.Join(dirname, "data")
+	mmapFile, err := OpenMMapFile(filename)
+	if err != nil {
+		logrus.Errorf("failed to make a mmap file %s, %v", filename, err)
+		return
+	}
+	// 将diskSegment添加进入tree，方便查询
+	if err = db.segments.Replace(m, newDiskSegment(db.opts, mmapFile, dirname, m.MinTs(), m.MaxTs())); err != nil {
+		logrus.Errorf("add diskSegment into in list error: %v", err)
+		mmapFile.Close()
+		return
+	}
+	logrus.Infof("write file %s take: %v", filename, time.Since(startTime))
+	db.truncateWAL()
+}
+
+// replayWAL 打开预写日志并将其中的rows重新写入memtable
+func (db *TSDB) replayWAL() error {
+	w, err := openWAL(db.opts.dataPath)
+	if err != nil {
+		return err
+	}
+	db.wal = w
+	start := time.Now()
+	count := 0
+	err = w.Replay(func(index int, rows []*Row) {
+		head, err := db.writeColdSegment()
+		if err != nil {
+			logrus.Errorf("failed to write cold data to disk: %v, err: %v", head, err)
+			return
+		}
+		head.MarkWAL(index)
+		head.InsertRows(rows)
+		head.writers.Done()
+		count += len(rows)
+	})
+	logrus.Infof("replay %d rows from wal, take: %v", count, time.Since(start))
+	return err
+}
+
+// truncateWAL 删除数据已经全部持久化的预写日志
+func (db *TSDB) truncateWAL() {
+	if db.wal == nil {
+		return
+	}
+	var index int64 = math.MaxInt64
+	for _, m := range db.segments.memtables() {
+		if m.WALIndex() < index {
+			index = m.WALIndex()
+		}
+	}
+	if index > math.MaxInt32 {
+		index = math.MaxInt32
+	}
+	if err := db.wal.Truncate(int(index)); err != nil {
+		logrus.Errorf("failed to truncate wal, err: %v", err)
+	}
+}
+
+// validate 校验row是否可以写入
+func (row *Row) validate() error {
+	if strings.EqualFold(row.Metric, "") {
+		return EmptyMetricError
+	}
+	if err := validateLabelSize(metricName, row.Metric); err != nil {
+		return err
+	}
+	return row.Labels.validate()
 }
 
 func (row Row) ID() string {
 	return joinSeprator(xxhash.Sum64([]byte(row.Metric)), row.Labels.Hash())
 }
 
-func makeDirName(a, b int64) string {
-	return path.Join(defaultOpts.dataPath, fmt.Sprintf("seg-%d-%d", a, b))
+func makeDirName(dataPath string, a, b int64) string {
+	return path.Join(dataPath, fmt.Sprintf("seg-%d-%d", a, b))
 }
 
 func joinSeprator(a, b interface{}) string {
 	return fmt.Sprintf("%v%s%v", a, separator, b)
 }
-
-func GetDataPath(dataPath string) Option {
-	return func(c *options) {
-		c.dataPath = dataPath
-	}
-}
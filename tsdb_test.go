@@ -1,11 +1,19 @@
 package tsdb
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestOpenTSDB(t *testing.T) {
@@ -107,3 +115,1451 @@ func TestOpenDB(t *testing.T) {
 	_ = store.InsertRows(rows)
 	fmt.Println(store)
 }
+
+func TestQueryRange(t *testing.T) {
+	store := OpenTSDB(GetDataPath(t.TempDir()))
+	head := newMemtable(store.opts).(*memtable)
+	var start int64 = 1600000000
+	for i := 0; i < 10; i++ {
+		head.InsertRows(genPoints(start+int64(i)*60, 1, 1))
+		head.InsertRows(genPoints(start+int64(i)*60, 2, 1))
+	}
+	// 乱序写入的数据点
+	head.InsertRows(genPoints(start-60, 1, 1))
+
+	matchers := []*Matcher{MustNewMatcher(MatchEqual, "node", "vm_node_azh1")}
+	selected, err := head.Select(append(matchers, MustNewMatcher(MatchEqual, metricName, "cpu.busy")), start-60, start+540)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 1 {
+		t.Fatalf("unexpected memtable result: %+v", selected)
+	}
+	if points, err := readPoints(selected[0].iterator); err != nil || len(points) != 11 {
+		t.Fatalf("unexpected memtable points: %+v, %v", points, err)
+	}
+
+	if err = head.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dirname := makeDirName(store.opts.dataPath, head.MinTs(), head.MaxTs())
+	mmapFile, err := OpenMMapFile(filepath.Join(dirname, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.segments.Add(newDiskSegment(store.opts, mmapFile, dirname, head.MinTs(), head.MaxTs()))
+
+	seriesList, err := store.QueryRange("cpu.busy", matchers, start, start+120)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 {
+		t.Fatalf("expected 1 series, got %d", len(seriesList))
+	}
+	points := seriesList[0].Points
+	if len(points) != 3 || points[0].Timestamp != start || points[2].Timestamp != start+120 {
+		t.Fatalf("unexpected disk points: %+v", points)
+	}
+
+	seriesList, err = store.QueryRange("cpu.busy", nil, start-60, start+540)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 2 || len(seriesList[0].Points) != 11 {
+		t.Fatalf("unexpected result: %+v", seriesList)
+	}
+}
+
+func TestMatchers(t *testing.T) {
+	store := OpenTSDB(GetDataPath(t.TempDir()))
+	var start int64 = 1600000000
+	for n := 0; n < 3; n++ {
+		store.segments.Head().InsertRows(genPoints(start, n, 1))
+	}
+	store.segments.Head().InsertRows([]*Row{{
+		Metric: "cpu.busy",
+		Labels: []Label{{Name: "node", Value: "vm_node_azh0"}},
+		Point:  Point{Timestamp: start, Value: 1},
+	}})
+
+	cases := []struct {
+		metric   string
+		matchers []*Matcher
+		expected int
+	}{
+		{"cpu.busy", nil, 4},
+		{"cpu.busy", []*Matcher{MustNewMatcher(MatchRegexp, "node", "vm_node_azh[01]")}, 3},
+		{"cpu.busy", []*Matcher{MustNewMatcher(MatchNotEqual, "node", "vm_node_azh1")}, 3},
+		{"cpu.busy", []*Matcher{MustNewMatcher(MatchNotRegexp, "node", ".*azh[12]")}, 2},
+		{"cpu.busy", []*Matcher{MustNewMatcher(MatchEqual, "computer", "")}, 1},
+		{"cpu.busy", []*Matcher{MustNewMatcher(MatchNotEqual, "computer", "")}, 3},
+		{"", []*Matcher{MustNewMatcher(MatchRegexp, metricName, "mem\\..*"), MustNewMatcher(MatchEqual, "node", "vm_node_azh2")}, 4},
+		{"cpu.busy", []*Matcher{MustNewMatcher(MatchEqual, "node", "vm_node_azh9")}, 0},
+	}
+	for _, c := range cases {
+		seriesList, err := store.QueryRange(c.metric, c.matchers, start, start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(seriesList) != c.expected {
+			t.Fatalf("%s %v: expected %d series, got %d", c.metric, c.matchers, c.expected, len(seriesList))
+		}
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	dataPath := t.TempDir()
+	store := OpenTSDB(GetDataPath(dataPath))
+	var start int64 = 1600000000
+	for i := 0; i < 10; i++ {
+		if err := store.InsertRows(genPoints(start+int64(i)*60, 1, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 乱序写入的数据点
+	if err := store.InsertRows(genPoints(start-60, 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟进程崩溃后重新打开
+	recovered := OpenTSDB(GetDataPath(dataPath))
+	seriesList, err := recovered.QueryRange("cpu.busy", nil, start-60, start+540)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 || len(seriesList[0].Points) != 11 {
+		t.Fatalf("unexpected replay result: %+v", seriesList)
+	}
+
+	recovered.truncateWAL()
+	indexes, err := walSegments(filepath.Join(dataPath, walDirname))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexes) != 2 {
+		t.Fatalf("replayed wal segments should be kept until flushed: %v", indexes)
+	}
+}
+
+func TestWALReplayOversizeLabel(t *testing.T) {
+	dataPath := t.TempDir()
+	store := OpenTSDB(GetDataPath(dataPath))
+	var start int64 = 1600000000
+	oversize := &Row{
+		Metric: "cpu.busy",
+		Labels: LabelList{{Name: "node", Value: strings.Repeat("a", 70*1024)}},
+		Point:  Point{Timestamp: start, Value: 1},
+	}
+	rows := append([]*Row{oversize}, genPoints(start, 1, 1)...)
+	if err := store.InsertRows(rows); !errors.Is(err, LabelTooLongError) {
+		t.Fatalf("expected %v, got %v", LabelTooLongError, err)
+	}
+	if _, err := store.wal.Append([]*Row{oversize}); !errors.Is(err, LabelTooLongError) {
+		t.Fatalf("wal should reject oversize rows, got %v", err)
+	}
+	// 校验和正确但无法解码的记录不能影响后面的记录
+	payload := []byte{1, 0, 0, 0, 0xff, 0xff}
+	buf := newEncodingBuf()
+	buf.MarshalUint32(uint32(len(payload)), crc32.Checksum(payload, walCastagnoli))
+	buf.B = append(buf.B, payload...)
+	store.wal.mutex.Lock()
+	if _, err := store.wal.fd.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	store.wal.mutex.Unlock()
+	for i := 1; i < 10; i++ {
+		if err := store.InsertRows(genPoints(start+int64(i)*60, 1, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 模拟进程崩溃后重新打开
+	recovered := OpenTSDB(GetDataPath(dataPath))
+	seriesList, err := recovered.QueryRange("cpu.busy", nil, start, start+540)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 || len(seriesList[0].Points) != 10 {
+		t.Fatalf("unexpected replay result: %+v", seriesList)
+	}
+}
+
+func TestFlushWaitsForWriters(t *testing.T) {
+	store, err := Open(WithDataPath(t.TempDir()), WithSegmentDuration(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+
+	var start int64 = 1600000000
+	head, err := store.writeColdSegment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	head.InsertRows(genPoints(start, 1, 1))
+	head.InsertRows(genPoints(start+7200, 1, 1))
+	// head已经写满，另一个协程取得新的head时开始刷盘
+	next, err := store.writeColdSegment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.writers.Done()
+	time.Sleep(20 * time.Millisecond)
+	head.InsertRows(genPoints(start+60, 1, 1))
+	head.writers.Done()
+	store.wait.Wait()
+
+	segments := store.segments.all()
+	if _, ok := segments[0].(*diskSegment); !ok {
+		t.Fatalf("expected a disk segment, got %T", segments[0])
+	}
+	seriesList, err := store.QueryRange("cpu.busy", nil, start, start+7200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 || len(seriesList[0].Points) != 3 {
+		t.Fatalf("rows written before the flush started should be persisted: %+v", seriesList)
+	}
+}
+
+func TestFlushAfterMinTsLowered(t *testing.T) {
+	dataPath := t.TempDir()
+	store, err := Open(WithDataPath(dataPath), WithSegmentDuration(time.Hour), WithEnableOutdated(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var start int64 = 1600000000
+	head, err := store.writeColdSegment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	head.InsertRows(genPoints(start, 1, 1))
+	head.InsertRows(genPoints(start+7200, 1, 1))
+	next, err := store.writeColdSegment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.writers.Done()
+	// 冻结的head在替换前已经可以查询
+	if segments := store.segments.all(); len(segments) != 2 || segments[0] != Segment(head) {
+		t.Fatalf("frozen head should be in the list: %v", segments)
+	}
+	// 冻结后乱序写入使MinTs变小
+	head.InsertRows(genPoints(start-60, 1, 1))
+	head.writers.Done()
+	store.wait.Wait()
+
+	if n := len(store.segments.memtables()); n != 1 {
+		t.Fatalf("flushed memtable should be replaced, got %d memtables", n)
+	}
+	if err = store.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(WithDataPath(dataPath), WithSegmentDuration(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close(context.Background())
+	seriesList, err := reopened.QueryRange("cpu.busy", nil, start-60, start+7200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 || len(seriesList[0].Points) != 3 {
+		t.Fatalf("rows should not be replayed twice: %+v", seriesList)
+	}
+}
+
+func TestRejectedRowsNotReplayed(t *testing.T) {
+	dataPath := t.TempDir()
+	store, err := Open(WithDataPath(dataPath), WithWriteTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var start int64 = 1600000000
+	// 占满写入队列
+	for i := 0; i < cap(store.slots); i++ {
+		store.slots <- struct{}{}
+	}
+	if err = store.InsertRows(genPoints(start, 1, 1)); err == nil {
+		t.Fatal("insert should time out when the queue is full")
+	}
+	for i := 0; i < cap(store.slots); i++ {
+		<-store.slots
+	}
+	if err = store.InsertRows(genPoints(start+60, 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟进程崩溃后重新打开，超时被拒绝的rows不能出现
+	recovered := OpenTSDB(GetDataPath(dataPath))
+	seriesList, err := recovered.QueryRange("cpu.busy", nil, start, start+60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 || len(seriesList[0].Points) != 1 || seriesList[0].Points[0].Timestamp != start+60 {
+		t.Fatalf("unexpected replay result: %+v", seriesList)
+	}
+}
+
+func TestClose(t *testing.T) {
+	dataPath := t.TempDir()
+	store := OpenTSDB(GetDataPath(dataPath))
+	var start int64 = 1600000000
+	for i := 0; i < 10; i++ {
+		if err := store.InsertRows(genPoints(start+int64(i)*60, 1, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertRows(genPoints(start, 1, 1)); err == nil {
+		t.Fatal("insert into a closed database should fail")
+	}
+	indexes, err := walSegments(filepath.Join(dataPath, walDirname))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexes) != 0 {
+		t.Fatalf("wal should be removed after close: %v", indexes)
+	}
+
+	reopened := OpenTSDB(GetDataPath(dataPath))
+	defer reopened.Close(context.Background())
+	seriesList, err := reopened.QueryRange("cpu.busy", nil, start, start+540)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 || len(seriesList[0].Points) != 10 {
+		t.Fatalf("unexpected result after reopen: %+v", seriesList)
+	}
+}
+
+func TestCloseReleasesOnTimeout(t *testing.T) {
+	dataPath := t.TempDir()
+	store, err := Open(WithDataPath(dataPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var start int64 = 1600000000
+	if _, err = store.Backfill(genPoints(start, 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.InsertRowsSync(context.Background(), genPoints(start+7200, 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	var disk *diskSegment
+	for _, segment := range store.segments.all() {
+		if ds, ok := segment.(*diskSegment); ok {
+			disk = ds
+		}
+	}
+	if disk == nil {
+		t.Fatal("backfill should create a disk segment")
+	}
+
+	// 模拟一直没有结束的刷盘，Close等待超时
+	store.wait.Add(1)
+	defer store.wait.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = store.Close(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if err = store.wal.fd.Sync(); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("wal should be closed, got %v", err)
+	}
+	if _, err = disk.dataFd.File().Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("disk segment should be unmapped, got %v", err)
+	}
+
+	// 没有持久化的rows保留在预写日志中
+	reopened, err := Open(WithDataPath(dataPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close(context.Background())
+	seriesList, err := reopened.QueryRange("cpu.busy", nil, start, start+7200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 || len(seriesList[0].Points) != 2 {
+		t.Fatalf("unexpected result after reopen: %+v", seriesList)
+	}
+}
+
+func TestDeleteBefore(t *testing.T) {
+	store := OpenTSDB(GetDataPath(t.TempDir()))
+	var start int64 = 1600000000
+	dirs := make([]string, 0)
+	for i := 0; i < 2; i++ {
+		head := newMemtable(store.opts).(*memtable)
+		for j := 0; j < 10; j++ {
+			head.InsertRows(genPoints(start+int64(i*600+j*60), 1, 1))
+		}
+		if err := head.Close(); err != nil {
+			t.Fatal(err)
+		}
+		dirname := makeDirName(store.opts.dataPath, head.MinTs(), head.MaxTs())
+		mmapFile, err := OpenMMapFile(filepath.Join(dirname, "data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.segments.Add(newDiskSegment(store.opts, mmapFile, dirname, head.MinTs(), head.MaxTs()))
+		dirs = append(dirs, dirname)
+	}
+
+	// 查询持有的segment在释放前不会被删除
+	segments := store.segments.Get(start, start+600)
+	deleted := make(chan error)
+	go func() {
+		deleted <- store.DeleteBefore(start + 600)
+	}()
+	select {
+	case <-deleted:
+		t.Fatal("segment deleted while a query is holding it")
+	case <-time.After(50 * time.Millisecond):
+	}
+	store.segments.Release(segments)
+	if err := <-deleted; err != nil {
+		t.Fatal(err)
+	}
+
+	if isFileExist(dirs[0]) || !isFileExist(dirs[1]) {
+		t.Fatalf("only the expired segment should be deleted")
+	}
+	seriesList, err := store.QueryRange("cpu.busy", nil, start, start+1200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 || len(seriesList[0].Points) != 10 || seriesList[0].Points[0].Timestamp != start+600 {
+		t.Fatalf("unexpected result after delete: %+v", seriesList)
+	}
+}
+
+func TestRetentionKeepForever(t *testing.T) {
+	dataPath := t.TempDir()
+	var start int64 = 1600000000
+	conf := *defaultOpts
+	conf.dataPath = dataPath
+	head := newMemtable(&conf).(*memtable)
+	for j := 0; j < 10; j++ {
+		head.InsertRows(genPoints(start+int64(j*60), 1, 1))
+	}
+	if err := head.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 保留时长为0时不会删除过期的segment
+	store, err := Open(WithDataPath(dataPath), WithRetention(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.applyRetention(); err != nil {
+		t.Fatal(err)
+	}
+	seriesList, err := store.QueryRange("cpu.busy", nil, start, start+540)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 || len(seriesList[0].Points) != 10 {
+		t.Fatalf("segment should be kept forever: %+v", seriesList)
+	}
+	if err = store.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = Open(WithDataPath(dataPath), WithRetention(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+	if err = store.applyRetention(); err != nil {
+		t.Fatal(err)
+	}
+	if seriesList, err = store.QueryRange("cpu.busy", nil, start, start+540); err != nil || len(seriesList) != 0 {
+		t.Fatalf("expired segment should be deleted: %+v, %v", seriesList, err)
+	}
+}
+
+func TestOpenOptions(t *testing.T) {
+	invalid := [][]Option{
+		{WithDataPath("")},
+		{WithRetention(-time.Hour)},
+		{WithSegmentDuration(-time.Hour)},
+		{WithWriteTimeout(0)},
+		{WithMaxRowsPerSegment(0)},
+		{WithMaxRowsPerChunk(0)},
+		{WithMetaSerializer(nil)},
+		{WithBytesCompressor(BytesCompressorType(99))},
+	}
+	for _, opts := range invalid {
+		if _, err := Open(opts...); err == nil {
+			t.Fatalf("expected option validation error")
+		}
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("OpenTSDB should panic instead of returning nil")
+			}
+		}()
+		OpenTSDB(WithDataPath(""))
+	}()
+
+	// 兼容旧版本的导出函数
+	if data, err := DoDecompress(DoCompress([]byte("data"))); err != nil || string(data) != "data" {
+		t.Fatalf("unexpected decompressed data: %s, %v", data, err)
+	}
+	metaBytes, err := MarshalMeta(Metadata{MinTimestamp: 1, MaxTimestamp: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := Metadata{}
+	if err = UnmarshaMeta(metaBytes, &meta); err != nil || meta.MinTimestamp != 1 || meta.MaxTimestamp != 2 {
+		t.Fatalf("unexpected meta: %+v, %v", meta, err)
+	}
+
+	dataPath := filepath.Join(t.TempDir(), "memory")
+	store, err := Open(WithDataPath(dataPath), WithOnlyMemoryMode(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if isFileExist(dataPath) {
+		t.Fatal("only memory mode should not create the data path")
+	}
+
+	dataPath = t.TempDir()
+	store, err = Open(WithDataPath(dataPath), WithBytesCompressor(ZSTDBytesCompressor), WithEnableOutdated(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var start int64 = 1600000000
+	for i := 0; i < 10; i++ {
+		store.segments.Head().InsertRows(genPoints(start+int64(i)*60, 1, 1))
+	}
+	// 关闭乱序写入后该数据点会被丢弃
+	store.segments.Head().InsertRows(genPoints(start-60, 1, 1))
+	if err = store.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	store, err = Open(WithDataPath(dataPath), WithBytesCompressor(ZSTDBytesCompressor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seriesList, err := store.QueryRange("cpu.busy", nil, start-60, start+540)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 || len(seriesList[0].Points) != 10 {
+		t.Fatalf("unexpected result with zstd: %+v", seriesList)
+	}
+}
+
+func TestMaxRowsPerSegment(t *testing.T) {
+	store, err := Open(WithDataPath(t.TempDir()), WithMaxRowsPerSegment(4), WithMaxRowsPerChunk(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+
+	var start int64 = 1600000000
+	if _, err = store.InsertRowsSync(context.Background(), genPoints(start, 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	// head写满后下一次写入时刷盘
+	if _, err = store.InsertRowsSync(context.Background(), genPoints(start+60, 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	store.wait.Wait()
+	disks := 0
+	for _, segment := range store.segments.all() {
+		if _, ok := segment.(*diskSegment); ok {
+			disks++
+		}
+	}
+	if disks != 1 {
+		t.Fatalf("full head should be flushed, got %d disk segments", disks)
+	}
+	seriesList, err := store.QueryRange("cpu.busy", nil, start, start+60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 || len(seriesList[0].Points) != 2 {
+		t.Fatalf("unexpected result: %+v", seriesList)
+	}
+}
+
+func TestIndependentInstances(t *testing.T) {
+	zstdPath, snappyPath := t.TempDir(), t.TempDir()
+	zstdStore, err := Open(WithDataPath(zstdPath), WithBytesCompressor(ZSTDBytesCompressor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snappyStore, err := Open(WithDataPath(snappyPath), WithBytesCompressor(SnappyBytesCompressor))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var start int64 = 1600000000
+	for i := 0; i < 10; i++ {
+		zstdStore.segments.Head().InsertRows(genPoints(start+int64(i)*60, 1, 1))
+		snappyStore.segments.Head().InsertRows(genPoints(start+int64(i)*60, 2, 1))
+	}
+	for _, store := range []*TSDB{zstdStore, snappyStore} {
+		if err = store.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reopen := map[string]Option{
+		"vm_node_azh1": WithDataPath(zstdPath),
+		"vm_node_azh2": WithDataPath(snappyPath),
+	}
+	compressors := map[string]Option{
+		"vm_node_azh1": WithBytesCompressor(ZSTDBytesCompressor),
+		"vm_node_azh2": WithBytesCompressor(SnappyBytesCompressor),
+	}
+	for node, opt := range reopen {
+		store, err := Open(opt, compressors[node])
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := store.QueryLabelValues("node", start, start+540)
+		if len(values) != 1 || values[0] != node {
+			t.Fatalf("expected only %s in %s, got %v", node, store.opts.dataPath, values)
+		}
+	}
+}
+
+func TestXORChunk(t *testing.T) {
+	points := []Point{
+		{Timestamp: -10, Value: 1},
+		{Timestamp: 1600000000000, Value: 1},
+		{Timestamp: 1600000015000, Value: 1.5},
+		{Timestamp: 1600000030000, Value: -2},
+		{Timestamp: 1600000030001, Value: math.NaN()},
+		{Timestamp: 1600000030001 + 1<<20, Value: math.Inf(1)},
+		{Timestamp: 5000000000000000000, Value: 0},
+		{Timestamp: 5000000000000000001, Value: 1e300},
+	}
+	chunk := newXORChunk()
+	for _, p := range points {
+		chunk.Append(p.Timestamp, p.Value)
+	}
+	iter, err := newChunkIterator(chunk.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; iter.Next(); i++ {
+		ts, value := iter.At()
+		if ts != points[i].Timestamp || math.Float64bits(value) != math.Float64bits(points[i].Value) {
+			t.Fatalf("point %d: expected %+v, got %d %v", i, points[i], ts, value)
+		}
+		if i == len(points)-1 && iter.Next() {
+			t.Fatal("too many points decoded")
+		}
+	}
+	if iter.Err() != nil {
+		t.Fatal(iter.Err())
+	}
+}
+
+func TestTimestampPrecision(t *testing.T) {
+	store, err := Open(WithDataPath(t.TempDir()), WithTimestampPrecision(PrecisionMillisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var start int64 = 1600000000000
+	head := store.segments.Head()
+	for i := 0; i < 60; i++ {
+		head.InsertRows(genPoints(start+int64(i)*60000, 1, 1))
+	}
+	if head.Frozen() {
+		t.Fatal("one hour of millisecond data should not freeze a two hours segment")
+	}
+	head.InsertRows(genPoints(start+int64(3*time.Hour/time.Millisecond), 1, 1))
+	if !head.Frozen() {
+		t.Fatal("three hours of millisecond data should freeze the segment")
+	}
+	seriesList, err := store.QueryRange("cpu.busy", nil, start, start+59*60000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 || len(seriesList[0].Points) != 60 || seriesList[0].Points[59].Timestamp != start+59*60000 {
+		t.Fatalf("unexpected millisecond result: %+v", seriesList)
+	}
+	if PrecisionMillisecond.ToTime(start).Unix() != 1600000000 || PrecisionSecond.Convert(start, PrecisionMillisecond) != 1600000000 {
+		t.Fatal("unexpected timestamp conversion")
+	}
+}
+
+func TestChunkedSeries(t *testing.T) {
+	store := &tsStore{maxRows: 4}
+	for i := 0; i < 10; i++ {
+		store.Append(&Point{Timestamp: int64(i * 10), Value: float64(i)})
+	}
+	if len(store.chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", len(store.chunks))
+	}
+
+	compressor := newSnappyBytesCompressor()
+	data := store.Encode(compressor)
+	cases := []struct {
+		start, end int64
+		expected   int
+	}{
+		{math.MinInt64, math.MaxInt64, 10},
+		{25, 55, 3},
+		{35, 40, 1},
+		{41, 49, 0},
+		{90, 1000, 1},
+	}
+	for _, c := range cases {
+		memPoints := store.Get(c.start, c.end)
+		chunks, err := encodedChunks(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diskPoints, err := readPoints(newChunksIterator(chunks, compressor, c.start, c.end))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(memPoints) != c.expected || len(diskPoints) != c.expected {
+			t.Fatalf("[%d, %d]: expected %d points, got %d in memory and %d on disk", c.start, c.end, c.expected, len(memPoints), len(diskPoints))
+		}
+		for i := range memPoints {
+			if memPoints[i] != diskPoints[i] || memPoints[i].Timestamp < c.start || memPoints[i].Timestamp > c.end {
+				t.Fatalf("[%d, %d]: unexpected point %+v, %+v", c.start, c.end, memPoints[i], diskPoints[i])
+			}
+		}
+	}
+
+	chunk := newXORChunk()
+	chunk.Append(1, 1)
+	data = append([]byte{}, chunk.Bytes()...)
+	data[0] = 0
+	if _, err := newChunkIterator(data); err == nil {
+		t.Fatal("unknown chunk version should be rejected")
+	}
+}
+
+func TestMergeOutdatedList(t *testing.T) {
+	store := &tsStore{maxRows: 16}
+	for i := 0; i < 200; i += 2 {
+		store.Append(&Point{Timestamp: int64(i), Value: float64(i)})
+	}
+	outdated := newTree()
+	for i := 199; i >= 0; i-- {
+		outdated.Add(int64(i), Point{Timestamp: int64(i), Value: -1})
+	}
+
+	points := store.MergeOutdatedList(outdated).All()
+	if len(points) != 200 {
+		t.Fatalf("expected 200 points, got %d", len(points))
+	}
+	for i, point := range points {
+		// 时间戳相同时保留数据块中的数据点
+		expected := float64(-1)
+		if i%2 == 0 {
+			expected = float64(i)
+		}
+		if point.Timestamp != int64(i) || point.Value != expected {
+			t.Fatalf("expected point %d with value %v, got %+v", i, expected, point)
+		}
+	}
+}
+
+func TestInsertRowsSync(t *testing.T) {
+	store, err := Open(WithDataPath(t.TempDir()), WithEnableOutdated(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+
+	var start int64 = 1600000000
+	if _, err = store.InsertRowsSync(context.Background(), genPoints(start, 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	rows := []*Row{
+		{Metric: "cpu.busy", Labels: LabelList{{Name: "node", Value: "vm1"}}, Point: Point{Timestamp: start, Value: 1}},
+		{Metric: "", Labels: LabelList{{Name: "node", Value: "vm1"}}, Point: Point{Timestamp: start, Value: 1}},
+		{Metric: "cpu.busy", Labels: LabelList{{Name: "node", Value: "vm1"}, {Name: "node", Value: "vm2"}}, Point: Point{Timestamp: start, Value: 1}},
+		{Metric: "cpu.busy", Labels: LabelList{{Name: metricName, Value: "mem.used"}}, Point: Point{Timestamp: start, Value: 1}},
+		genPoints(start-60, 1, 1)[0],
+	}
+	errs, err := store.InsertRowsSync(context.Background(), rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []error{nil, EmptyMetricError, DuplicateLabelError, ReservedLabelError, OutOfOrderError}
+	for i := range expected {
+		if !errors.Is(errs[i], expected[i]) {
+			t.Fatalf("row %d: expected %v, got %v", i, expected[i], errs[i])
+		}
+	}
+
+	// 同步写入返回后数据已经可以查询
+	seriesList, err := store.QueryRange("cpu.busy", []*Matcher{MustNewMatcher(MatchEqual, "node", "vm1")}, start, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 {
+		t.Fatalf("unexpected result: %+v", seriesList)
+	}
+}
+
+func TestInsertRowsSyncCancelAfterQueued(t *testing.T) {
+	store, err := Open(WithDataPath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+
+	// 阻塞写入协程，rows写入预写日志并进入队列后取消ctx
+	store.mutex.Lock()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var start int64 = 1600000000
+	type result struct {
+		errs []error
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		errs, err := store.InsertRowsSync(ctx, genPoints(start, 1, 1))
+		done <- result{errs: errs, err: err}
+	}()
+	for queued := false; !queued; {
+		store.wal.mutex.Lock()
+		queued = len(store.wal.pending) > 0
+		store.wal.mutex.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	store.mutex.Unlock()
+
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("queued rows should not fail after ctx is cancelled: %v", r.err)
+	}
+	for _, err := range r.errs {
+		if err != nil {
+			t.Fatalf("unexpected row error: %v", err)
+		}
+	}
+	seriesList, err := store.QueryRange("cpu.busy", nil, start, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 {
+		t.Fatalf("queued rows should be written: %+v", seriesList)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	dataPath := t.TempDir()
+	store, err := Open(WithDataPath(dataPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := func(node string, ts int64, value float64) *Row {
+		return &Row{Metric: "cpu.busy", Labels: LabelList{{Name: "node", Value: node}}, Point: Point{Timestamp: ts, Value: value}}
+	}
+	segmentDirs := func() []string {
+		dirs, err := filepath.Glob(filepath.Join(dataPath, "seg-*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dirs
+	}
+
+	var start int64 = 1600000000
+	rows := []*Row{{Metric: "", Point: Point{Timestamp: start}}}
+	for i := 9; i >= 0; i-- {
+		rows = append(rows, row("vm1", start+int64(i*60), float64(i)))
+	}
+	// 下一个时间窗口
+	rows = append(rows, row("vm1", start+7200, 10))
+	errs, err := store.Backfill(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(errs[0], EmptyMetricError) {
+		t.Fatalf("expected %v, got %v", EmptyMetricError, errs[0])
+	}
+	if dirs := segmentDirs(); len(dirs) != 2 {
+		t.Fatalf("expected 2 segments, got %v", dirs)
+	}
+
+	// 与已有segment合并，相同时间戳以回填的数据为准
+	errs, err = store.Backfill([]*Row{row("vm1", start+60, 100), row("vm2", start+30, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("row %d: %v", i, err)
+		}
+	}
+	if dirs := segmentDirs(); len(dirs) != 2 {
+		t.Fatalf("expected 2 segments after merge, got %v", dirs)
+	}
+
+	// 不早于内存中数据的row不能回填
+	if _, err = store.InsertRowsSync(context.Background(), []*Row{row("vm1", start+20000, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	errs, err = store.Backfill([]*Row{row("vm1", start+20000, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(errs[0], BackfillRangeError) {
+		t.Fatalf("expected %v, got %v", BackfillRangeError, errs[0])
+	}
+
+	check := func(store *TSDB) {
+		seriesList, err := store.QueryRange("cpu.busy", nil, start, start+7200)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(seriesList) != 2 || len(seriesList[0].Points) != 11 || len(seriesList[1].Points) != 1 {
+			t.Fatalf("unexpected result: %+v", seriesList)
+		}
+		points := seriesList[0].Points
+		if points[1].Timestamp != start+60 || points[1].Value != 100 || points[10].Value != 10 {
+			t.Fatalf("unexpected points: %+v", points)
+		}
+	}
+	check(store)
+	if err = store.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(WithDataPath(dataPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close(context.Background())
+	check(reopened)
+}
+
+// TestBackfillRecover 模拟回填替换segment的各个阶段进程退出后重新打开数据库
+func TestBackfillRecover(t *testing.T) {
+	var start int64 = 1600000000
+	backfill := func(dataPath string, value float64) string {
+		store, err := Open(WithDataPath(dataPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows := []*Row{
+			{Metric: "cpu.busy", Point: Point{Timestamp: start, Value: value}},
+			{Metric: "cpu.busy", Point: Point{Timestamp: start + 60, Value: value}},
+		}
+		if _, err = store.Backfill(rows); err != nil {
+			t.Fatal(err)
+		}
+		if err = store.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return filepath.Base(makeDirName(dataPath, start, start+60))
+	}
+	rename := func(from, to string) {
+		if err := os.Rename(from, to); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 旧segment的值为1，回填后新segment的值为2
+	tests := []struct {
+		name     string
+		crash    func(dataPath, newSeg, name string)
+		expected float64
+	}{
+		{"incomplete", func(dataPath, newSeg, name string) {
+			rename(newSeg, filepath.Join(dataPath, backfillPrefix+name))
+		}, 1},
+		{"written", func(dataPath, newSeg, name string) {
+			tmpDir := filepath.Join(dataPath, backfillPrefix+name)
+			rename(newSeg, tmpDir)
+			if err := writeReplaced(tmpDir, []string{backfillOldPrefix + name}); err != nil {
+				t.Fatal(err)
+			}
+		}, 2},
+		{"old moved", func(dataPath, newSeg, name string) {
+			tmpDir := filepath.Join(dataPath, backfillPrefix+name)
+			rename(newSeg, tmpDir)
+			if err := writeReplaced(tmpDir, []string{backfillOldPrefix + name}); err != nil {
+				t.Fatal(err)
+			}
+			rename(filepath.Join(dataPath, name), filepath.Join(dataPath, backfillOldPrefix+name))
+		}, 2},
+		{"renamed", func(dataPath, newSeg, name string) {
+			rename(filepath.Join(dataPath, name), filepath.Join(dataPath, backfillOldPrefix+name))
+			rename(newSeg, filepath.Join(dataPath, name))
+			if err := writeReplaced(filepath.Join(dataPath, name), []string{backfillOldPrefix + name}); err != nil {
+				t.Fatal(err)
+			}
+		}, 2},
+		{"rollback failed", func(dataPath, newSeg, name string) {
+			rename(filepath.Join(dataPath, name), filepath.Join(dataPath, backfillOldPrefix+name))
+		}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataPath, otherPath := t.TempDir(), t.TempDir()
+			name := backfill(dataPath, 1)
+			backfill(otherPath, 2)
+			tt.crash(dataPath, filepath.Join(otherPath, name), name)
+
+			store, err := Open(WithDataPath(dataPath))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close(context.Background())
+			seriesList, err := store.QueryRange("cpu.busy", nil, start, start+60)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(seriesList) != 1 || len(seriesList[0].Points) != 2 || seriesList[0].Points[0].Value != tt.expected {
+				t.Fatalf("unexpected result: %+v", seriesList)
+			}
+			dirs, err := filepath.Glob(filepath.Join(dataPath, "*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, dir := range dirs {
+				if strings.HasPrefix(filepath.Base(dir), backfillPrefix) || isFileExist(filepath.Join(dir, replacedFilename)) {
+					t.Fatalf("unexpected leftover: %s", dir)
+				}
+			}
+		})
+	}
+}
+
+func TestBackfillConflict(t *testing.T) {
+	list := newSegmentList(defaultOpts)
+	old := &diskSegment{minTimestamp: 100, maxTimestamp: 200}
+	other := &diskSegment{minTimestamp: 300, maxTimestamp: 400}
+	list.Add(old)
+	list.Add(other)
+	if err := list.Swap([]Segment{old}, &diskSegment{minTimestamp: 300, maxTimestamp: 500}); !errors.Is(err, SegmentConflictError) {
+		t.Fatalf("expected %v, got %v", SegmentConflictError, err)
+	}
+	if err := list.Swap([]Segment{old, other}, &diskSegment{minTimestamp: 300, maxTimestamp: 500}); err != nil {
+		t.Fatal(err)
+	}
+	segments := list.Get(0, 1000)
+	defer list.Release(segments)
+	if len(segments) != 1 || segments[0].MaxTs() != 500 {
+		t.Fatalf("unexpected segments: %v", segments)
+	}
+}
+
+func TestSegmentListConflict(t *testing.T) {
+	list := newSegmentList(defaultOpts)
+	old := &diskSegment{minTimestamp: 100, maxTimestamp: 200}
+	other := &diskSegment{minTimestamp: 300, maxTimestamp: 400}
+	if err := list.Add(old); err != nil {
+		t.Fatal(err)
+	}
+	if err := list.Add(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := list.Add(&diskSegment{minTimestamp: 100, maxTimestamp: 150}); !errors.Is(err, SegmentConflictError) {
+		t.Fatalf("expected %v, got %v", SegmentConflictError, err)
+	}
+	if err := list.Replace(old, &diskSegment{minTimestamp: 300, maxTimestamp: 500}); !errors.Is(err, SegmentConflictError) {
+		t.Fatalf("expected %v, got %v", SegmentConflictError, err)
+	}
+	if err := list.Replace(&diskSegment{minTimestamp: 500, maxTimestamp: 600}, &diskSegment{minTimestamp: 500, maxTimestamp: 600}); err == nil {
+		t.Fatal("replace a segment not in list should fail")
+	}
+	segments := list.Get(0, 1000)
+	defer list.Release(segments)
+	if len(segments) != 2 || segments[0] != Segment(old) || segments[1] != Segment(other) {
+		t.Fatalf("list should be unchanged: %v", segments)
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	store, err := Open(WithDataPath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+	row := func(ts int64, value float64) *Row {
+		return &Row{Metric: "cpu.busy", Labels: LabelList{{Name: "node", Value: "vm1"}}, Point: Point{Timestamp: ts, Value: value}}
+	}
+
+	// 前两个小时回填到磁盘segment，之后的数据在head memtable中，包括一个乱序的数据点
+	var start int64 = 1600002000
+	backfill, rows := make([]*Row, 0), make([]*Row, 0)
+	for i := int64(0); i < 180; i++ {
+		if i < 120 {
+			backfill = append(backfill, row(start+i*60, float64(i%7)))
+		} else {
+			rows = append(rows, row(start+i*60, float64(i%7)))
+		}
+	}
+	rows = append(rows, row(start+150*60+30, 100))
+	if _, err = store.Backfill(backfill); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.InsertRowsSync(context.Background(), rows); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := store.QueryRange("cpu.busy", nil, start+90, start+10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 1 {
+		t.Fatalf("unexpected series: %v", raw)
+	}
+	// 时间窗口跨越segment的边界
+	var step int64 = 2700
+	groups := make(map[int64][]Point)
+	for _, p := range raw[0].Points {
+		bucket := p.Timestamp - p.Timestamp%step
+		groups[bucket] = append(groups[bucket], p)
+	}
+	expected := func(points []Point, fn DownsampleFunc) float64 {
+		values := make([]float64, 0, len(points))
+		var sum float64
+		for _, p := range points {
+			values = append(values, p.Value)
+			sum += p.Value
+		}
+		sort.Float64s(values)
+		switch fn {
+		case DownsampleAvg:
+			return sum / float64(len(values))
+		case DownsampleMin:
+			return values[0]
+		case DownsampleMax:
+			return values[len(values)-1]
+		case DownsampleSum:
+			return sum
+		case DownsampleCount:
+			return float64(len(values))
+		case DownsampleFirst:
+			return points[0].Value
+		case DownsampleLast:
+			return points[len(points)-1].Value
+		}
+		// 90分位
+		rank := 0.9 * float64(len(values)-1)
+		lower := int(rank)
+		if lower+1 >= len(values) {
+			return values[lower]
+		}
+		return values[lower] + (values[lower+1]-values[lower])*(rank-float64(lower))
+	}
+
+	for _, fn := range []DownsampleFunc{DownsampleAvg, DownsampleMin, DownsampleMax, DownsampleSum, DownsampleCount, DownsampleFirst, DownsampleLast, DownsamplePercentile} {
+		opt := WithDownsample(step, fn)
+		if fn == DownsamplePercentile {
+			opt = WithPercentileDownsample(step, 90)
+		}
+		seriesList, err := store.QueryRange("cpu.busy", nil, start+90, start+10000, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(seriesList) != 1 || len(seriesList[0].Points) != len(groups) {
+			t.Fatalf("%s: unexpected result: %v", fn, seriesList)
+		}
+		for _, p := range seriesList[0].Points {
+			if value := expected(groups[p.Timestamp], fn); math.Abs(value-p.Value) > 1e-9 {
+				t.Fatalf("%s: bucket %d expected %v, got %v", fn, p.Timestamp, value, p.Value)
+			}
+		}
+	}
+
+	if _, err = store.QueryRange("cpu.busy", nil, start, start+10000, WithDownsample(0, DownsampleAvg)); err == nil {
+		t.Fatal("expected step error")
+	}
+	if _, err = store.QueryRange("cpu.busy", nil, start, start+10000, WithDownsample(step, "median")); err == nil {
+		t.Fatal("expected function error")
+	}
+	if _, err = store.QueryRange("cpu.busy", nil, start, start+10000, WithPercentileDownsample(step, 101)); err == nil {
+		t.Fatal("expected percentile error")
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	store, err := Open(WithDataPath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+	row := func(computer, iface string, ts int64, value float64) *Row {
+		return &Row{
+			Metric: "net.in.bytes",
+			Labels: LabelList{{Name: "computer", Value: computer}, {Name: "iface", Value: iface}},
+			Point:  Point{Timestamp: ts, Value: value},
+		}
+	}
+
+	// 第一个小时回填到磁盘segment，第二个小时在head memtable中
+	var start int64 = 1600002000
+	backfill, rows := make([]*Row, 0), make([]*Row, 0)
+	for i := int64(0); i < 120; i++ {
+		batch := []*Row{row("pc1", "eth0", start+i*60, 1), row("pc1", "eth1", start+i*60, 2), row("pc2", "eth0", start+i*60, 4)}
+		if i < 60 {
+			backfill = append(backfill, batch...)
+		} else {
+			rows = append(rows, batch...)
+		}
+	}
+	if _, err = store.Backfill(backfill); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.InsertRowsSync(context.Background(), rows); err != nil {
+		t.Fatal(err)
+	}
+
+	seriesList, err := store.Aggregate("net.in.bytes", nil, DownsampleSum, []string{"computer"}, start, start+7199, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 每条时间线在每个时间窗口只取一个值
+	expected := map[string]float64{`{computer="pc1"}`: 3, `{computer="pc2"}`: 4}
+	if len(seriesList) != len(expected) {
+		t.Fatalf("unexpected result: %v", seriesList)
+	}
+	for _, series := range seriesList {
+		if len(series.Points) != 2 {
+			t.Fatalf("%s: unexpected points: %v", series.Labels, series.Points)
+		}
+		for _, p := range series.Points {
+			if p.Value != expected[series.Labels.String()] {
+				t.Fatalf("%s: unexpected point: %v", series.Labels, p)
+			}
+		}
+	}
+
+	// 不分组时合并为一条时间线
+	seriesList, err = store.Aggregate("net.in.bytes", []*Matcher{MustNewMatcher(MatchEqual, "iface", "eth0")}, DownsampleMax, nil, start, start+7199, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 || len(seriesList[0].Labels) != 0 || len(seriesList[0].Points) != 2 || seriesList[0].Points[1].Value != 4 {
+		t.Fatalf("unexpected result: %v", seriesList)
+	}
+
+	if _, err = store.Aggregate("net.in.bytes", nil, DownsamplePercentile, nil, start, start+7199, 60); err == nil {
+		t.Fatal("expected function error")
+	}
+}
+
+func TestAggregateOffsetSeries(t *testing.T) {
+	store, err := Open(WithDataPath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+	row := func(node string, ts int64, value float64) *Row {
+		return &Row{Metric: "cpu.busy", Labels: LabelList{{Name: "node", Value: node}}, Point: Point{Timestamp: ts, Value: value}}
+	}
+	// vm1每30秒采集一次，vm2每60秒采集一次且时间戳偏移45秒
+	var start int64 = 1600000020
+	rows := make([]*Row, 0)
+	for i := int64(0); i < 4; i++ {
+		rows = append(rows, row("vm1", start+i*30, float64(i+1)))
+	}
+	rows = append(rows, row("vm2", start+45, 10), row("vm2", start+105, 20))
+	if _, err = store.InsertRowsSync(context.Background(), rows); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[DownsampleFunc][]float64{
+		DownsampleSum:   {12, 24},
+		DownsampleAvg:   {6, 12},
+		DownsampleCount: {2, 2},
+		DownsampleMax:   {10, 20},
+		DownsampleLast:  {10, 20},
+		DownsampleFirst: {2, 4},
+	}
+	for fn, values := range expected {
+		seriesList, err := store.Aggregate("cpu.busy", nil, fn, nil, start, start+119, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(seriesList) != 1 || len(seriesList[0].Points) != len(values) {
+			t.Fatalf("%s: unexpected result: %v", fn, seriesList)
+		}
+		for i, p := range seriesList[0].Points {
+			if p.Timestamp != start+int64(i)*60 || p.Value != values[i] {
+				t.Fatalf("%s: unexpected points: %v", fn, seriesList[0].Points)
+			}
+		}
+	}
+}
+
+func TestCounterFunctions(t *testing.T) {
+	// 第4个数据点计数器重置
+	points := []Point{{10, 10}, {20, 20}, {30, 30}, {40, 5}, {50, 15}}
+	if v, ok := Increase(points, 0, 60); !ok || v != 52.5 {
+		t.Fatalf("unexpected increase: %v", v)
+	}
+	if v, ok := Rate(points, 0, 60, PrecisionSecond); !ok || v != 0.875 {
+		t.Fatalf("unexpected rate: %v", v)
+	}
+	if v, ok := Rate(points, 0, 60, PrecisionMillisecond); !ok || v != 875 {
+		t.Fatalf("unexpected rate: %v", v)
+	}
+	if v, ok := IRate(points, PrecisionSecond); !ok || v != 1 {
+		t.Fatalf("unexpected irate: %v", v)
+	}
+	if v, ok := IRate(points[:4], PrecisionSecond); !ok || v != 0.5 {
+		t.Fatalf("unexpected irate: %v", v)
+	}
+	if v, ok := Delta(points, 0, 60); !ok || v != 7.5 {
+		t.Fatalf("unexpected delta: %v", v)
+	}
+	// 从0开始的计数器不会外推到0之前
+	if v, ok := Increase([]Point{{30, 0}, {40, 10}, {50, 20}}, 0, 60); !ok || v != 30 {
+		t.Fatalf("unexpected increase: %v", v)
+	}
+	if _, ok := Increase(points[:1], 0, 60); ok {
+		t.Fatal("expected no result with one point")
+	}
+
+	store, err := Open(WithDataPath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+	var start int64 = 1600000000
+	rows := make([]*Row, 0)
+	for _, p := range points {
+		rows = append(rows, &Row{
+			Metric: "net.in.bytes",
+			Labels: LabelList{{Name: "computer", Value: "pc1"}},
+			Point:  Point{Timestamp: start + p.Timestamp, Value: p.Value},
+		})
+	}
+	if _, err = store.InsertRowsSync(context.Background(), rows); err != nil {
+		t.Fatal(err)
+	}
+	seriesList, err := store.QueryCounter("net.in.bytes", nil, CounterRate, start+30, start+60, 30, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesList) != 1 || seriesList[0].Labels.String() != `{computer="pc1"}` {
+		t.Fatalf("unexpected result: %v", seriesList)
+	}
+	if got := seriesList[0].Points; len(got) != 2 || got[0] != (Point{start + 30, 0.5}) || got[1] != (Point{start + 60, 0.875}) {
+		t.Fatalf("unexpected points: %v", got)
+	}
+	if _, err = store.QueryCounter("net.in.bytes", nil, "deriv", start, start+60, 30, 60); err == nil {
+		t.Fatal("expected function error")
+	}
+}
+
+func TestSelect(t *testing.T) {
+	store, err := Open(WithDataPath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+	row := func(node string, ts int64, value float64) *Row {
+		return &Row{Metric: "cpu.busy", Labels: LabelList{{Name: "node", Value: node}}, Point: Point{Timestamp: ts, Value: value}}
+	}
+
+	// vm1前两个小时在磁盘segment中，之后在head memtable中，vm2只在head memtable中
+	var start int64 = 1600002000
+	backfill, rows := make([]*Row, 0), make([]*Row, 0)
+	for i := int64(0); i < 180; i++ {
+		if i < 120 {
+			backfill = append(backfill, row("vm1", start+i*60, float64(i)))
+		} else {
+			rows = append(rows, row("vm1", start+i*60, float64(i)), row("vm2", start+i*60, float64(i)))
+		}
+	}
+	// 乱序写入的数据点
+	rows = append(rows, row("vm2", start+150*60+30, -1))
+	if _, err = store.Backfill(backfill); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.InsertRowsSync(context.Background(), rows); err != nil {
+		t.Fatal(err)
+	}
+
+	set, err := store.Select("cpu.busy", nil, start+60, start+10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.Close()
+	var nodes []string
+	for set.Next() {
+		labels, it := set.At()
+		nodes = append(nodes, labels.Get("node"))
+		points, err := readPoints(it)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := 166
+		if labels.Get("node") == "vm2" {
+			expected = 48
+		}
+		if len(points) != expected {
+			t.Fatalf("%s: expected %d points, got %d", labels, expected, len(points))
+		}
+		for i := 1; i < len(points); i++ {
+			if points[i].Timestamp <= points[i-1].Timestamp {
+				t.Fatalf("%s: unordered points %v, %v", labels, points[i-1], points[i])
+			}
+		}
+	}
+	if err = set.Err(); err != nil {
+		t.Fatal(err)
+	}
+	set.Close()
+	if fmt.Sprint(nodes) != "[vm1 vm2]" {
+		t.Fatalf("unexpected series: %v", nodes)
+	}
+
+	// SeekTo跨越segment边界，当前数据点满足条件时不移动
+	set, err = store.Select("cpu.busy", []*Matcher{MustNewMatcher(MatchEqual, "node", "vm1")}, start, start+10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.Close()
+	if !set.Next() {
+		t.Fatal("expected vm1")
+	}
+	_, it := set.At()
+	if !it.SeekTo(start + 7170) {
+		t.Fatal("expected point after seek")
+	}
+	if ts, v := it.At(); ts != start+7200 || v != 120 {
+		t.Fatalf("unexpected point after seek: %d %v", ts, v)
+	}
+	if !it.SeekTo(start) || !it.Next() {
+		t.Fatal("seek backwards should not move")
+	}
+	if ts, _ := it.At(); ts != start+7260 {
+		t.Fatalf("unexpected point: %d", ts)
+	}
+	if it.SeekTo(start + 20000) {
+		t.Fatal("expected no point after end")
+	}
+	// 提前结束遍历
+	set.Close()
+
+	set, err = store.Select("cpu.busy", nil, start+20000, start+30000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.Close()
+	if set.Next() {
+		t.Fatal("expected no series out of range")
+	}
+	set.Close()
+}
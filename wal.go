@@ -0,0 +1,297 @@
+package tsdb
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// 预写日志，保证head memtable中的数据在进程崩溃后可以恢复
+// 每条记录的格式为: | payload长度 uint32 | crc32 uint32 | payload |
+
+type wal struct {
+	mutex   sync.Mutex
+	dir     string
+	fd      *os.File
+	index   int
+	size    int64
+	pending map[int]int // 已写入日志但还未写入memtable的batch数量
+}
+
+const (
+	walDirname     = "wal"
+	walSegmentSize = 64 * 1024 * 1024
+	walHeaderSize  = uint32Size << 1
+)
+
+var (
+	walCastagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+func openWAL(dataPath string) (*wal, error) {
+	dir := filepath.Join(dataPath, walDirname)
+	mkdir(dir)
+	indexes, err := walSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	w := &wal{
+		dir:     dir,
+		pending: make(map[int]int),
+	}
+	// 每次启动都写入新的日志文件，避免在可能损坏的尾部追加
+	next := 0
+	if len(indexes) > 0 {
+		next = indexes[len(indexes)-1] + 1
+	}
+	if err = w.openSegment(next); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// walSegments 返回目录中按序号升序排列的日志文件
+func walSegments(dir string) ([]int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wal dir: %s, err: %v", dir, err)
+	}
+	indexes := make([]int, 0, len(files))
+	for _, file := range files {
+		index, err := strconv.Atoi(file.Name())
+		if err != nil || file.IsDir() {
+			continue
+		}
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	return indexes, nil
+}
+
+func walSegmentName(dir string, index int) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d", index))
+}
+
+func (w *wal) openSegment(index int) error {
+	fd, err := os.OpenFile(walSegmentName(w.dir, index), os.O_CREATE|os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("failed to open wal segment %d, err: %v", index, err)
+	}
+	if w.fd != nil {
+		if err = w.fd.Sync(); err != nil {
+			logrus.Errorf("failed to sync wal segment %d, err: %v", w.index, err)
+		}
+		if err = w.fd.Close(); err != nil {
+			logrus.Errorf("failed to close wal segment %d, err: %v", w.index, err)
+		}
+	}
+	w.fd = fd
+	w.index = index
+	w.size = 0
+	return nil
+}
+
+// Append 写入一批rows，返回所在日志文件的序号，rows写入memtable后需要调用Done
+func (w *wal) Append(rows []*Row) (int, error) {
+	payload, err := encodeWALRows(rows)
+	if err != nil {
+		return 0, err
+	}
+	buf := newEncodingBuf()
+	buf.MarshalUint32(uint32(len(payload)), crc32.Checksum(payload, walCastagnoli))
+	buf.B = append(buf.B, payload...)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.size > 0 && w.size+int64(buf.Len()) > walSegmentSize {
+		if err := w.openSegment(w.index + 1); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.fd.Write(buf.Bytes())
+	w.size += int64(n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write wal segment %d, err: %v", w.index, err)
+	}
+	w.pending[w.index]++
+	return w.index, nil
+}
+
+// Done 标记序号为index的日志文件中的一批rows已经写入memtable
+func (w *wal) Done(index int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.pending[index]--
+	if w.pending[index] <= 0 {
+		delete(w.pending, index)
+	}
+}
+
+// Truncate 删除序号小于index的日志文件，仍有rows未写入memtable的日志文件以及正在写入的日志文件会被保留
+func (w *wal) Truncate(index int) error {
+	w.mutex.Lock()
+	if index > w.index {
+		index = w.index
+	}
+	for pending := range w.pending {
+		if pending < index {
+			index = pending
+		}
+	}
+	w.mutex.Unlock()
+
+	indexes, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, i := range indexes {
+		if i >= index {
+			break
+		}
+		if err = os.Remove(walSegmentName(w.dir, i)); err != nil {
+			return fmt.Errorf("failed to remove wal segment %d, err: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Replay 按顺序回放当前日志文件之前的全部日志，日志尾部损坏的记录会被丢弃
+func (w *wal) Replay(fn func(index int, rows []*Row)) error {
+	indexes, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if index >= w.index {
+			break
+		}
+		data, err := ioutil.ReadFile(walSegmentName(w.dir, index))
+		if err != nil {
+			return fmt.Errorf("failed to read wal segment %d, err: %v", index, err)
+		}
+		offset := 0
+		for offset+walHeaderSize <= len(data) {
+			decodingBuf := newDecodingBuf()
+			length := int(decodingBuf.UnmarshalUint32(data[offset : offset+uint32Size]))
+			checksum := decodingBuf.UnmarshalUint32(data[offset+uint32Size : offset+walHeaderSize])
+			if offset+walHeaderSize+length > len(data) {
+				break
+			}
+			payload := data[offset+walHeaderSize : offset+walHeaderSize+length]
+			if crc32.Checksum(payload, walCastagnoli) != checksum {
+				break
+			}
+			offset += walHeaderSize + length
+			// 校验和正确但无法解码的记录只跳过这一条，不影响后面的记录
+			rows, err := decodeWALRows(payload)
+			if err != nil {
+				logrus.Errorf("skip wal record in segment %d at offset %d, err: %v", index, offset-walHeaderSize-length, err)
+				continue
+			}
+			fn(index, rows)
+		}
+		if offset < len(data) {
+			logrus.Errorf("wal segment %d is corrupted at offset %d, drop %d bytes", index, offset, len(data)-offset)
+		}
+	}
+	return nil
+}
+
+func (w *wal) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.fd.Sync(); err != nil {
+		return err
+	}
+	return w.fd.Close()
+}
+
+// Cleanup 删除全部日志文件，只能在Close之后并且数据已经全部持久化时调用
+func (w *wal) Cleanup() error {
+	indexes, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if err = os.Remove(walSegmentName(w.dir, index)); err != nil {
+			return fmt.Errorf("failed to remove wal segment %d, err: %v", index, err)
+		}
+	}
+	return nil
+}
+
+// encodeWALRows 编码一批rows，长度超过uint16的字段会导致整批rows无法回放，需要直接拒绝
+func encodeWALRows(rows []*Row) ([]byte, error) {
+	buf := newEncodingBuf()
+	buf.MarshalUint32(uint32(len(rows)))
+	for _, row := range rows {
+		if len(row.Metric) > math.MaxUint16 {
+			return nil, fmt.Errorf("%w: metric %.64s", LabelTooLongError, row.Metric)
+		}
+		if len(row.Labels) > math.MaxUint16 {
+			return nil, fmt.Errorf("%w: %d", TooManyLabelsError, len(row.Labels))
+		}
+		for _, label := range row.Labels {
+			if len(label.Name) > math.MaxUint16 || len(label.Value) > math.MaxUint16 {
+				return nil, fmt.Errorf("%w: %.64s", LabelTooLongError, label.Name)
+			}
+		}
+		buf.MarshalUint16(uint16(len(row.Metric)))
+		buf.MarshalString(row.Metric)
+		buf.MarshalUint16(uint16(len(row.Labels)))
+		for _, label := range row.Labels {
+			buf.MarshalUint16(uint16(len(label.Name)))
+			buf.MarshalString(label.Name)
+			buf.MarshalUint16(uint16(len(label.Value)))
+			buf.MarshalString(label.Value)
+		}
+		buf.MarshalUint64(uint64(row.Point.Timestamp), math.Float64bits(row.Point.Value))
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeWALRows(data []byte) (rows []*Row, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			rows, err = nil, fmt.Errorf("failed to decode wal record: %v", r)
+		}
+	}()
+	decodingBuf := newDecodingBuf()
+	offset := 0
+	readString := func() string {
+		length := int(decodingBuf.UnmarshalUint16(data[offset : offset+uint16Size]))
+		offset += uint16Size
+		// 拷贝一份，避免引用整个日志文件的数据
+		s := string(data[offset : offset+length])
+		offset += length
+		return s
+	}
+
+	count := int(decodingBuf.UnmarshalUint32(data[offset : offset+uint32Size]))
+	offset += uint32Size
+	rows = make([]*Row, 0, count)
+	for i := 0; i < count; i++ {
+		row := &Row{}
+		row.Metric = readString()
+		labelCount := int(decodingBuf.UnmarshalUint16(data[offset : offset+uint16Size]))
+		offset += uint16Size
+		row.Labels = make(LabelList, 0, labelCount)
+		for j := 0; j < labelCount; j++ {
+			name := readString()
+			row.Labels = append(row.Labels, Label{Name: name, Value: readString()})
+		}
+		row.Point.Timestamp = int64(decodingBuf.UnmarshalUint64(data[offset : offset+uint64Size]))
+		offset += uint64Size
+		row.Point.Value = math.Float64frombits(decodingBuf.UnmarshalUint64(data[offset : offset+uint64Size]))
+		offset += uint64Size
+		rows = append(rows, row)
+	}
+	return rows, decodingBuf.err
+}